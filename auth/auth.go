@@ -4,6 +4,7 @@ package auth
 import (
 	"errors"
 	"regexp"
+	"time"
 )
 
 // Auther is a generic interface to implement password-based authentication and authorization
@@ -13,9 +14,18 @@ type Auther interface {
 	// correct or incorrect.
 	Authenticate(username, password string) (*User, error)
 
+	// AuthenticateToken checks the given access token and returns the user it belongs to if the
+	// token exists and has not expired. It also updates the token's last access time.
+	AuthenticateToken(token string) (*User, error)
+
 	// Authorize returns nil if the given user has access to the given topic using the desired
 	// permission. The user param may be nil to signal an anonymous user.
 	Authorize(user *User, topic string, perm Permission) error
+
+	// AuthorizeCapability returns nil if the given user may use the given publishing capability
+	// (e.g. attachments) on the given topic. It does not check the write permission itself, see
+	// Authorize. The user param may be nil to signal an anonymous user.
+	AuthorizeCapability(user *User, topic string, capability Capability) error
 }
 
 // Manager is an interface representing user and access management
@@ -38,20 +48,153 @@ type Manager interface {
 	// ChangePassword changes a user's password
 	ChangePassword(username, password string) error
 
+	// UnlockUser resets the failed login counter of the given user, and lifts a lockout if there is one.
+	// The function returns ErrNotFound if the user does not exist.
+	UnlockUser(username string) error
+
 	// ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
 	// all existing access control entries (Grant) are removed, since they are no longer needed.
 	ChangeRole(username string, role Role) error
 
 	// AllowAccess adds or updates an entry in th access control list for a specific user. It controls
-	// read/write access to a topic. The parameter topicPattern may include wildcards (*).
+	// read/write access to a topic. The parameter topicPattern may include wildcards (*). The entry
+	// allows all publishing capabilities, unless restricted with SetCapabilities.
 	AllowAccess(username string, topicPattern string, read bool, write bool) error
 
+	// AllowAccessUntil is like AllowAccess, but the entry expires at the given time. Expired entries are
+	// ignored, and deleted with RemoveExpiredAccess. If expires is the zero time, the entry never expires.
+	AllowAccessUntil(username string, topicPattern string, read bool, write bool, expires time.Time) error
+
+	// RemoveExpiredAccess deletes all access control entries that have expired
+	RemoveExpiredAccess() error
+
+	// SetCapabilities restricts the publishing capabilities of an existing access control entry of a user.
+	// If capabilities is nil, all capabilities are allowed. The function returns ErrNotFound if the entry
+	// does not exist. Note that AllowAccess resets the capabilities of an entry.
+	SetCapabilities(username string, topicPattern string, capabilities []Capability) error
+
 	// ResetAccess removes an access control list entry for a specific username/topic, or (if topic is
 	// empty) for an entire user. The parameter topicPattern may include wildcards (*).
 	ResetAccess(username string, topicPattern string) error
 
 	// DefaultAccess returns the default read/write access if no access control entry matches
 	DefaultAccess() (read bool, write bool)
+
+	// Decide resolves the access control list for the given user (or Everyone) and topic, and returns the
+	// resulting permissions, as well as the entries that led to the decision. Token scopes are not considered.
+	Decide(username, topic string) (*Decision, error)
+
+	// CreateToken generates a new random access token for the given user. The token can be used instead
+	// of the user's password. If expires is the zero time, the token never expires. If scopes is not empty,
+	// the token is restricted to the given topic patterns and permissions (in addition to the user's grants).
+	CreateToken(username, label string, expires time.Time, scopes []Grant) (*Token, error)
+
+	// Tokens returns all (non-expired) access tokens of the given user
+	Tokens(username string) ([]*Token, error)
+
+	// RemoveToken deletes the given access token of the given user. The function returns ErrNotFound
+	// if the token does not exist.
+	RemoveToken(username, token string) error
+
+	// AddGroup adds a group with the given name. Groups have their own access control entries, which
+	// apply to all members of the group.
+	AddGroup(name string) error
+
+	// RemoveGroup deletes the group with the given name, including its members and access control entries.
+	// The function returns nil on success, even if the group did not exist in the first place.
+	RemoveGroup(name string) error
+
+	// Groups returns a list of all groups
+	Groups() ([]*Group, error)
+
+	// Group returns the group with the given name if it exists, or ErrNotFound otherwise
+	Group(name string) (*Group, error)
+
+	// AddGroupMember adds a user to a group. Both the user and the group must exist.
+	AddGroupMember(name, username string) error
+
+	// RemoveGroupMember removes a user from a group. The function returns ErrNotFound if the user
+	// is not a member of the group.
+	RemoveGroupMember(name, username string) error
+
+	// AllowGroupAccess adds or updates an entry in the access control list for a specific group. It
+	// controls read/write access to a topic. The parameter topicPattern may include wildcards (*).
+	AllowGroupAccess(name string, topicPattern string, read bool, write bool) error
+
+	// SetGroupCapabilities restricts the publishing capabilities of an existing access control entry of a
+	// group, see SetCapabilities.
+	SetGroupCapabilities(name string, topicPattern string, capabilities []Capability) error
+
+	// ResetGroupAccess removes an access control list entry for a specific group/topic, or (if topic
+	// is empty) for an entire group. The parameter topicPattern may include wildcards (*).
+	ResetGroupAccess(name string, topicPattern string) error
+
+	// AddTier adds a tier with the given code and limits. Tiers can be assigned to users via ChangeUserTier.
+	AddTier(tier *Tier) error
+
+	// ChangeTier updates the limits of an existing tier. The function returns ErrNotFound if the tier does not exist.
+	ChangeTier(tier *Tier) error
+
+	// RemoveTier deletes the tier with the given code. Users of the tier fall back to the default limits.
+	// The function returns nil on success, even if the tier did not exist in the first place.
+	RemoveTier(code string) error
+
+	// Tiers returns a list of all tiers
+	Tiers() ([]*Tier, error)
+
+	// Tier returns the tier with the given code if it exists, or ErrNotFound otherwise
+	Tier(code string) (*Tier, error)
+
+	// ChangeUserTier assigns the given tier to a user, or removes the user's tier if code is empty.
+	// The function returns ErrNotFound if the user or the tier does not exist.
+	ChangeUserTier(username, code string) error
+
+	// AddReservation reserves a topic for a user: it grants the user read-write access to the topic, and denies
+	// everyone else, regardless of their wildcard entries or the entries of their groups. The user's own access control entry for the topic (if any) is kept aside, and restored when
+	// the reservation is removed. The function returns ErrTopicReserved if the topic is already reserved by another
+	// user, and ErrTopicInUse if other users, groups or the everyone user have an entry for the topic. Reserving a
+	// topic again is a no-op.
+	AddReservation(username, topic string) error
+
+	// RemoveReservation removes a user's reservation of a topic, including the access control entries that came
+	// with it, and restores the user's previous entry for the topic (if any). The function returns ErrNotFound if
+	// the topic is not reserved by the user.
+	RemoveReservation(username, topic string) error
+
+	// Reservations returns the topics reserved by the given user, or of all users if username is empty
+	Reservations(username string) ([]*Reservation, error)
+
+	// Reservation returns the reservation of the given topic if it exists, or ErrNotFound otherwise
+	Reservation(topic string) (*Reservation, error)
+
+	// Provision reconciles the given users and access control entries (e.g. from the server config) into the
+	// database: users and entries are added or updated and marked as provisioned, and users and entries that were
+	// provisioned before, but are no longer part of the given provisioning, are removed. Users and entries that
+	// were not provisioned (e.g. created with 'ntfy user add') are left alone, unless they are overridden.
+	Provision(provisioning *Provisioning) error
+
+	// Import adds or updates the given users and access control entries. Unlike Provision, the users and entries
+	// are not marked as provisioned, and no existing users or entries are removed.
+	Import(provisioning *Provisioning) error
+}
+
+// Auditor is an interface to record security-relevant events in an append-only audit log. Implementations
+// record all changes made through Manager themselves; other events (e.g. logins) are recorded via Audit.
+type Auditor interface {
+	// Audit records the given event in the audit log. If the event's time is not set, the current time is used.
+	Audit(event *AuditEvent) error
+
+	// AuditEvents returns the events in the audit log that match the given filter, oldest first. If the
+	// filter has a limit, only the most recent events are returned.
+	AuditEvents(filter *AuditFilter) ([]*AuditEvent, error)
+
+	// PruneAuditEvents deletes logins and publishes that are older than activityOlderThan, and all other
+	// events (i.e. changes to users, access control entries, etc.) that are older than changesOlderThan.
+	// If one of the times is zero, the respective events are not deleted.
+	PruneAuditEvents(activityOlderThan, changesOlderThan time.Time) error
+
+	// WithActor returns a Manager that records the given username as the actor of all changes in the audit log
+	WithActor(actor string) Manager
 }
 
 // User is a struct that represents a user
@@ -60,6 +203,102 @@ type User struct {
 	Hash   string // password hash (bcrypt)
 	Role   Role
 	Grants []Grant
+	Groups []string // Names of the groups the user is a member of
+	Scopes []Grant  // Only set if authenticated with a scoped token, see Token
+
+	// ExternalGroups are the groups asserted by an identity provider, if the user was authenticated via a JWT
+	// (see JWTVerifier). They are considered in addition to the group memberships in the database.
+	ExternalGroups []string
+
+	// LockedUntil is set if the user is locked out due to too many failed logins, see LockoutDuration
+	LockedUntil time.Time
+
+	// FailedLogins is the number of consecutive failed logins, see LockoutThreshold
+	FailedLogins int
+
+	// Provisioned is true if the user is defined in the server config, see Manager.Provision
+	Provisioned bool
+
+	// Tier defines the user's rate limits and quotas, nil if the default limits apply
+	Tier *Tier
+}
+
+// Locked returns true if the user is currently locked out due to too many failed logins
+func (u *User) Locked() bool {
+	return !u.LockedUntil.IsZero() && time.Now().Before(u.LockedUntil)
+}
+
+// Group is a struct that represents a group of users. A group's access control entries (Grant)
+// apply to all of its members, unless a member has its own entry for a topic.
+type Group struct {
+	Name    string
+	Members []string
+	Grants  []Grant
+}
+
+// Tier is a set of rate limits and quotas that can be assigned to users, see Manager.ChangeUserTier.
+// Limits that are zero are not overridden by the tier, i.e. the server's default limits apply.
+type Tier struct {
+	Code                     string
+	RequestLimit             int           // Number of requests a user can make at once (burst)
+	RequestLimitReplenish    time.Duration // Rate at which the request limit is replenished
+	EmailLimit               int           // Number of e-mails a user can send at once (burst)
+	EmailLimitReplenish      time.Duration // Rate at which the e-mail limit is replenished
+	SubscriptionLimit        int           // Number of subscriptions a user can hold at the same time
+	AttachmentTotalSizeLimit int64         // Total size of all (non-expired) attachments of a user, in bytes
+	AttachmentBandwidthLimit int64         // Daily upload/download bandwidth of attachments, in bytes
+	ReservationLimit         int           // Number of topics a user can reserve, see Manager.AddReservation
+}
+
+// Reservation is a topic that is reserved by a user, see Manager.AddReservation
+type Reservation struct {
+	Topic    string
+	Username string
+	Created  time.Time
+}
+
+// Provisioning is a set of users and access control entries, as defined in the server config (auth-users and
+// auth-access), or as written by 'ntfy access export'. See Manager.Provision and Manager.Import.
+type Provisioning struct {
+	Users  []*ProvisionedUser
+	Access map[string][]Grant // Access control entries by username (may include Everyone); only the topic pattern and permissions are used
+}
+
+// ProvisionedUser is a user of a Provisioning
+type ProvisionedUser struct {
+	Name     string
+	Password string // Plain text password or bcrypt hash, see IsPasswordHash
+	Role     Role
+}
+
+// Token represents an access token that can be used to authenticate as a user instead of the
+// user's password. Tokens are passed via the "Authorization: Bearer <token>" header.
+type Token struct {
+	Value      string
+	Label      string
+	LastAccess time.Time // Zero if the token was never used
+	Expires    time.Time // Zero if the token never expires
+	Scopes     []Grant   // Restricts the token to these topics, empty if the token has the user's full access
+}
+
+// AuditEvent is an entry in the audit log, see Auditor
+type AuditEvent struct {
+	Time    time.Time
+	Action  AuditAction
+	Actor   string // User that performed the action, empty if unknown (e.g. changes via the CLI)
+	Subject string // User or group the action applies to, or the username used in a login attempt
+	Topic   string // Topic or topic pattern, if any
+	IP      string // IP address of the client, if any
+	Detail  string // Additional information, e.g. the new role or permission
+}
+
+// AuditFilter restricts the events returned by Auditor.AuditEvents. Empty fields match all events.
+type AuditFilter struct {
+	Username string // Matches the actor or the subject
+	Action   AuditAction
+	Topic    string
+	Since    time.Time
+	Limit    int
 }
 
 // Grant is a struct that represents an access control entry to a topic
@@ -67,8 +306,39 @@ type Grant struct {
 	TopicPattern string // May include wildcard (*)
 	AllowRead    bool
 	AllowWrite   bool
+	Capabilities []Capability // Publishing capabilities, nil if all capabilities are allowed
+	Expires      time.Time    // Time at which the entry expires, zero if it never expires (only for entries of users)
+}
+
+// Rule is an access control entry (Grant) of a user, a group, or the everyone user
+type Rule struct {
+	Grant
+	Source Source // SourceUser, SourceGroup or SourceEveryone
+	Owner  string // Name of the user or group the entry belongs to
 }
 
+// Decision is the result of resolving the access control list for a user and a topic, see Manager.Decide
+type Decision struct {
+	AllowRead    bool
+	AllowWrite   bool
+	Capabilities []Capability // Publishing capabilities, nil if all capabilities are allowed
+	Source       Source       // Where the decision came from
+	Rules        []Rule       // Matching entries that led to the decision, empty for SourceAdmin, SourceDefault and SourceReservation
+}
+
+// Source describes where an access decision came from
+type Source string
+
+// Decision sources, in order of precedence
+const (
+	SourceAdmin       = Source("admin")       // User has the admin role
+	SourceUser        = Source("user")        // The user's own access control entries
+	SourceGroup       = Source("group")       // The access control entries of the user's groups
+	SourceEveryone    = Source("everyone")    // The access control entries of the everyone user
+	SourceDefault     = Source("default")     // The default access from the server config
+	SourceReservation = Source("reservation") // The topic is reserved, and there is no entry for it
+)
+
 // Permission represents a read or write permission to a topic
 type Permission int
 
@@ -78,6 +348,22 @@ const (
 	PermissionWrite = Permission(2)
 )
 
+// Capability represents an optional publishing feature, which may be restricted per access
+// control entry (Grant). Capabilities only apply if the entry also allows writing to the topic.
+type Capability string
+
+// Publishing capabilities
+const (
+	CapabilityAttach      = Capability("attach")       // Attach files or external URLs
+	CapabilityEmail       = Capability("email")        // Forward messages via e-mail
+	CapabilityMaxPriority = Capability("max-priority") // Publish messages with priority 5 (max/urgent)
+	CapabilityDelay       = Capability("delay")        // Schedule delayed messages
+	CapabilityDelete      = Capability("delete")       // Delete messages (incl. scheduled messages) from the cache
+)
+
+// Capabilities is a list of all publishing capabilities
+var Capabilities = []Capability{CapabilityAttach, CapabilityEmail, CapabilityMaxPriority, CapabilityDelay, CapabilityDelete}
+
 // Role represents a user's role, either admin or regular user
 type Role string
 
@@ -96,6 +382,8 @@ const (
 var (
 	allowedUsernameRegex     = regexp.MustCompile(`^[-_.@a-zA-Z0-9]+$`)     // Does not include Everyone (*)
 	allowedTopicPatternRegex = regexp.MustCompile(`^[-_*A-Za-z0-9]{1,64}$`) // Adds '*' for wildcards!
+	allowedTopicRegex        = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+	passwordHashRegex        = regexp.MustCompile(`^\$2[aby]\$\d{2}\$[./A-Za-z0-9]{53}$`) // bcrypt
 )
 
 // AllowedRole returns true if the given role can be used for new users
@@ -108,15 +396,151 @@ func AllowedUsername(username string) bool {
 	return allowedUsernameRegex.MatchString(username)
 }
 
+// AllowedGroupName returns true if the given group name is valid
+func AllowedGroupName(name string) bool {
+	return allowedUsernameRegex.MatchString(name)
+}
+
+// AllowedTierCode returns true if the given tier code is valid
+func AllowedTierCode(code string) bool {
+	return allowedUsernameRegex.MatchString(code)
+}
+
+// AllowedTier returns true if the given tier has a valid code, and none of its limits are negative
+func AllowedTier(tier *Tier) bool {
+	return tier != nil && AllowedTierCode(tier.Code) && tier.RequestLimit >= 0 && tier.RequestLimitReplenish >= 0 &&
+		tier.EmailLimit >= 0 && tier.EmailLimitReplenish >= 0 && tier.SubscriptionLimit >= 0 &&
+		tier.AttachmentTotalSizeLimit >= 0 && tier.AttachmentBandwidthLimit >= 0 && tier.ReservationLimit >= 0
+}
+
+// IsPasswordHash returns true if the given password is a bcrypt hash (as stored in the database) rather than
+// a plain text password
+func IsPasswordHash(password string) bool {
+	return passwordHashRegex.MatchString(password)
+}
+
+// AllowedTopic returns true if the given topic name is valid; unlike AllowedTopicPattern, no wildcards are allowed
+func AllowedTopic(topic string) bool {
+	return allowedTopicRegex.MatchString(topic)
+}
+
+// AllowedCapability returns true if the given capability is one of the known Capabilities
+func AllowedCapability(capability Capability) bool {
+	for _, c := range Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCapability returns true if the given capability is part of the list of capabilities. As with
+// Grant, a nil list means that all capabilities are allowed.
+func HasCapability(capabilities []Capability, capability Capability) bool {
+	if capabilities == nil {
+		return true
+	}
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
 // AllowedTopicPattern returns true if the given topic pattern is valid; this includes the wildcard character (*)
 func AllowedTopicPattern(username string) bool {
 	return allowedTopicPatternRegex.MatchString(username)
 }
 
+// AuditAction is the type of an AuditEvent
+type AuditAction string
+
+// Audit actions, see AuditEvent
+const (
+	AuditActionLoginSuccess            = AuditAction("login-success")
+	AuditActionLoginFailure            = AuditAction("login-failure")
+	AuditActionPublish                 = AuditAction("publish")
+	AuditActionUserAdd                 = AuditAction("user-add")
+	AuditActionUserRemove              = AuditAction("user-remove")
+	AuditActionUserChangePassword      = AuditAction("user-change-pass")
+	AuditActionUserChangeRole          = AuditAction("user-change-role")
+	AuditActionUserUnlock              = AuditAction("user-unlock")
+	AuditActionUserChangeTier          = AuditAction("user-change-tier")
+	AuditActionAccessAllow             = AuditAction("access-allow")
+	AuditActionAccessCapabilities      = AuditAction("access-capabilities")
+	AuditActionAccessReset             = AuditAction("access-reset")
+	AuditActionTokenCreate             = AuditAction("token-create")
+	AuditActionTokenRemove             = AuditAction("token-remove")
+	AuditActionGroupAdd                = AuditAction("group-add")
+	AuditActionGroupRemove             = AuditAction("group-remove")
+	AuditActionGroupMemberAdd          = AuditAction("group-member-add")
+	AuditActionGroupMemberRemove       = AuditAction("group-member-remove")
+	AuditActionGroupAccessAllow        = AuditAction("group-access-allow")
+	AuditActionGroupAccessCapabilities = AuditAction("group-access-capabilities")
+	AuditActionGroupAccessReset        = AuditAction("group-access-reset")
+	AuditActionTierAdd                 = AuditAction("tier-add")
+	AuditActionTierChange              = AuditAction("tier-change")
+	AuditActionTierRemove              = AuditAction("tier-remove")
+	AuditActionReservationAdd          = AuditAction("reservation-add")
+	AuditActionReservationRemove       = AuditAction("reservation-remove")
+)
+
+// AuditActions is a list of all audit actions
+var AuditActions = []AuditAction{
+	AuditActionLoginSuccess, AuditActionLoginFailure, AuditActionPublish,
+	AuditActionUserAdd, AuditActionUserRemove, AuditActionUserChangePassword, AuditActionUserChangeRole, AuditActionUserUnlock, AuditActionUserChangeTier,
+	AuditActionAccessAllow, AuditActionAccessCapabilities, AuditActionAccessReset,
+	AuditActionTokenCreate, AuditActionTokenRemove,
+	AuditActionGroupAdd, AuditActionGroupRemove, AuditActionGroupMemberAdd, AuditActionGroupMemberRemove,
+	AuditActionGroupAccessAllow, AuditActionGroupAccessCapabilities, AuditActionGroupAccessReset,
+	AuditActionTierAdd, AuditActionTierChange, AuditActionTierRemove,
+	AuditActionReservationAdd, AuditActionReservationRemove,
+}
+
+// AllowedAuditAction returns true if the given audit action is valid
+func AllowedAuditAction(action AuditAction) bool {
+	for _, a := range AuditActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Brute-force protection: after LockoutThreshold consecutive failed logins, a user (or IP address) is locked out
+// for LockoutBaseDuration. Every further failure doubles the lockout, up to LockoutMaxDuration. The failure counter
+// is reset after a successful login, or if there were no failures for LockoutResetAfter.
+const (
+	LockoutThreshold    = 5
+	LockoutBaseDuration = time.Minute
+	LockoutMaxDuration  = 24 * time.Hour
+	LockoutResetAfter   = 24 * time.Hour
+)
+
+// LockoutDuration returns how long a user or IP address is locked out after the given number of
+// consecutive failed logins, or zero if there should be no lockout.
+func LockoutDuration(failures int) time.Duration {
+	if failures < LockoutThreshold {
+		return 0
+	}
+	lockout := LockoutBaseDuration
+	for i := LockoutThreshold; i < failures && lockout < LockoutMaxDuration; i++ {
+		lockout *= 2
+	}
+	if lockout > LockoutMaxDuration {
+		return LockoutMaxDuration
+	}
+	return lockout
+}
+
 // Error constants used by the package
 var (
 	ErrUnauthenticated = errors.New("unauthenticated")
 	ErrUnauthorized    = errors.New("unauthorized")
 	ErrInvalidArgument = errors.New("invalid argument")
 	ErrNotFound        = errors.New("not found")
+	ErrLockedOut       = errors.New("locked out due to too many failed logins")
+	ErrTopicReserved   = errors.New("topic is reserved by another user")
+	ErrTopicInUse      = errors.New("topic has access control entries of other users")
 )
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// authCache is an in-memory cache of the users and access control entries of a SQLiteAuth, so that
+// Authorize does not have to query the database for every topic of every request.
+//
+// Whenever users, groups, tiers or access control entries change, SQLiteAuth increments the data version in the
+// database (see SQLiteAuth.exec), and clears the cache. To pick up changes made by other processes, e.g. by the
+// 'ntfy user' or 'ntfy access' commands, the cache compares the data version with its last known value at most
+// once per checkInterval, and is cleared if it has changed. Other writes, such as audit log events or the last
+// access time of tokens, do not change the data version, so they do not clear the cache. Failed logins only
+// remove the affected user from the cache (see removeUser).
+type authCache struct {
+	db            *sql.DB
+	version       int64         // Last known data version, -1 if it could not be read
+	checked       time.Time     // Last time the data version was read, see checkVersion
+	checkInterval time.Duration // Minimum time between two reads of the data version
+	users         map[string]*User
+	rules         map[string]*ruleSet
+	owners        map[string]string // Reserved topics and their owners, nil if not cached
+	generation    int64             // Incremented whenever the cache is cleared, see setUser and setRuleSet
+	mu            sync.Mutex
+}
+
+const authCacheCheckInterval = time.Second
+
+func newAuthCache(db *sql.DB) *authCache {
+	c := &authCache{
+		db:            db,
+		checkInterval: authCacheCheckInterval,
+		users:         make(map[string]*User),
+		rules:         make(map[string]*ruleSet),
+	}
+	c.version = c.dataVersion()
+	c.checked = time.Now()
+	return c
+}
+
+// user returns a copy of the cached user with the given name, if it is cached. The returned generation
+// must be passed to setUser if the user was not cached.
+func (c *authCache) user(username string) (user *User, generation int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVersion()
+	user, ok = c.users[username]
+	if !ok {
+		return nil, c.generation, false
+	}
+	return copyUser(user), c.generation, true
+}
+
+// setUser caches the given user, unless the cache was cleared since the given generation, in which case
+// the user may have been read from the database before the change that cleared the cache
+func (c *authCache) setUser(username string, user *User, generation int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.users[username] = copyUser(user)
+	}
+}
+
+// ruleSet returns the cached rules with the given key, if they are cached. Rule sets are never modified,
+// so they can be shared. The returned generation must be passed to setRuleSet if the rules were not cached.
+func (c *authCache) ruleSet(key string) (rules *ruleSet, generation int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVersion()
+	rules, ok = c.rules[key]
+	return rules, c.generation, ok
+}
+
+// setRuleSet caches the given rules, unless the cache was cleared since the given generation (see setUser)
+func (c *authCache) setRuleSet(key string, rules *ruleSet, generation int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.rules[key] = rules
+	}
+}
+
+// reservationOwners returns the cached reserved topics and their owners, if they are cached. The map is never
+// modified, so it can be shared. The returned generation must be passed to setReservationOwners if the
+// reservations were not cached.
+func (c *authCache) reservationOwners() (owners map[string]string, generation int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVersion()
+	return c.owners, c.generation, c.owners != nil
+}
+
+// setReservationOwners caches the given reserved topics, unless the cache was cleared since the given
+// generation (see setUser)
+func (c *authCache) setReservationOwners(owners map[string]string, generation int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.owners = owners
+	}
+}
+
+// invalidate removes all users, rules and reservations from the cache. It is called after the data version
+// was incremented, so the new data version is read as well, so that the cache is not cleared a second time.
+func (c *authCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version = c.dataVersion()
+	c.checked = time.Now()
+	c.clear()
+}
+
+// removeUser removes the given user from the cache, e.g. after a failed login, leaving all other users and
+// all rules in the cache. Like clear, it increments the generation, so that a copy of the user that was read
+// from the database before the change is not cached (see setUser).
+func (c *authCache) removeUser(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, username)
+	c.generation++
+}
+
+func (c *authCache) clear() {
+	c.users = make(map[string]*User)
+	c.rules = make(map[string]*ruleSet)
+	c.owners = nil
+	c.generation++
+}
+
+// checkVersion reads the data version if it was not read within the last checkInterval, and clears the cache if it
+// differs from the last known one. If the data version could not be read (-1), the cache is cleared, and the data
+// version is read again on the next lookup. It must be called with the lock held.
+func (c *authCache) checkVersion() {
+	if time.Since(c.checked) < c.checkInterval {
+		return
+	}
+	version := c.dataVersion()
+	if version == -1 {
+		c.checked = time.Time{}
+	} else {
+		c.checked = time.Now()
+	}
+	if version != c.version || version == -1 {
+		c.version = version
+		c.clear()
+	}
+}
+
+// dataVersion reads the current data version from the database, or returns -1 if it cannot be read
+func (c *authCache) dataVersion() int64 {
+	var version int64
+	if err := c.db.QueryRow(selectDataVersionQuery).Scan(&version); err != nil {
+		return -1
+	}
+	return version
+}
+
+// copyUser returns a copy of the given user that can be safely modified by the caller. Grants that
+// have expired since the user was read from the database are removed.
+func copyUser(u *User) *User {
+	user := *u
+	now := time.Now()
+	user.Grants = make([]Grant, 0, len(u.Grants))
+	for _, grant := range u.Grants {
+		if grant.Expires.IsZero() || !grant.Expires.Before(now) {
+			user.Grants = append(user.Grants, grant)
+		}
+	}
+	if u.Groups != nil {
+		user.Groups = append(make([]string, 0, len(u.Groups)), u.Groups...)
+	}
+	if u.Scopes != nil {
+		user.Scopes = append(make([]Grant, 0, len(u.Scopes)), u.Scopes...)
+	}
+	if u.ExternalGroups != nil {
+		user.ExternalGroups = append(make([]string, 0, len(u.ExternalGroups)), u.ExternalGroups...)
+	}
+	if u.Tier != nil {
+		tier := *u.Tier
+		user.Tier = &tier
+	}
+	return &user
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthCache_InvalidatedOnChange(t *testing.T) {
+	a := newTestCachedAuth(t, filepath.Join(t.TempDir(), "user.db"))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionRead))
+
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, false))
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ben.Grants))
+
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds", true, true))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "builds", PermissionWrite))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.Authorize(ben, "builds", PermissionWrite))
+}
+
+func TestAuthCache_ChangedByOtherProcess(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	a := newTestCachedAuth(t, filename)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionRead))
+
+	// Another instance (e.g. the 'ntfy access' command) changes the database; the change is
+	// picked up once the data version is read again
+	a.cache.checkInterval = 100 * time.Millisecond
+	other := newTestCachedAuth(t, filename)
+	require.Nil(t, other.AllowAccess("ben", "mytopic", true, false))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionRead))
+	time.Sleep(150 * time.Millisecond)
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+
+	require.Nil(t, other.ChangeRole("ben", RoleAdmin))
+	time.Sleep(150 * time.Millisecond)
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, ben.Role)
+}
+
+func TestAuthCache_RepeatedPublishes(t *testing.T) {
+	a := newTestCachedAuth(t, filepath.Join(t.TempDir(), "user.db"))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, true))
+	token, err := a.CreateToken("ben", "", time.Time{}, nil)
+	require.Nil(t, err)
+
+	// Like the server does for every authenticated publish: authenticate (updating the token's last access
+	// time), authorize, and record the login and the message in the audit log. None of this clears the cache.
+	publish := func() {
+		ben, err := a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.Nil(t, a.Audit(&AuditEvent{Action: AuditActionLoginSuccess, Subject: "ben", IP: "1.2.3.4", Detail: "token"}))
+		require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+		require.Nil(t, a.Audit(&AuditEvent{Action: AuditActionPublish, Actor: "ben", Topic: "mytopic", IP: "1.2.3.4"}))
+		ben, err = a.Authenticate("ben", "ben")
+		require.Nil(t, err)
+		require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+	}
+	publish()
+	generation := a.cache.generation
+	for i := 0; i < 10; i++ {
+		publish()
+	}
+	require.Equal(t, generation, a.cache.generation)
+	_, _, ok := a.cache.user("ben")
+	require.True(t, ok)
+	_, _, ok = a.cache.ruleSet("user:ben")
+	require.True(t, ok)
+
+	// Changes that do not change anything do not clear the cache either
+	require.Nil(t, a.RemoveExpiredAccess())
+	require.Equal(t, generation, a.cache.generation)
+}
+
+func TestAuthCache_FailedLogins(t *testing.T) {
+	a := newTestCachedAuth(t, filepath.Join(t.TempDir(), "user.db"))
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("phil", "mytopic", true, true))
+	phil, err := a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(phil, "mytopic", PermissionWrite))
+	version := a.cache.version
+
+	// Failed logins only remove the affected user from the cache, and do not change the data version
+	for i := 0; i < LockoutThreshold; i++ {
+		_, err := a.Authenticate("ben", "wrong")
+		require.Equal(t, ErrUnauthenticated, err)
+	}
+	_, err = a.Authenticate("ben", "ben")
+	require.Equal(t, ErrLockedOut, err)
+	require.Equal(t, version, a.cache.dataVersion())
+	_, _, ok := a.cache.user("phil")
+	require.True(t, ok)
+	_, _, ok = a.cache.ruleSet("user:phil")
+	require.True(t, ok)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, LockoutThreshold, ben.FailedLogins)
+	require.True(t, ben.Locked())
+}
+
+func TestAuthCache_UserCopy(t *testing.T) {
+	a := newTestCachedAuth(t, filepath.Join(t.TempDir(), "user.db"))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, false))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	ben.Scopes = []Grant{{TopicPattern: "other", AllowRead: true}}
+	ben.Grants[0].AllowWrite = true
+
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Scopes)
+	require.False(t, ben.Grants[0].AllowWrite)
+}
+
+func TestAuthCache_Expires(t *testing.T) {
+	a := newTestCachedAuth(t, filepath.Join(t.TempDir(), "user.db"))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccessUntil("ben", "incident", true, true, time.Now().Add(time.Second)))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "incident", PermissionWrite))
+
+	// The cached entry expires without a change to the database
+	time.Sleep(1100 * time.Millisecond)
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "incident", PermissionWrite))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ben.Grants))
+}
+
+func BenchmarkSQLiteAuth_Authorize_Cached(b *testing.B) {
+	benchmarkSQLiteAuthAuthorize(b, true)
+}
+
+func BenchmarkSQLiteAuth_Authorize_Uncached(b *testing.B) {
+	benchmarkSQLiteAuthAuthorize(b, false)
+}
+
+// benchmarkSQLiteAuthAuthorize authorizes a user for 20 topics per iteration, like a subscription to 20 topics
+func benchmarkSQLiteAuthAuthorize(b *testing.B, cached bool) {
+	a, err := NewSQLiteAuth(filepath.Join(b.TempDir(), "user.db"), false, false)
+	require.Nil(b, err)
+	if !cached {
+		a.cache = nil
+	}
+	require.Nil(b, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(b, a.AddGroup("devs"))
+	require.Nil(b, a.AddGroupMember("devs", "ben"))
+	require.Nil(b, a.AllowGroupAccess("devs", "builds-*", true, true))
+	require.Nil(b, a.AllowAccess(Everyone, "announcements", true, false))
+	topics := make([]string, 20)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("topic%d", i)
+		require.Nil(b, a.AllowAccess("ben", topics[i], true, true))
+	}
+	ben, err := a.User("ben")
+	require.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, topic := range topics {
+			if err := a.Authorize(ben, topic, PermissionRead); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func newTestCachedAuth(t *testing.T, filename string) *SQLiteAuth {
+	a, err := NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	require.NotNil(t, a.cache)
+	return a
+}
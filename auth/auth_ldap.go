@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LDAPUsernamePlaceholder is replaced with the username in LDAPConfig.UserDN
+	LDAPUsernamePlaceholder = "{username}"
+
+	ldapTimeout = 10 * time.Second
+)
+
+var (
+	errLDAPInvalidCredentials = errors.New("invalid credentials")
+	errLDAPUnknownUser        = errors.New("user does not exist in the directory")
+)
+
+// LDAPConfig configures how LDAPAuth authenticates users and looks up their groups
+type LDAPConfig struct {
+	URL                  string        // Server URL, e.g. ldaps://ldap.example.com
+	UserDN               string        // DN template to bind as, e.g. uid={username},ou=people,dc=example,dc=com
+	GroupBaseDN          string        // Base DN of the group search, e.g. ou=groups,dc=example,dc=com; groups are not looked up if empty
+	GroupMemberAttribute string        // Group attribute that contains the member DNs, e.g. member or uniqueMember
+	GroupNameAttribute   string        // Group attribute that contains the group name, e.g. cn
+	CacheDuration        time.Duration // Duration for which successful logins are cached; caching is disabled if zero
+	LocalFallback        bool          // Authenticate all users against the local database if the LDAP server cannot be reached
+}
+
+// LDAPAuth is an implementation of Auther that authenticates users against an LDAP directory by binding as
+// the user. The user's LDAP groups are mapped to the groups in the local SQLite database, so the access control
+// entries of a group with the same name apply to the user (see User.ExternalGroups). The local database also acts
+// as an overlay: users do not have to exist in it, but if they do, their role and own entries are considered as
+// well. All Manager functions operate on the local database.
+//
+// The directory is the source of truth: users that exist in the directory can only log in with their LDAP password.
+// Users that exist only in the local database (e.g. service accounts) can log in with their local password. If the
+// LDAP server cannot be reached, logins fail, unless LDAPConfig.LocalFallback is set.
+//
+// Since clients send their credentials with every request, successful logins are cached for
+// LDAPConfig.CacheDuration, so that the directory is not queried for every single request. The cache stores
+// an HMAC of the password (keyed with a random per-process key), never the password itself.
+type LDAPAuth struct {
+	*SQLiteAuth
+	config   *LDAPConfig
+	cache    map[string]*ldapCacheEntry // Username -> cached login
+	cacheKey []byte
+	mu       sync.Mutex
+}
+
+type ldapCacheEntry struct {
+	password []byte // HMAC-SHA256 of the password
+	groups   []string
+	expires  time.Time
+}
+
+var _ Auther = (*LDAPAuth)(nil)
+var _ Manager = (*LDAPAuth)(nil)
+
+// NewLDAPAuth creates a new LDAPAuth instance, using the given SQLiteAuth as local overlay
+func NewLDAPAuth(local *SQLiteAuth, config *LDAPConfig) (*LDAPAuth, error) {
+	if !strings.HasPrefix(config.URL, "ldap://") && !strings.HasPrefix(config.URL, "ldaps://") {
+		return nil, errors.New("LDAP URL must start with ldap:// or ldaps://")
+	} else if !strings.Contains(config.UserDN, LDAPUsernamePlaceholder) {
+		return nil, errors.New("LDAP user DN must contain " + LDAPUsernamePlaceholder)
+	} else if config.GroupBaseDN != "" && (config.GroupMemberAttribute == "" || config.GroupNameAttribute == "") {
+		return nil, errors.New("LDAP group member and name attributes must be set if group base DN is set")
+	}
+	cacheKey := make([]byte, 32)
+	if _, err := rand.Read(cacheKey); err != nil {
+		return nil, err
+	}
+	return &LDAPAuth{
+		SQLiteAuth: local,
+		config:     config,
+		cache:      make(map[string]*ldapCacheEntry),
+		cacheKey:   cacheKey,
+	}, nil
+}
+
+// Authenticate checks username and password against the LDAP directory, and returns a user including its
+// LDAP groups if correct. The local database is only checked instead if the user does not exist in the directory,
+// or if the LDAP server cannot be reached and LDAPConfig.LocalFallback is set.
+func (a *LDAPAuth) Authenticate(username, password string) (*User, error) {
+	if username == Everyone || !AllowedUsername(username) || password == "" {
+		return nil, ErrUnauthenticated // An empty password would result in an anonymous bind!
+	}
+	if local, err := a.SQLiteAuth.User(username); err == nil && local.Locked() {
+		return nil, ErrLockedOut
+	}
+	groups, ok := a.cachedGroups(username, password)
+	if !ok {
+		var err error
+		groups, err = a.authenticateLDAP(username, password)
+		if err == errLDAPUnknownUser {
+			return a.SQLiteAuth.Authenticate(username, password)
+		} else if err == errLDAPInvalidCredentials {
+			return nil, ErrUnauthenticated
+		} else if err != nil {
+			log.Printf("LDAP authentication of user %s failed: %s", username, err.Error())
+			if a.config.LocalFallback {
+				return a.SQLiteAuth.Authenticate(username, password)
+			}
+			return nil, ErrUnauthenticated
+		}
+		a.cacheGroups(username, password, groups)
+	}
+	user, err := a.SQLiteAuth.User(username)
+	if err == ErrNotFound {
+		user = &User{Name: username, Role: RoleUser}
+	} else if err != nil {
+		return nil, err
+	}
+	user.ExternalGroups = append(make([]string, 0, len(groups)), groups...)
+	return user, nil
+}
+
+// authenticateLDAP binds as the user, and returns the names of the user's groups. If the bind fails, it returns
+// errLDAPUnknownUser if the user's entry does not exist in the directory, and errLDAPInvalidCredentials otherwise.
+// The username does not have to be escaped in the DN, since AllowedUsername does not allow any special characters.
+func (a *LDAPAuth) authenticateLDAP(username, password string) ([]string, error) {
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	userDN := strings.ReplaceAll(a.config.UserDN, LDAPUsernamePlaceholder, username)
+	if err := conn.Bind(userDN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		if !a.userExists(conn, userDN) {
+			return nil, errLDAPUnknownUser
+		}
+		return nil, errLDAPInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0)
+	if a.config.GroupBaseDN == "" {
+		return groups, nil
+	}
+	filter := fmt.Sprintf("(%s=%s)", a.config.GroupMemberAttribute, ldap.EscapeFilter(userDN))
+	request := ldap.NewSearchRequest(a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0,
+		int(ldapTimeout.Seconds()), false, filter, []string{a.config.GroupNameAttribute}, nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetEqualFoldAttributeValues(a.config.GroupNameAttribute)...)
+	}
+	return groups, nil
+}
+
+// userExists looks up the entry with the given DN (anonymously, since the bind as the user failed). Only if the
+// directory reports that there is no such entry, the user is considered to not exist; if the lookup fails for
+// any other reason (e.g. because anonymous lookups are not allowed), the user is assumed to exist.
+func (a *LDAPAuth) userExists(conn *ldap.Conn, userDN string) bool {
+	request := ldap.NewSearchRequest(userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1,
+		int(ldapTimeout.Seconds()), false, "(objectClass=*)", []string{"1.1"}, nil)
+	_, err := conn.Search(request)
+	return !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject)
+}
+
+// cachedGroups returns the groups of a cached successful login, if the login has not expired and was
+// done with the same password
+func (a *LDAPAuth) cachedGroups(username, password string) ([]string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.cache[username]
+	if !ok {
+		return nil, false
+	} else if time.Now().After(entry.expires) {
+		delete(a.cache, username)
+		return nil, false
+	} else if !hmac.Equal(entry.password, a.hashPassword(password)) {
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+func (a *LDAPAuth) cacheGroups(username, password string, groups []string) {
+	if a.config.CacheDuration <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cache[username] = &ldapCacheEntry{
+		password: a.hashPassword(password),
+		groups:   groups,
+		expires:  time.Now().Add(a.config.CacheDuration),
+	}
+}
+
+func (a *LDAPAuth) hashPassword(password string) []byte {
+	h := hmac.New(sha256.New, a.cacheKey)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testLDAPUserDN = "uid={username},ou=people,dc=example,dc=com"
+
+func TestLDAPAuth_Authenticate(t *testing.T) {
+	server := newTestLDAPServer(t)
+	server.AddUser("uid=ben,ou=people,dc=example,dc=com", "ben-ldap", "devs", "ops")
+	a := newTestLDAPAuth(t, server)
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds", true, true))
+
+	ben, err := a.Authenticate("ben", "ben-ldap")
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, RoleUser, ben.Role)
+	require.ElementsMatch(t, []string{"devs", "ops"}, ben.ExternalGroups)
+	require.Nil(t, a.Authorize(ben, "builds", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "other", PermissionRead))
+
+	_, err = a.Authenticate("ben", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+
+	_, err = a.Authenticate("ben", "") // Would be an anonymous bind
+	require.Equal(t, ErrUnauthenticated, err)
+
+	_, err = a.Authenticate("ben,ou=admins", "ben-ldap")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuth_LocalOverlay(t *testing.T) {
+	server := newTestLDAPServer(t)
+	server.AddUser("uid=ben,ou=people,dc=example,dc=com", "ben-ldap")
+	a := newTestLDAPAuth(t, server)
+
+	// Local entries of LDAP users apply, and the local role is used
+	require.Nil(t, a.AddUser("ben", "ben-local", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, false))
+	ben, err := a.Authenticate("ben", "ben-ldap")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ben.ExternalGroups))
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionWrite))
+
+	// Users that exist in LDAP cannot log in with their local password
+	_, err = a.Authenticate("ben", "ben-local")
+	require.Equal(t, ErrUnauthenticated, err)
+
+	// Local users that are not in LDAP can still log in
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+	phil, err := a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, phil.Role)
+	_, err = a.Authenticate("phil", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuth_ServerDown(t *testing.T) {
+	server := newTestLDAPServer(t)
+	server.AddUser("uid=ben,ou=people,dc=example,dc=com", "ben-ldap")
+	a := newTestLDAPAuth(t, server)
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben-local", RoleUser))
+	server.Close()
+
+	// Without the fallback, nobody can log in
+	_, err := a.Authenticate("ben", "ben-ldap")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("phil", "phil")
+	require.Equal(t, ErrUnauthenticated, err)
+
+	// With the fallback, local users can log in with their local password
+	a.config.LocalFallback = true
+	_, err = a.Authenticate("ben", "ben-ldap")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("ben", "ben-local")
+	require.Nil(t, err)
+	_, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+}
+
+func TestLDAPAuth_InvalidConfig(t *testing.T) {
+	local, err := NewSQLiteAuth(filepath.Join(t.TempDir(), "user.db"), false, false)
+	require.Nil(t, err)
+	_, err = NewLDAPAuth(local, &LDAPConfig{URL: "http://ldap.example.com", UserDN: testLDAPUserDN})
+	require.NotNil(t, err)
+	_, err = NewLDAPAuth(local, &LDAPConfig{URL: "ldap://ldap.example.com", UserDN: "cn=admin,dc=example,dc=com"})
+	require.NotNil(t, err)
+	_, err = NewLDAPAuth(local, &LDAPConfig{URL: "ldap://ldap.example.com", UserDN: testLDAPUserDN, GroupBaseDN: "ou=groups,dc=example,dc=com"})
+	require.NotNil(t, err)
+}
+
+func TestLDAPAuth_Cache(t *testing.T) {
+	server := newTestLDAPServer(t)
+	server.AddUser("uid=ben,ou=people,dc=example,dc=com", "ben-ldap", "devs")
+	a := newTestLDAPAuth(t, server)
+
+	ben, err := a.Authenticate("ben", "ben-ldap")
+	require.Nil(t, err)
+	require.Equal(t, []string{"devs"}, ben.ExternalGroups)
+	require.Equal(t, int64(1), server.Binds())
+
+	// Repeated logins with the same password are served from the cache
+	for i := 0; i < 5; i++ {
+		ben, err = a.Authenticate("ben", "ben-ldap")
+		require.Nil(t, err)
+		require.Equal(t, []string{"devs"}, ben.ExternalGroups)
+	}
+	require.Equal(t, int64(1), server.Binds())
+
+	// A different password is always checked against the directory
+	_, err = a.Authenticate("ben", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Equal(t, int64(2), server.Binds())
+
+	// Cached logins expire
+	a.config.CacheDuration = 0
+	a.cache["ben"].expires = time.Now().Add(-time.Second)
+	_, err = a.Authenticate("ben", "ben-ldap")
+	require.Nil(t, err)
+	_, err = a.Authenticate("ben", "ben-ldap")
+	require.Nil(t, err)
+	require.Equal(t, int64(4), server.Binds())
+}
+
+func newTestLDAPAuth(t *testing.T, server *testLDAPServer) *LDAPAuth {
+	local, err := NewSQLiteAuth(filepath.Join(t.TempDir(), "user.db"), false, false)
+	require.Nil(t, err)
+	a, err := NewLDAPAuth(local, &LDAPConfig{
+		URL:                  "ldap://" + server.Addr(),
+		UserDN:               testLDAPUserDN,
+		GroupBaseDN:          "ou=groups,dc=example,dc=com",
+		GroupMemberAttribute: "member",
+		GroupNameAttribute:   "cn",
+		CacheDuration:        time.Minute,
+	})
+	require.Nil(t, err)
+	return a
+}
+
+// testLDAPServer is an in-process LDAP server that understands just enough of the protocol to test LDAPAuth:
+// simple bind (anonymous binds are allowed, like most real servers do), looking up user entries by DN (also
+// anonymously), and searching groups by member.
+type testLDAPServer struct {
+	listener  net.Listener
+	passwords map[string]string   // User DN -> password
+	groups    map[string][]string // Group name -> member DNs
+	binds     int64
+	mu        sync.Mutex
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &testLDAPServer{
+		listener:  listener,
+		passwords: make(map[string]string),
+		groups:    make(map[string][]string),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testLDAPServer) AddUser(dn, password string, groups ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[dn] = password
+	for _, group := range groups {
+		s.groups[group] = append(s.groups[group], dn)
+	}
+}
+
+func (s *testLDAPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *testLDAPServer) Binds() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.binds
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := false
+	for {
+		message, err := ber.ReadPacket(conn)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		messageID, op := message.Children[0].Value.(int64), message.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Value.(string), op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			s.mu.Lock()
+			s.binds++
+			if expected, ok := s.passwords[dn]; password == "" || (ok && expected == password) {
+				code, bound = ldap.LDAPResultSuccess, password != ""
+			}
+			s.mu.Unlock()
+			s.write(conn, messageID, testLDAPResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if baseDN, scope := op.Children[0].Value.(string), op.Children[1].Value.(int64); scope == ldap.ScopeBaseObject {
+				s.mu.Lock()
+				_, ok := s.passwords[baseDN]
+				s.mu.Unlock()
+				code := uint16(ldap.LDAPResultNoSuchObject)
+				if ok {
+					s.write(conn, messageID, testLDAPEntry(baseDN, "objectClass", "person"))
+					code = ldap.LDAPResultSuccess
+				}
+				s.write(conn, messageID, testLDAPResult(ldap.ApplicationSearchResultDone, code))
+				continue
+			}
+			if !bound {
+				s.write(conn, messageID, testLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			baseDN, member := op.Children[0].Value.(string), op.Children[6].Children[1].Value.(string)
+			s.mu.Lock()
+			for name, members := range s.groups {
+				for _, m := range members {
+					if m == member {
+						s.write(conn, messageID, testLDAPEntry("cn="+name+","+baseDN, "cn", name))
+					}
+				}
+			}
+			s.mu.Unlock()
+			s.write(conn, messageID, testLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) write(conn net.Conn, messageID int64, op *ber.Packet) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
+
+func testLDAPResult(tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func testLDAPEntry(dn, attribute, value string) *ber.Packet {
+	values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+	values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, ""))
+	attr.AppendChild(values)
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	attrs.AppendChild(attr)
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	op.AppendChild(attrs)
+	return op
+}
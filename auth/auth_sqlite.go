@@ -1,17 +1,25 @@
 package auth
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 	"golang.org/x/crypto/bcrypt"
+	"log"
+	"math/big"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
 	bcryptCost              = 10
 	intentionalSlowDownHash = "$2a$10$YFCQvqQDwIIwnJM1xkAYOeih0dg17UVGanaTStnrSzC8NCWxcLDwy" // Cost should match bcryptCost
+	tokenPrefix             = "tk_"
+	tokenLength             = 32 // Including prefix
+	tokenCharset            = "abcdefghijklmnopqrstuvwxyz0123456789"
 )
 
 // Auther-related queries
@@ -21,28 +29,120 @@ const (
 		CREATE TABLE IF NOT EXISTS user (
 			user TEXT NOT NULL PRIMARY KEY,
 			pass TEXT NOT NULL,
-			role TEXT NOT NULL
+			role TEXT NOT NULL,
+			failed_logins INT NOT NULL DEFAULT 0,
+			last_failed_login INT NOT NULL DEFAULT 0,
+			locked_until INT NOT NULL DEFAULT 0,
+			tier TEXT NOT NULL DEFAULT '',
+			provisioned INT NOT NULL DEFAULT 0
 		);
 		CREATE TABLE IF NOT EXISTS access (
 			user TEXT NOT NULL,		
 			topic TEXT NOT NULL,
 			read INT NOT NULL,
 			write INT NOT NULL,
+			capabilities TEXT NOT NULL DEFAULT '*',
+			expires INT NOT NULL DEFAULT 0,
+			provisioned INT NOT NULL DEFAULT 0,
 			PRIMARY KEY (topic, user)
 		);
+		CREATE TABLE IF NOT EXISTS user_token (
+			user TEXT NOT NULL,
+			token TEXT NOT NULL,
+			label TEXT NOT NULL,
+			last_access INT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (user, token)
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_user_token ON user_token (token);
+		CREATE TABLE IF NOT EXISTS user_token_scope (
+			token TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (token, topic)
+		);
+		CREATE TABLE IF NOT EXISTS user_group (
+			name TEXT NOT NULL PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_name TEXT NOT NULL,
+			user TEXT NOT NULL,
+			PRIMARY KEY (group_name, user)
+		);
+		CREATE TABLE IF NOT EXISTS group_access (
+			group_name TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			capabilities TEXT NOT NULL DEFAULT '*',
+			PRIMARY KEY (topic, group_name)
+		);
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INT NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			detail TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log (time);
+		CREATE TABLE IF NOT EXISTS tier (
+			code TEXT NOT NULL PRIMARY KEY,
+			request_limit INT NOT NULL,
+			request_limit_replenish INT NOT NULL,
+			email_limit INT NOT NULL,
+			email_limit_replenish INT NOT NULL,
+			subscription_limit INT NOT NULL,
+			attachment_total_size_limit INT NOT NULL,
+			attachment_bandwidth_limit INT NOT NULL,
+			reservation_limit INT NOT NULL DEFAULT 0
+		);
+		CREATE TABLE IF NOT EXISTS reservation (
+			topic TEXT NOT NULL PRIMARY KEY,
+			user TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS reservation_access (
+			user TEXT NOT NULL,
+			topic TEXT NOT NULL PRIMARY KEY,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			capabilities TEXT NOT NULL,
+			expires INT NOT NULL,
+			provisioned INT NOT NULL
+		);
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
 			version INT NOT NULL
 		);
+		CREATE TABLE IF NOT EXISTS dataVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		INSERT INTO dataVersion VALUES (1, 0);
 		COMMIT;
 	`
-	selectUserQuery       = `SELECT pass, role FROM user WHERE user = ?`
-	selectTopicPermsQuery = `
-		SELECT read, write 
-		FROM access 
-		WHERE user IN ('*', ?) AND ? LIKE topic
-		ORDER BY user DESC
+	selectUserQuery            = `SELECT pass, role, failed_logins, locked_until, tier, provisioned FROM user WHERE user = ?`
+	selectUserGroupAccessQuery = `
+		SELECT a.group_name, a.topic, a.read, a.write, a.capabilities
+		FROM group_access a
+		JOIN user_group_member m ON a.group_name = m.group_name
+		WHERE m.user = ?
+	`
+	selectTokenUserQuery   = `SELECT user FROM user_token WHERE token = ? AND (expires = 0 OR expires >= ?)`
+	updateTokenAccessQuery = `UPDATE user_token SET last_access = ? WHERE token = ?`
+
+	updateUserFailedLoginQuery = `
+		UPDATE user
+		SET failed_logins = CASE WHEN last_failed_login < ? THEN 1 ELSE failed_logins + 1 END, last_failed_login = ?
+		WHERE user = ?
 	`
+	selectUserFailedLoginsQuery = `SELECT failed_logins FROM user WHERE user = ?`
+	updateUserLockedUntilQuery  = `UPDATE user SET locked_until = ? WHERE user = ?`
+	resetUserFailedLoginsQuery  = `UPDATE user SET failed_logins = 0, last_failed_login = 0, locked_until = 0 WHERE user = ?`
 )
 
 // Manager-related queries
@@ -54,21 +154,288 @@ const (
 	deleteUserQuery      = `DELETE FROM user WHERE user = ?`
 
 	upsertUserAccessQuery = `
-		INSERT INTO access (user, topic, read, write) 
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT (user, topic) DO UPDATE SET read=excluded.read, write=excluded.write
+		INSERT INTO access (user, topic, read, write, capabilities, expires) 
+		VALUES (?, ?, ?, ?, '*', ?)
+		ON CONFLICT (user, topic) DO UPDATE SET read=excluded.read, write=excluded.write, capabilities=excluded.capabilities, expires=excluded.expires
+	`
+	updateUserCapabilitiesQuery = `UPDATE access SET capabilities = ? WHERE user = ? AND topic = ?`
+	selectUserAccessQuery       = `SELECT topic, read, write, capabilities, expires FROM access WHERE user = ? AND (expires = 0 OR expires >= ?)`
+	deleteExpiredAccessQuery    = `DELETE FROM access WHERE expires > 0 AND expires < ?`
+	deleteAllAccessQuery        = `DELETE FROM access`
+	deleteUserAccessQuery       = `DELETE FROM access WHERE user = ?`
+	deleteTopicAccessQuery      = `DELETE FROM access WHERE user = ? AND topic = ?`
+
+	insertTokenQuery  = `INSERT INTO user_token (user, token, label, last_access, expires) VALUES (?, ?, ?, 0, ?)`
+	selectTokensQuery = `
+		SELECT token, label, last_access, expires
+		FROM user_token
+		WHERE user = ? AND (expires = 0 OR expires >= ?)
+		ORDER BY expires, token
+	`
+	deleteTokenQuery         = `DELETE FROM user_token WHERE user = ? AND token = ?`
+	deleteUserTokensQuery    = `DELETE FROM user_token WHERE user = ?`
+	deleteExpiredTokensQuery = `DELETE FROM user_token WHERE expires > 0 AND expires < ?`
+
+	insertGroupQuery            = `INSERT INTO user_group (name) VALUES (?)`
+	selectGroupQuery            = `SELECT name FROM user_group WHERE name = ?`
+	selectGroupNamesQuery       = `SELECT name FROM user_group ORDER BY name`
+	deleteGroupQuery            = `DELETE FROM user_group WHERE name = ?`
+	insertGroupMemberQuery      = `INSERT OR IGNORE INTO user_group_member (group_name, user) VALUES (?, ?)`
+	selectGroupMembersQuery     = `SELECT user FROM user_group_member WHERE group_name = ? ORDER BY user`
+	selectUserGroupsQuery       = `SELECT group_name FROM user_group_member WHERE user = ? ORDER BY group_name`
+	deleteGroupMemberQuery      = `DELETE FROM user_group_member WHERE group_name = ? AND user = ?`
+	deleteGroupMembersQuery     = `DELETE FROM user_group_member WHERE group_name = ?`
+	deleteUserGroupMembersQuery = `DELETE FROM user_group_member WHERE user = ?`
+	upsertGroupAccessQuery      = `
+		INSERT INTO group_access (group_name, topic, read, write, capabilities) 
+		VALUES (?, ?, ?, ?, '*')
+		ON CONFLICT (topic, group_name) DO UPDATE SET read=excluded.read, write=excluded.write, capabilities=excluded.capabilities
+	`
+	updateGroupCapabilitiesQuery = `UPDATE group_access SET capabilities = ? WHERE group_name = ? AND topic = ?`
+	selectGroupAccessQuery       = `SELECT topic, read, write, capabilities, 0 FROM group_access WHERE group_name = ?`
+	deleteGroupAccessQuery       = `DELETE FROM group_access WHERE group_name = ?`
+	deleteGroupTopicAccessQuery  = `DELETE FROM group_access WHERE group_name = ? AND topic = ?`
+
+	insertTokenScopeQuery        = `INSERT INTO user_token_scope (token, topic, read, write) VALUES (?, ?, ?, ?)`
+	selectTokenScopesQuery       = `SELECT topic, read, write FROM user_token_scope WHERE token = ? ORDER BY topic`
+	deleteOrphanTokenScopesQuery = `DELETE FROM user_token_scope WHERE token NOT IN (SELECT token FROM user_token)`
+
+	insertTierQuery = `
+		INSERT INTO tier (code, request_limit, request_limit_replenish, email_limit, email_limit_replenish, subscription_limit, attachment_total_size_limit, attachment_bandwidth_limit, reservation_limit)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	updateTierQuery = `
+		UPDATE tier
+		SET request_limit = ?, request_limit_replenish = ?, email_limit = ?, email_limit_replenish = ?, subscription_limit = ?, attachment_total_size_limit = ?, attachment_bandwidth_limit = ?, reservation_limit = ?
+		WHERE code = ?
+	`
+	selectTierQuery = `
+		SELECT code, request_limit, request_limit_replenish, email_limit, email_limit_replenish, subscription_limit, attachment_total_size_limit, attachment_bandwidth_limit, reservation_limit
+		FROM tier
+		WHERE code = ?
 	`
-	selectUserAccessQuery  = `SELECT topic, read, write FROM access WHERE user = ?`
-	deleteAllAccessQuery   = `DELETE FROM access`
-	deleteUserAccessQuery  = `DELETE FROM access WHERE user = ?`
-	deleteTopicAccessQuery = `DELETE FROM access WHERE user = ? AND topic = ?`
+	selectTierCodesQuery = `SELECT code FROM tier ORDER BY code`
+	deleteTierQuery      = `DELETE FROM tier WHERE code = ?`
+	updateUserTierQuery  = `UPDATE user SET tier = ? WHERE user = ?`
+	resetTierUsersQuery  = `UPDATE user SET tier = '' WHERE tier = ?`
+
+	insertReservationQuery       = `INSERT OR IGNORE INTO reservation (topic, user, created) VALUES (?, ?, ?)`
+	selectReservationQuery       = `SELECT topic, user, created FROM reservation WHERE topic = ?`
+	selectReservationOwnerQuery  = `SELECT user FROM reservation WHERE topic = ?`
+	selectReservationOwnersQuery = `SELECT topic, user FROM reservation`
+	selectReservationsQuery      = `SELECT topic, user, created FROM reservation WHERE user = ? OR ? = '' ORDER BY user, topic`
+	deleteReservationQuery       = `DELETE FROM reservation WHERE topic = ? AND user = ?`
+	selectUserReservationsQuery  = `SELECT topic FROM reservation WHERE user = ?`
+	deleteUserReservationsQuery  = `DELETE FROM reservation WHERE user = ?`
+	selectTopicAccessCountQuery  = `
+		SELECT (SELECT COUNT(*) FROM access WHERE topic = ? AND user != ?) + (SELECT COUNT(*) FROM group_access WHERE topic = ?)
+	`
+	insertReservationAccessQuery = `
+		INSERT INTO reservation_access (user, topic, read, write, capabilities, expires, provisioned)
+		SELECT user, topic, read, write, capabilities, expires, provisioned FROM access WHERE user = ? AND topic = ?
+	`
+	upsertReservedAccessQuery = `
+		INSERT INTO access (user, topic, read, write, capabilities, expires, provisioned)
+		VALUES (?, ?, ?, ?, '*', 0, 0)
+		ON CONFLICT (user, topic) DO UPDATE SET read=excluded.read, write=excluded.write, capabilities='*', expires=0, provisioned=0
+	`
+	restoreReservationAccessQuery = `
+		INSERT INTO access (user, topic, read, write, capabilities, expires, provisioned)
+		SELECT user, topic, read, write, capabilities, expires, provisioned FROM reservation_access WHERE topic = ?
+	`
+	deleteReservationAccessQuery     = `DELETE FROM reservation_access WHERE topic = ?`
+	deleteUserReservationAccessQuery = `DELETE FROM reservation_access WHERE user = ?`
+
+	insertProvisionedUserQuery   = `INSERT INTO user (user, pass, role, provisioned) VALUES (?, ?, ?, ?)`
+	selectProvisionedUsersQuery  = `SELECT user FROM user WHERE provisioned = 1`
+	updateUserProvisionedQuery   = `UPDATE user SET provisioned = 1 WHERE user = ?`
+	selectAccessEntryQuery       = `SELECT read, write, capabilities, expires, provisioned FROM access WHERE user = ? AND topic = ?`
+	selectProvisionedAccessQuery = `SELECT user, topic FROM access WHERE provisioned = 1`
+	upsertProvisionedAccessQuery = `
+		INSERT INTO access (user, topic, read, write, capabilities, expires, provisioned) 
+		VALUES (?, ?, ?, ?, '*', 0, ?)
+		ON CONFLICT (user, topic) DO UPDATE SET read=excluded.read, write=excluded.write, capabilities=excluded.capabilities, expires=excluded.expires, provisioned=MAX(provisioned, excluded.provisioned)
+	`
+)
+
+// Auditor-related queries
+const (
+	insertAuditEventQuery  = `INSERT INTO audit_log (time, action, actor, subject, topic, ip, detail) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	selectAuditEventsQuery = `
+		SELECT time, action, actor, subject, topic, ip, detail
+		FROM (
+			SELECT id, time, action, actor, subject, topic, ip, detail
+			FROM audit_log
+			WHERE time >= ?
+			  AND (? = '' OR actor = ? OR subject = ?)
+			  AND (? = '' OR action = ?)
+			  AND (? = '' OR topic = ?)
+			ORDER BY id DESC
+			LIMIT ?
+		)
+		ORDER BY id
+	`
+	deleteAuditActivityQuery = `DELETE FROM audit_log WHERE time < ? AND action IN ('login-success', 'login-failure', 'publish')`
+	deleteAuditChangesQuery  = `DELETE FROM audit_log WHERE time < ? AND action NOT IN ('login-success', 'login-failure', 'publish')`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion     = 1
+	currentSchemaVersion     = 13
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
+	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
+
+	// The data version is incremented whenever users, groups, tiers or access control entries change, see authCache
+	incrementDataVersionQuery = `UPDATE dataVersion SET version = version + 1 WHERE id = 1`
+	selectDataVersionQuery    = `SELECT version FROM dataVersion WHERE id = 1`
+
+	// 1 -> 2
+	migrate1To2CreateTokenTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS user_token (
+			user TEXT NOT NULL,
+			token TEXT NOT NULL,
+			label TEXT NOT NULL,
+			last_access INT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (user, token)
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_user_token ON user_token (token);
+		COMMIT;
+	`
+
+	// 2 -> 3
+	migrate2To3CreateTokenScopeTableQuery = `
+		CREATE TABLE IF NOT EXISTS user_token_scope (
+			token TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (token, topic)
+		);
+	`
+
+	// 3 -> 4
+	migrate3To4CreateGroupTablesQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS user_group (
+			name TEXT NOT NULL PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_name TEXT NOT NULL,
+			user TEXT NOT NULL,
+			PRIMARY KEY (group_name, user)
+		);
+		CREATE TABLE IF NOT EXISTS group_access (
+			group_name TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (topic, group_name)
+		);
+		COMMIT;
+	`
+
+	// 4 -> 5
+	migrate4To5AddCapabilitiesColumnsQuery = `
+		BEGIN;
+		ALTER TABLE access ADD COLUMN capabilities TEXT NOT NULL DEFAULT '*';
+		ALTER TABLE group_access ADD COLUMN capabilities TEXT NOT NULL DEFAULT '*';
+		COMMIT;
+	`
+
+	// 5 -> 6
+	migrate5To6AddLockoutColumnsQuery = `
+		BEGIN;
+		ALTER TABLE user ADD COLUMN failed_logins INT NOT NULL DEFAULT 0;
+		ALTER TABLE user ADD COLUMN last_failed_login INT NOT NULL DEFAULT 0;
+		ALTER TABLE user ADD COLUMN locked_until INT NOT NULL DEFAULT 0;
+		COMMIT;
+	`
+
+	// 6 -> 7
+	migrate6To7CreateAuditLogTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INT NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			detail TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log (time);
+		COMMIT;
+	`
+
+	// 7 -> 8
+	migrate7To8CreateTierTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS tier (
+			code TEXT NOT NULL PRIMARY KEY,
+			request_limit INT NOT NULL,
+			request_limit_replenish INT NOT NULL,
+			email_limit INT NOT NULL,
+			email_limit_replenish INT NOT NULL,
+			subscription_limit INT NOT NULL,
+			attachment_total_size_limit INT NOT NULL,
+			attachment_bandwidth_limit INT NOT NULL
+		);
+		ALTER TABLE user ADD COLUMN tier TEXT NOT NULL DEFAULT '';
+		COMMIT;
+	`
+
+	// 8 -> 9
+	migrate8To9CreateReservationTableQuery = `
+		BEGIN;
+		ALTER TABLE tier ADD COLUMN reservation_limit INT NOT NULL DEFAULT 0;
+		CREATE TABLE IF NOT EXISTS reservation (
+			topic TEXT NOT NULL PRIMARY KEY,
+			user TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		COMMIT;
+	`
+
+	// 9 -> 10
+	migrate9To10AlterAccessTableQuery = `
+		ALTER TABLE access ADD COLUMN expires INT NOT NULL DEFAULT 0;
+	`
+
+	// 10 -> 11
+	migrate10To11AddProvisionedColumnsQuery = `
+		BEGIN;
+		ALTER TABLE user ADD COLUMN provisioned INT NOT NULL DEFAULT 0;
+		ALTER TABLE access ADD COLUMN provisioned INT NOT NULL DEFAULT 0;
+		COMMIT;
+	`
+
+	// 11 -> 12
+	migrate11To12CreateReservationAccessTableQuery = `
+		CREATE TABLE IF NOT EXISTS reservation_access (
+			user TEXT NOT NULL,
+			topic TEXT NOT NULL PRIMARY KEY,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			capabilities TEXT NOT NULL,
+			expires INT NOT NULL,
+			provisioned INT NOT NULL
+		);
+	`
+
+	// 12 -> 13
+	migrate12To13CreateDataVersionTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS dataVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		INSERT INTO dataVersion VALUES (1, 0);
+		COMMIT;
+	`
 )
 
 // SQLiteAuth is an implementation of Auther and Manager. It stores users and access control list
@@ -77,10 +444,13 @@ type SQLiteAuth struct {
 	db           *sql.DB
 	defaultRead  bool
 	defaultWrite bool
+	actor        string     // Recorded as the actor of all changes in the audit log, see WithActor
+	cache        *authCache // Cache of users and access control entries, nil if disabled
 }
 
 var _ Auther = (*SQLiteAuth)(nil)
 var _ Manager = (*SQLiteAuth)(nil)
+var _ Auditor = (*SQLiteAuth)(nil)
 
 // NewSQLiteAuth creates a new SQLiteAuth instance
 func NewSQLiteAuth(filename string, defaultRead, defaultWrite bool) (*SQLiteAuth, error) {
@@ -95,264 +465,1847 @@ func NewSQLiteAuth(filename string, defaultRead, defaultWrite bool) (*SQLiteAuth
 		db:           db,
 		defaultRead:  defaultRead,
 		defaultWrite: defaultWrite,
+		cache:        newAuthCache(db),
 	}, nil
 }
 
 // Authenticate checks username and password and returns a user if correct. The method
 // returns in constant-ish time, regardless of whether the user exists or the password is
 // correct or incorrect.
+//
+// Failed logins are counted per user. After LockoutThreshold consecutive failures, the user is
+// locked out (see LockoutDuration), and the method returns ErrLockedOut without checking the password.
+// Callers should not reveal the difference between ErrLockedOut and ErrUnauthenticated to the client,
+// since that would reveal that the user exists.
 func (a *SQLiteAuth) Authenticate(username, password string) (*User, error) {
 	if username == Everyone {
 		return nil, ErrUnauthenticated
 	}
 	user, err := a.User(username)
-	if err != nil {
+	if err != nil || user.Locked() {
 		bcrypt.CompareHashAndPassword([]byte(intentionalSlowDownHash),
 			[]byte("intentional slow-down to avoid timing attacks"))
+		if err == nil {
+			return nil, ErrLockedOut
+		}
 		return nil, ErrUnauthenticated
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)); err != nil {
+		if err := a.recordFailedLogin(username); err != nil {
+			log.Printf("Cannot record failed login of user %s: %s", username, err.Error())
+		}
 		return nil, ErrUnauthenticated
 	}
+	if user.FailedLogins > 0 || !user.LockedUntil.IsZero() {
+		if err := a.execLogin(username, resetUserFailedLoginsQuery, username); err != nil {
+			return nil, err
+		}
+		user.FailedLogins, user.LockedUntil = 0, time.Time{}
+	}
 	return user, nil
 }
 
-// Authorize returns nil if the given user has access to the given topic using the desired
-// permission. The user param may be nil to signal an anonymous user.
-func (a *SQLiteAuth) Authorize(user *User, topic string, perm Permission) error {
-	if user != nil && user.Role == RoleAdmin {
-		return nil // Admin can do everything
-	}
-	username := Everyone
-	if user != nil {
-		username = user.Name
-	}
-	// Select the read/write permissions for this user/topic combo. The query may return two
-	// rows (one for everyone, and one for the user), but prioritizes the user. The value for
-	// user.Name may be empty (= everyone).
-	rows, err := a.db.Query(selectTopicPermsQuery, username, topic)
-	if err != nil {
+// recordFailedLogin increases the failed login counter of the given user, and locks the user out if
+// there were too many consecutive failures. The counter is reset after LockoutResetAfter without failures.
+func (a *SQLiteAuth) recordFailedLogin(username string) error {
+	now := time.Now()
+	if err := a.execLogin(username, updateUserFailedLoginQuery, now.Add(-LockoutResetAfter).Unix(), now.Unix(), username); err != nil {
 		return err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return a.resolvePerms(a.defaultRead, a.defaultWrite, perm)
-	}
-	var read, write bool
-	if err := rows.Scan(&read, &write); err != nil {
-		return err
-	} else if err := rows.Err(); err != nil {
+	var failures int
+	if err := a.db.QueryRow(selectUserFailedLoginsQuery, username).Scan(&failures); err != nil {
 		return err
 	}
-	return a.resolvePerms(read, write, perm)
-}
-
-func (a *SQLiteAuth) resolvePerms(read, write bool, perm Permission) error {
-	if perm == PermissionRead && read {
-		return nil
-	} else if perm == PermissionWrite && write {
+	lockout := LockoutDuration(failures)
+	if lockout == 0 {
 		return nil
 	}
-	return ErrUnauthorized
+	log.Printf("Too many failed logins (%d) for user %s, locking out user for %s", failures, username, lockout)
+	return a.execLogin(username, updateUserLockedUntilQuery, now.Add(lockout).Unix(), username)
 }
 
-// AddUser adds a user with the given username, password and role. The password should be hashed
-// before it is stored in a persistence layer.
-func (a *SQLiteAuth) AddUser(username, password string, role Role) error {
-	if !AllowedUsername(username) || !AllowedRole(role) {
-		return ErrInvalidArgument
-	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
-	if err != nil {
+// execLogin executes a query that changes the failed login counter or the lockout of the given user. Unlike exec,
+// it does not increment the data version, and only removes the user from the cache, so that failed logins (e.g.
+// password spraying) do not clear the cache for all users.
+func (a *SQLiteAuth) execLogin(username string, query string, args ...interface{}) error {
+	if _, err := a.db.Exec(query, args...); err != nil {
 		return err
 	}
-	if _, err = a.db.Exec(insertUserQuery, username, hash, role); err != nil {
-		return err
+	if a.cache != nil {
+		a.cache.removeUser(username)
 	}
 	return nil
 }
 
-// RemoveUser deletes the user with the given username. The function returns nil on success, even
-// if the user did not exist in the first place.
-func (a *SQLiteAuth) RemoveUser(username string) error {
+// UnlockUser resets the failed login counter of the given user, and lifts a lockout if there is one.
+// The function returns ErrNotFound if the user does not exist.
+func (a *SQLiteAuth) UnlockUser(username string) error {
 	if !AllowedUsername(username) {
 		return ErrInvalidArgument
 	}
-	if _, err := a.db.Exec(deleteUserQuery, username); err != nil {
+	result, err := a.exec(resetUserFailedLoginsQuery, username)
+	if err != nil {
 		return err
 	}
-	if _, err := a.db.Exec(deleteUserAccessQuery, username); err != nil {
+	if rows, err := result.RowsAffected(); err != nil {
 		return err
+	} else if rows == 0 {
+		return ErrNotFound
 	}
+	a.audit(AuditActionUserUnlock, username, "", "")
 	return nil
 }
 
-// Users returns a list of users. It always also returns the Everyone user ("*").
-func (a *SQLiteAuth) Users() ([]*User, error) {
-	rows, err := a.db.Query(selectUsernamesQuery)
+// AuthenticateToken checks the given access token and returns the user it belongs to if the
+// token exists and has not expired. It also updates the token's last access time.
+func (a *SQLiteAuth) AuthenticateToken(token string) (*User, error) {
+	if !strings.HasPrefix(token, tokenPrefix) || len(token) != tokenLength {
+		return nil, ErrUnauthenticated
+	}
+	rows, err := a.db.Query(selectTokenUserQuery, token, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	usernames := make([]string, 0)
-	for rows.Next() {
-		var username string
-		if err := rows.Scan(&username); err != nil {
-			return nil, err
-		} else if err := rows.Err(); err != nil {
-			return nil, err
-		}
-		usernames = append(usernames, username)
+	if !rows.Next() {
+		return nil, ErrUnauthenticated
+	}
+	var username string
+	if err := rows.Scan(&username); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
 	}
 	rows.Close()
-	users := make([]*User, 0)
-	for _, username := range usernames {
-		user, err := a.User(username)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+	user, err := a.User(username)
+	if err != nil {
+		return nil, ErrUnauthenticated
 	}
-	everyone, err := a.everyoneUser()
+	user.Scopes, err = a.readTokenScopes(token)
 	if err != nil {
 		return nil, err
 	}
-	users = append(users, everyone)
-	return users, nil
+	if _, err := a.db.Exec(updateTokenAccessQuery, time.Now().Unix(), token); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
-// User returns the user with the given username if it exists, or ErrNotFound otherwise.
-// You may also pass Everyone to retrieve the anonymous user and its Grant list.
-func (a *SQLiteAuth) User(username string) (*User, error) {
-	if username == Everyone {
-		return a.everyoneUser()
+// Authorize returns nil if the given user has access to the given topic using the desired
+// permission. The user param may be nil to signal an anonymous user.
+func (a *SQLiteAuth) Authorize(user *User, topic string, perm Permission) error {
+	if user != nil && len(user.Scopes) > 0 && !a.scopesAllow(user.Scopes, topic, perm) {
+		return ErrUnauthorized // Scoped token does not allow access, regardless of the user's grants
 	}
-	rows, err := a.db.Query(selectUserQuery, username)
+	if user != nil && user.Role == RoleAdmin {
+		return nil // Admin can do everything
+	}
+	username, groups := Everyone, []string(nil)
+	if user != nil {
+		username, groups = user.Name, user.ExternalGroups
+	}
+	decision, err := a.decide(username, groups, topic)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	var hash, role string
-	if !rows.Next() {
-		return nil, ErrNotFound
+	return a.resolvePerms(decision.AllowRead, decision.AllowWrite, perm)
+}
+
+// AuthorizeCapability returns nil if the given user may use the given publishing capability (e.g. attachments)
+// on the given topic. The capabilities are taken from the entries that decide the user's access to the topic (see
+// decide). The default access from the server config allows all capabilities. Token scopes are not considered.
+func (a *SQLiteAuth) AuthorizeCapability(user *User, topic string, capability Capability) error {
+	if user != nil && user.Role == RoleAdmin {
+		return nil // Admin can do everything
 	}
-	if err := rows.Scan(&hash, &role); err != nil {
-		return nil, err
-	} else if err := rows.Err(); err != nil {
+	username, groups := Everyone, []string(nil)
+	if user != nil {
+		username, groups = user.Name, user.ExternalGroups
+	}
+	decision, err := a.decide(username, groups, topic)
+	if err != nil {
+		return err
+	} else if !HasCapability(decision.Capabilities, capability) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Decide resolves the access control list for the given user (or Everyone) and topic, and returns the
+// resulting permissions, as well as the entries that led to the decision. Token scopes are not considered.
+func (a *SQLiteAuth) Decide(username, topic string) (*Decision, error) {
+	if username != Everyone {
+		user, err := a.User(username)
+		if err != nil {
+			return nil, err
+		} else if user.Role == RoleAdmin {
+			return &Decision{AllowRead: true, AllowWrite: true, Source: SourceAdmin, Rules: make([]Rule, 0)}, nil
+		}
+	}
+	return a.decide(username, nil, topic)
+}
+
+// decide resolves the access control list for the given user and topic. Entries are checked in the following
+// order, and the first level with a matching entry decides: (1) the user's own entries, (2) the entries of all of
+// the user's groups, (3) the entries of the everyone user, and (4) the default access from the server config.
+// Within a level, the most specific matching entry wins (see resolveRules). The given groups are considered in
+// addition to the user's group memberships in the database, e.g. groups asserted by an identity provider (see
+// JWTVerifier).
+//
+// Reserved topics are decided differently, see decideReserved.
+func (a *SQLiteAuth) decide(username string, groups []string, topic string) (*Decision, error) {
+	owner, err := a.reservationOwner(topic)
+	if err != nil {
 		return nil, err
+	} else if owner != "" {
+		return a.decideReserved(username, topic)
 	}
-	grants, err := a.readGrants(username)
+	if username != Everyone {
+		userRules, err := a.readUserRules(username, SourceUser)
+		if err != nil {
+			return nil, err
+		} else if decision := resolveRules(userRules, topic); decision != nil {
+			return decision, nil
+		}
+		groupRules, err := a.readGroupRules(username, groups)
+		if err != nil {
+			return nil, err
+		} else if decision := resolveRules(groupRules, topic); decision != nil {
+			return decision, nil
+		}
+	}
+	everyoneRules, err := a.readUserRules(Everyone, SourceEveryone)
 	if err != nil {
 		return nil, err
+	} else if decision := resolveRules(everyoneRules, topic); decision != nil {
+		return decision, nil
 	}
-	return &User{
-		Name:   username,
-		Hash:   hash,
-		Role:   Role(role),
-		Grants: grants,
+	return &Decision{
+		AllowRead:  a.defaultRead,
+		AllowWrite: a.defaultWrite,
+		Source:     SourceDefault,
+		Rules:      make([]Rule, 0),
 	}, nil
 }
 
-func (a *SQLiteAuth) everyoneUser() (*User, error) {
-	grants, err := a.readGrants(Everyone)
+// decideReserved resolves the access control list for a reserved topic. Only entries for exactly this topic
+// are considered, so that wildcard entries of users and groups cannot be used to access someone else's reserved
+// topic: (1) the user's own entry for the topic, which is the read-write entry of the reservation for the owner,
+// (2) the entry of the everyone user, which is the deny entry of the reservation, and (3) no access at all, e.g.
+// if the entries of the reservation were removed.
+func (a *SQLiteAuth) decideReserved(username string, topic string) (*Decision, error) {
+	if username != Everyone {
+		userRules, err := a.readUserRules(username, SourceUser)
+		if err != nil {
+			return nil, err
+		} else if decision := resolveRules(userRules.exact(topic), topic); decision != nil {
+			return decision, nil
+		}
+	}
+	everyoneRules, err := a.readUserRules(Everyone, SourceEveryone)
 	if err != nil {
 		return nil, err
+	} else if decision := resolveRules(everyoneRules.exact(topic), topic); decision != nil {
+		return decision, nil
 	}
-	return &User{
-		Name:   Everyone,
-		Hash:   "",
-		Role:   RoleAnonymous,
-		Grants: grants,
+	return &Decision{
+		Source:       SourceReservation,
+		Capabilities: make([]Capability, 0),
+		Rules:        make([]Rule, 0),
 	}, nil
 }
 
-func (a *SQLiteAuth) readGrants(username string) ([]Grant, error) {
-	rows, err := a.db.Query(selectUserAccessQuery, username)
+// reservationOwner returns the user that reserved the given topic, or an empty string if the
+// topic is not reserved, see authCache
+func (a *SQLiteAuth) reservationOwner(topic string) (string, error) {
+	if a.cache == nil {
+		var owner string
+		if err := a.db.QueryRow(selectReservationOwnerQuery, topic).Scan(&owner); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		return owner, nil
+	}
+	owners, generation, ok := a.cache.reservationOwners()
+	if ok {
+		return owners[topic], nil
+	}
+	rows, err := a.db.Query(selectReservationOwnersQuery)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer rows.Close()
-	grants := make([]Grant, 0)
+	owners = make(map[string]string)
 	for rows.Next() {
-		var topic string
-		var read, write bool
-		if err := rows.Scan(&topic, &read, &write); err != nil {
-			return nil, err
+		var reserved, owner string
+		if err := rows.Scan(&reserved, &owner); err != nil {
+			return "", err
 		} else if err := rows.Err(); err != nil {
-			return nil, err
+			return "", err
+		}
+		owners[reserved] = owner
+	}
+	a.cache.setReservationOwners(owners, generation)
+	return owners[topic], nil
+}
+
+// readUserRules returns the (non-expired) entries of the given user or the everyone user, see authCache
+func (a *SQLiteAuth) readUserRules(username string, source Source) (*ruleSet, error) {
+	return a.cachedRules("user:"+username, func() ([]Rule, error) {
+		return a.readRules(selectUserAccessQuery, source, username, username, time.Now().Unix())
+	})
+}
+
+func (a *SQLiteAuth) readRules(query string, source Source, owner string, args ...interface{}) ([]Rule, error) {
+	grants, err := a.readAccess(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, 0)
+	for _, grant := range grants {
+		rules = append(rules, Rule{Grant: grant, Source: source, Owner: owner})
+	}
+	return rules, nil
+}
+
+// readGroupRules returns the entries of all groups the user is a member of in the database, as well
+// as the entries of the given (external) groups, see authCache
+func (a *SQLiteAuth) readGroupRules(username string, groups []string) (*ruleSet, error) {
+	rules, err := a.cachedRules("member:"+username, func() ([]Rule, error) {
+		return a.readMemberRules(username)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if rules.containsOwner(group) {
+			continue // Already a member in the database
+		}
+		group := group
+		groupRules, err := a.cachedRules("group:"+group, func() ([]Rule, error) {
+			return a.readRules(selectGroupAccessQuery, SourceGroup, group, group)
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = rules.append(groupRules)
+	}
+	return rules, nil
+}
+
+func (a *SQLiteAuth) readMemberRules(username string) ([]Rule, error) {
+	rows, err := a.db.Query(selectUserGroupAccessQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := make([]Rule, 0)
+	for rows.Next() {
+		var group, topic, capabilities string
+		var read, write bool
+		if err := rows.Scan(&group, &topic, &read, &write, &capabilities); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, Rule{
+			Grant: Grant{
+				TopicPattern: fromSQLWildcard(topic),
+				AllowRead:    read,
+				AllowWrite:   write,
+				Capabilities: fromCapabilitiesString(capabilities),
+			},
+			Source: SourceGroup,
+			Owner:  group,
+		})
+	}
+	return rules, nil
+}
+
+// cachedRules returns the rules with the given cache key from the cache, or loads (and caches) them
+// using the given function if they are not cached. If the cache is disabled, the rules are always loaded.
+func (a *SQLiteAuth) cachedRules(key string, load func() ([]Rule, error)) (*ruleSet, error) {
+	if a.cache == nil {
+		rules, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return newRuleSet(rules), nil
+	}
+	rules, generation, ok := a.cache.ruleSet(key)
+	if ok {
+		return rules, nil
+	}
+	loaded, err := load()
+	if err != nil {
+		return nil, err
+	}
+	rules = newRuleSet(loaded)
+	a.cache.setRuleSet(key, rules, generation)
+	return rules, nil
+}
+
+// ruleSet is a list of rules (all of the same level), along with their compiled topic patterns
+type ruleSet struct {
+	rules    []Rule
+	patterns []topicPattern
+}
+
+func newRuleSet(rules []Rule) *ruleSet {
+	patterns := make([]topicPattern, len(rules))
+	for i, rule := range rules {
+		patterns[i] = compileTopicPattern(rule.TopicPattern)
+	}
+	return &ruleSet{
+		rules:    rules,
+		patterns: patterns,
+	}
+}
+
+// append returns a new rule set with the rules of both sets; neither of the sets is modified
+func (s *ruleSet) append(other *ruleSet) *ruleSet {
+	return &ruleSet{
+		rules:    append(append(make([]Rule, 0, len(s.rules)+len(other.rules)), s.rules...), other.rules...),
+		patterns: append(append(make([]topicPattern, 0, len(s.patterns)+len(other.patterns)), s.patterns...), other.patterns...),
+	}
+}
+
+// exact returns a new rule set with only the rules for exactly the given topic, i.e. without wildcard rules
+func (s *ruleSet) exact(topic string) *ruleSet {
+	exact := &ruleSet{
+		rules:    make([]Rule, 0),
+		patterns: make([]topicPattern, 0),
+	}
+	for i, rule := range s.rules {
+		if rule.TopicPattern == topic {
+			exact.rules = append(exact.rules, rule)
+			exact.patterns = append(exact.patterns, s.patterns[i])
+		}
+	}
+	return exact
+}
+
+func (s *ruleSet) containsOwner(owner string) bool {
+	for _, rule := range s.rules {
+		if rule.Owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRules returns the decision for the given topic based on the given rules (all of the same level),
+// or nil if no rule matches the topic. The most specific matching rule wins (see compareTopicPatterns). If
+// multiple rules are equally specific, an explicit deny (neither read nor write) wins over all other rules,
+// and otherwise the permissions and capabilities of these rules are combined. Expired rules are ignored, since
+// cached rules may have expired after they were read from the database.
+func resolveRules(set *ruleSet, topic string) *Decision {
+	now := time.Now()
+	matches := make([]Rule, 0)
+	for i, rule := range set.rules {
+		if !set.patterns[i].match(topic) || (!rule.Expires.IsZero() && rule.Expires.Before(now)) {
+			continue
+		}
+		if len(matches) == 0 {
+			matches = append(matches, rule)
+		} else if c := compareTopicPatterns(rule.TopicPattern, matches[0].TopicPattern); c > 0 {
+			matches = []Rule{rule}
+		} else if c == 0 {
+			matches = append(matches, rule)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	decision := &Decision{Source: matches[0].Source, Capabilities: make([]Capability, 0), Rules: make([]Rule, 0)}
+	for _, rule := range matches {
+		if !rule.AllowRead && !rule.AllowWrite {
+			return &Decision{Source: rule.Source, Capabilities: make([]Capability, 0), Rules: []Rule{rule}}
+		}
+		decision.AllowRead = decision.AllowRead || rule.AllowRead
+		decision.AllowWrite = decision.AllowWrite || rule.AllowWrite
+		decision.Capabilities = combineCapabilities(decision.Capabilities, rule.Capabilities)
+		decision.Rules = append(decision.Rules, rule)
+	}
+	return decision
+}
+
+// scopesAllow returns true if any of the given token scopes matches the topic and grants the desired permission
+func (a *SQLiteAuth) scopesAllow(scopes []Grant, topic string, perm Permission) bool {
+	for _, scope := range scopes {
+		if matchTopicPattern(scope.TopicPattern, topic) && a.resolvePerms(scope.AllowRead, scope.AllowWrite, perm) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *SQLiteAuth) resolvePerms(read, write bool, perm Permission) error {
+	if perm == PermissionRead && read {
+		return nil
+	} else if perm == PermissionWrite && write {
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+// AddUser adds a user with the given username, password and role. The password should be hashed
+// before it is stored in a persistence layer.
+func (a *SQLiteAuth) AddUser(username, password string, role Role) error {
+	if !AllowedUsername(username) || !AllowedRole(role) {
+		return ErrInvalidArgument
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	if _, err = a.exec(insertUserQuery, username, hash, role); err != nil {
+		return err
+	}
+	a.audit(AuditActionUserAdd, username, "", "role "+string(role))
+	return nil
+}
+
+// RemoveUser deletes the user with the given username. The function returns nil on success, even
+// if the user did not exist in the first place.
+func (a *SQLiteAuth) RemoveUser(username string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.exec(deleteUserQuery, username); err != nil {
+		return err
+	}
+	if _, err := a.exec(deleteUserAccessQuery, username); err != nil {
+		return err
+	}
+	if _, err := a.exec(deleteUserTokensQuery, username); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(deleteOrphanTokenScopesQuery); err != nil {
+		return err
+	}
+	if _, err := a.exec(deleteUserGroupMembersQuery, username); err != nil {
+		return err
+	}
+	topics, err := a.readStrings(selectUserReservationsQuery, username)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if _, err := a.exec(deleteTopicAccessQuery, Everyone, topic); err != nil {
+			return err
+		}
+	}
+	if _, err := a.exec(deleteUserReservationsQuery, username); err != nil {
+		return err
+	}
+	if _, err := a.exec(deleteUserReservationAccessQuery, username); err != nil {
+		return err
+	}
+	a.audit(AuditActionUserRemove, username, "", "")
+	return nil
+}
+
+// Users returns a list of users. It always also returns the Everyone user ("*").
+func (a *SQLiteAuth) Users() ([]*User, error) {
+	rows, err := a.db.Query(selectUsernamesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+	users := make([]*User, 0)
+	for _, username := range usernames {
+		user, err := a.User(username)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	everyone, err := a.everyoneUser()
+	if err != nil {
+		return nil, err
+	}
+	users = append(users, everyone)
+	return users, nil
+}
+
+// User returns the user with the given username if it exists, or ErrNotFound otherwise.
+// You may also pass Everyone to retrieve the anonymous user and its Grant list.
+func (a *SQLiteAuth) User(username string) (*User, error) {
+	if a.cache == nil {
+		return a.readUser(username)
+	}
+	user, generation, ok := a.cache.user(username)
+	if ok {
+		return user, nil
+	}
+	user, err := a.readUser(username)
+	if err != nil {
+		return nil, err
+	}
+	a.cache.setUser(username, user, generation)
+	return user, nil
+}
+
+func (a *SQLiteAuth) readUser(username string) (*User, error) {
+	if username == Everyone {
+		return a.everyoneUser()
+	}
+	rows, err := a.db.Query(selectUserQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hash, role, tierCode string
+	var failedLogins int
+	var lockedUntil int64
+	var provisioned bool
+	if !rows.Next() {
+		return nil, ErrNotFound
+	}
+	if err := rows.Scan(&hash, &role, &failedLogins, &lockedUntil, &tierCode, &provisioned); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	grants, err := a.readGrants(username)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := a.readStrings(selectUserGroupsQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{
+		Name:         username,
+		Hash:         hash,
+		Role:         Role(role),
+		Grants:       grants,
+		Groups:       groups,
+		FailedLogins: failedLogins,
+		Provisioned:  provisioned,
+	}
+	if lockedUntil > 0 {
+		user.LockedUntil = time.Unix(lockedUntil, 0)
+	}
+	if tierCode != "" {
+		user.Tier, err = a.Tier(tierCode)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (a *SQLiteAuth) everyoneUser() (*User, error) {
+	grants, err := a.readGrants(Everyone)
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		Name:   Everyone,
+		Hash:   "",
+		Role:   RoleAnonymous,
+		Grants: grants,
+		Groups: make([]string, 0),
+	}, nil
+}
+
+func (a *SQLiteAuth) readGrants(username string) ([]Grant, error) {
+	return a.readAccess(selectUserAccessQuery, username, time.Now().Unix())
+}
+
+func (a *SQLiteAuth) readAccess(query string, args ...interface{}) ([]Grant, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make([]Grant, 0)
+	for rows.Next() {
+		var topic, capabilities string
+		var read, write bool
+		var expires int64
+		if err := rows.Scan(&topic, &read, &write, &capabilities, &expires); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
 		}
 		grants = append(grants, Grant{
 			TopicPattern: fromSQLWildcard(topic),
 			AllowRead:    read,
 			AllowWrite:   write,
+			Capabilities: fromCapabilitiesString(capabilities),
+			Expires:      fromUnixTime(expires),
 		})
 	}
-	return grants, nil
+	return grants, nil
+}
+
+// exec executes a query that changes users, groups, tiers or access control entries. If the query changed
+// anything, the data version is incremented, which clears the cache of this and all other instances using the
+// same database (see authCache). Queries that do not affect the cache (e.g. the audit log, or the last access
+// time of tokens) must use a.db.Exec directly, so that they do not clear the cache.
+func (a *SQLiteAuth) exec(query string, args ...interface{}) (sql.Result, error) {
+	result, err := a.db.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows > 0 {
+		if _, err := a.db.Exec(incrementDataVersionQuery); err != nil {
+			return nil, err
+		}
+		a.invalidateCache()
+	}
+	return result, nil
+}
+
+// commit increments the data version and commits the given transaction, see exec
+func (a *SQLiteAuth) commit(tx *sql.Tx) error {
+	if _, err := tx.Exec(incrementDataVersionQuery); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.invalidateCache()
+	return nil
+}
+
+func (a *SQLiteAuth) invalidateCache() {
+	if a.cache != nil {
+		a.cache.invalidate()
+	}
+}
+
+func (a *SQLiteAuth) readStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// ChangePassword changes a user's password
+func (a *SQLiteAuth) ChangePassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	if _, err := a.exec(updateUserPassQuery, hash, username); err != nil {
+		return err
+	}
+	a.audit(AuditActionUserChangePassword, username, "", "")
+	return nil
+}
+
+// ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
+// all existing access control entries (Grant) are removed, since they are no longer needed.
+func (a *SQLiteAuth) ChangeRole(username string, role Role) error {
+	if !AllowedUsername(username) || !AllowedRole(role) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.exec(updateUserRoleQuery, string(role), username); err != nil {
+		return err
+	}
+	if role == RoleAdmin {
+		if _, err := a.exec(deleteUserAccessQuery, username); err != nil {
+			return err
+		}
+	}
+	a.audit(AuditActionUserChangeRole, username, "", "role "+string(role))
+	return nil
+}
+
+// AllowAccess adds or updates an entry in th access control list for a specific user. It controls
+// read/write access to a topic. The parameter topicPattern may include wildcards (*). The entry
+// allows all publishing capabilities, unless restricted with SetCapabilities.
+func (a *SQLiteAuth) AllowAccess(username string, topicPattern string, read bool, write bool) error {
+	return a.AllowAccessUntil(username, topicPattern, read, write, time.Time{})
+}
+
+// AllowAccessUntil is like AllowAccess, but the entry expires at the given time. Expired entries are
+// ignored, and deleted with RemoveExpiredAccess. If expires is the zero time, the entry never expires.
+func (a *SQLiteAuth) AllowAccessUntil(username string, topicPattern string, read bool, write bool, expires time.Time) error {
+	if (!AllowedUsername(username) && username != Everyone) || !AllowedTopicPattern(topicPattern) {
+		return ErrInvalidArgument
+	}
+	var expiresUnix int64
+	detail := auditPermission(read, write)
+	if !expires.IsZero() {
+		expiresUnix = expires.Unix()
+		detail += ", expires " + expires.UTC().Format(time.RFC3339)
+	}
+	if _, err := a.exec(upsertUserAccessQuery, username, toSQLWildcard(topicPattern), read, write, expiresUnix); err != nil {
+		return err
+	}
+	a.audit(AuditActionAccessAllow, username, topicPattern, detail)
+	return nil
+}
+
+// RemoveExpiredAccess deletes all access control entries that have expired
+func (a *SQLiteAuth) RemoveExpiredAccess() error {
+	_, err := a.exec(deleteExpiredAccessQuery, time.Now().Unix())
+	return err
+}
+
+// SetCapabilities restricts the publishing capabilities of an existing access control entry of a user.
+// If capabilities is nil, all capabilities are allowed. The function returns ErrNotFound if the entry
+// does not exist. Note that AllowAccess resets the capabilities of an entry.
+func (a *SQLiteAuth) SetCapabilities(username string, topicPattern string, capabilities []Capability) error {
+	if (!AllowedUsername(username) && username != Everyone) || !AllowedTopicPattern(topicPattern) {
+		return ErrInvalidArgument
+	}
+	if err := a.updateCapabilities(updateUserCapabilitiesQuery, username, topicPattern, capabilities); err != nil {
+		return err
+	}
+	a.audit(AuditActionAccessCapabilities, username, topicPattern, toCapabilitiesString(capabilities))
+	return nil
+}
+
+func (a *SQLiteAuth) updateCapabilities(query, name, topicPattern string, capabilities []Capability) error {
+	for _, c := range capabilities {
+		if !AllowedCapability(c) {
+			return ErrInvalidArgument
+		}
+	}
+	result, err := a.exec(query, toCapabilitiesString(capabilities), name, toSQLWildcard(topicPattern))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ResetAccess removes an access control list entry for a specific username/topic, or (if topic is
+// empty) for an entire user. The parameter topicPattern may include wildcards (*).
+func (a *SQLiteAuth) ResetAccess(username string, topicPattern string) error {
+	if !AllowedUsername(username) && username != Everyone && username != "" {
+		return ErrInvalidArgument
+	} else if !AllowedTopicPattern(topicPattern) && topicPattern != "" {
+		return ErrInvalidArgument
+	}
+	var err error
+	if username == "" && topicPattern == "" {
+		_, err = a.exec(deleteAllAccessQuery, username)
+	} else if topicPattern == "" {
+		_, err = a.exec(deleteUserAccessQuery, username)
+	} else {
+		_, err = a.exec(deleteTopicAccessQuery, username, toSQLWildcard(topicPattern))
+	}
+	if err != nil {
+		return err
+	}
+	a.audit(AuditActionAccessReset, username, topicPattern, "")
+	return nil
+}
+
+// DefaultAccess returns the default read/write access if no access control entry matches
+func (a *SQLiteAuth) DefaultAccess() (read bool, write bool) {
+	return a.defaultRead, a.defaultWrite
+}
+
+// CreateToken generates a new random access token for the given user. The token can be used instead
+// of the user's password. If expires is the zero time, the token never expires. If scopes is not empty,
+// the token is restricted to the given topic patterns and permissions (in addition to the user's grants).
+func (a *SQLiteAuth) CreateToken(username, label string, expires time.Time, scopes []Grant) (*Token, error) {
+	if !AllowedUsername(username) {
+		return nil, ErrInvalidArgument
+	}
+	for _, scope := range scopes {
+		if !AllowedTopicPattern(scope.TopicPattern) {
+			return nil, ErrInvalidArgument
+		}
+	}
+	if _, err := a.User(username); err != nil {
+		return nil, err
+	}
+	if _, err := a.db.Exec(deleteExpiredTokensQuery, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	if _, err := a.db.Exec(deleteOrphanTokenScopesQuery); err != nil {
+		return nil, err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	var expiresUnix int64
+	if !expires.IsZero() {
+		expiresUnix = expires.Unix()
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(insertTokenQuery, username, token, label, expiresUnix); err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		if _, err := tx.Exec(insertTokenScopeQuery, token, scope.TopicPattern, scope.AllowRead, scope.AllowWrite); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	a.audit(AuditActionTokenCreate, username, "", auditToken(token))
+	if scopes == nil {
+		scopes = make([]Grant, 0)
+	}
+	return &Token{
+		Value:   token,
+		Label:   label,
+		Expires: expires,
+		Scopes:  scopes,
+	}, nil
+}
+
+// Tokens returns all (non-expired) access tokens of the given user
+func (a *SQLiteAuth) Tokens(username string) ([]*Token, error) {
+	rows, err := a.db.Query(selectTokensQuery, username, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]*Token, 0)
+	for rows.Next() {
+		var token, label string
+		var lastAccess, expires int64
+		if err := rows.Scan(&token, &label, &lastAccess, &expires); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &Token{
+			Value:      token,
+			Label:      label,
+			LastAccess: fromUnixTime(lastAccess),
+			Expires:    fromUnixTime(expires),
+		})
+	}
+	rows.Close()
+	for _, token := range tokens {
+		if token.Scopes, err = a.readTokenScopes(token.Value); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func (a *SQLiteAuth) readTokenScopes(token string) ([]Grant, error) {
+	rows, err := a.db.Query(selectTokenScopesQuery, token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scopes := make([]Grant, 0)
+	for rows.Next() {
+		var topic string
+		var read, write bool
+		if err := rows.Scan(&topic, &read, &write); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, Grant{
+			TopicPattern: topic,
+			AllowRead:    read,
+			AllowWrite:   write,
+		})
+	}
+	return scopes, nil
+}
+
+// RemoveToken deletes the given access token of the given user. The function returns ErrNotFound
+// if the token does not exist.
+func (a *SQLiteAuth) RemoveToken(username, token string) error {
+	result, err := a.db.Exec(deleteTokenQuery, username, token)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	if _, err := a.db.Exec(deleteOrphanTokenScopesQuery); err != nil {
+		return err
+	}
+	a.audit(AuditActionTokenRemove, username, "", auditToken(token))
+	return nil
+}
+
+// AddGroup adds a group with the given name. Groups have their own access control entries, which
+// apply to all members of the group.
+func (a *SQLiteAuth) AddGroup(name string) error {
+	if !AllowedGroupName(name) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.exec(insertGroupQuery, name); err != nil {
+		return err
+	}
+	a.audit(AuditActionGroupAdd, name, "", "")
+	return nil
+}
+
+// RemoveGroup deletes the group with the given name, including its members and access control entries.
+// The function returns nil on success, even if the group did not exist in the first place.
+func (a *SQLiteAuth) RemoveGroup(name string) error {
+	if !AllowedGroupName(name) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.exec(deleteGroupQuery, name); err != nil {
+		return err
+	}
+	if _, err := a.exec(deleteGroupMembersQuery, name); err != nil {
+		return err
+	}
+	if _, err := a.exec(deleteGroupAccessQuery, name); err != nil {
+		return err
+	}
+	a.audit(AuditActionGroupRemove, name, "", "")
+	return nil
+}
+
+// Groups returns a list of all groups
+func (a *SQLiteAuth) Groups() ([]*Group, error) {
+	names, err := a.readStrings(selectGroupNamesQuery)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*Group, 0)
+	for _, name := range names {
+		group, err := a.Group(name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// Group returns the group with the given name if it exists, or ErrNotFound otherwise
+func (a *SQLiteAuth) Group(name string) (*Group, error) {
+	names, err := a.readStrings(selectGroupQuery, name)
+	if err != nil {
+		return nil, err
+	} else if len(names) == 0 {
+		return nil, ErrNotFound
+	}
+	members, err := a.readStrings(selectGroupMembersQuery, name)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := a.readAccess(selectGroupAccessQuery, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Group{
+		Name:    name,
+		Members: members,
+		Grants:  grants,
+	}, nil
+}
+
+// AddGroupMember adds a user to a group. Both the user and the group must exist.
+func (a *SQLiteAuth) AddGroupMember(name, username string) error {
+	if !AllowedGroupName(name) || !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.Group(name); err != nil {
+		return err
+	} else if _, err := a.User(username); err != nil {
+		return err
+	}
+	if _, err := a.exec(insertGroupMemberQuery, name, username); err != nil {
+		return err
+	}
+	a.audit(AuditActionGroupMemberAdd, username, "", "group "+name)
+	return nil
+}
+
+// RemoveGroupMember removes a user from a group. The function returns ErrNotFound if the user
+// is not a member of the group.
+func (a *SQLiteAuth) RemoveGroupMember(name, username string) error {
+	result, err := a.exec(deleteGroupMemberQuery, name, username)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	a.audit(AuditActionGroupMemberRemove, username, "", "group "+name)
+	return nil
+}
+
+// AllowGroupAccess adds or updates an entry in the access control list for a specific group. It
+// controls read/write access to a topic. The parameter topicPattern may include wildcards (*).
+func (a *SQLiteAuth) AllowGroupAccess(name string, topicPattern string, read bool, write bool) error {
+	if !AllowedGroupName(name) || !AllowedTopicPattern(topicPattern) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.Group(name); err != nil {
+		return err
+	}
+	if _, err := a.exec(upsertGroupAccessQuery, name, toSQLWildcard(topicPattern), read, write); err != nil {
+		return err
+	}
+	a.audit(AuditActionGroupAccessAllow, name, topicPattern, auditPermission(read, write))
+	return nil
+}
+
+// SetGroupCapabilities restricts the publishing capabilities of an existing access control entry of a
+// group, see SetCapabilities.
+func (a *SQLiteAuth) SetGroupCapabilities(name string, topicPattern string, capabilities []Capability) error {
+	if !AllowedGroupName(name) || !AllowedTopicPattern(topicPattern) {
+		return ErrInvalidArgument
+	}
+	if err := a.updateCapabilities(updateGroupCapabilitiesQuery, name, topicPattern, capabilities); err != nil {
+		return err
+	}
+	a.audit(AuditActionGroupAccessCapabilities, name, topicPattern, toCapabilitiesString(capabilities))
+	return nil
+}
+
+// ResetGroupAccess removes an access control list entry for a specific group/topic, or (if topic
+// is empty) for an entire group. The parameter topicPattern may include wildcards (*).
+func (a *SQLiteAuth) ResetGroupAccess(name string, topicPattern string) error {
+	if !AllowedGroupName(name) {
+		return ErrInvalidArgument
+	} else if !AllowedTopicPattern(topicPattern) && topicPattern != "" {
+		return ErrInvalidArgument
+	}
+	var err error
+	if topicPattern == "" {
+		_, err = a.exec(deleteGroupAccessQuery, name)
+	} else {
+		_, err = a.exec(deleteGroupTopicAccessQuery, name, toSQLWildcard(topicPattern))
+	}
+	if err != nil {
+		return err
+	}
+	a.audit(AuditActionGroupAccessReset, name, topicPattern, "")
+	return nil
+}
+
+// AddTier adds a tier with the given code and limits. Tiers can be assigned to users via ChangeUserTier.
+func (a *SQLiteAuth) AddTier(tier *Tier) error {
+	if !AllowedTier(tier) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.exec(insertTierQuery, tier.Code, tier.RequestLimit, tier.RequestLimitReplenish.Milliseconds(), tier.EmailLimit,
+		tier.EmailLimitReplenish.Milliseconds(), tier.SubscriptionLimit, tier.AttachmentTotalSizeLimit, tier.AttachmentBandwidthLimit,
+		tier.ReservationLimit); err != nil {
+		return err
+	}
+	a.audit(AuditActionTierAdd, tier.Code, "", "")
+	return nil
+}
+
+// ChangeTier updates the limits of an existing tier. The function returns ErrNotFound if the tier does not exist.
+func (a *SQLiteAuth) ChangeTier(tier *Tier) error {
+	if !AllowedTier(tier) {
+		return ErrInvalidArgument
+	}
+	result, err := a.exec(updateTierQuery, tier.RequestLimit, tier.RequestLimitReplenish.Milliseconds(), tier.EmailLimit,
+		tier.EmailLimitReplenish.Milliseconds(), tier.SubscriptionLimit, tier.AttachmentTotalSizeLimit, tier.AttachmentBandwidthLimit,
+		tier.ReservationLimit, tier.Code)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrNotFound
+	}
+	a.audit(AuditActionTierChange, tier.Code, "", "")
+	return nil
+}
+
+// RemoveTier deletes the tier with the given code. Users of the tier fall back to the default limits.
+// The function returns nil on success, even if the tier did not exist in the first place.
+func (a *SQLiteAuth) RemoveTier(code string) error {
+	if !AllowedTierCode(code) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.exec(deleteTierQuery, code); err != nil {
+		return err
+	}
+	if _, err := a.exec(resetTierUsersQuery, code); err != nil {
+		return err
+	}
+	a.audit(AuditActionTierRemove, code, "", "")
+	return nil
+}
+
+// Tiers returns a list of all tiers
+func (a *SQLiteAuth) Tiers() ([]*Tier, error) {
+	codes, err := a.readStrings(selectTierCodesQuery)
+	if err != nil {
+		return nil, err
+	}
+	tiers := make([]*Tier, 0)
+	for _, code := range codes {
+		tier, err := a.Tier(code)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// Tier returns the tier with the given code if it exists, or ErrNotFound otherwise
+func (a *SQLiteAuth) Tier(code string) (*Tier, error) {
+	rows, err := a.db.Query(selectTierQuery, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, ErrNotFound
+	}
+	var tier Tier
+	var requestLimitReplenish, emailLimitReplenish int64
+	if err := rows.Scan(&tier.Code, &tier.RequestLimit, &requestLimitReplenish, &tier.EmailLimit, &emailLimitReplenish,
+		&tier.SubscriptionLimit, &tier.AttachmentTotalSizeLimit, &tier.AttachmentBandwidthLimit, &tier.ReservationLimit); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	tier.RequestLimitReplenish = time.Duration(requestLimitReplenish) * time.Millisecond
+	tier.EmailLimitReplenish = time.Duration(emailLimitReplenish) * time.Millisecond
+	return &tier, nil
+}
+
+// ChangeUserTier assigns the given tier to a user, or removes the user's tier if code is empty.
+// The function returns ErrNotFound if the user or the tier does not exist.
+func (a *SQLiteAuth) ChangeUserTier(username, code string) error {
+	if !AllowedUsername(username) || (code != "" && !AllowedTierCode(code)) {
+		return ErrInvalidArgument
+	}
+	if code != "" {
+		if _, err := a.Tier(code); err != nil {
+			return err
+		}
+	}
+	result, err := a.exec(updateUserTierQuery, code, username)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrNotFound
+	}
+	detail := "tier " + code
+	if code == "" {
+		detail = "no tier"
+	}
+	a.audit(AuditActionUserChangeTier, username, "", detail)
+	return nil
+}
+
+// AddReservation reserves a topic for a user: it grants the user read-write access to the topic, and denies
+// everyone else. Wildcard entries of other users and groups do not apply to reserved topics (see decideReserved).
+// The user's own access control entry for the topic (if any) is kept aside, and restored when
+// the reservation is removed. The function returns ErrTopicReserved if the topic is already reserved by another
+// user, and ErrTopicInUse if other users, groups or the everyone user have an entry for the topic. Reserving a
+// topic again is a no-op.
+func (a *SQLiteAuth) AddReservation(username, topic string) error {
+	if !AllowedUsername(username) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(insertReservationQuery, topic, username, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		var owner string
+		if err := tx.QueryRow(selectReservationOwnerQuery, topic).Scan(&owner); err != nil {
+			return err
+		} else if owner != username {
+			return ErrTopicReserved
+		}
+		return nil // Already reserved by this user
+	}
+	var entries int
+	if err := tx.QueryRow(selectTopicAccessCountQuery, topic, username, topic).Scan(&entries); err != nil {
+		return err
+	} else if entries > 0 {
+		return ErrTopicInUse
+	}
+	if _, err := tx.Exec(insertReservationAccessQuery, username, topic); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(upsertReservedAccessQuery, username, topic, true, true); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(upsertReservedAccessQuery, Everyone, topic, false, false); err != nil {
+		return err
+	}
+	if err := a.commit(tx); err != nil {
+		return err
+	}
+	a.audit(AuditActionReservationAdd, username, topic, "")
+	return nil
+}
+
+// RemoveReservation removes a user's reservation of a topic, including the access control entries that came
+// with it, and restores the user's previous entry for the topic (if any). The function returns ErrNotFound if
+// the topic is not reserved by the user.
+func (a *SQLiteAuth) RemoveReservation(username, topic string) error {
+	if !AllowedUsername(username) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(deleteReservationQuery, topic, username)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(deleteTopicAccessQuery, username, topic); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteTopicAccessQuery, Everyone, topic); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(restoreReservationAccessQuery, topic); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteReservationAccessQuery, topic); err != nil {
+		return err
+	}
+	if err := a.commit(tx); err != nil {
+		return err
+	}
+	a.audit(AuditActionReservationRemove, username, topic, "")
+	return nil
+}
+
+// Reservations returns the topics reserved by the given user, or of all users if username is empty
+func (a *SQLiteAuth) Reservations(username string) ([]*Reservation, error) {
+	return a.readReservations(selectReservationsQuery, username, username)
+}
+
+// Reservation returns the reservation of the given topic if it exists, or ErrNotFound otherwise
+func (a *SQLiteAuth) Reservation(topic string) (*Reservation, error) {
+	reservations, err := a.readReservations(selectReservationQuery, topic)
+	if err != nil {
+		return nil, err
+	} else if len(reservations) == 0 {
+		return nil, ErrNotFound
+	}
+	return reservations[0], nil
+}
+
+func (a *SQLiteAuth) readReservations(query string, args ...interface{}) ([]*Reservation, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reservations := make([]*Reservation, 0)
+	for rows.Next() {
+		var topic, username string
+		var created int64
+		if err := rows.Scan(&topic, &username, &created); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, &Reservation{
+			Topic:    topic,
+			Username: username,
+			Created:  time.Unix(created, 0),
+		})
+	}
+	return reservations, nil
+}
+
+// Provision reconciles the given users and access control entries (e.g. from the server config) into the
+// database: users and entries are added or updated and marked as provisioned, and users and entries that were
+// provisioned before, but are no longer part of the given provisioning, are removed. Users and entries that
+// were not provisioned (e.g. created with 'ntfy user add') are left alone, unless they are overridden.
+//
+// Users and entries that have not changed are not written, so that the audit log only shows actual changes.
+func (a *SQLiteAuth) Provision(provisioning *Provisioning) error {
+	if err := validateProvisioning(provisioning); err != nil {
+		return err
+	}
+	if err := a.removeUnprovisioned(provisioning); err != nil {
+		return err
+	}
+	return a.applyProvisioning(provisioning, true)
 }
 
-// ChangePassword changes a user's password
-func (a *SQLiteAuth) ChangePassword(username, password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+// Import adds or updates the given users and access control entries. Unlike Provision, the users and entries
+// are not marked as provisioned, and no existing users or entries are removed.
+func (a *SQLiteAuth) Import(provisioning *Provisioning) error {
+	if err := validateProvisioning(provisioning); err != nil {
+		return err
+	}
+	return a.applyProvisioning(provisioning, false)
+}
+
+func (a *SQLiteAuth) removeUnprovisioned(provisioning *Provisioning) error {
+	usernames, err := a.readStrings(selectProvisionedUsersQuery)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if !provisioning.hasUser(username) {
+			if err := a.RemoveUser(username); err != nil {
+				return err
+			}
+		}
+	}
+	rows, err := a.db.Query(selectProvisionedAccessQuery)
 	if err != nil {
 		return err
 	}
-	if _, err := a.db.Exec(updateUserPassQuery, hash, username); err != nil {
+	defer rows.Close()
+	stale := make([]Rule, 0)
+	for rows.Next() {
+		var username, topic string
+		if err := rows.Scan(&username, &topic); err != nil {
+			return err
+		} else if !provisioning.hasGrant(username, fromSQLWildcard(topic)) {
+			stale = append(stale, Rule{Grant: Grant{TopicPattern: fromSQLWildcard(topic)}, Owner: username})
+		}
+	}
+	if err := rows.Err(); err != nil {
 		return err
 	}
+	rows.Close()
+	for _, rule := range stale {
+		if err := a.ResetAccess(rule.Owner, rule.TopicPattern); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
-// all existing access control entries (Grant) are removed, since they are no longer needed.
-func (a *SQLiteAuth) ChangeRole(username string, role Role) error {
-	if !AllowedUsername(username) || !AllowedRole(role) {
-		return ErrInvalidArgument
+func (a *SQLiteAuth) applyProvisioning(provisioning *Provisioning, provisioned bool) error {
+	for _, user := range provisioning.Users {
+		if err := a.provisionUser(user, provisioned); err != nil {
+			return err
+		}
 	}
-	if _, err := a.db.Exec(updateUserRoleQuery, string(role), username); err != nil {
+	usernames := make([]string, 0, len(provisioning.Access))
+	for username := range provisioning.Access {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		for _, grant := range provisioning.Access[username] {
+			if err := a.provisionAccess(username, grant, provisioned); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *SQLiteAuth) provisionUser(user *ProvisionedUser, provisioned bool) error {
+	detail := provisioningDetail(provisioned)
+	rows, err := a.db.Query(selectUserQuery, user.Name)
+	if err != nil {
 		return err
 	}
-	if role == RoleAdmin {
-		if _, err := a.db.Exec(deleteUserAccessQuery, username); err != nil {
+	defer rows.Close()
+	if !rows.Next() {
+		rows.Close()
+		hash, err := hashPassword(user.Password)
+		if err != nil {
+			return err
+		}
+		if _, err := a.exec(insertProvisionedUserQuery, user.Name, hash, user.Role, provisioned); err != nil {
+			return err
+		}
+		a.audit(AuditActionUserAdd, user.Name, "", "role "+string(user.Role)+", "+detail)
+		return nil
+	}
+	var hash, role, tierCode string
+	var failedLogins int
+	var lockedUntil int64
+	var wasProvisioned bool
+	if err := rows.Scan(&hash, &role, &failedLogins, &lockedUntil, &tierCode, &wasProvisioned); err != nil {
+		return err
+	}
+	rows.Close()
+	if !passwordMatches(hash, user.Password) {
+		newHash, err := hashPassword(user.Password)
+		if err != nil {
+			return err
+		}
+		if _, err := a.exec(updateUserPassQuery, newHash, user.Name); err != nil {
+			return err
+		}
+		a.audit(AuditActionUserChangePassword, user.Name, "", detail)
+	}
+	if Role(role) != user.Role {
+		if _, err := a.exec(updateUserRoleQuery, string(user.Role), user.Name); err != nil {
+			return err
+		}
+		if user.Role == RoleAdmin {
+			if _, err := a.exec(deleteUserAccessQuery, user.Name); err != nil {
+				return err
+			}
+		}
+		a.audit(AuditActionUserChangeRole, user.Name, "", "role "+string(user.Role)+", "+detail)
+	}
+	if provisioned && !wasProvisioned {
+		if _, err := a.exec(updateUserProvisionedQuery, user.Name); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// AllowAccess adds or updates an entry in th access control list for a specific user. It controls
-// read/write access to a topic. The parameter topicPattern may include wildcards (*).
-func (a *SQLiteAuth) AllowAccess(username string, topicPattern string, read bool, write bool) error {
-	if (!AllowedUsername(username) && username != Everyone) || !AllowedTopicPattern(topicPattern) {
-		return ErrInvalidArgument
+func (a *SQLiteAuth) provisionAccess(username string, grant Grant, provisioned bool) error {
+	topic := toSQLWildcard(grant.TopicPattern)
+	var read, write, wasProvisioned bool
+	var capabilities string
+	var expires int64
+	err := a.db.QueryRow(selectAccessEntryQuery, username, topic).Scan(&read, &write, &capabilities, &expires, &wasProvisioned)
+	if err == nil && read == grant.AllowRead && write == grant.AllowWrite && capabilities == "*" && expires == 0 && (wasProvisioned || !provisioned) {
+		return nil // Unchanged
+	} else if err != nil && err != sql.ErrNoRows {
+		return err
 	}
-	if _, err := a.db.Exec(upsertUserAccessQuery, username, toSQLWildcard(topicPattern), read, write); err != nil {
+	if _, err := a.exec(upsertProvisionedAccessQuery, username, topic, grant.AllowRead, grant.AllowWrite, provisioned); err != nil {
 		return err
 	}
+	a.audit(AuditActionAccessAllow, username, grant.TopicPattern, auditPermission(grant.AllowRead, grant.AllowWrite)+", "+provisioningDetail(provisioned))
 	return nil
 }
 
-// ResetAccess removes an access control list entry for a specific username/topic, or (if topic is
-// empty) for an entire user. The parameter topicPattern may include wildcards (*).
-func (a *SQLiteAuth) ResetAccess(username string, topicPattern string) error {
-	if !AllowedUsername(username) && username != Everyone && username != "" {
-		return ErrInvalidArgument
-	} else if !AllowedTopicPattern(topicPattern) && topicPattern != "" {
+// Audit records the given event in the audit log. If the event's time is not set, the current time is used.
+func (a *SQLiteAuth) Audit(event *AuditEvent) error {
+	eventTime := event.Time
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+	_, err := a.db.Exec(insertAuditEventQuery, eventTime.Unix(), string(event.Action), event.Actor, event.Subject, event.Topic, event.IP, event.Detail)
+	return err
+}
+
+// AuditEvents returns the events in the audit log that match the given filter, oldest first. If the
+// filter has a limit, only the most recent events are returned.
+func (a *SQLiteAuth) AuditEvents(filter *AuditFilter) ([]*AuditEvent, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	var since int64
+	if !filter.Since.IsZero() {
+		since = filter.Since.Unix()
+	}
+	action := string(filter.Action)
+	rows, err := a.db.Query(selectAuditEventsQuery, since, filter.Username, filter.Username, filter.Username, action, action, filter.Topic, filter.Topic, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		var eventTime int64
+		var action string
+		event := &AuditEvent{}
+		if err := rows.Scan(&eventTime, &action, &event.Actor, &event.Subject, &event.Topic, &event.IP, &event.Detail); err != nil {
+			return nil, err
+		}
+		event.Time = time.Unix(eventTime, 0)
+		event.Action = AuditAction(action)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// PruneAuditEvents deletes logins and publishes that are older than activityOlderThan, and all other events
+// that are older than changesOlderThan. If one of the times is zero, the respective events are not deleted.
+func (a *SQLiteAuth) PruneAuditEvents(activityOlderThan, changesOlderThan time.Time) error {
+	if !activityOlderThan.IsZero() {
+		if _, err := a.db.Exec(deleteAuditActivityQuery, activityOlderThan.Unix()); err != nil {
+			return err
+		}
+	}
+	if !changesOlderThan.IsZero() {
+		if _, err := a.db.Exec(deleteAuditChangesQuery, changesOlderThan.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithActor returns a Manager that operates on the same database, but records the given username
+// as the actor of all changes in the audit log
+func (a *SQLiteAuth) WithActor(actor string) Manager {
+	return &SQLiteAuth{
+		db:           a.db,
+		defaultRead:  a.defaultRead,
+		defaultWrite: a.defaultWrite,
+		actor:        actor,
+		cache:        a.cache,
+	}
+}
+
+// audit records a change made through Manager in the audit log. Errors are only logged, since the
+// change itself has already been made at this point.
+func (a *SQLiteAuth) audit(action AuditAction, subject, topic, detail string) {
+	event := &AuditEvent{
+		Action:  action,
+		Actor:   a.actor,
+		Subject: subject,
+		Topic:   topic,
+		Detail:  detail,
+	}
+	if err := a.Audit(event); err != nil {
+		log.Printf("Cannot write audit log: %s", err.Error())
+	}
+}
+
+func auditPermission(read, write bool) string {
+	if read && write {
+		return "read-write"
+	} else if read {
+		return "read-only"
+	} else if write {
+		return "write-only"
+	}
+	return "deny"
+}
+
+// auditToken shortens the token for the audit log, so that the audit log cannot be used to log in
+func provisioningDetail(provisioned bool) string {
+	if provisioned {
+		return "provisioned"
+	}
+	return "imported"
+}
+
+func auditToken(token string) string {
+	if len(token) < len(tokenPrefix)+4 {
+		return token
+	}
+	return token[:len(tokenPrefix)+4] + "..."
+}
+
+// generateToken creates a new random access token, e.g. tk_1x9v3a...
+func generateToken() (string, error) {
+	b := make([]byte, tokenLength-len(tokenPrefix))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(tokenCharset))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = tokenCharset[n.Int64()]
+	}
+	return tokenPrefix + string(b), nil
+}
+
+func fromUnixTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+// compareTopicPatterns returns a positive number if topic pattern a is more specific than b, a negative
+// number if it is less specific, and 0 if both are equally specific. Patterns without wildcards are more specific
+// than patterns with wildcards. Otherwise, the pattern with more non-wildcard characters is more specific,
+// e.g. "alerts-prod-*" is more specific than "alerts-*", which is more specific than "*".
+func compareTopicPatterns(a, b string) int {
+	aExact, bExact := !strings.Contains(a, "*"), !strings.Contains(b, "*")
+	if aExact && !bExact {
+		return 1
+	} else if !aExact && bExact {
+		return -1
+	}
+	return len(strings.ReplaceAll(a, "*", "")) - len(strings.ReplaceAll(b, "*", ""))
+}
+
+// matchTopicPattern returns true if the given topic matches the topic pattern, which may include
+// the wildcard character (*), e.g. "backup-*" matches "backup-db" and "backup-"
+func matchTopicPattern(pattern, topic string) bool {
+	return compileTopicPattern(pattern).match(topic)
+}
+
+// topicPattern is a compiled topic pattern, i.e. the parts of the pattern between the wildcards (*)
+type topicPattern []string
+
+func compileTopicPattern(pattern string) topicPattern {
+	return strings.Split(pattern, "*")
+}
+
+func (p topicPattern) match(topic string) bool {
+	if len(p) == 1 {
+		return p[0] == topic
+	} else if !strings.HasPrefix(topic, p[0]) || !strings.HasSuffix(topic, p[len(p)-1]) {
+		return false
+	}
+	remaining := topic[len(p[0]):]
+	for _, part := range p[1 : len(p)-1] {
+		i := strings.Index(remaining, part)
+		if i < 0 {
+			return false
+		}
+		remaining = remaining[i+len(part):]
+	}
+	return len(remaining) >= len(p[len(p)-1])
+}
+
+// combineCapabilities returns the union of the given capabilities, where nil means all capabilities
+func combineCapabilities(a, b []Capability) []Capability {
+	if a == nil || b == nil {
+		return nil
+	}
+	combined := append(make([]Capability, 0), a...)
+	for _, c := range b {
+		if !HasCapability(combined, c) {
+			combined = append(combined, c)
+		}
+	}
+	return combined
+}
+
+// toCapabilitiesString converts the capabilities to their database representation: "*" means all
+// capabilities (nil), and an empty string means no capabilities
+func toCapabilitiesString(capabilities []Capability) string {
+	if capabilities == nil {
+		return "*"
+	}
+	values := make([]string, len(capabilities))
+	for i, c := range capabilities {
+		values[i] = string(c)
+	}
+	return strings.Join(values, ",")
+}
+
+func fromCapabilitiesString(s string) []Capability {
+	if s == "*" {
+		return nil
+	}
+	capabilities := make([]Capability, 0)
+	for _, c := range strings.Split(s, ",") {
+		if c != "" {
+			capabilities = append(capabilities, Capability(c))
+		}
+	}
+	return capabilities
+}
+
+// validateProvisioning checks the users and access control entries of the given provisioning. All entries
+// must belong to a user of the provisioning, or to Everyone.
+func validateProvisioning(provisioning *Provisioning) error {
+	if provisioning == nil {
 		return ErrInvalidArgument
 	}
-	if username == "" && topicPattern == "" {
-		_, err := a.db.Exec(deleteAllAccessQuery, username)
-		return err
-	} else if topicPattern == "" {
-		_, err := a.db.Exec(deleteUserAccessQuery, username)
-		return err
+	usernames := make(map[string]bool)
+	for _, user := range provisioning.Users {
+		if !AllowedUsername(user.Name) || !AllowedRole(user.Role) || user.Password == "" || usernames[user.Name] {
+			return ErrInvalidArgument
+		}
+		usernames[user.Name] = true
 	}
-	_, err := a.db.Exec(deleteTopicAccessQuery, username, toSQLWildcard(topicPattern))
-	return err
+	for username, grants := range provisioning.Access {
+		if username != Everyone && !usernames[username] {
+			return ErrInvalidArgument
+		}
+		for _, grant := range grants {
+			if !AllowedTopicPattern(grant.TopicPattern) {
+				return ErrInvalidArgument
+			}
+		}
+	}
+	return nil
 }
 
-// DefaultAccess returns the default read/write access if no access control entry matches
-func (a *SQLiteAuth) DefaultAccess() (read bool, write bool) {
-	return a.defaultRead, a.defaultWrite
+func (p *Provisioning) hasUser(username string) bool {
+	for _, user := range p.Users {
+		if user.Name == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provisioning) hasGrant(username, topicPattern string) bool {
+	for _, grant := range p.Access[username] {
+		if grant.TopicPattern == topicPattern {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPassword returns the bcrypt hash of the given password, or the password itself if it is already a hash
+func hashPassword(password string) (string, error) {
+	if IsPasswordHash(password) {
+		return password, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// passwordMatches returns true if the given password (plain text or bcrypt hash) matches the stored hash
+func passwordMatches(hash, password string) bool {
+	if IsPasswordHash(password) {
+		return hash == password
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
 func toSQLWildcard(s string) string {
@@ -384,6 +2337,30 @@ func setupAuthDB(db *sql.DB) error {
 	// Do migrations
 	if schemaVersion == currentSchemaVersion {
 		return nil
+	} else if schemaVersion == 1 {
+		return migrateFrom1(db)
+	} else if schemaVersion == 2 {
+		return migrateFrom2(db)
+	} else if schemaVersion == 3 {
+		return migrateFrom3(db)
+	} else if schemaVersion == 4 {
+		return migrateFrom4(db)
+	} else if schemaVersion == 5 {
+		return migrateFrom5(db)
+	} else if schemaVersion == 6 {
+		return migrateFrom6(db)
+	} else if schemaVersion == 7 {
+		return migrateFrom7(db)
+	} else if schemaVersion == 8 {
+		return migrateFrom8(db)
+	} else if schemaVersion == 9 {
+		return migrateFrom9(db)
+	} else if schemaVersion == 10 {
+		return migrateFrom10(db)
+	} else if schemaVersion == 11 {
+		return migrateFrom11(db)
+	} else if schemaVersion == 12 {
+		return migrateFrom12(db)
 	}
 	return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
 }
@@ -397,3 +2374,135 @@ func setupNewAuthDB(db *sql.DB) error {
 	}
 	return nil
 }
+
+func migrateFrom1(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 1 to 2")
+	if _, err := db.Exec(migrate1To2CreateTokenTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 2); err != nil {
+		return err
+	}
+	return migrateFrom2(db)
+}
+
+func migrateFrom2(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 2 to 3")
+	if _, err := db.Exec(migrate2To3CreateTokenScopeTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 3); err != nil {
+		return err
+	}
+	return migrateFrom3(db)
+}
+
+func migrateFrom3(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 3 to 4")
+	if _, err := db.Exec(migrate3To4CreateGroupTablesQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 4); err != nil {
+		return err
+	}
+	return migrateFrom4(db)
+}
+
+func migrateFrom4(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 4 to 5")
+	if _, err := db.Exec(migrate4To5AddCapabilitiesColumnsQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 5); err != nil {
+		return err
+	}
+	return migrateFrom5(db)
+}
+
+func migrateFrom5(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 5 to 6")
+	if _, err := db.Exec(migrate5To6AddLockoutColumnsQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 6); err != nil {
+		return err
+	}
+	return migrateFrom6(db)
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 6 to 7")
+	if _, err := db.Exec(migrate6To7CreateAuditLogTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return migrateFrom7(db)
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 7 to 8")
+	if _, err := db.Exec(migrate7To8CreateTierTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return migrateFrom8(db)
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 8 to 9")
+	if _, err := db.Exec(migrate8To9CreateReservationTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return migrateFrom9(db)
+}
+
+func migrateFrom9(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 9 to 10")
+	if _, err := db.Exec(migrate9To10AlterAccessTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return migrateFrom10(db)
+}
+
+func migrateFrom10(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 10 to 11")
+	if _, err := db.Exec(migrate10To11AddProvisionedColumnsQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
+	return migrateFrom11(db)
+}
+
+func migrateFrom11(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 11 to 12")
+	if _, err := db.Exec(migrate11To12CreateReservationAccessTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 12); err != nil {
+		return err
+	}
+	return migrateFrom12(db)
+}
+
+func migrateFrom12(db *sql.DB) error {
+	log.Print("Migrating auth database schema: from 12 to 13")
+	if _, err := db.Exec(migrate12To13CreateDataVersionTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 13); err != nil {
+		return err
+	}
+	return nil // Update this when a new version is added
+}
@@ -1,6 +1,7 @@
 package auth_test
 
 import (
+	"database/sql"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/auth"
 	"path/filepath"
@@ -36,10 +37,10 @@ func TestSQLiteAuth_FullScenario_Default_DenyAll(t *testing.T) {
 	require.True(t, strings.HasPrefix(ben.Hash, "$2a$10$"))
 	require.Equal(t, auth.RoleUser, ben.Role)
 	require.Equal(t, []auth.Grant{
-		{"mytopic", true, true},
-		{"readme", true, false},
-		{"writeme", false, true},
-		{"everyonewrite", false, false},
+		{"mytopic", true, true, nil, time.Time{}},
+		{"readme", true, false, nil, time.Time{}},
+		{"writeme", false, true, nil, time.Time{}},
+		{"everyonewrite", false, false, nil, time.Time{}},
 	}, ben.Grants)
 
 	notben, err := a.Authenticate("ben", "this is wrong")
@@ -145,10 +146,10 @@ func TestSQLiteAuth_UserManagement(t *testing.T) {
 	require.True(t, strings.HasPrefix(ben.Hash, "$2a$10$"))
 	require.Equal(t, auth.RoleUser, ben.Role)
 	require.Equal(t, []auth.Grant{
-		{"mytopic", true, true},
-		{"readme", true, false},
-		{"writeme", false, true},
-		{"everyonewrite", false, false},
+		{"mytopic", true, true, nil, time.Time{}},
+		{"readme", true, false, nil, time.Time{}},
+		{"writeme", false, true, nil, time.Time{}},
+		{"everyonewrite", false, false, nil, time.Time{}},
 	}, ben.Grants)
 
 	everyone, err := a.User(auth.Everyone)
@@ -157,8 +158,8 @@ func TestSQLiteAuth_UserManagement(t *testing.T) {
 	require.Equal(t, "", everyone.Hash)
 	require.Equal(t, auth.RoleAnonymous, everyone.Role)
 	require.Equal(t, []auth.Grant{
-		{"announcements", true, false},
-		{"everyonewrite", true, true},
+		{"announcements", true, false, nil, time.Time{}},
+		{"everyonewrite", true, true, nil, time.Time{}},
 	}, everyone.Grants)
 
 	// Ben: Before revoking
@@ -235,6 +236,968 @@ func TestSQLiteAuth_ChangeRole(t *testing.T) {
 	require.Equal(t, 0, len(ben.Grants))
 }
 
+func TestSQLiteAuth_Authorize_MostSpecificWins(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "alerts-*", true, true))
+	require.Nil(t, a.AllowAccess("ben", "alerts-secret", false, false)) // Explicit deny
+	require.Nil(t, a.AllowAccess("ben", "alerts-prod-*", true, false))
+	require.Nil(t, a.AllowAccess("ben", "*", true, false))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "alerts-dev", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-secret", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-secret", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts-secret2", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts-prod-db", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-prod-db", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "other", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "other", auth.PermissionWrite))
+}
+
+func TestSQLiteAuth_Authorize_EquallySpecific(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "up*", true, false))
+	require.Nil(t, a.AllowAccess("ben", "*up", false, true))
+	require.Nil(t, a.AllowAccess("ben", "ab*", true, true))
+	require.Nil(t, a.AllowAccess("ben", "*ba", false, false)) // Explicit deny
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+
+	// Equally specific entries are combined
+	require.Nil(t, a.Authorize(ben, "upup", auth.PermissionRead))
+	require.Nil(t, a.Authorize(ben, "upup", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "upxx", auth.PermissionWrite))
+
+	// ... unless one of them is an explicit deny
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "abba", auth.PermissionRead))
+	require.Nil(t, a.Authorize(ben, "abab", auth.PermissionRead))
+}
+
+func TestSQLiteAuth_Authorize_NoSQLWildcards(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "my_topic", true, true))
+	require.Nil(t, a.AllowAccess("ben", "Alerts*", true, true))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "my_topic", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "myXtopic", auth.PermissionRead)) // '_' is not a wildcard
+	require.Nil(t, a.Authorize(ben, "Alerts1", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts1", auth.PermissionRead)) // Case-sensitive
+}
+
+func TestSQLiteAuth_Authorize_Groups_MostSpecificWins(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroup("interns"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.AddGroupMember("interns", "ben"))
+	require.Nil(t, a.AllowGroupAccess("devs", "prod-*", true, true))
+	require.Nil(t, a.AllowGroupAccess("interns", "prod-db", false, false))
+	require.Nil(t, a.AllowGroupAccess("interns", "prod-*", true, false))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "prod-web", auth.PermissionWrite)) // Combined: devs allows writing
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "prod-db", auth.PermissionRead))
+}
+
+func TestSQLiteAuth_Decide(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.AllowAccess("ben", "alerts-*", true, true))
+	require.Nil(t, a.AllowAccess("ben", "alerts-secret", false, false))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds", true, false))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "announcements", true, false))
+
+	decision, err := a.Decide("phil", "anything")
+	require.Nil(t, err)
+	require.Equal(t, &auth.Decision{AllowRead: true, AllowWrite: true, Source: auth.SourceAdmin, Rules: []auth.Rule{}}, decision)
+	require.Nil(t, decision.Capabilities) // All capabilities
+
+	decision, err = a.Decide("ben", "alerts-secret")
+	require.Nil(t, err)
+	require.False(t, decision.AllowRead)
+	require.False(t, decision.AllowWrite)
+	require.Equal(t, auth.SourceUser, decision.Source)
+	require.Equal(t, []auth.Rule{{Grant: auth.Grant{TopicPattern: "alerts-secret"}, Source: auth.SourceUser, Owner: "ben"}}, decision.Rules)
+
+	decision, err = a.Decide("ben", "builds")
+	require.Nil(t, err)
+	require.True(t, decision.AllowRead)
+	require.False(t, decision.AllowWrite)
+	require.Equal(t, auth.SourceGroup, decision.Source)
+	require.Equal(t, "devs", decision.Rules[0].Owner)
+
+	decision, err = a.Decide("ben", "announcements")
+	require.Nil(t, err)
+	require.True(t, decision.AllowRead)
+	require.Equal(t, auth.SourceEveryone, decision.Source)
+
+	decision, err = a.Decide(auth.Everyone, "other")
+	require.Nil(t, err)
+	require.Equal(t, &auth.Decision{Source: auth.SourceDefault, Rules: []auth.Rule{}}, decision)
+
+	_, err = a.Decide("nobody", "other")
+	require.Equal(t, auth.ErrNotFound, err)
+}
+
+func TestSQLiteAuth_Tokens(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, true))
+
+	token, err := a.CreateToken("ben", "backups", time.Time{}, nil)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(token.Value, "tk_"))
+	require.Equal(t, 32, len(token.Value))
+	require.Equal(t, "backups", token.Label)
+	require.True(t, token.Expires.IsZero())
+
+	ben, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, auth.RoleUser, ben.Role)
+	require.Equal(t, []auth.Grant{{"mytopic", true, true, nil, time.Time{}}}, ben.Grants)
+	require.Nil(t, a.Authorize(ben, "mytopic", auth.PermissionWrite))
+
+	tokens, err := a.Tokens("ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tokens))
+	require.Equal(t, token.Value, tokens[0].Value)
+	require.Equal(t, "backups", tokens[0].Label)
+	require.False(t, tokens[0].LastAccess.IsZero())
+
+	require.Nil(t, a.RemoveToken("ben", token.Value))
+	require.Equal(t, auth.ErrNotFound, a.RemoveToken("ben", token.Value))
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, auth.ErrUnauthenticated, err)
+
+	tokens, err = a.Tokens("ben")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(tokens))
+}
+
+func TestSQLiteAuth_Tokens_Invalid(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+
+	_, err := a.CreateToken("nobody", "", time.Time{}, nil)
+	require.Equal(t, auth.ErrNotFound, err)
+	_, err = a.AuthenticateToken("")
+	require.Equal(t, auth.ErrUnauthenticated, err)
+	_, err = a.AuthenticateToken("ben")
+	require.Equal(t, auth.ErrUnauthenticated, err)
+	_, err = a.AuthenticateToken("tk_AAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+	require.Equal(t, auth.ErrUnauthenticated, err)
+}
+
+func TestSQLiteAuth_Tokens_Expired(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+
+	expired, err := a.CreateToken("ben", "", time.Now().Add(-time.Minute), nil)
+	require.Nil(t, err)
+	valid, err := a.CreateToken("ben", "", time.Now().Add(time.Hour), nil)
+	require.Nil(t, err)
+
+	_, err = a.AuthenticateToken(expired.Value)
+	require.Equal(t, auth.ErrUnauthenticated, err)
+	ben, err := a.AuthenticateToken(valid.Value)
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+
+	tokens, err := a.Tokens("ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tokens))
+	require.Equal(t, valid.Value, tokens[0].Value)
+	require.Equal(t, valid.Expires.Unix(), tokens[0].Expires.Unix())
+}
+
+func TestSQLiteAuth_Tokens_Scoped(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "backup-*", true, true))
+	require.Nil(t, a.AllowAccess("ben", "alerts", true, true))
+
+	token, err := a.CreateToken("ben", "ci", time.Time{}, []auth.Grant{
+		{"backup-*", false, true, nil, time.Time{}},
+		{"other", true, true, nil, time.Time{}}, // User has no access, so the token has none either
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(token.Scopes))
+
+	ben, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{"backup-*", false, true, nil, time.Time{}}, {"other", true, true, nil, time.Time{}}}, ben.Scopes)
+	require.Nil(t, a.Authorize(ben, "backup-db", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "backup-db", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "other", auth.PermissionWrite))
+
+	ben, err = a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Scopes)
+	require.Nil(t, a.Authorize(ben, "alerts", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "backup-db", auth.PermissionRead))
+
+	tokens, err := a.Tokens("ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tokens))
+	require.Equal(t, []auth.Grant{{"backup-*", false, true, nil, time.Time{}}, {"other", true, true, nil, time.Time{}}}, tokens[0].Scopes)
+}
+
+func TestSQLiteAuth_Tokens_Scoped_Admin(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleAdmin))
+
+	token, err := a.CreateToken("phil", "", time.Time{}, []auth.Grant{{"announcements", true, false, nil, time.Time{}}})
+	require.Nil(t, err)
+	phil, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(phil, "announcements", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(phil, "announcements", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(phil, "mytopic", auth.PermissionRead))
+}
+
+func TestSQLiteAuth_Tokens_Scoped_Invalid(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	_, err := a.CreateToken("ben", "", time.Time{}, []auth.Grant{{"not/valid", true, true, nil, time.Time{}}})
+	require.Equal(t, auth.ErrInvalidArgument, err)
+}
+
+func TestSQLiteAuth_Tokens_RemoveUser(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	token, err := a.CreateToken("ben", "", time.Time{}, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, a.RemoveUser("ben"))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, auth.ErrUnauthenticated, err)
+}
+
+func TestSQLiteAuth_Groups(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddUser("marian", "marian", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroup("ops"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.AddGroupMember("devs", "marian"))
+	require.Nil(t, a.AddGroupMember("devs", "marian")) // Adding twice is fine
+	require.Nil(t, a.AddGroupMember("ops", "ben"))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds", true, false))
+	require.Nil(t, a.AllowGroupAccess("devs", "alerts*", true, false))
+	require.Nil(t, a.AllowGroupAccess("ops", "alerts*", false, true))
+
+	groups, err := a.Groups()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(groups))
+	require.Equal(t, "devs", groups[0].Name)
+	require.Equal(t, []string{"ben", "marian"}, groups[0].Members)
+	require.Equal(t, []auth.Grant{{"builds", true, false, nil, time.Time{}}, {"alerts*", true, false, nil, time.Time{}}}, groups[0].Grants)
+	require.Equal(t, "ops", groups[1].Name)
+	require.Equal(t, []string{"ben"}, groups[1].Members)
+
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Equal(t, []string{"devs", "ops"}, ben.Groups)
+	require.Nil(t, a.Authorize(ben, "builds", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "builds", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts_prod", auth.PermissionRead))  // From devs
+	require.Nil(t, a.Authorize(ben, "alerts_prod", auth.PermissionWrite)) // From ops
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "other", auth.PermissionRead))
+
+	marian, err := a.Authenticate("marian", "marian")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(marian, "alerts_prod", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(marian, "alerts_prod", auth.PermissionWrite))
+
+	require.Nil(t, a.RemoveGroupMember("ops", "ben"))
+	require.Equal(t, auth.ErrNotFound, a.RemoveGroupMember("ops", "ben"))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts_prod", auth.PermissionWrite))
+
+	require.Nil(t, a.RemoveGroup("devs"))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "builds", auth.PermissionRead))
+	_, err = a.Group("devs")
+	require.Equal(t, auth.ErrNotFound, err)
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, []string{}, ben.Groups)
+}
+
+func TestSQLiteAuth_Groups_Precedence(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.AllowGroupAccess("devs", "mytopic", true, true))
+	require.Nil(t, a.AllowGroupAccess("devs", "announcements", false, false))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, false))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "announcements", true, false))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "public", true, true))
+
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+
+	// User entry beats group entry
+	require.Nil(t, a.Authorize(ben, "mytopic", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "mytopic", auth.PermissionWrite))
+
+	// Group entry beats everyone entry
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "announcements", auth.PermissionRead))
+	require.Nil(t, a.Authorize(nil, "announcements", auth.PermissionRead))
+
+	// Everyone entry applies if there is no user or group entry
+	require.Nil(t, a.Authorize(ben, "public", auth.PermissionWrite))
+}
+
+func TestSQLiteAuth_Groups_Invalid(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Error(t, a.AddGroup("devs"))
+	require.Equal(t, auth.ErrInvalidArgument, a.AddGroup("*"))
+	require.Equal(t, auth.ErrNotFound, a.AddGroupMember("nope", "ben"))
+	require.Equal(t, auth.ErrNotFound, a.AddGroupMember("devs", "nobody"))
+	require.Equal(t, auth.ErrNotFound, a.AllowGroupAccess("nope", "mytopic", true, true))
+	require.Equal(t, auth.ErrInvalidArgument, a.AllowGroupAccess("devs", "not/valid", true, true))
+}
+
+func TestSQLiteAuth_Groups_RemoveUser(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.RemoveUser("ben"))
+
+	devs, err := a.Group("devs")
+	require.Nil(t, err)
+	require.Equal(t, []string{}, devs.Members)
+}
+
+func TestSQLiteAuth_Capabilities(t *testing.T) {
+	a := newTestAuth(t, true, true)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "alerts", true, true))
+	require.Nil(t, a.AllowAccess("ben", "backups", false, true))
+	require.Nil(t, a.SetCapabilities("ben", "backups", []auth.Capability{auth.CapabilityAttach, auth.CapabilityDelay}))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "*", true, true))
+	require.Nil(t, a.SetCapabilities(auth.Everyone, "*", []auth.Capability{}))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{
+		{"alerts", true, true, nil, time.Time{}},
+		{"backups", false, true, []auth.Capability{auth.CapabilityAttach, auth.CapabilityDelay}, time.Time{}},
+	}, ben.Grants)
+	require.Nil(t, a.AuthorizeCapability(ben, "alerts", auth.CapabilityEmail))
+	require.Nil(t, a.AuthorizeCapability(ben, "backups", auth.CapabilityAttach))
+	require.Equal(t, auth.ErrUnauthorized, a.AuthorizeCapability(ben, "backups", auth.CapabilityEmail))
+	require.Equal(t, auth.ErrUnauthorized, a.AuthorizeCapability(ben, "other", auth.CapabilityMaxPriority)) // Everyone entry
+	require.Equal(t, auth.ErrUnauthorized, a.AuthorizeCapability(nil, "alerts", auth.CapabilityAttach))
+	require.Nil(t, a.Authorize(nil, "alerts", auth.PermissionWrite)) // Writing is still allowed
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, a.AuthorizeCapability(phil, "alerts", auth.CapabilityEmail))
+
+	// Re-granting access resets the capabilities
+	require.Nil(t, a.AllowAccess("ben", "backups", false, true))
+	require.Nil(t, a.AuthorizeCapability(ben, "backups", auth.CapabilityEmail))
+}
+
+func TestSQLiteAuth_Capabilities_Groups(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroup("ops"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.AddGroupMember("ops", "ben"))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds*", true, true))
+	require.Nil(t, a.SetGroupCapabilities("devs", "builds*", []auth.Capability{auth.CapabilityAttach}))
+	require.Nil(t, a.AllowGroupAccess("ops", "builds*", true, true))
+	require.Nil(t, a.SetGroupCapabilities("ops", "builds*", []auth.Capability{auth.CapabilityEmail}))
+
+	decision, err := a.Decide("ben", "builds-main")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Capability{auth.CapabilityAttach, auth.CapabilityEmail}, decision.Capabilities) // Combined
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.AuthorizeCapability(ben, "builds-main", auth.CapabilityEmail))
+	require.Equal(t, auth.ErrUnauthorized, a.AuthorizeCapability(ben, "builds-main", auth.CapabilityDelay))
+}
+
+func TestSQLiteAuth_Capabilities_Invalid(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Equal(t, auth.ErrNotFound, a.SetCapabilities("ben", "mytopic", nil))
+	require.Equal(t, auth.ErrNotFound, a.SetGroupCapabilities("devs", "mytopic", nil))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, true))
+	require.Equal(t, auth.ErrInvalidArgument, a.SetCapabilities("ben", "mytopic", []auth.Capability{"invalid"}))
+}
+
+func TestSQLiteAuth_Lockout(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	a, err := auth.NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+
+	// Failures are reset after a successful login
+	for i := 0; i < auth.LockoutThreshold-1; i++ {
+		_, err := a.Authenticate("phil", "wrong")
+		require.Equal(t, auth.ErrUnauthenticated, err)
+	}
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, auth.LockoutThreshold-1, phil.FailedLogins)
+	_, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, 0, phil.FailedLogins)
+	for i := 0; i < auth.LockoutThreshold-1; i++ {
+		_, err := a.Authenticate("phil", "wrong")
+		require.Equal(t, auth.ErrUnauthenticated, err)
+	}
+
+	// Lockout, even with the correct password; other users are not affected
+	_, err = a.Authenticate("phil", "wrong")
+	require.Equal(t, auth.ErrUnauthenticated, err)
+	_, err = a.Authenticate("phil", "phil")
+	require.Equal(t, auth.ErrLockedOut, err)
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.True(t, phil.Locked())
+	require.True(t, phil.LockedUntil.After(time.Now().Add(50*time.Second)))
+	_, err = a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+
+	// Lockout expires
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = db.Exec("UPDATE user SET locked_until = ? WHERE user = 'phil'", time.Now().Add(-time.Second).Unix())
+	require.Nil(t, err)
+	_, err = db.Exec("UPDATE dataVersion SET version = version + 1") // Clears the cache, see authCache
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+	time.Sleep(1100 * time.Millisecond) // The data version is read at most once per second
+	_, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.False(t, phil.Locked())
+	require.True(t, phil.LockedUntil.IsZero())
+}
+
+func TestSQLiteAuth_UnlockUser(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	for i := 0; i < auth.LockoutThreshold; i++ {
+		_, err := a.Authenticate("phil", "wrong")
+		require.Equal(t, auth.ErrUnauthenticated, err)
+	}
+	_, err := a.Authenticate("phil", "phil")
+	require.Equal(t, auth.ErrLockedOut, err)
+
+	require.Nil(t, a.UnlockUser("phil"))
+	_, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.Equal(t, auth.ErrNotFound, a.UnlockUser("ben"))
+	require.Equal(t, auth.ErrInvalidArgument, a.UnlockUser("not valid"))
+}
+
+func TestSQLiteAuth_Audit(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleAdmin))
+	admin := a.WithActor("phil")
+	require.Nil(t, admin.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, admin.AllowAccess("ben", "alerts", true, false))
+	require.Nil(t, admin.SetCapabilities("ben", "alerts", []auth.Capability{auth.CapabilityEmail}))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	token, err := a.CreateToken("ben", "backups", time.Time{}, nil)
+	require.Nil(t, err)
+	require.Nil(t, a.Audit(&auth.AuditEvent{Action: auth.AuditActionLoginFailure, Subject: "ben", IP: "1.2.3.4", Detail: "password"}))
+
+	events, err := a.AuditEvents(&auth.AuditFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 8, len(events))
+	require.Equal(t, auth.AuditActionUserAdd, events[0].Action)
+	require.Equal(t, "", events[0].Actor)
+	require.Equal(t, "phil", events[0].Subject)
+	require.Equal(t, &auth.AuditEvent{Time: events[1].Time, Action: auth.AuditActionUserAdd, Actor: "phil", Subject: "ben", Detail: "role user"}, events[1])
+	require.Equal(t, &auth.AuditEvent{Time: events[2].Time, Action: auth.AuditActionAccessAllow, Actor: "phil", Subject: "ben", Topic: "alerts", Detail: "read-only"}, events[2])
+	require.Equal(t, "email", events[3].Detail)
+	require.Equal(t, auth.AuditActionGroupAdd, events[4].Action)
+	require.Equal(t, "group devs", events[5].Detail)
+	require.Equal(t, auth.AuditActionTokenCreate, events[6].Action)
+	require.NotContains(t, events[6].Detail, token.Value)
+	require.Equal(t, "1.2.3.4", events[7].IP)
+
+	// Filters
+	events, err = a.AuditEvents(&auth.AuditFilter{Username: "phil"})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(events)) // Subject of user-add, actor of user-add, access-allow and access-capabilities
+	events, err = a.AuditEvents(&auth.AuditFilter{Username: "ben", Action: auth.AuditActionLoginFailure})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(events))
+	events, err = a.AuditEvents(&auth.AuditFilter{Topic: "alerts"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(events))
+	events, err = a.AuditEvents(&auth.AuditFilter{Limit: 2})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(events))
+	require.Equal(t, auth.AuditActionTokenCreate, events[0].Action) // Most recent events, oldest first
+	require.Equal(t, auth.AuditActionLoginFailure, events[1].Action)
+	events, err = a.AuditEvents(&auth.AuditFilter{Since: time.Now().Add(time.Hour)})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(events))
+
+	// Prune
+	require.Nil(t, a.Audit(&auth.AuditEvent{Time: time.Now().Add(-48 * time.Hour), Action: auth.AuditActionPublish, Actor: "ben", Topic: "alerts"}))
+	require.Nil(t, a.Audit(&auth.AuditEvent{Time: time.Now().Add(-48 * time.Hour), Action: auth.AuditActionUserAdd, Subject: "carl"}))
+	require.Nil(t, a.PruneAuditEvents(time.Now().Add(-24*time.Hour), time.Time{}))
+	events, err = a.AuditEvents(&auth.AuditFilter{Action: auth.AuditActionPublish})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(events))
+	events, err = a.AuditEvents(&auth.AuditFilter{Username: "carl"})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(events)) // Changes are kept
+
+	require.Nil(t, a.Audit(&auth.AuditEvent{Time: time.Now().Add(-48 * time.Hour), Action: auth.AuditActionPublish, Actor: "ben", Topic: "alerts"}))
+	require.Nil(t, a.PruneAuditEvents(time.Time{}, time.Now().Add(-24*time.Hour)))
+	events, err = a.AuditEvents(&auth.AuditFilter{Username: "carl"})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(events))
+	events, err = a.AuditEvents(&auth.AuditFilter{Action: auth.AuditActionPublish})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(events)) // Publishes are kept
+}
+
+func TestSQLiteAuth_Tiers(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddTier(&auth.Tier{
+		Code:                     "pro",
+		RequestLimit:             500,
+		RequestLimitReplenish:    time.Second,
+		SubscriptionLimit:        100,
+		AttachmentTotalSizeLimit: 1024 * 1024 * 1024,
+	}))
+	require.NotNil(t, a.AddTier(&auth.Tier{Code: "pro"})) // Already exists
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, phil.Tier)
+
+	require.Nil(t, a.ChangeUserTier("phil", "pro"))
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "pro", phil.Tier.Code)
+	require.Equal(t, 500, phil.Tier.RequestLimit)
+	require.Equal(t, time.Second, phil.Tier.RequestLimitReplenish)
+	require.Equal(t, 0, phil.Tier.EmailLimit)
+	require.Equal(t, time.Duration(0), phil.Tier.EmailLimitReplenish)
+	require.Equal(t, 100, phil.Tier.SubscriptionLimit)
+	require.Equal(t, int64(1024*1024*1024), phil.Tier.AttachmentTotalSizeLimit)
+
+	phil, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.Equal(t, "pro", phil.Tier.Code)
+
+	require.Nil(t, a.ChangeTier(&auth.Tier{Code: "pro", EmailLimit: 50, EmailLimitReplenish: time.Minute}))
+	pro, err := a.Tier("pro")
+	require.Nil(t, err)
+	require.Equal(t, 0, pro.RequestLimit)
+	require.Equal(t, 50, pro.EmailLimit)
+	require.Equal(t, time.Minute, pro.EmailLimitReplenish)
+
+	require.Nil(t, a.AddTier(&auth.Tier{Code: "business"}))
+	tiers, err := a.Tiers()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(tiers))
+	require.Equal(t, "business", tiers[0].Code)
+	require.Equal(t, "pro", tiers[1].Code)
+
+	require.Nil(t, a.RemoveTier("pro"))
+	_, err = a.Tier("pro")
+	require.Equal(t, auth.ErrNotFound, err)
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, phil.Tier)
+
+	require.Nil(t, a.ChangeUserTier("phil", "business"))
+	require.Nil(t, a.ChangeUserTier("phil", ""))
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, phil.Tier)
+}
+
+func TestSQLiteAuth_Tiers_Invalid(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Equal(t, auth.ErrInvalidArgument, a.AddTier(&auth.Tier{Code: "not valid"}))
+	require.Equal(t, auth.ErrInvalidArgument, a.AddTier(&auth.Tier{Code: "pro", RequestLimit: -1}))
+	require.Equal(t, auth.ErrNotFound, a.ChangeTier(&auth.Tier{Code: "pro"}))
+	require.Equal(t, auth.ErrNotFound, a.ChangeUserTier("phil", "pro"))
+	require.Nil(t, a.AddTier(&auth.Tier{Code: "pro"}))
+	require.Equal(t, auth.ErrNotFound, a.ChangeUserTier("ben", "pro"))
+}
+
+func TestLockoutDuration(t *testing.T) {
+	require.Equal(t, time.Duration(0), auth.LockoutDuration(0))
+	require.Equal(t, time.Duration(0), auth.LockoutDuration(auth.LockoutThreshold-1))
+	require.Equal(t, time.Minute, auth.LockoutDuration(auth.LockoutThreshold))
+	require.Equal(t, 2*time.Minute, auth.LockoutDuration(auth.LockoutThreshold+1))
+	require.Equal(t, 8*time.Minute, auth.LockoutDuration(auth.LockoutThreshold+3))
+	require.Equal(t, 24*time.Hour, auth.LockoutDuration(auth.LockoutThreshold+20))
+	require.Equal(t, 24*time.Hour, auth.LockoutDuration(1000000))
+}
+
+func TestSQLiteAuth_Migration_From1(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE user (user TEXT NOT NULL PRIMARY KEY, pass TEXT NOT NULL, role TEXT NOT NULL);
+		CREATE TABLE access (user TEXT NOT NULL, topic TEXT NOT NULL, read INT NOT NULL, write INT NOT NULL, PRIMARY KEY (topic, user));
+		CREATE TABLE schemaVersion (id INT PRIMARY KEY, version INT NOT NULL);
+		INSERT INTO user VALUES ('ben', '$2a$10$EEp6gBheOsqEFsXlo523E.gBVoeg1ytphXiEvTPlNzkenBlHZBPQy', 'user');
+		INSERT INTO access VALUES ('ben', 'alerts', 1, 1);
+		INSERT INTO schemaVersion VALUES (1, 1);
+	`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	a, err := auth.NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	token, err := a.CreateToken("ben", "", time.Time{}, []auth.Grant{{"mytopic", true, false, nil, time.Time{}}})
+	require.Nil(t, err)
+	ben, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, []auth.Grant{{"mytopic", true, false, nil, time.Time{}}}, ben.Scopes)
+	require.Equal(t, []auth.Grant{{"alerts", true, true, nil, time.Time{}}}, ben.Grants)
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroupMember("devs", "ben"))
+	require.Nil(t, a.SetCapabilities("ben", "alerts", []auth.Capability{auth.CapabilityEmail}))
+	require.Equal(t, auth.ErrUnauthorized, a.AuthorizeCapability(ben, "alerts", auth.CapabilityAttach))
+	require.Nil(t, a.AddTier(&auth.Tier{Code: "pro", RequestLimit: 500}))
+	require.Nil(t, a.ChangeUserTier("ben", "pro"))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, 500, ben.Tier.RequestLimit)
+	require.Nil(t, a.AddReservation("ben", "bentopic"))
+	reservations, err := a.Reservations("ben")
+	require.Nil(t, err)
+	require.Equal(t, "bentopic", reservations[0].Topic)
+	require.Nil(t, a.AllowAccessUntil("ben", "incident", true, true, time.Now().Add(time.Hour)))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	decision, err := a.Decide("ben", "incident")
+	require.Nil(t, err)
+	require.False(t, decision.Rules[0].Expires.IsZero())
+	require.Nil(t, a.Provision(&auth.Provisioning{
+		Users:  []*auth.ProvisionedUser{{Name: "ben", Password: "ben", Role: auth.RoleUser}},
+		Access: map[string][]auth.Grant{"ben": {{TopicPattern: "alerts", AllowRead: true}}},
+	}))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.True(t, ben.Provisioned)
+}
+
+func TestSQLiteAuth_AllowAccessUntil(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	a, err := auth.NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	expires := time.Now().Add(7 * 24 * time.Hour)
+	require.Nil(t, a.AllowAccessUntil("ben", "incident", true, true, expires))
+	require.Nil(t, a.AllowAccessUntil("ben", "old-incident", true, true, time.Now().Add(-time.Minute)))
+	require.Nil(t, a.AllowAccessUntil(auth.Everyone, "status", true, false, time.Now().Add(-time.Minute)))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ben.Grants))
+	require.Equal(t, "incident", ben.Grants[0].TopicPattern)
+	require.Equal(t, expires.Unix(), ben.Grants[0].Expires.Unix())
+	require.Nil(t, a.Authorize(ben, "incident", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "old-incident", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "status", auth.PermissionRead))
+
+	// Expired entries are removed, others are kept
+	require.Nil(t, a.RemoveExpiredAccess())
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	defer db.Close()
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM access`).Scan(&count))
+	require.Equal(t, 1, count)
+	require.Nil(t, a.AllowAccess("ben", "incident", true, false)) // Extends the entry indefinitely
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{"incident", true, false, nil, time.Time{}}}, ben.Grants)
+
+	events, err := a.AuditEvents(&auth.AuditFilter{Action: auth.AuditActionAccessAllow, Username: "ben"})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(events))
+	require.Equal(t, "read-write, expires "+expires.UTC().Format(time.RFC3339), events[0].Detail)
+}
+
+func TestSQLiteAuth_Reservations(t *testing.T) {
+	a := newTestAuth(t, true, true)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddReservation("phil", "mytopic"))
+	require.Nil(t, a.AddReservation("phil", "mytopic")) // Reserving twice is fine
+	require.Nil(t, a.AddReservation("ben", "bentopic"))
+	require.Equal(t, auth.ErrTopicReserved, a.AddReservation("ben", "mytopic"))
+	require.Equal(t, auth.ErrInvalidArgument, a.AddReservation("ben", "my*"))
+
+	reservation, err := a.Reservation("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, "phil", reservation.Username)
+	require.False(t, reservation.Created.IsZero())
+	_, err = a.Reservation("othertopic")
+	require.Equal(t, auth.ErrNotFound, err)
+
+	reservations, err := a.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(reservations))
+	require.Equal(t, "mytopic", reservations[0].Topic)
+	reservations, err = a.Reservations("")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(reservations))
+	require.Equal(t, "ben", reservations[0].Username)
+
+	// Only the owner can use the topic
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(phil, "mytopic", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "mytopic", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "mytopic", auth.PermissionRead))
+
+	require.Equal(t, auth.ErrNotFound, a.RemoveReservation("ben", "mytopic"))
+	require.Nil(t, a.RemoveReservation("phil", "mytopic"))
+	require.Nil(t, a.Authorize(ben, "mytopic", auth.PermissionRead))
+	require.Nil(t, a.Authorize(nil, "mytopic", auth.PermissionRead))
+
+	// Removing a user removes the reservations
+	require.Nil(t, a.RemoveUser("ben"))
+	reservations, err = a.Reservations("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(reservations))
+	require.Nil(t, a.Authorize(nil, "bentopic", auth.PermissionRead))
+}
+
+func TestSQLiteAuth_Reservations_ExistingEntries(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+
+	// Topics with entries of other users, groups or everyone cannot be reserved
+	require.Nil(t, a.AllowAccess("ben", "bentopic", true, false))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "announcements", true, false))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds", true, true))
+	require.Equal(t, auth.ErrTopicInUse, a.AddReservation("phil", "bentopic"))
+	require.Equal(t, auth.ErrTopicInUse, a.AddReservation("phil", "announcements"))
+	require.Equal(t, auth.ErrTopicInUse, a.AddReservation("phil", "builds"))
+	_, err := a.Reservation("bentopic")
+	require.Equal(t, auth.ErrNotFound, err)
+	everyone, err := a.User(auth.Everyone)
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{"announcements", true, false, nil, time.Time{}}}, everyone.Grants)
+
+	// The user's own entry is replaced by the reservation, and restored afterwards
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.Nil(t, a.AllowAccessUntil("phil", "philtopic", true, false, expires))
+	require.Nil(t, a.AddReservation("phil", "philtopic"))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{"philtopic", true, true, nil, time.Time{}}}, phil.Grants)
+	require.Nil(t, a.AddReservation("phil", "philtopic")) // Reserving again does not overwrite the previous entry
+	require.Nil(t, a.RemoveReservation("phil", "philtopic"))
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{"philtopic", true, false, nil, expires}}, phil.Grants)
+	everyone, err = a.User(auth.Everyone)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(everyone.Grants))
+}
+
+func TestSQLiteAuth_Reservations_Wildcards(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddUser("bob", "bob", auth.RoleUser))
+	require.Nil(t, a.AddUser("carl", "carl", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("bob", "team-*", true, true))
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AddGroupMember("devs", "carl"))
+	require.Nil(t, a.AllowGroupAccess("devs", "*", true, true))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "team-*", true, false))
+	require.Nil(t, a.AddReservation("phil", "team-alpha"))
+
+	// Wildcard entries of users, groups and everyone do not apply to reserved topics
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	bob, err := a.User("bob")
+	require.Nil(t, err)
+	carl, err := a.User("carl")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(phil, "team-alpha", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(bob, "team-alpha", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(bob, "team-alpha", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(carl, "team-alpha", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(&auth.User{Name: "dave", Role: auth.RoleUser, ExternalGroups: []string{"devs"}}, "team-alpha", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "team-alpha", auth.PermissionRead))
+	require.Nil(t, a.Authorize(bob, "team-beta", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(carl, "team-beta", auth.PermissionWrite))
+
+	decision, err := a.Decide("carl", "team-alpha")
+	require.Nil(t, err)
+	require.Equal(t, auth.SourceEveryone, decision.Source)
+	require.Equal(t, "team-alpha", decision.Rules[0].TopicPattern)
+
+	// An explicit entry for exactly the reserved topic still applies
+	require.Nil(t, a.AllowAccess("carl", "team-alpha", true, false))
+	require.Nil(t, a.Authorize(carl, "team-alpha", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(carl, "team-alpha", auth.PermissionWrite))
+
+	// Without the entries of the reservation, nobody but admins has access
+	require.Nil(t, a.ResetAccess(auth.Everyone, "team-alpha"))
+	decision, err = a.Decide("bob", "team-alpha")
+	require.Nil(t, err)
+	require.Equal(t, auth.SourceReservation, decision.Source)
+	require.False(t, decision.AllowRead)
+	require.False(t, decision.AllowWrite)
+
+	// Wildcards apply again once the reservation is removed
+	require.Nil(t, a.RemoveReservation("phil", "team-alpha"))
+	require.Nil(t, a.Authorize(bob, "team-alpha", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(phil, "team-alpha", auth.PermissionWrite))
+}
+
+func TestSQLiteAuth_Provision(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "bentopic", true, true))
+	provisioning := &auth.Provisioning{
+		Users: []*auth.ProvisionedUser{
+			{Name: "phil", Password: "$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C", Role: auth.RoleAdmin},
+			{Name: "backup", Password: "backup-pass", Role: auth.RoleUser},
+		},
+		Access: map[string][]auth.Grant{
+			"backup":      {{TopicPattern: "backups*", AllowRead: true, AllowWrite: true}},
+			auth.Everyone: {{TopicPattern: "announcements", AllowRead: true}},
+		},
+	}
+	require.Nil(t, a.Provision(provisioning))
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, auth.RoleAdmin, phil.Role)
+	require.True(t, phil.Provisioned)
+	require.Equal(t, "$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C", phil.Hash)
+	backup, err := a.Authenticate("backup", "backup-pass")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(backup, "backups-nightly", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(nil, "announcements", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "announcements", auth.PermissionWrite))
+
+	// Provisioning again does not change anything
+	events, err := a.AuditEvents(&auth.AuditFilter{})
+	require.Nil(t, err)
+	require.Nil(t, a.Provision(provisioning))
+	eventsAfter, err := a.AuditEvents(&auth.AuditFilter{})
+	require.Nil(t, err)
+	require.Equal(t, len(events), len(eventsAfter))
+
+	// Users and entries that are no longer provisioned are removed, others are left alone
+	require.Nil(t, a.Provision(&auth.Provisioning{
+		Users:  []*auth.ProvisionedUser{{Name: "backup", Password: "new-pass", Role: auth.RoleUser}},
+		Access: map[string][]auth.Grant{"backup": {{TopicPattern: "backups*", AllowRead: true}}},
+	}))
+	_, err = a.User("phil")
+	require.Equal(t, auth.ErrNotFound, err)
+	_, err = a.Authenticate("backup", "new-pass")
+	require.Nil(t, err)
+	backup, err = a.User("backup")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{"backups*", true, false, nil, time.Time{}}}, backup.Grants)
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "announcements", auth.PermissionRead))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.False(t, ben.Provisioned)
+	require.Equal(t, []auth.Grant{{"bentopic", true, true, nil, time.Time{}}}, ben.Grants)
+
+	// An empty provisioning removes all provisioned users
+	require.Nil(t, a.Provision(&auth.Provisioning{}))
+	_, err = a.User("backup")
+	require.Equal(t, auth.ErrNotFound, err)
+	_, err = a.User("ben")
+	require.Nil(t, err)
+}
+
+func TestSQLiteAuth_Provision_Invalid(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Equal(t, auth.ErrInvalidArgument, a.Provision(&auth.Provisioning{
+		Users: []*auth.ProvisionedUser{{Name: "phil", Password: "phil", Role: auth.RoleAnonymous}},
+	}))
+	require.Equal(t, auth.ErrInvalidArgument, a.Provision(&auth.Provisioning{
+		Users: []*auth.ProvisionedUser{{Name: "phil", Password: "phil", Role: auth.RoleUser}, {Name: "phil", Password: "phil", Role: auth.RoleAdmin}},
+	}))
+	require.Equal(t, auth.ErrInvalidArgument, a.Provision(&auth.Provisioning{
+		Access: map[string][]auth.Grant{"ben": {{TopicPattern: "mytopic", AllowRead: true}}},
+	}))
+	require.Equal(t, auth.ErrInvalidArgument, a.Provision(&auth.Provisioning{
+		Access: map[string][]auth.Grant{auth.Everyone: {{TopicPattern: "my topic", AllowRead: true}}},
+	}))
+}
+
+func TestSQLiteAuth_Import(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.Import(&auth.Provisioning{
+		Users:  []*auth.ProvisionedUser{{Name: "phil", Password: "phil", Role: auth.RoleUser}},
+		Access: map[string][]auth.Grant{"phil": {{TopicPattern: "mytopic", AllowWrite: true}}},
+	}))
+	phil, err := a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.False(t, phil.Provisioned)
+	require.Nil(t, a.Authorize(phil, "mytopic", auth.PermissionWrite))
+
+	// Imported users are not removed by Provision
+	require.Nil(t, a.Provision(&auth.Provisioning{}))
+	_, err = a.User("phil")
+	require.Nil(t, err)
+	_, err = a.User("ben")
+	require.Nil(t, err)
+
+	events, err := a.AuditEvents(&auth.AuditFilter{Username: "phil", Action: auth.AuditActionUserAdd})
+	require.Nil(t, err)
+	require.Equal(t, "role user, imported", events[0].Detail)
+}
+
 func newTestAuth(t *testing.T, defaultRead, defaultWrite bool) *auth.SQLiteAuth {
 	filename := filepath.Join(t.TempDir(), "user.db")
 	a, err := auth.NewSQLiteAuth(filename, defaultRead, defaultWrite)
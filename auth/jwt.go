@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register SHA-256 for crypto.Hash
+	_ "crypto/sha512" // Register SHA-384 and SHA-512 for crypto.Hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwtClockSkew         = time.Minute // Leeway when checking the exp and nbf claims
+	jwksRefreshInterval  = time.Minute // Minimum time between reloading the JWKS, if a token has an unknown key ID
+	jwksFetchTimeout     = 10 * time.Second
+	jwksMaxResponseBytes = 1024 * 1024
+)
+
+// JWTIdentity is the identity of a user, as asserted by a verified JWT
+type JWTIdentity struct {
+	Username string
+	Groups   []string
+}
+
+// JWTVerifier verifies signed JWTs (e.g. OIDC ID tokens or access tokens) against the keys of a JSON Web Key Set (JWKS),
+// which is read from a file or URL. Only asymmetric signature algorithms are supported (RS*, PS* and ES*); tokens must
+// have the configured issuer and audience, and must not be expired.
+type JWTVerifier struct {
+	jwks          string // File or URL
+	issuer        string
+	audience      string
+	usernameClaim string
+	groupsClaim   string
+	keys          []*jwk
+	loaded        time.Time
+	client        *http.Client
+	mu            sync.Mutex
+}
+
+type jwk struct {
+	ID  string
+	Alg string
+	Key crypto.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwkJSON struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSetJSON struct {
+	Keys []*jwkJSON `json:"keys"`
+}
+
+// NewJWTVerifier creates a new JWTVerifier and loads the JWKS from the given file or http(s) URL. The username and
+// group memberships are read from the given claims (e.g. "sub" or "preferred_username", and "groups").
+func NewJWTVerifier(jwks, issuer, audience, usernameClaim, groupsClaim string) (*JWTVerifier, error) {
+	if jwks == "" || issuer == "" || audience == "" || usernameClaim == "" {
+		return nil, ErrInvalidArgument
+	}
+	v := &JWTVerifier{
+		jwks:          jwks,
+		issuer:        issuer,
+		audience:      audience,
+		usernameClaim: usernameClaim,
+		groupsClaim:   groupsClaim,
+		client:        &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if err := v.reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Verify checks the signature and claims of the given JWT, and returns the identity it asserts
+func (v *JWTVerifier) Verify(token string) (*JWTIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid token: not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %s", err.Error())
+	}
+	hash, ok := jwtAlgorithmHash(header.Alg)
+	if !ok {
+		return nil, fmt.Errorf("invalid token: unsupported algorithm %s", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid token: cannot decode signature")
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	keys, err := v.keysFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, key := range keys {
+		if (key.Alg == "" || key.Alg == header.Alg) && verifyJWTSignature(header.Alg, hash, key.Key, digest, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid token: signature verification failed")
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %s", err.Error())
+	}
+	return v.identity(claims)
+}
+
+func (v *JWTVerifier) identity(claims map[string]interface{}) (*JWTIdentity, error) {
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return nil, fmt.Errorf("invalid token: unexpected issuer %s", iss)
+	} else if !jwtAudienceMatches(claims["aud"], v.audience) {
+		return nil, errors.New("invalid token: unexpected audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("invalid token: exp claim missing")
+	} else if now.Add(-jwtClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("invalid token: token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("invalid token: token not yet valid")
+	}
+	username, _ := claims[v.usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("invalid token: %s claim missing", v.usernameClaim)
+	}
+	groups := make([]string, 0)
+	if v.groupsClaim != "" {
+		switch g := claims[v.groupsClaim].(type) {
+		case string:
+			groups = append(groups, g)
+		case []interface{}:
+			for _, group := range g {
+				if name, ok := group.(string); ok {
+					groups = append(groups, name)
+				}
+			}
+		}
+	}
+	return &JWTIdentity{
+		Username: username,
+		Groups:   groups,
+	}, nil
+}
+
+// keysFor returns the keys that may have signed a token with the given key ID. If the key ID is unknown,
+// the JWKS is reloaded (at most once per jwksRefreshInterval), since the identity provider may have rotated
+// its keys. Tokens without key ID are checked against all keys.
+func (v *JWTVerifier) keysFor(kid string) ([]*jwk, error) {
+	v.mu.Lock()
+	keys, loaded := v.keys, v.loaded
+	v.mu.Unlock()
+	matches := filterJWKs(keys, kid)
+	if len(matches) == 0 && time.Since(loaded) > jwksRefreshInterval {
+		if err := v.reload(); err != nil {
+			return nil, err
+		}
+		v.mu.Lock()
+		matches = filterJWKs(v.keys, kid)
+		v.mu.Unlock()
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("invalid token: unknown key ID %s", kid)
+	}
+	return matches, nil
+}
+
+func (v *JWTVerifier) reload() error {
+	var b []byte
+	var err error
+	if strings.HasPrefix(v.jwks, "http://") || strings.HasPrefix(v.jwks, "https://") {
+		b, err = v.fetch()
+	} else {
+		b, err = os.ReadFile(v.jwks)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot load JWKS from %s: %s", v.jwks, err.Error())
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("cannot parse JWKS from %s: %s", v.jwks, err.Error())
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.loaded = time.Now()
+	return nil
+}
+
+func (v *JWTVerifier) fetch() ([]byte, error) {
+	resp, err := v.client.Get(v.jwks)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxResponseBytes))
+}
+
+func parseJWKS(b []byte) ([]*jwk, error) {
+	var set jwkSetJSON
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := make([]*jwk, 0)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", k.Kid, err.Error())
+		} else if key == nil {
+			continue // Unsupported key type, e.g. symmetric keys
+		}
+		keys = append(keys, &jwk{ID: k.Kid, Alg: k.Alg, Key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys found")
+	}
+	return keys, nil
+}
+
+func parseJWK(k *jwkJSON) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func filterJWKs(keys []*jwk, kid string) []*jwk {
+	matches := make([]*jwk, 0)
+	for _, key := range keys {
+		if kid == "" || key.ID == kid {
+			matches = append(matches, key)
+		}
+	}
+	return matches
+}
+
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+		} else if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size || k.Curve != jwtAlgorithmCurve(alg) {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func jwtAlgorithmHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256, true
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384, true
+	case "RS512", "PS512", "ES512":
+		return crypto.SHA512, true
+	}
+	return 0, false // Includes "none" and symmetric algorithms (HS*)
+}
+
+func jwtAlgorithmCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+func jwtAudienceMatches(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
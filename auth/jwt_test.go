@@ -0,0 +1,209 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testJWTIssuer   = "https://id.example.com"
+	testJWTAudience = "ntfy"
+)
+
+func TestJWTVerifier_RS256(t *testing.T) {
+	key := newTestRSAKey(t)
+	v := newTestJWTVerifier(t, writeTestJWKS(t, rsaJWK("key1", key)))
+
+	token := signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{
+		"groups": []string{"devs", "ops"},
+	}))
+	identity, err := v.Verify(token)
+	require.Nil(t, err)
+	require.Equal(t, "phil", identity.Username)
+	require.Equal(t, []string{"devs", "ops"}, identity.Groups)
+}
+
+func TestJWTVerifier_ES256_NoKeyID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	v := newTestJWTVerifier(t, writeTestJWKS(t, map[string]string{
+		"kty": "EC",
+		"kid": "eckey",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}))
+
+	token := signTestJWT(t, "ES256", "", key, validTestClaims(map[string]interface{}{
+		"aud":    []string{"other", testJWTAudience},
+		"groups": "devs",
+	}))
+	identity, err := v.Verify(token)
+	require.Nil(t, err)
+	require.Equal(t, "phil", identity.Username)
+	require.Equal(t, []string{"devs"}, identity.Groups)
+}
+
+func TestJWTVerifier_Invalid(t *testing.T) {
+	key := newTestRSAKey(t)
+	otherKey := newTestRSAKey(t)
+	v := newTestJWTVerifier(t, writeTestJWKS(t, rsaJWK("key1", key)))
+
+	tokens := map[string]string{
+		"wrong issuer":    signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"wrong audience":  signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{"aud": "other"})),
+		"expired":         signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"not yet valid":   signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"no expiry":       signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{"exp": nil})),
+		"no username":     signTestJWT(t, "RS256", "key1", key, validTestClaims(map[string]interface{}{"sub": nil})),
+		"wrong key":       signTestJWT(t, "RS256", "key1", otherKey, validTestClaims(nil)),
+		"unknown key ID":  signTestJWT(t, "RS256", "key2", key, validTestClaims(nil)),
+		"alg none":        unsignedTestJWT(t, "none", validTestClaims(nil)),
+		"alg HS256":       unsignedTestJWT(t, "HS256", validTestClaims(nil)),
+		"not a JWT":       "tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2",
+		"garbage payload": "eyJhbGciOiJSUzI1NiJ9.!!!.abc",
+	}
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			_, err := v.Verify(token)
+			require.NotNil(t, err)
+		})
+	}
+}
+
+func TestJWTVerifier_URL(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks, err := os.ReadFile(writeTestJWKS(t, rsaJWK("key1", key)))
+	require.Nil(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	v := newTestJWTVerifier(t, server.URL)
+	identity, err := v.Verify(signTestJWT(t, "RS256", "key1", key, validTestClaims(nil)))
+	require.Nil(t, err)
+	require.Equal(t, "phil", identity.Username)
+	require.Equal(t, 0, len(identity.Groups))
+}
+
+func TestJWTVerifier_InvalidJWKS(t *testing.T) {
+	_, err := auth.NewJWTVerifier(filepath.Join(t.TempDir(), "does-not-exist.json"), testJWTIssuer, testJWTAudience, "sub", "groups")
+	require.NotNil(t, err)
+
+	_, err = auth.NewJWTVerifier(writeTestJWKS(t, map[string]string{"kty": "oct", "k": "c2VjcmV0"}), testJWTIssuer, testJWTAudience, "sub", "groups")
+	require.NotNil(t, err) // No usable keys
+
+	_, err = auth.NewJWTVerifier(writeTestJWKS(t, rsaJWK("key1", newTestRSAKey(t))), testJWTIssuer, "", "sub", "groups")
+	require.Equal(t, auth.ErrInvalidArgument, err)
+}
+
+func TestSQLiteAuth_Authorize_ExternalGroups(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddGroup("devs"))
+	require.Nil(t, a.AllowGroupAccess("devs", "builds", true, true))
+
+	// User does not exist in the database, only the groups from the identity provider are considered
+	phil := &auth.User{Name: "phil", Role: auth.RoleUser, ExternalGroups: []string{"devs", "unknown"}}
+	require.Nil(t, a.Authorize(phil, "builds", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(phil, "other", auth.PermissionRead))
+
+	phil.ExternalGroups = nil
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(phil, "builds", auth.PermissionRead))
+}
+
+func newTestJWTVerifier(t *testing.T, jwks string) *auth.JWTVerifier {
+	v, err := auth.NewJWTVerifier(jwks, testJWTIssuer, testJWTAudience, "sub", "groups")
+	require.Nil(t, err)
+	return v
+}
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	return key
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func writeTestJWKS(t *testing.T, keys ...map[string]string) string {
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(filename, b, 0600))
+	return filename
+}
+
+func validTestClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": testJWTIssuer,
+		"aud": testJWTAudience,
+		"sub": "phil",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	payload := encodeTestJWTPart(t, header) + "." + encodeTestJWTPart(t, claims)
+	digest := sha256.Sum256([]byte(payload))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.Nil(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.Nil(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		t.Fatalf("unsupported key type %T", key)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func unsignedTestJWT(t *testing.T, alg string, claims map[string]interface{}) string {
+	return encodeTestJWTPart(t, map[string]string{"alg": alg}) + "." + encodeTestJWTPart(t, claims) + "."
+}
+
+func encodeTestJWTPart(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	require.Nil(t, err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -3,6 +3,7 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -25,7 +26,14 @@ const (
 )
 
 const (
-	maxResponseBytes = 4096
+	maxResponseBytes      = 4096
+	idempotencyKeyLength  = 16
+	publishMaxAttempts    = 3
+	publishRetryBaseDelay = time.Second
+
+	// errorCodeIdempotencyKeyInProgress is the error code returned by the server if a request with the
+	// same idempotency key is still being processed, see doPublish
+	errorCodeIdempotencyKeyInProgress = 40903
 )
 
 // Client is the ntfy client that can be used to publish and subscribe to ntfy topics
@@ -38,16 +46,19 @@ type Client struct {
 
 // Message is a struct that represents a ntfy message
 type Message struct { // TODO combine with server.message
-	ID         string
-	Event      string
-	Time       int64
-	Topic      string
-	Message    string
-	Title      string
-	Priority   int
-	Tags       []string
-	Click      string
-	Attachment *Attachment
+	ID          string
+	Event       string
+	Time        int64
+	Topic       string
+	Message     string
+	Title       string
+	Priority    int
+	Tags        []string
+	Click       string
+	Icon        string
+	Attachment  *Attachment
+	ContentType string `json:"content_type"` // Empty for plain text, or "text/markdown"
+	Sender      string // Username of the authenticated publisher, empty if published anonymously
 
 	// Additional fields
 	TopicURL       string
@@ -65,6 +76,40 @@ type Attachment struct {
 	Owner   string `json:"-"` // IP address of uploader, used for rate limiting
 }
 
+// PublishMessage is a message to be published as part of a batch, see PublishBatch. Fields correspond
+// to the JSON publishing format, see https://ntfy.sh/docs/publish/#publish-as-json for details.
+type PublishMessage struct {
+	Topic    string          `json:"topic,omitempty"`
+	Topics   []string        `json:"topics,omitempty"`
+	Title    string          `json:"title,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Priority int             `json:"priority,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+	Click    string          `json:"click,omitempty"`
+	Icon     string          `json:"icon,omitempty"`
+	Actions  json.RawMessage `json:"actions,omitempty"`
+	Attach   string          `json:"attach,omitempty"`
+	Filename string          `json:"filename,omitempty"`
+	Email    string          `json:"email,omitempty"`
+	Delay    string          `json:"delay,omitempty"`
+	Markdown bool            `json:"markdown,omitempty"`
+}
+
+// PublishResult is the result of publishing a single message in a batch. Either Message
+// or Error is set, depending on whether the message was published successfully.
+type PublishResult struct {
+	Message *Message
+	Error   error
+}
+
+type publishBatchResult struct {
+	Message json.RawMessage `json:"message"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"error"`
+	} `json:"error"`
+}
+
 type subscription struct {
 	ID       string
 	topicURL string
@@ -94,15 +139,13 @@ func (c *Client) Publish(topic, message string, options ...PublishOption) (*Mess
 //
 // To pass title, priority and tags, check out WithTitle, WithPriority, WithTagsList, WithDelay, WithNoCache,
 // WithNoFirebase, and the generic WithHeader.
+//
+// Each message is sent with a random idempotency key (see WithIdempotencyKey). If the request fails due to a
+// network error and the body can be rewound (i.e. it implements io.Seeker), the request is retried with the same
+// key, so that the server does not publish the message twice (see doPublish).
 func (c *Client) PublishReader(topic string, body io.Reader, options ...PublishOption) (*Message, error) {
 	topicURL := c.expandTopicURL(topic)
-	req, _ := http.NewRequest("POST", topicURL, body)
-	for _, option := range options {
-		if err := option(req); err != nil {
-			return nil, err
-		}
-	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doPublish(topicURL, body, "", options)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +164,114 @@ func (c *Client) PublishReader(topic string, body io.Reader, options ...PublishO
 	return m, nil
 }
 
+// doPublish sends a publish request with a random idempotency key (see WithIdempotencyKey). If the request fails
+// due to a network error and the body can be rewound (i.e. it implements io.Seeker), the request is retried with
+// the same key. If the server is still processing an earlier attempt with the same key (409 Conflict with error
+// code 40903), the request is retried as well.
+func doPublish(url string, body io.Reader, contentType string, options []PublishOption) (*http.Response, error) {
+	idempotencyKey := util.RandomString(idempotencyKeyLength)
+	for attempt := 1; ; attempt++ {
+		req, _ := http.NewRequest("POST", url, body)
+		req.Header.Set("X-Idempotency-Key", idempotencyKey)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for _, option := range options {
+			if err := option(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil && (!idempotencyKeyInProgress(resp) || attempt >= publishMaxAttempts || !rewind(body)) {
+			return resp, nil
+		} else if err == nil {
+			resp.Body.Close()
+			log.Printf("Publishing to %s is still in progress, retrying", url)
+		} else if attempt >= publishMaxAttempts || !rewind(body) {
+			return nil, err
+		} else {
+			log.Printf("Publishing to %s failed: %s, retrying", url, err.Error())
+		}
+		time.Sleep(time.Duration(attempt) * publishRetryBaseDelay)
+	}
+}
+
+// idempotencyKeyInProgress returns true if the server rejected the request because an earlier request with the
+// same idempotency key is still in progress. The response body is read, and replaced so that it can be read again.
+func idempotencyKeyInProgress(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusConflict {
+		return false
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	var httpErr struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(b, &httpErr); err != nil {
+		return false
+	}
+	return httpErr.Code == errorCodeIdempotencyKeyInProgress
+}
+
+// PublishBatch sends a list of messages to the default host in a single request, optionally using options.
+// Each message may be sent to a different topic, but all topics must be short topic names (e.g. mytopic).
+//
+// The returned results are in the same order as the messages. A non-nil error is only returned if the
+// request as a whole failed. If individual messages were rejected by the server, the error is set in the
+// corresponding PublishResult.
+//
+// Like PublishReader, the request is sent with a random idempotency key and retried with the same key
+// on network errors, so that the server does not publish the messages twice.
+func (c *Client) PublishBatch(messages []*PublishMessage, options ...PublishOption) ([]*PublishResult, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, m := range messages {
+		if err := encoder.Encode(m); err != nil {
+			return nil, err
+		}
+	}
+	batchURL := fmt.Sprintf("%s/v1/publish/batch", c.config.DefaultHost)
+	resp, err := doPublish(batchURL, bytes.NewReader(body.Bytes()), "application/x-ndjson", options)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(strings.TrimSpace(string(b)))
+	}
+	var batchResults []*publishBatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&batchResults); err != nil {
+		return nil, err
+	}
+	results := make([]*PublishResult, 0)
+	for _, r := range batchResults {
+		if r.Error != nil {
+			results = append(results, &PublishResult{Error: errors.New(r.Error.Message)})
+			continue
+		}
+		var topic struct {
+			Topic string `json:"topic"`
+		}
+		if err := json.Unmarshal(r.Message, &topic); err != nil {
+			return nil, err
+		}
+		m, err := toMessage(string(r.Message), c.expandTopicURL(topic.Topic), "")
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &PublishResult{Message: m})
+	}
+	return results, nil
+}
+
 // Poll queries a topic for all (or a limited set) of messages. Unlike Subscribe, this method only polls for
 // messages and does not subscribe to messages that arrive after this call.
 //
@@ -161,11 +312,12 @@ func (c *Client) Poll(topic string, options ...SubscribeOption) ([]*Message, err
 // The method returns a unique subscriptionID that can be used in Unsubscribe.
 //
 // Example:
-//   c := client.New(client.NewConfig())
-//   subscriptionID := c.Subscribe("mytopic")
-//   for m := range c.Messages {
-//     fmt.Printf("New message: %s", m.Message)
-//   }
+//
+//	c := client.New(client.NewConfig())
+//	subscriptionID := c.Subscribe("mytopic")
+//	for m := range c.Messages {
+//	  fmt.Printf("New message: %s", m.Message)
+//	}
 func (c *Client) Subscribe(topic string, options ...SubscribeOption) string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -212,6 +364,20 @@ func (c *Client) UnsubscribeAll(topic string) {
 	}
 }
 
+// rewind resets the body to its beginning, so that it can be re-sent. It returns false if
+// the body cannot be rewound, e.g. if it is read from stdin.
+func rewind(body io.Reader) bool {
+	if body == nil {
+		return true
+	}
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return false
+	}
+	_, err := seeker.Seek(0, io.SeekStart)
+	return err == nil
+}
+
 func (c *Client) expandTopicURL(topic string) string {
 	if strings.HasPrefix(topic, "http://") || strings.HasPrefix(topic, "https://") {
 		return topic
@@ -5,6 +5,10 @@ import (
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/client"
 	"heckel.io/ntfy/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
@@ -94,6 +98,108 @@ func TestClient_Publish_Poll(t *testing.T) {
 	require.Equal(t, "some delayed message", messages[1].Message)
 }
 
+func TestClient_Publish_Icon(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	msg, err := c.Publish("mytopic", "some message", client.WithIcon("https://ntfy.sh/static/img/ntfy.png"))
+	require.Nil(t, err)
+	require.Equal(t, "https://ntfy.sh/static/img/ntfy.png", msg.Icon)
+}
+
+func TestClient_Publish_Markdown(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	msg, err := c.Publish("mytopic", "some **bold** text", client.WithMarkdown())
+	require.Nil(t, err)
+	require.Equal(t, "some **bold** text", msg.Message)
+	require.Equal(t, "text/markdown", msg.ContentType)
+
+	messages, err := c.Poll("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "text/markdown", messages[0].ContentType)
+}
+
+func TestClient_PublishBatch(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	results, err := c.PublishBatch([]*client.PublishMessage{
+		{Topic: "mytopic", Message: "message 1", Tags: []string{"tag1"}},
+		{Topic: "not a topic!", Message: "message 2"},
+		{Topic: "othertopic", Message: "message 3", Priority: 5},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(results))
+	require.Nil(t, results[0].Error)
+	require.Equal(t, "message 1", results[0].Message.Message)
+	require.Equal(t, []string{"tag1"}, results[0].Message.Tags)
+	require.Equal(t, fmt.Sprintf("http://127.0.0.1:%d/mytopic", port), results[0].Message.TopicURL)
+	require.Nil(t, results[1].Message)
+	require.Contains(t, results[1].Error.Error(), "invalid topic")
+	require.Equal(t, 5, results[2].Message.Priority)
+
+	messages, err := c.Poll("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+}
+
+func TestClient_Publish_IdempotencyKey(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	msg1, err := c.Publish("mytopic", "some message", client.WithIdempotencyKey("job-123"))
+	require.Nil(t, err)
+	msg2, err := c.Publish("mytopic", "some message", client.WithIdempotencyKey("job-123"))
+	require.Nil(t, err)
+	require.Equal(t, msg1.ID, msg2.ID)
+
+	msg3, err := c.Publish("mytopic", "some message") // Random key
+	require.Nil(t, err)
+	require.NotEqual(t, msg1.ID, msg3.ID)
+
+	messages, err := c.Poll("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+}
+
+func TestClient_Publish_RetryWithSameIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	keys := make([]string, 0)
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		keys = append(keys, r.Header.Get("X-Idempotency-Key"))
+		bodies = append(bodies, string(body))
+		attempt := len(keys)
+		mu.Unlock()
+		if attempt == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close() // Simulate network error
+			return
+		}
+		io.WriteString(w, `{"id":"abc","event":"message","topic":"mytopic","message":"some message"}`)
+	}))
+	defer server.Close()
+
+	c := client.New(client.NewConfig())
+	msg, err := c.Publish(server.URL+"/mytopic", "some message")
+	require.Nil(t, err)
+	require.Equal(t, "abc", msg.ID)
+	require.Equal(t, 2, len(keys))
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+	require.Equal(t, "some message", bodies[1])
+}
+
 func newTestConfig(port int) *client.Config {
 	c := client.NewConfig()
 	c.DefaultHost = fmt.Sprintf("http://127.0.0.1:%d", port)
@@ -108,3 +214,76 @@ func nextMessage(c *client.Client) *client.Message {
 		return nil
 	}
 }
+
+func TestClient_Publish_RetryIfInProgress(t *testing.T) {
+	var mu sync.Mutex
+	keys := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("X-Idempotency-Key"))
+		attempt := len(keys)
+		mu.Unlock()
+		if attempt == 1 {
+			w.WriteHeader(http.StatusConflict) // Earlier attempt with the same key still in progress
+			io.WriteString(w, `{"code":40903,"http":409,"error":"conflict: a request with this idempotency key is still in progress"}`)
+			return
+		}
+		io.WriteString(w, `{"id":"abc","event":"message","topic":"mytopic","message":"some message"}`)
+	}))
+	defer server.Close()
+
+	c := client.New(client.NewConfig())
+	msg, err := c.Publish(server.URL+"/mytopic", "some message")
+	require.Nil(t, err)
+	require.Equal(t, "abc", msg.ID)
+	require.Equal(t, 2, len(keys))
+	require.Equal(t, keys[0], keys[1])
+}
+
+func TestClient_Publish_NoRetryIfOtherConflict(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, `{"code":40902,"http":409,"error":"conflict: topic is reserved by another user"}`)
+	}))
+	defer server.Close()
+
+	c := client.New(client.NewConfig())
+	_, err := c.Publish(server.URL+"/mytopic", "some message")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "40902")
+	require.Equal(t, 1, attempts)
+}
+
+func TestClient_PublishBatch_RetryWithSameIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	keys := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("X-Idempotency-Key"))
+		attempt := len(keys)
+		mu.Unlock()
+		if attempt == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close() // Simulate network error
+			return
+		}
+		io.WriteString(w, `[{"message":{"id":"abc","event":"message","topic":"mytopic","message":"some message"}}]`)
+	}))
+	defer server.Close()
+
+	conf := client.NewConfig()
+	conf.DefaultHost = server.URL
+	c := client.New(conf)
+	results, err := c.PublishBatch([]*client.PublishMessage{{Topic: "mytopic", Message: "some message"}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(results))
+	require.Equal(t, "abc", results[0].Message.ID)
+	require.Equal(t, 2, len(keys))
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+}
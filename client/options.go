@@ -56,6 +56,18 @@ func WithClick(url string) PublishOption {
 	return WithHeader("X-Click", url)
 }
 
+// WithIcon sets the URL of the icon to be shown in the notification, see
+// https://ntfy.sh/docs/publish/#icons for details.
+func WithIcon(icon string) PublishOption {
+	return WithHeader("X-Icon", icon)
+}
+
+// WithMarkdown instructs the server to interpret the message as Markdown, see
+// https://ntfy.sh/docs/publish/#markdown-formatting for details.
+func WithMarkdown() PublishOption {
+	return WithHeader("X-Markdown", "yes")
+}
+
 // WithActions adds custom user actions to the notification. The value can be either a JSON array or the
 // simple format definition. See https://ntfy.sh/docs/publish/#action-buttons for details.
 func WithActions(value string) PublishOption {
@@ -82,6 +94,19 @@ func WithBasicAuth(user, pass string) PublishOption {
 	return WithHeader("Authorization", util.BasicAuth(user, pass))
 }
 
+// WithBearerAuth adds the Authorization header for an access token to the request
+func WithBearerAuth(token string) PublishOption {
+	return WithHeader("Authorization", util.BearerAuth(token))
+}
+
+// WithIdempotencyKey sets the idempotency key of a message. If a message with the same key was already published
+// to the same topic recently, the server does not publish it again, and instead returns the original message.
+// By default, Client.Publish and Client.PublishReader set a random key, so this is only needed to detect
+// duplicates across separate Publish calls (e.g. retries of an entire CI job).
+func WithIdempotencyKey(key string) PublishOption {
+	return WithHeader("X-Idempotency-Key", key)
+}
+
 // WithNoCache instructs the server not to cache the message server-side
 func WithNoCache() PublishOption {
 	return WithHeader("X-Cache", "no")
@@ -4,8 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
 	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/util"
+	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -15,16 +19,77 @@ const (
 var flagsAccess = append(
 	userCommandFlags(),
 	&cli.BoolFlag{Name: "reset", Aliases: []string{"r"}, Usage: "reset access for user (and topic)"},
+	&cli.StringFlag{Name: "capabilities", Usage: "restrict publishing capabilities (comma-separated list, all or none)"},
+	&cli.StringFlag{Name: "expires", Aliases: []string{"e"}, Usage: "access control entry expires after, e.g. 7d"},
 )
 
 var cmdAccess = &cli.Command{
 	Name:      "access",
 	Usage:     "Grant/revoke access to a topic, or show access",
-	UsageText: "ntfy access [USERNAME [TOPIC [PERMISSION]]]",
+	UsageText: "ntfy access [--capabilities=..] [--expires=..] [USERNAME [TOPIC [PERMISSION]]]",
 	Flags:     flagsAccess,
 	Before:    initConfigFileInputSource("config", flagsAccess),
 	Action:    execUserAccess,
 	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "check",
+			Usage:     "Shows whether a user can access a topic, and why",
+			UsageText: "ntfy access check USERNAME TOPIC",
+			Action:    execAccessCheck,
+			Description: `Shows the resulting access of a user to a topic, and explains which access control entry matched.
+
+Entries are checked in the following order, and the first level with a matching entry decides:
+  1. the user's own entries
+  2. the entries of the user's groups
+  3. the entries of the everyone user ("*")
+  4. the default access (auth-default-access)
+
+Within a level, the most specific entry wins: an exact topic name beats a pattern, and a pattern
+with more non-wildcard characters beats a pattern with fewer. If multiple entries are equally
+specific, an explicit deny wins, and otherwise their permissions are combined. Users with the
+admin role have access to all topics.
+
+Examples:
+  ntfy access check phil alerts-secret   # Check access for user phil to topic alerts-secret
+  ntfy access check everyone mytopic     # Check anonymous access to mytopic
+`,
+		},
+		{
+			Name:      "export",
+			Usage:     "Writes users and access control entries as YAML",
+			UsageText: "ntfy access export [FILE]",
+			Action:    execAccessExport,
+			Description: `Writes all users and access control entries to FILE (or stdout) in the format of the
+auth-users and auth-access options of the server config file server.yml.
+
+Passwords are written as bcrypt hashes. The output can be pasted into server.yml to provision the
+users and entries declaratively, or read by 'ntfy access import', e.g. to copy them to another
+server. Groups, tokens, tiers and reservations are not exported, and neither are access control
+entries that expire or that restrict the publishing capabilities.
+
+Examples:
+  ntfy access export                   # Writes users and access control entries to stdout
+  ntfy access export access.yml        # Writes users and access control entries to access.yml
+`,
+		},
+		{
+			Name:      "import",
+			Usage:     "Reads users and access control entries from YAML",
+			UsageText: "ntfy access import FILE",
+			Action:    execAccessImport,
+			Description: `Reads users and access control entries from the auth-users and auth-access options of
+FILE, as written by 'ntfy access export', and adds them to the auth database.
+
+Existing users and entries with the same name/topic are updated, all others are left alone.
+Passwords may be plain text or bcrypt hashes. Unlike the users and entries in server.yml,
+imported users and entries are not removed when they are removed from FILE.
+
+Examples:
+  ntfy access import access.yml        # Adds users and access control entries from access.yml
+`,
+		},
+	},
 	Description: `Manage the access control list for the ntfy server.
 
 This is a server-only command. It directly manages the user.db as defined in the server config
@@ -38,6 +103,9 @@ Usage:
   ntfy access                            # Shows access control list (alias: 'ntfy user list')
   ntfy access USERNAME                   # Shows access control entries for USERNAME
   ntfy access USERNAME TOPIC PERMISSION  # Allow/deny access for USERNAME to TOPIC
+  ntfy access check USERNAME TOPIC       # Shows access for USERNAME to TOPIC, and which entry matched
+  ntfy access export [FILE]              # Writes users and access control entries as YAML
+  ntfy access import FILE                # Reads users and access control entries from YAML
 
 Arguments:
   USERNAME     an existing user, as created with 'ntfy user add', or "everyone"/"*"
@@ -49,15 +117,36 @@ Arguments:
                - write-only (aliases: write, wo)
                - deny (alias: none)
 
+Capabilities:
+  Entries that allow writing also allow the following publishing capabilities, unless
+  restricted with --capabilities=CAPABILITIES (comma-separated list, "all" or "none"):
+               - attach: attach files or external URLs
+               - email: forward messages via e-mail
+               - max-priority: publish messages with priority 5 (max/urgent)
+               - delay: schedule delayed messages
+               - delete: delete messages, e.g. to cancel scheduled messages
+
+Expiry:
+  Entries can be limited in time with --expires=EXPIRES, e.g. for contractors or incident
+  responders. EXPIRES can be a duration (e.g. 7d), a natural language date (e.g. "tomorrow"),
+  or a Unix timestamp. Expired entries are ignored, and removed by the server automatically.
+
 Examples:
   ntfy access                        # Shows access control list (alias: 'ntfy user list')
   ntfy access phil                   # Shows access for user phil
   ntfy access phil mytopic rw        # Allow read-write access to mytopic for user phil
+  ntfy access --expires=7d phil mytopic rw  # Allow read-write access to mytopic for 7 days
   ntfy access everyone mytopic rw    # Allow anonymous read-write access to mytopic
   ntfy access everyone "up*" write   # Allow anonymous write-only access to topics "up..." 
+  ntfy access --capabilities=none everyone "*" rw  # Allow anonymous read-write access, but no attachments/e-mails/...
   ntfy access --reset                # Reset entire access control list
   ntfy access --reset phil           # Reset all access for user phil
   ntfy access --reset phil mytopic   # Reset access for user phil and topic mytopic
+  ntfy access check phil mytopic     # Shows whether phil can access mytopic, and why
+
+If multiple entries match a topic, the most specific one wins, e.g. a "deny" entry for topic
+"alerts-secret" overrides a "read-write" entry for "alerts-*". See 'ntfy access check --help'
+for details.
 `,
 }
 
@@ -91,20 +180,35 @@ func execUserAccess(c *cli.Context) error {
 }
 
 func changeAccess(c *cli.Context, manager auth.Manager, username string, topic string, perms string) error {
-	if !util.InStringList([]string{"", "read-write", "rw", "read-only", "read", "ro", "write-only", "write", "wo", "none", "deny"}, perms) {
-		return errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none)")
+	read, write, err := parsePermission(perms)
+	if err != nil {
+		return err
+	}
+	capabilities, err := parseCapabilities(c.String("capabilities"))
+	if err != nil {
+		return err
+	}
+	expires := time.Time{}
+	if c.String("expires") != "" {
+		expires, err = util.ParseFutureTime(c.String("expires"), time.Now())
+		if err != nil {
+			return err
+		}
 	}
-	read := util.InStringList([]string{"read-write", "rw", "read-only", "read", "ro"}, perms)
-	write := util.InStringList([]string{"read-write", "rw", "write-only", "write", "wo"}, perms)
 	user, err := manager.User(username)
 	if err == auth.ErrNotFound {
 		return fmt.Errorf("user %s does not exist", username)
 	} else if user.Role == auth.RoleAdmin {
 		return fmt.Errorf("user %s is an admin user, access control entries have no effect", username)
 	}
-	if err := manager.AllowAccess(username, topic, read, write); err != nil {
+	if err := manager.AllowAccessUntil(username, topic, read, write, expires); err != nil {
 		return err
 	}
+	if capabilities != nil {
+		if err := manager.SetCapabilities(username, topic, capabilities); err != nil {
+			return err
+		}
+	}
 	if read && write {
 		fmt.Fprintf(c.App.ErrWriter, "granted read-write access to topic %s\n\n", topic)
 	} else if read {
@@ -117,6 +221,298 @@ func changeAccess(c *cli.Context, manager auth.Manager, username string, topic s
 	return showUserAccess(c, manager, username)
 }
 
+func execAccessCheck(c *cli.Context) error {
+	username, topic := c.Args().Get(0), c.Args().Get(1)
+	if username == "" || topic == "" || c.NArg() > 2 {
+		return errors.New("username and topic expected, type 'ntfy access check --help' for help")
+	} else if username == userEveryone {
+		username = auth.Everyone
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	decision, err := manager.Decide(username, topic)
+	if err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "user %s has %s to topic %s\n", username, formatAccess(decision.AllowRead, decision.AllowWrite), topic)
+	switch decision.Source {
+	case auth.SourceAdmin:
+		fmt.Fprintln(c.App.ErrWriter, "- decided by admin role")
+	case auth.SourceDefault:
+		fmt.Fprintln(c.App.ErrWriter, "- decided by default access (server config), no matching entry")
+	case auth.SourceReservation:
+		fmt.Fprintln(c.App.ErrWriter, "- decided by reservation of the topic (see 'ntfy reservation list'), no entry for the topic")
+	default:
+		for _, rule := range decision.Rules {
+			owner := fmt.Sprintf("%s %s", rule.Source, rule.Owner)
+			if rule.Source == auth.SourceEveryone {
+				owner = "everyone"
+			}
+			fmt.Fprintf(c.App.ErrWriter, "- decided by entry of %s: %s to topic %s%s\n", owner, formatAccess(rule.AllowRead, rule.AllowWrite), rule.TopicPattern, formatGrantExpiry(rule.Grant))
+		}
+	}
+	if decision.AllowWrite && decision.Capabilities != nil {
+		fmt.Fprintf(c.App.ErrWriter, "- publishing capabilities: %s\n", formatCapabilityList(decision.Capabilities))
+	}
+	return nil
+}
+
+func execAccessExport(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errors.New("too many arguments, type 'ntfy access export --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	users, err := manager.Users()
+	if err != nil {
+		return err
+	}
+	file := &provisioningFile{
+		Users:  make([]*provisioningUser, 0),
+		Access: make([]*provisioningAccess, 0),
+	}
+	for _, user := range users {
+		if user.Name != auth.Everyone {
+			file.Users = append(file.Users, &provisioningUser{
+				Username: user.Name,
+				Password: user.Hash,
+				Role:     string(user.Role),
+			})
+		}
+		for _, grant := range user.Grants {
+			if !grant.Expires.IsZero() || grant.Capabilities != nil {
+				fmt.Fprintf(c.App.ErrWriter, "skipping access of user %s to topic %s (expires or restricts capabilities)\n", user.Name, grant.TopicPattern)
+				continue
+			}
+			file.Access = append(file.Access, formatProvisionedAccess(user.Name, grant))
+		}
+	}
+	b, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if filename := c.Args().Get(0); filename != "" {
+		if err := os.WriteFile(filename, b, 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "exported %d user(s) and %d access control entries to %s\n", len(file.Users), len(file.Access), filename)
+		return nil
+	}
+	_, err = c.App.Writer.Write(b)
+	return err
+}
+
+func execAccessImport(c *cli.Context) error {
+	filename := c.Args().Get(0)
+	if filename == "" || c.NArg() > 1 {
+		return errors.New("file expected, type 'ntfy access import --help' for help")
+	}
+	file, err := readProvisioningFile(filename)
+	if err != nil {
+		return err
+	}
+	provisioning, err := parseProvisioning(file)
+	if err != nil {
+		return err
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.Import(provisioning); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "imported %d user(s) and %d access control entries from %s\n", len(file.Users), len(file.Access), filename)
+	return nil
+}
+
+// provisioningFile is the YAML format of the auth-users and auth-access options in server.yml. It is also written
+// by 'ntfy access export' and read by 'ntfy access import', so an exported file can be pasted into server.yml.
+type provisioningFile struct {
+	Users  []*provisioningUser   `yaml:"auth-users"`
+	Access []*provisioningAccess `yaml:"auth-access"`
+}
+
+// provisioningUser is an entry of the auth-users option
+type provisioningUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"` // Plain text password or bcrypt hash
+	Role     string `yaml:"role"`
+}
+
+// provisioningAccess is an entry of the auth-access option
+type provisioningAccess struct {
+	Username   string `yaml:"username"` // Username, or "everyone"/"*"
+	Topic      string `yaml:"topic"`    // Topic pattern
+	Permission string `yaml:"permission"`
+}
+
+// readProvisioningFile reads the auth-users and auth-access options from a YAML file, e.g. server.yml or
+// a file written by 'ntfy access export'. All other options in the file are ignored.
+func readProvisioningFile(filename string) (*provisioningFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file provisioningFile
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("cannot read auth-users and auth-access from %s: %s", filename, err.Error())
+	}
+	return &file, nil
+}
+
+// parseProvisioning validates the auth-users and auth-access entries of a provisioning file, and
+// converts them to auth.Provisioning
+func parseProvisioning(file *provisioningFile) (*auth.Provisioning, error) {
+	provisioning := &auth.Provisioning{
+		Users:  make([]*auth.ProvisionedUser, 0),
+		Access: make(map[string][]auth.Grant),
+	}
+	usernames := make(map[string]bool)
+	for i, user := range file.Users {
+		if user == nil {
+			return nil, fmt.Errorf("invalid auth-users entry #%d, must have username, password and role", i+1)
+		}
+		role := auth.Role(user.Role)
+		if !auth.AllowedUsername(user.Username) {
+			return nil, fmt.Errorf("invalid username %s in auth-users entry #%d", user.Username, i+1)
+		} else if user.Password == "" {
+			return nil, fmt.Errorf("empty password for user %s in auth-users", user.Username)
+		} else if !auth.AllowedRole(role) {
+			return nil, fmt.Errorf("invalid role %s for user %s in auth-users, must be 'user' or 'admin'", user.Role, user.Username)
+		} else if usernames[user.Username] {
+			return nil, fmt.Errorf("user %s is defined more than once in auth-users", user.Username)
+		}
+		usernames[user.Username] = true
+		provisioning.Users = append(provisioning.Users, &auth.ProvisionedUser{
+			Name:     user.Username,
+			Password: user.Password,
+			Role:     role,
+		})
+	}
+	for i, entry := range file.Access {
+		if entry == nil || entry.Username == "" || entry.Topic == "" || entry.Permission == "" {
+			return nil, fmt.Errorf("invalid auth-access entry #%d, must have username, topic and permission", i+1)
+		}
+		username := entry.Username
+		if username == userEveryone {
+			username = auth.Everyone
+		}
+		read, write, err := parsePermission(entry.Permission)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth-access entry #%d: %s", i+1, err.Error())
+		} else if username != auth.Everyone && !usernames[username] {
+			return nil, fmt.Errorf("invalid auth-access entry #%d: user %s is not defined in auth-users", i+1, username)
+		} else if !auth.AllowedTopicPattern(entry.Topic) {
+			return nil, fmt.Errorf("invalid auth-access entry #%d: invalid topic pattern %s", i+1, entry.Topic)
+		}
+		provisioning.Access[username] = append(provisioning.Access[username], auth.Grant{
+			TopicPattern: entry.Topic,
+			AllowRead:    read,
+			AllowWrite:   write,
+		})
+	}
+	return provisioning, nil
+}
+
+// formatProvisionedAccess converts an access control entry to an entry of the auth-access option
+func formatProvisionedAccess(username string, grant auth.Grant) *provisioningAccess {
+	if username == auth.Everyone {
+		username = userEveryone
+	}
+	perms := "deny"
+	if grant.AllowRead && grant.AllowWrite {
+		perms = "rw"
+	} else if grant.AllowRead {
+		perms = "ro"
+	} else if grant.AllowWrite {
+		perms = "wo"
+	}
+	return &provisioningAccess{
+		Username:   username,
+		Topic:      grant.TopicPattern,
+		Permission: perms,
+	}
+}
+
+func formatAccess(read, write bool) string {
+	if read && write {
+		return "read-write access"
+	} else if read {
+		return "read-only access"
+	} else if write {
+		return "write-only access"
+	}
+	return "no access"
+}
+
+// formatCapabilities returns a suffix describing the publishing capabilities of the grant, or
+// an empty string if all capabilities are allowed (or if the grant does not allow writing)
+func formatCapabilities(grant auth.Grant) string {
+	if !grant.AllowWrite || grant.Capabilities == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (capabilities: %s)", formatCapabilityList(grant.Capabilities))
+}
+
+// formatGrantExpiry returns a suffix with the remaining time until the grant expires, or an
+// empty string if the grant never expires
+func formatGrantExpiry(grant auth.Grant) string {
+	if grant.Expires.IsZero() {
+		return ""
+	}
+	remaining := time.Until(grant.Expires).Round(time.Minute)
+	if remaining < time.Minute {
+		return " (expires in less than a minute)"
+	}
+	return fmt.Sprintf(" (expires in %s)", util.DurationToHuman(remaining))
+}
+
+func formatCapabilityList(capabilities []auth.Capability) string {
+	if len(capabilities) == 0 {
+		return "none"
+	}
+	values := make([]string, len(capabilities))
+	for i, capability := range capabilities {
+		values[i] = string(capability)
+	}
+	return strings.Join(values, ", ")
+}
+
+// parseCapabilities parses a comma-separated list of capabilities. It returns nil if the list is
+// empty or "all", and an empty list if it is "none".
+func parseCapabilities(s string) ([]auth.Capability, error) {
+	if s == "" || s == "all" {
+		return nil, nil
+	} else if s == "none" {
+		return make([]auth.Capability, 0), nil
+	}
+	capabilities := make([]auth.Capability, 0)
+	for _, value := range util.SplitNoEmpty(s, ",") {
+		capability := auth.Capability(strings.TrimSpace(value))
+		if !auth.AllowedCapability(capability) {
+			return nil, fmt.Errorf("invalid capability %s, must be one of: attach, email, max-priority, delay, delete (or all, none)", capability)
+		}
+		capabilities = append(capabilities, capability)
+	}
+	return capabilities, nil
+}
+
+func parsePermission(perms string) (read bool, write bool, err error) {
+	if !util.InStringList([]string{"", "read-write", "rw", "read-only", "read", "ro", "write-only", "write", "wo", "none", "deny"}, perms) {
+		return false, false, errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none)")
+	}
+	read = util.InStringList([]string{"read-write", "rw", "read-only", "read", "ro"}, perms)
+	write = util.InStringList([]string{"read-write", "rw", "write-only", "write", "wo"}, perms)
+	return read, write, nil
+}
+
 func resetAccess(c *cli.Context, manager auth.Manager, username, topic string) error {
 	if username == "" {
 		return resetAllAccess(c, manager)
@@ -177,24 +573,37 @@ func showUserAccess(c *cli.Context, manager auth.Manager, username string) error
 
 func showUsers(c *cli.Context, manager auth.Manager, users []*auth.User) error {
 	for _, user := range users {
-		fmt.Fprintf(c.App.ErrWriter, "user %s (%s)\n", user.Name, user.Role)
+		details := string(user.Role)
+		if user.Tier != nil {
+			details += ", tier " + user.Tier.Code
+		}
+		if user.Locked() {
+			details += ", locked until " + user.LockedUntil.Format(time.RFC3339)
+		}
+		if user.Provisioned {
+			details += ", provisioned"
+		}
+		fmt.Fprintf(c.App.ErrWriter, "user %s (%s)\n", user.Name, details)
 		if user.Role == auth.RoleAdmin {
 			fmt.Fprintf(c.App.ErrWriter, "- read-write access to all topics (admin role)\n")
 		} else if len(user.Grants) > 0 {
 			for _, grant := range user.Grants {
 				if grant.AllowRead && grant.AllowWrite {
-					fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s\n", grant.TopicPattern)
+					fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s%s%s\n", grant.TopicPattern, formatCapabilities(grant), formatGrantExpiry(grant))
 				} else if grant.AllowRead {
-					fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
+					fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s%s\n", grant.TopicPattern, formatGrantExpiry(grant))
 				} else if grant.AllowWrite {
-					fmt.Fprintf(c.App.ErrWriter, "- write-only access to topic %s\n", grant.TopicPattern)
+					fmt.Fprintf(c.App.ErrWriter, "- write-only access to topic %s%s%s\n", grant.TopicPattern, formatCapabilities(grant), formatGrantExpiry(grant))
 				} else {
-					fmt.Fprintf(c.App.ErrWriter, "- no access to topic %s\n", grant.TopicPattern)
+					fmt.Fprintf(c.App.ErrWriter, "- no access to topic %s%s\n", grant.TopicPattern, formatGrantExpiry(grant))
 				}
 			}
 		} else {
 			fmt.Fprintf(c.App.ErrWriter, "- no topic-specific permissions\n")
 		}
+		if user.Role != auth.RoleAdmin && len(user.Groups) > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- access via groups %s (see 'ntfy group list')\n", strings.Join(user.Groups, ", "))
+		}
 		if user.Name == auth.Everyone {
 			defaultRead, defaultWrite := manager.DefaultAccess()
 			if defaultRead && defaultWrite {
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/bcrypt"
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/server"
 	"heckel.io/ntfy/test"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -76,6 +80,172 @@ user * (anonymous)
 	}))
 }
 
+func TestCLI_Access_Capabilities(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--capabilities=attach,max-priority", "ben", "alerts", "rw"))
+	require.Equal(t, "granted read-write access to topic alerts\n\nuser ben (user)\n- read-write access to topic alerts (capabilities: attach, max-priority)\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--capabilities=none", "ben", "backups", "wo"))
+	require.Contains(t, stderr.String(), "- write-only access to topic backups (capabilities: none)\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "ben", "alerts"))
+	require.Equal(t, "user ben has read-write access to topic alerts\n- decided by entry of user ben: read-write access to topic alerts\n- publishing capabilities: attach, max-priority\n", stderr.String())
+
+	// Granting access again without --capabilities allows all capabilities
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts", "rw"))
+	require.Contains(t, stderr.String(), "- read-write access to topic alerts\n")
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, runAccessCommand(app, conf, "--capabilities=invalid", "ben", "alerts", "rw"))
+}
+
+func TestCLI_Access_Expires(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--expires=7d", "ben", "incident", "rw"))
+	require.Equal(t, "granted read-write access to topic incident\n\nuser ben (user)\n- read-write access to topic incident (expires in 7d)\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "ben", "incident"))
+	require.Equal(t, "user ben has read-write access to topic incident\n- decided by entry of user ben: read-write access to topic incident (expires in 7d)\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, runAccessCommand(app, conf, "--expires=not-a-date", "ben", "incident", "rw"))
+}
+
+func TestCLI_Access_Export_Import(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("philpass\nphilpass\nbenpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "--role=admin", "phil"))
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts-*", "rw"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts-secret", "deny"))
+	require.Nil(t, runAccessCommand(app, conf, "--expires=7d", "ben", "incident", "rw"))
+	require.Nil(t, runAccessCommand(app, conf, "everyone", "announcements", "read"))
+
+	app, _, stdout, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "export"))
+	require.Contains(t, stdout.String(), "auth-users:\n- username: phil\n  password: $2a$10$")
+	require.Contains(t, stdout.String(), "auth-access:\n- username: ben\n  topic: alerts-*\n  permission: rw\n")
+	require.Equal(t, "skipping access of user ben to topic incident (expires or restricts capabilities)\n", stderr.String())
+
+	// Export can be read back as provisioning config, e.g. when pasted into server.yml
+	filename := filepath.Join(t.TempDir(), "access.yml")
+	require.Nil(t, os.WriteFile(filename, stdout.Bytes(), 0600))
+	file, err := readProvisioningFile(filename)
+	require.Nil(t, err)
+	provisioning, err := parseProvisioning(file)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(provisioning.Users))
+	require.Equal(t, "phil", provisioning.Users[0].Name)
+	require.Equal(t, auth.RoleAdmin, provisioning.Users[0].Role)
+	require.Equal(t, "ben", provisioning.Users[1].Name)
+	require.Equal(t, auth.RoleUser, provisioning.Users[1].Role)
+	require.Nil(t, bcrypt.CompareHashAndPassword([]byte(provisioning.Users[1].Password), []byte("benpass")))
+	require.Equal(t, []auth.Grant{
+		{TopicPattern: "alerts-*", AllowRead: true, AllowWrite: true},
+		{TopicPattern: "alerts-secret"},
+	}, provisioning.Access["ben"])
+	require.Equal(t, []auth.Grant{{TopicPattern: "announcements", AllowRead: true}}, provisioning.Access[auth.Everyone])
+
+	// Import into a second server
+	s2, conf2, port2 := newTestServerWithAuth(t)
+	defer test.StopServer(t, s2, port2)
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf2, "import", filename))
+	require.Equal(t, "imported 2 user(s) and 3 access control entries from "+filename+"\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf2, "check", "ben", "alerts-prod"))
+	require.Equal(t, "user ben has read-write access to topic alerts-prod\n- decided by entry of user ben: read-write access to topic alerts-*\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/alerts-prod", port2),
+	}))
+}
+
+func TestCLI_Access_Import_Invalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	filename := filepath.Join(t.TempDir(), "access.yml")
+	require.Nil(t, os.WriteFile(filename, []byte("auth-users:\n  - username: phil\n    password: phil\n    role: user\nauth-access:\n  - username: ben\n    topic: mytopic\n    permission: rw\n"), 0600))
+	app, _, _, _ := newTestApp()
+	err := runAccessCommand(app, conf, "import", filename)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user ben is not defined in auth-users")
+}
+
+func TestCLI_Access_ParseProvisioning(t *testing.T) {
+	provisioning, err := parseProvisioning(&provisioningFile{
+		Users: []*provisioningUser{
+			{Username: "phil", Password: "$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C", Role: "admin"},
+			{Username: "ben", Password: "pass:with:colons", Role: "user"},
+		},
+		Access: []*provisioningAccess{
+			{Username: "ben", Topic: "mytopic", Permission: "rw"},
+			{Username: "everyone", Topic: "announcements", Permission: "read"},
+			{Username: "*", Topic: "up*", Permission: "wo"},
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(provisioning.Users))
+	require.Equal(t, "$2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C", provisioning.Users[0].Password)
+	require.Equal(t, auth.RoleAdmin, provisioning.Users[0].Role)
+	require.Equal(t, "pass:with:colons", provisioning.Users[1].Password)
+	require.Equal(t, []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true}}, provisioning.Access["ben"])
+	require.Equal(t, []auth.Grant{
+		{TopicPattern: "announcements", AllowRead: true},
+		{TopicPattern: "up*", AllowWrite: true},
+	}, provisioning.Access[auth.Everyone])
+
+	invalidUsers := [][]*provisioningUser{
+		{nil},
+		{{Username: "phil", Password: "phil"}},
+		{{Username: "phil", Password: "phil", Role: "anonymous"}},
+		{{Username: "phil", Role: "user"}},
+		{{Username: "phil", Password: "phil", Role: "user"}, {Username: "phil", Password: "other", Role: "admin"}},
+	}
+	for _, users := range invalidUsers {
+		_, err = parseProvisioning(&provisioningFile{Users: users})
+		require.Error(t, err)
+	}
+	invalidAccess := [][]*provisioningAccess{
+		{{Username: "everyone", Topic: "mytopic"}},
+		{{Username: "everyone", Topic: "my topic", Permission: "rw"}},
+		{{Username: "everyone", Topic: "mytopic", Permission: "all"}},
+		{{Username: "ben", Topic: "mytopic", Permission: "rw"}},
+	}
+	for _, access := range invalidAccess {
+		_, err = parseProvisioning(&provisioningFile{Access: access})
+		require.Error(t, err)
+	}
+}
+
 func runAccessCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
@@ -85,3 +255,41 @@ func runAccessCommand(app *cli.App, conf *server.Config, args ...string) error {
 	}
 	return app.Run(append(userArgs, args...))
 }
+
+func TestCLI_Access_Check(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("philpass\nphilpass\nbenpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "--role=admin", "phil"))
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts-*", "rw"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts-secret", "deny"))
+	require.Nil(t, runAccessCommand(app, conf, "everyone", "announcements", "read"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "ben", "alerts-secret"))
+	require.Equal(t, "user ben has no access to topic alerts-secret\n- decided by entry of user ben: no access to topic alerts-secret\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "ben", "alerts-prod"))
+	require.Equal(t, "user ben has read-write access to topic alerts-prod\n- decided by entry of user ben: read-write access to topic alerts-*\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "ben", "announcements"))
+	require.Equal(t, "user ben has read-only access to topic announcements\n- decided by entry of everyone: read-only access to topic announcements\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "everyone", "mytopic"))
+	require.Equal(t, "user * has no access to topic mytopic\n- decided by default access (server config), no matching entry\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "check", "phil", "alerts-secret"))
+	require.Equal(t, "user phil has read-write access to topic alerts-secret\n- decided by admin role\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	err := runAccessCommand(app, conf, "check", "nobody", "mytopic")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user nobody does not exist")
+}
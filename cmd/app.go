@@ -35,6 +35,11 @@ func New() *cli.App {
 			cmdServe,
 			cmdUser,
 			cmdAccess,
+			cmdGroup,
+			cmdToken,
+			cmdTier,
+			cmdReservation,
+			cmdAudit,
 
 			// Client commands
 			cmdPublish,
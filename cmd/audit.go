@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"strings"
+	"time"
+)
+
+const (
+	auditDefaultLimit = 100
+)
+
+var flagsAudit = append(
+	userCommandFlags(),
+	&cli.StringFlag{Name: "user", Aliases: []string{"u"}, Usage: "only show events of this user (as actor or subject)"},
+	&cli.StringFlag{Name: "action", Aliases: []string{"a"}, Usage: "only show events with this action, e.g. login-failure"},
+	&cli.StringFlag{Name: "topic", Aliases: []string{"t"}, Usage: "only show events of this topic (or topic pattern)"},
+	&cli.StringFlag{Name: "since", Aliases: []string{"s"}, Usage: "only show events since this time (duration or Unix timestamp)"},
+	&cli.IntFlag{Name: "limit", Aliases: []string{"n"}, Value: auditDefaultLimit, Usage: "show at most this many (recent) events, 0 for all"},
+)
+
+var cmdAudit = &cli.Command{
+	Name:      "audit",
+	Usage:     "Shows the audit log of logins, publishes and user/access changes",
+	UsageText: "ntfy audit [--user=..] [--action=..] [--topic=..] [--since=..] [--limit=..]",
+	Flags:     flagsAudit,
+	Before:    initConfigFileInputSource("config", flagsAudit),
+	Action:    execAudit,
+	Category:  categoryServer,
+	Description: `Shows the audit log, oldest events first.
+
+The audit log is stored in the user.db, and records all changes to users, groups, access
+control entries and tokens (via the 'ntfy user', 'ntfy access', 'ntfy group' and 'ntfy token'
+commands, or via the admin and account API), as well as successful and failed logins and
+messages published by authenticated users. The server deletes logins and publishes after the time
+defined by 'auth-audit-duration' in the server config. If it is not set (or set to 0), they are
+not recorded at all. All other events are deleted after 'auth-audit-changes-duration' (default: 90 days).
+
+This is a server-only command. It directly reads from the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Actions:
+  ` + auditActionsHelp() + `
+
+Examples:
+  ntfy audit                                  # Shows the last 100 events
+  ntfy audit --user=phil --since=1d           # Shows events of user phil in the last day
+  ntfy audit --action=login-failure -n 0      # Shows all failed logins
+  ntfy audit --action=publish --topic=alerts  # Shows who published to topic alerts
+`,
+}
+
+func execAudit(c *cli.Context) error {
+	filter := &auth.AuditFilter{
+		Username: c.String("user"),
+		Action:   auth.AuditAction(c.String("action")),
+		Topic:    c.String("topic"),
+		Limit:    c.Int("limit"),
+	}
+	if filter.Username == userEveryone {
+		filter.Username = auth.Everyone
+	}
+	if filter.Action != "" && !auth.AllowedAuditAction(filter.Action) {
+		return fmt.Errorf("invalid action %s, type 'ntfy audit --help' for a list of actions", filter.Action)
+	}
+	if c.String("since") != "" {
+		since, err := util.ParsePastTime(c.String("since"), time.Now())
+		if err != nil {
+			return errors.New("invalid since time, must be a duration (e.g. 30m or 2d) or a Unix timestamp")
+		}
+		filter.Since = since
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	auditor, ok := manager.(auth.Auditor)
+	if !ok {
+		return errors.New("auth backend does not support an audit log")
+	}
+	events, err := auditor.AuditEvents(filter)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(c.App.ErrWriter, "no matching events in audit log")
+		return nil
+	}
+	for _, event := range events {
+		fmt.Fprintln(c.App.ErrWriter, formatAuditEvent(event))
+	}
+	return nil
+}
+
+func formatAuditEvent(event *auth.AuditEvent) string {
+	fields := []string{event.Time.Format("2006-01-02 15:04:05"), string(event.Action)}
+	if event.Actor != "" {
+		fields = append(fields, "actor="+event.Actor)
+	}
+	if event.Subject != "" {
+		fields = append(fields, "subject="+event.Subject)
+	}
+	if event.Topic != "" {
+		fields = append(fields, "topic="+event.Topic)
+	}
+	if event.IP != "" {
+		fields = append(fields, "ip="+event.IP)
+	}
+	if event.Detail != "" {
+		fields = append(fields, fmt.Sprintf("detail=%q", event.Detail))
+	}
+	return strings.Join(fields, " ")
+}
+
+func auditActionsHelp() string {
+	actions := make([]string, 0)
+	for _, action := range auth.AuditActions {
+		actions = append(actions, string(action))
+	}
+	return strings.Join(actions, ", ")
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"testing"
+)
+
+func TestCLI_Audit(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	app, _, _, _ = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-role", "phil", "admin"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAuditCommand(app, conf, "--user=phil"))
+	require.Contains(t, stderr.String(), `user-add subject=phil detail="role user"`)
+	require.Contains(t, stderr.String(), `user-change-role subject=phil detail="role admin"`)
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAuditCommand(app, conf, "--action=user-change-role", "--since=1h"))
+	require.NotContains(t, stderr.String(), "user-add")
+	require.Contains(t, stderr.String(), "user-change-role")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAuditCommand(app, conf, "--user=ben"))
+	require.Contains(t, stderr.String(), "no matching events in audit log")
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, runAuditCommand(app, conf, "--action=invalid"))
+	app, _, _, _ = newTestApp()
+	require.Error(t, runAuditCommand(app, conf, "--since=tomorrow"))
+}
+
+func runAuditCommand(app *cli.App, conf *server.Config, args ...string) error {
+	auditArgs := []string{
+		"ntfy",
+		"audit",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(auditArgs, args...))
+}
@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"strings"
+)
+
+var flagsGroup = userCommandFlags()
+var cmdGroup = &cli.Command{
+	Name:      "group",
+	Usage:     "Manage/show groups, their members and access",
+	UsageText: "ntfy group [list|add|remove|member|access] ...",
+	Flags:     flagsGroup,
+	Before:    initConfigFileInputSource("config", flagsGroup),
+	Action:    execGroupList,
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new group",
+			UsageText: "ntfy group add GROUP",
+			Action:    execGroupAdd,
+			Description: `Add a new group to the ntfy user database.
+
+A new group has no members and no access control entries. Use 'ntfy group member' to add
+users to the group, and 'ntfy group access' to grant the group access to topics.
+
+Example:
+  ntfy group add devs
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a group",
+			UsageText: "ntfy group remove GROUP",
+			Action:    execGroupDel,
+			Description: `Remove a group from the ntfy user database, including its members and access control entries.
+
+The users of the group are not removed, but they lose the access granted via the group.
+
+Example:
+  ntfy group del devs
+`,
+		},
+		{
+			Name:      "member",
+			Aliases:   []string{"m"},
+			Usage:     "Adds/removes a user to/from a group",
+			UsageText: "ntfy group member [--remove] GROUP USERNAME",
+			Action:    execGroupMember,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "remove", Aliases: []string{"r"}, Usage: "remove user from group"},
+			},
+			Description: `Add a user to a group, or remove a user from a group.
+
+Members of a group have access to all topics the group has access to, unless they
+have their own access control entry for a topic (see 'ntfy access').
+
+Examples:
+  ntfy group member devs phil            # Add user phil to group devs
+  ntfy group member --remove devs phil   # Remove user phil from group devs
+`,
+		},
+		{
+			Name:      "access",
+			Usage:     "Grant/revoke access to a topic for a group",
+			UsageText: "ntfy group access [--reset] [--capabilities=..] GROUP [TOPIC [PERMISSION]]",
+			Action:    execGroupAccess,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "reset", Aliases: []string{"r"}, Usage: "reset access for group (and topic)"},
+				&cli.StringFlag{Name: "capabilities", Usage: "restrict publishing capabilities (comma-separated list, all or none)"},
+			},
+			Description: `Manage the access control entries of a group.
+
+TOPIC is the name of a topic with optional wildcards, e.g. "mytopic*", and PERMISSION is one
+of read-write (alias: rw), read-only (aliases: read, ro), write-only (aliases: write, wo), or
+deny (alias: none), just like in 'ntfy access'. Publishing capabilities (attach, email, max-priority,
+delay, delete) can be restricted with --capabilities, also just like in 'ntfy access'.
+
+Examples:
+  ntfy group access devs                  # Shows access for group devs
+  ntfy group access devs "builds*" ro     # Allow read-only access to topics "builds..." for group devs
+  ntfy group access --capabilities=attach devs "builds*" rw  # Allow read-write access, but only attachments
+  ntfy group access --reset devs          # Reset all access for group devs
+  ntfy group access --reset devs builds   # Reset access for group devs and topic builds
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of groups",
+			Action:  execGroupList,
+			Description: `Shows a list of all groups, including their members and access control entries.
+
+This is a server-only command. It directly reads from the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+`,
+		},
+	},
+	Description: `Manage groups of the ntfy server.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
+to the related commands 'ntfy user' and 'ntfy access'.
+
+Groups have their own access control entries, which apply to all members of the group. When
+deciding whether a user may access a topic, the user's own entries take precedence over
+the entries of the user's groups, which take precedence over the entries of the everyone user.
+If a user is a member of multiple groups, the access granted by these groups is combined.
+
+Examples:
+  ntfy group list                         # Shows list of groups, their members and access
+  ntfy group add devs                     # Add group devs
+  ntfy group del devs                     # Delete group devs
+  ntfy group member devs phil             # Add user phil to group devs
+  ntfy group member --remove devs phil    # Remove user phil from group devs
+  ntfy group access devs "builds*" ro     # Allow read-only access to topics "builds..." for group devs
+  ntfy group access --reset devs          # Reset all access for group devs
+`,
+}
+
+func execGroupAdd(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group add --help' for help")
+	} else if !auth.AllowedGroupName(name) {
+		return errors.New("group name not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if group, _ := manager.Group(name); group != nil {
+		return fmt.Errorf("group %s already exists", name)
+	}
+	if err := manager.AddGroup(name); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "group %s added\n", name)
+	return nil
+}
+
+func execGroupDel(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group del --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.Group(name); err == auth.ErrNotFound {
+		return fmt.Errorf("group %s does not exist", name)
+	}
+	if err := manager.RemoveGroup(name); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "group %s removed\n", name)
+	return nil
+}
+
+func execGroupMember(c *cli.Context) error {
+	name, username := c.Args().Get(0), c.Args().Get(1)
+	if name == "" || username == "" {
+		return errors.New("group name and username expected, type 'ntfy group member --help' for help")
+	} else if username == userEveryone || username == auth.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.Group(name); err == auth.ErrNotFound {
+		return fmt.Errorf("group %s does not exist", name)
+	} else if err != nil {
+		return err
+	}
+	if c.Bool("remove") {
+		if err := manager.RemoveGroupMember(name, username); err == auth.ErrNotFound {
+			return fmt.Errorf("user %s is not a member of group %s", username, name)
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "user %s removed from group %s\n", username, name)
+		return nil
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	if err := manager.AddGroupMember(name, username); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "user %s added to group %s\n", username, name)
+	return nil
+}
+
+func execGroupAccess(c *cli.Context) error {
+	if c.NArg() > 3 {
+		return errors.New("too many arguments, please check 'ntfy group access --help' for usage details")
+	}
+	name, topic, perms := c.Args().Get(0), c.Args().Get(1), c.Args().Get(2)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group access --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	group, err := manager.Group(name)
+	if err == auth.ErrNotFound {
+		return fmt.Errorf("group %s does not exist", name)
+	} else if err != nil {
+		return err
+	}
+	if c.Bool("reset") {
+		if perms != "" {
+			return errors.New("too many arguments, please check 'ntfy group access --help' for usage details")
+		}
+		if err := manager.ResetGroupAccess(name, topic); err != nil {
+			return err
+		}
+		if topic == "" {
+			fmt.Fprintf(c.App.ErrWriter, "reset access for group %s\n\n", name)
+		} else {
+			fmt.Fprintf(c.App.ErrWriter, "reset access for group %s and topic %s\n\n", name, topic)
+		}
+		return showGroup(c, manager, name)
+	} else if perms == "" {
+		if topic != "" {
+			return errors.New("invalid syntax, please check 'ntfy group access --help' for usage details")
+		}
+		showGroups(c, []*auth.Group{group})
+		return nil
+	}
+	read, write, err := parsePermission(perms)
+	if err != nil {
+		return err
+	}
+	capabilities, err := parseCapabilities(c.String("capabilities"))
+	if err != nil {
+		return err
+	}
+	if err := manager.AllowGroupAccess(name, topic, read, write); err != nil {
+		return err
+	}
+	if capabilities != nil {
+		if err := manager.SetGroupCapabilities(name, topic, capabilities); err != nil {
+			return err
+		}
+	}
+	if read && write {
+		fmt.Fprintf(c.App.ErrWriter, "granted read-write access to topic %s\n\n", topic)
+	} else if read {
+		fmt.Fprintf(c.App.ErrWriter, "granted read-only access to topic %s\n\n", topic)
+	} else if write {
+		fmt.Fprintf(c.App.ErrWriter, "granted write-only access to topic %s\n\n", topic)
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "revoked all access to topic %s\n\n", topic)
+	}
+	return showGroup(c, manager, name)
+}
+
+func execGroupList(c *cli.Context) error {
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	groups, err := manager.Groups()
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		fmt.Fprintln(c.App.ErrWriter, "no groups")
+		return nil
+	}
+	showGroups(c, groups)
+	return nil
+}
+
+func showGroup(c *cli.Context, manager auth.Manager, name string) error {
+	group, err := manager.Group(name)
+	if err != nil {
+		return err
+	}
+	showGroups(c, []*auth.Group{group})
+	return nil
+}
+
+func showGroups(c *cli.Context, groups []*auth.Group) {
+	for _, group := range groups {
+		if len(group.Members) > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "group %s (members: %s)\n", group.Name, strings.Join(group.Members, ", "))
+		} else {
+			fmt.Fprintf(c.App.ErrWriter, "group %s (no members)\n", group.Name)
+		}
+		if len(group.Grants) == 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- no topic-specific permissions\n")
+		}
+		for _, grant := range group.Grants {
+			if grant.AllowRead && grant.AllowWrite {
+				fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s%s\n", grant.TopicPattern, formatCapabilities(grant))
+			} else if grant.AllowRead {
+				fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
+			} else if grant.AllowWrite {
+				fmt.Fprintf(c.App.ErrWriter, "- write-only access to topic %s%s\n", grant.TopicPattern, formatCapabilities(grant))
+			} else {
+				fmt.Fprintf(c.App.ErrWriter, "- no access to topic %s\n", grant.TopicPattern)
+			}
+		}
+	}
+}
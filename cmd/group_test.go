@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"testing"
+	"time"
+)
+
+func TestCLI_Group_AddMemberAccess(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "add", "devs"))
+	require.Contains(t, stderr.String(), "group devs added")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "member", "devs", "ben"))
+	require.Contains(t, stderr.String(), "user ben added to group devs")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "access", "devs", "builds*", "rw"))
+	require.Contains(t, stderr.String(), "granted read-write access to topic builds*")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "list"))
+	require.Equal(t, "group devs (members: ben)\n- read-write access to topic builds*\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "access", "--capabilities=email", "devs", "alerts", "wo"))
+	require.Contains(t, stderr.String(), "- write-only access to topic alerts (capabilities: email)\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "ben"))
+	require.Contains(t, stderr.String(), "user ben (user)\n- no topic-specific permissions\n- access via groups devs (see 'ntfy group list')\n")
+
+	// See if access permissions match
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/builds-main", port),
+	}))
+	require.Error(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/something-else", port),
+	}))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "member", "--remove", "devs", "ben"))
+	require.Contains(t, stderr.String(), "user ben removed from group devs")
+	time.Sleep(1100 * time.Millisecond) // The server picks up changes of other processes within a second
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/builds-main", port),
+	}))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "access", "--reset", "devs"))
+	require.Contains(t, stderr.String(), "reset access for group devs\n\ngroup devs (no members)\n- no topic-specific permissions\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "remove", "devs"))
+	require.Contains(t, stderr.String(), "group devs removed")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "list"))
+	require.Equal(t, "no groups\n", stderr.String())
+}
+
+func TestCLI_Group_Errors(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "add", "devs"))
+
+	app, _, _, _ = newTestApp()
+	err := runGroupCommand(app, conf, "add", "devs")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "group devs already exists")
+
+	app, _, _, _ = newTestApp()
+	err = runGroupCommand(app, conf, "member", "devs", "nobody")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user nobody does not exist")
+
+	app, _, _, _ = newTestApp()
+	err = runGroupCommand(app, conf, "member", "ops", "nobody")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "group ops does not exist")
+
+	app, _, _, _ = newTestApp()
+	err = runGroupCommand(app, conf, "member", "--remove", "devs", "nobody")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user nobody is not a member of group devs")
+}
+
+func runGroupCommand(app *cli.App, conf *server.Config, args ...string) error {
+	groupArgs := []string{
+		"ntfy",
+		"group",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(groupArgs, args...))
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
@@ -16,7 +17,7 @@ var cmdPublish = &cli.Command{
 	Name:      "publish",
 	Aliases:   []string{"pub", "send", "trigger"},
 	Usage:     "Send message via a ntfy server",
-	UsageText: "ntfy send [OPTIONS..] TOPIC [MESSAGE]\n   NTFY_TOPIC=.. ntfy send [OPTIONS..] -P [MESSAGE]",
+	UsageText: "ntfy send [OPTIONS..] TOPIC [MESSAGE]\n   NTFY_TOPIC=.. ntfy send [OPTIONS..] -P [MESSAGE]\n   ntfy send --batch [OPTIONS..] [SERVER] < messages.ndjson",
 	Action:    execPublish,
 	Category:  categoryClient,
 	Flags: []cli.Flag{
@@ -26,16 +27,20 @@ var cmdPublish = &cli.Command{
 		&cli.StringFlag{Name: "tags", Aliases: []string{"tag", "T"}, EnvVars: []string{"NTFY_TAGS"}, Usage: "comma separated list of tags and emojis"},
 		&cli.StringFlag{Name: "delay", Aliases: []string{"at", "in", "D"}, EnvVars: []string{"NTFY_DELAY"}, Usage: "delay/schedule message"},
 		&cli.StringFlag{Name: "click", Aliases: []string{"U"}, EnvVars: []string{"NTFY_CLICK"}, Usage: "URL to open when notification is clicked"},
+		&cli.StringFlag{Name: "icon", Aliases: []string{"i"}, EnvVars: []string{"NTFY_ICON"}, Usage: "URL to use as notification icon"},
+		&cli.BoolFlag{Name: "markdown", Aliases: []string{"md"}, EnvVars: []string{"NTFY_MARKDOWN"}, Usage: "interpret the message as Markdown"},
 		&cli.StringFlag{Name: "actions", Aliases: []string{"A"}, EnvVars: []string{"NTFY_ACTIONS"}, Usage: "actions JSON array or simple definition"},
 		&cli.StringFlag{Name: "attach", Aliases: []string{"a"}, EnvVars: []string{"NTFY_ATTACH"}, Usage: "URL to send as an external attachment"},
 		&cli.StringFlag{Name: "filename", Aliases: []string{"name", "n"}, EnvVars: []string{"NTFY_FILENAME"}, Usage: "filename for the attachment"},
 		&cli.StringFlag{Name: "file", Aliases: []string{"f"}, EnvVars: []string{"NTFY_FILE"}, Usage: "file to upload as an attachment"},
 		&cli.StringFlag{Name: "email", Aliases: []string{"mail", "e"}, EnvVars: []string{"NTFY_EMAIL"}, Usage: "also send to e-mail address"},
 		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, EnvVars: []string{"NTFY_USER"}, Usage: "username[:password] used to auth against the server"},
+		&cli.StringFlag{Name: "token", Aliases: []string{"k"}, EnvVars: []string{"NTFY_TOKEN"}, Usage: "access token used to auth against the server"},
 		&cli.BoolFlag{Name: "no-cache", Aliases: []string{"C"}, EnvVars: []string{"NTFY_NO_CACHE"}, Usage: "do not cache message server-side"},
 		&cli.BoolFlag{Name: "no-firebase", Aliases: []string{"F"}, EnvVars: []string{"NTFY_NO_FIREBASE"}, Usage: "do not forward message to Firebase"},
 		&cli.BoolFlag{Name: "env-topic", Aliases: []string{"P"}, EnvVars: []string{"NTFY_ENV_TOPIC"}, Usage: "use topic from NTFY_TOPIC env variable"},
 		&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, EnvVars: []string{"NTFY_QUIET"}, Usage: "do print message"},
+		&cli.BoolFlag{Name: "batch", Aliases: []string{"B"}, EnvVars: []string{"NTFY_BATCH"}, Usage: "read JSON messages (one per line) from stdin and publish them in a single request"},
 	},
 	Description: `Publish a message to a ntfy server.
 
@@ -48,13 +53,17 @@ Examples:
   ntfy pub --at=8:30am delayed_topic Laterzz              # Send message at 8:30am
   ntfy pub -e phil@example.com alerts 'App is down!'      # Also send email to phil@example.com
   ntfy pub --click="https://reddit.com" redd 'New msg'    # Opens Reddit when notification is clicked
+  ntfy pub --icon="http://some.tld/icon.png" alerts Hi    # Send notification with custom icon
+  ntfy pub --markdown backups '**Backups** failed'        # Send message formatted as Markdown
   ntfy pub --attach="http://some.tld/file.zip" files      # Send ZIP archive from URL as attachment
   ntfy pub --file=flower.jpg flowers 'Nice!'              # Send image.jpg as attachment
   ntfy pub -u phil:mypass secret Psst                     # Publish with username/password
   NTFY_USER=phil:mypass ntfy pub secret Psst              # Use env variables to set username/password
+  ntfy pub -k tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2 secret Hi  # Publish with access token
   NTFY_TOPIC=mytopic ntfy pub -P "some message""          # Use NTFY_TOPIC variable as topic 
   cat flower.jpg | ntfy pub --file=- flowers 'Nice!'      # Same as above, send image.jpg as attachment
   ntfy trigger mywebhook                                  # Sending without message, useful for webhooks
+  ntfy pub --batch myserver.com < messages.ndjson         # Publish many JSON messages in a single request
  
 Please also check out the docs on publishing messages. Especially for the --tags and --delay options, 
 it has incredibly useful information: https://ntfy.sh/docs/publish/.
@@ -68,21 +77,30 @@ func execPublish(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if c.Bool("batch") {
+		return execPublishBatch(c, conf)
+	}
 	title := c.String("title")
 	priority := c.String("priority")
 	tags := c.String("tags")
 	delay := c.String("delay")
 	click := c.String("click")
+	icon := c.String("icon")
+	markdown := c.Bool("markdown")
 	actions := c.String("actions")
 	attach := c.String("attach")
 	filename := c.String("filename")
 	file := c.String("file")
 	email := c.String("email")
 	user := c.String("user")
+	token := c.String("token")
 	noCache := c.Bool("no-cache")
 	noFirebase := c.Bool("no-firebase")
 	envTopic := c.Bool("env-topic")
 	quiet := c.Bool("quiet")
+	if user != "" && token != "" {
+		return errors.New("cannot set both --user and --token")
+	}
 	var topic, message string
 	if envTopic {
 		topic = os.Getenv("NTFY_TOPIC")
@@ -114,6 +132,12 @@ func execPublish(c *cli.Context) error {
 	if click != "" {
 		options = append(options, client.WithClick(click))
 	}
+	if icon != "" {
+		options = append(options, client.WithIcon(icon))
+	}
+	if markdown {
+		options = append(options, client.WithMarkdown())
+	}
 	if actions != "" {
 		options = append(options, client.WithActions(strings.ReplaceAll(actions, "\n", " ")))
 	}
@@ -148,6 +172,8 @@ func execPublish(c *cli.Context) error {
 			fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 20))
 		}
 		options = append(options, client.WithBasicAuth(user, pass))
+	} else if token != "" {
+		options = append(options, client.WithBearerAuth(token))
 	}
 	var body io.Reader
 	if file == "" {
@@ -181,3 +207,63 @@ func execPublish(c *cli.Context) error {
 	}
 	return nil
 }
+
+func execPublishBatch(c *cli.Context, conf *client.Config) error {
+	user := c.String("user")
+	token := c.String("token")
+	quiet := c.Bool("quiet")
+	if user != "" && token != "" {
+		return errors.New("cannot set both --user and --token")
+	} else if c.NArg() > 1 {
+		return errors.New("too many arguments, type 'ntfy publish --help' for help")
+	} else if c.NArg() == 1 {
+		conf.DefaultHost = expandServerURL(c.Args().Get(0))
+	}
+	var options []client.PublishOption
+	if user != "" {
+		parts := strings.SplitN(user, ":", 2)
+		if len(parts) != 2 {
+			return errors.New("password must be passed as --user=username:password when using --batch, since messages are read from stdin")
+		}
+		options = append(options, client.WithBasicAuth(parts[0], parts[1]))
+	} else if token != "" {
+		options = append(options, client.WithBearerAuth(token))
+	}
+	messages := make([]*client.PublishMessage, 0)
+	decoder := json.NewDecoder(c.App.Reader)
+	for decoder.More() {
+		var m client.PublishMessage
+		if err := decoder.Decode(&m); err != nil {
+			return fmt.Errorf("cannot read message %d from stdin: %s", len(messages)+1, err.Error())
+		}
+		messages = append(messages, &m)
+	}
+	if len(messages) == 0 {
+		return errors.New("no messages read from stdin, type 'ntfy publish --help' for help")
+	}
+	cl := client.New(conf)
+	results, err := cl.PublishBatch(messages, options...)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i, result := range results {
+		if result.Error != nil {
+			failed++
+			fmt.Fprintf(c.App.ErrWriter, "message %d failed: %s\n", i+1, result.Error.Error())
+		} else if !quiet {
+			fmt.Fprintln(c.App.Writer, strings.TrimSpace(result.Message.Raw))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d message(s) could not be published", failed, len(results))
+	}
+	return nil
+}
+
+func expandServerURL(server string) string {
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		return strings.TrimSuffix(server, "/")
+	}
+	return fmt.Sprintf("https://%s", strings.TrimSuffix(server, "/"))
+}
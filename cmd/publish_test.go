@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/test"
 	"heckel.io/ntfy/util"
+	"strings"
 	"testing"
 )
 
@@ -70,3 +71,42 @@ func TestCLI_Publish_All_The_Things(t *testing.T) {
 	require.Equal(t, int64(0), m.Attachment.Expires)
 	require.Equal(t, "", m.Attachment.Type)
 }
+
+func TestCLI_Publish_Batch(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	server := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	app, stdin, stdout, _ := newTestApp()
+	stdin.WriteString(`{"topic":"mytopic","message":"message 1"}
+{"topic":"othertopic","message":"message 2","title":"a title"}
+`)
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--batch", server}))
+	messages := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Equal(t, 2, len(messages))
+	m := toMessage(t, messages[0])
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "message 1", m.Message)
+	m = toMessage(t, messages[1])
+	require.Equal(t, "othertopic", m.Topic)
+	require.Equal(t, "a title", m.Title)
+
+	app2, _, stdout, _ := newTestApp()
+	require.Nil(t, app2.Run([]string{"ntfy", "subscribe", "--poll", server + "/othertopic"}))
+	m = toMessage(t, stdout.String())
+	require.Equal(t, "message 2", m.Message)
+}
+
+func TestCLI_Publish_Batch_PartialFailure(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, stdout, stderr := newTestApp()
+	stdin.WriteString(`{"topic":"mytopic","message":"message 1"}
+{"topic":"invalid topic","message":"message 2"}
+`)
+	err := app.Run([]string{"ntfy", "publish", "--batch", fmt.Sprintf("http://127.0.0.1:%d", port)})
+	require.Equal(t, "1 of 2 message(s) could not be published", err.Error())
+	require.Equal(t, "message 1", toMessage(t, stdout.String()).Message)
+	require.Contains(t, stderr.String(), "message 2 failed: invalid topic")
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"time"
+)
+
+var flagsReservation = userCommandFlags()
+var cmdReservation = &cli.Command{
+	Name:      "reservation",
+	Usage:     "Create, list or delete topic reservations",
+	UsageText: "ntfy reservation [list|add|remove] ...",
+	Flags:     flagsReservation,
+	Before:    initConfigFileInputSource("config", flagsReservation),
+	Action:    execReservationList,
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Reserves a topic for a user",
+			UsageText: "ntfy reservation add USERNAME TOPIC",
+			Action:    execReservationAdd,
+			Description: `Reserve a topic for a user.
+
+The user is granted read-write access to the topic, and everyone else is denied access to it,
+unless they have their own access control entry for the topic. Unlike reservations made via the
+account API, reservations made with this command are not subject to the reservation limit.
+
+Example:
+  ntfy reservation add phil mytopic
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a topic reservation",
+			UsageText: "ntfy reservation remove TOPIC",
+			Action:    execReservationDel,
+			Description: `Remove a topic reservation, regardless of which user reserved the topic.
+
+The access control entries of the reservation are removed as well, i.e. the owner's entry for the
+topic, and the entry that denied access to everyone else.
+
+Example:
+  ntfy reservation del mytopic
+`,
+		},
+		{
+			Name:      "list",
+			Aliases:   []string{"l"},
+			Usage:     "Shows a list of topic reservations",
+			UsageText: "ntfy reservation list [USERNAME]",
+			Action:    execReservationList,
+			Description: `Shows a list of all topic reservations.
+
+This is a server-only command. It directly reads from the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy reservation list                    # Shows list of reservations of all users
+  ntfy reservation list phil               # Shows list of reservations of user phil
+`,
+		},
+	},
+	Description: `Manage topic reservations of the ntfy server.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
+to the related command 'ntfy access'.
+
+Users can reserve topics via the account API (POST /v1/account/reservations), up to the limit
+defined by the auth-reservation-limit option, or by their tier. A reserved topic can only be
+used by the user who reserved it, and by admins. Topics that have access control entries of
+other users, groups or everyone cannot be reserved.
+
+Examples:
+  ntfy reservation list                    # Shows list of reservations of all users
+  ntfy reservation list phil               # Shows list of reservations of user phil
+  ntfy reservation add phil mytopic        # Reserve topic mytopic for user phil
+  ntfy reservation remove mytopic          # Remove the reservation of topic mytopic
+`,
+}
+
+func execReservationAdd(c *cli.Context) error {
+	username, topic := c.Args().Get(0), c.Args().Get(1)
+	if username == "" || topic == "" {
+		return errors.New("username and topic expected, type 'ntfy reservation add --help' for help")
+	} else if username == userEveryone || username == auth.Everyone {
+		return errors.New("username not allowed")
+	} else if !auth.AllowedTopic(topic) {
+		return errors.New("topic not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	if err := manager.AddReservation(username, topic); err == auth.ErrTopicReserved {
+		reservation, err := manager.Reservation(topic)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("topic %s is already reserved by user %s", topic, reservation.Username)
+	} else if err == auth.ErrTopicInUse {
+		return fmt.Errorf("topic %s has access control entries of other users, remove them first", topic)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "topic %s reserved for user %s\n", topic, username)
+	return nil
+}
+
+func execReservationDel(c *cli.Context) error {
+	topic := c.Args().Get(0)
+	if topic == "" {
+		return errors.New("topic expected, type 'ntfy reservation remove --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	reservation, err := manager.Reservation(topic)
+	if err == auth.ErrNotFound {
+		return fmt.Errorf("topic %s is not reserved", topic)
+	} else if err != nil {
+		return err
+	}
+	if err := manager.RemoveReservation(reservation.Username, topic); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "reservation of topic %s by user %s removed\n", topic, reservation.Username)
+	return nil
+}
+
+func execReservationList(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == userEveryone || username == auth.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		if _, err := manager.User(username); err == auth.ErrNotFound {
+			return fmt.Errorf("user %s does not exist", username)
+		} else if err != nil {
+			return err
+		}
+	}
+	reservations, err := manager.Reservations(username)
+	if err != nil {
+		return err
+	}
+	if len(reservations) == 0 && username != "" {
+		fmt.Fprintf(c.App.ErrWriter, "user %s has no reservations\n", username)
+		return nil
+	} else if len(reservations) == 0 {
+		fmt.Fprintln(c.App.ErrWriter, "no reservations")
+		return nil
+	}
+	lastUsername := ""
+	for _, r := range reservations {
+		if r.Username != lastUsername {
+			fmt.Fprintf(c.App.ErrWriter, "user %s\n", r.Username)
+			lastUsername = r.Username
+		}
+		fmt.Fprintf(c.App.ErrWriter, "- %s, reserved %s\n", r.Topic, r.Created.Format(time.UnixDate))
+	}
+	return nil
+}
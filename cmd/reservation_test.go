@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"testing"
+)
+
+func TestCLI_Reservation_AddListRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("philpass\nphilpass\nbenpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runReservationCommand(app, conf, "list"))
+	require.Equal(t, "no reservations\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runReservationCommand(app, conf, "add", "phil", "mytopic"))
+	require.Equal(t, "topic mytopic reserved for user phil\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	err := runReservationCommand(app, conf, "add", "ben", "mytopic")
+	require.Error(t, err)
+	require.Equal(t, "topic mytopic is already reserved by user phil", err.Error())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runReservationCommand(app, conf, "list"))
+	require.Regexp(t, `^user phil\n- mytopic, reserved .+\n$`, stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runReservationCommand(app, conf, "list", "ben"))
+	require.Equal(t, "user ben has no reservations\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runReservationCommand(app, conf, "remove", "mytopic"))
+	require.Equal(t, "reservation of topic mytopic by user phil removed\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	err = runReservationCommand(app, conf, "remove", "mytopic")
+	require.Error(t, err)
+	require.Equal(t, "topic mytopic is not reserved", err.Error())
+}
+
+func runReservationCommand(app *cli.App, conf *server.Config, args ...string) error {
+	reservationArgs := []string{
+		"ntfy",
+		"reservation",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(reservationArgs, args...))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/server"
 	"heckel.io/ntfy/util"
 	"log"
@@ -24,9 +25,32 @@ var flagsServe = []cli.Flag{
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cert-file", Aliases: []string{"E"}, EnvVars: []string{"NTFY_CERT_FILE"}, Usage: "certificate file, if listen-https is set"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "firebase-key-file", Aliases: []string{"F"}, EnvVars: []string{"NTFY_FIREBASE_KEY_FILE"}, Usage: "Firebase credentials file; if set additionally publish to FCM topic"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-file", Aliases: []string{"C"}, EnvVars: []string{"NTFY_CACHE_FILE"}, Usage: "cache file used for message caching"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-database-url", EnvVars: []string{"NTFY_CACHE_DATABASE_URL"}, Usage: "PostgreSQL connection URL used for message caching (instead of cache-file)"}),
 	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-duration", Aliases: []string{"b"}, EnvVars: []string{"NTFY_CACHE_DURATION"}, Value: server.DefaultCacheDuration, Usage: "buffer messages for this time to allow `since` requests"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "idempotency-key-duration", EnvVars: []string{"NTFY_IDEMPOTENCY_KEY_DURATION"}, Value: server.DefaultIdempotencyKeyDuration, Usage: "duration for which idempotency keys are remembered to detect repeated publish requests"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-access", Aliases: []string{"p"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ACCESS"}, Value: "read-write", Usage: "default permissions if no matching entries in the auth database are found"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-proxy-header", EnvVars: []string{"NTFY_AUTH_PROXY_HEADER"}, Usage: "header set by a trusted reverse proxy that contains the authenticated username (e.g. X-Forwarded-User)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-proxy-trusted-cidrs", EnvVars: []string{"NTFY_AUTH_PROXY_TRUSTED_CIDRS"}, Usage: "comma-separated list of IP ranges (CIDR) of reverse proxies that are trusted to set auth-proxy-header"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "auth-proxy-auto-provision", EnvVars: []string{"NTFY_AUTH_PROXY_AUTO_PROVISION"}, Value: false, Usage: "if set, users authenticated via auth-proxy-header are created automatically"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-jwt-jwks", EnvVars: []string{"NTFY_AUTH_JWT_JWKS"}, Usage: "JSON Web Key Set (JWKS) file or URL used to verify JWTs of an identity provider (OIDC)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-jwt-issuer", EnvVars: []string{"NTFY_AUTH_JWT_ISSUER"}, Usage: "expected issuer (iss claim) of JWTs, if auth-jwt-jwks is set"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-jwt-audience", EnvVars: []string{"NTFY_AUTH_JWT_AUDIENCE"}, Usage: "expected audience (aud claim) of JWTs, if auth-jwt-jwks is set"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-jwt-username-claim", EnvVars: []string{"NTFY_AUTH_JWT_USERNAME_CLAIM"}, Value: server.DefaultAuthJWTUsernameClaim, Usage: "JWT claim that contains the username"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-jwt-groups-claim", EnvVars: []string{"NTFY_AUTH_JWT_GROUPS_CLAIM"}, Value: server.DefaultAuthJWTGroupsClaim, Usage: "JWT claim that contains the user's groups"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-url", EnvVars: []string{"NTFY_AUTH_LDAP_URL"}, Usage: "LDAP server URL (ldap:// or ldaps://); if set, users are authenticated against LDAP"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-user-dn", EnvVars: []string{"NTFY_AUTH_LDAP_USER_DN"}, Usage: "DN template to bind as, e.g. uid={username},ou=people,dc=example,dc=com"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-group-base-dn", EnvVars: []string{"NTFY_AUTH_LDAP_GROUP_BASE_DN"}, Usage: "base DN to search for the user's groups, e.g. ou=groups,dc=example,dc=com"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-group-member-attr", EnvVars: []string{"NTFY_AUTH_LDAP_GROUP_MEMBER_ATTR"}, Value: server.DefaultAuthLDAPGroupMemberAttr, Usage: "LDAP group attribute that contains the member DNs"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-group-name-attr", EnvVars: []string{"NTFY_AUTH_LDAP_GROUP_NAME_ATTR"}, Value: server.DefaultAuthLDAPGroupNameAttr, Usage: "LDAP group attribute that contains the group name"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "auth-ldap-cache-duration", EnvVars: []string{"NTFY_AUTH_LDAP_CACHE_DURATION"}, Value: server.DefaultAuthLDAPCacheDuration, Usage: "cache successful LDAP logins for this time (0 = query LDAP for every request)"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "auth-ldap-local-fallback", EnvVars: []string{"NTFY_AUTH_LDAP_LOCAL_FALLBACK"}, Value: false, Usage: "if set, users are authenticated against the auth-file if the LDAP server cannot be reached"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-client-ca-file", EnvVars: []string{"NTFY_AUTH_CLIENT_CA_FILE"}, Usage: "CA certificate bundle (PEM) used to verify client certificates, if listen-https is set"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-client-cert-username", EnvVars: []string{"NTFY_AUTH_CLIENT_CERT_USERNAME"}, Value: server.DefaultAuthClientCertUsername, Usage: "client certificate field used as username: cn, san-dns or san-email"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-client-cert-mapping", EnvVars: []string{"NTFY_AUTH_CLIENT_CERT_MAPPING"}, Usage: "comma-separated list of certificate-value=username mappings, e.g. backup.example.com=backup"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "auth-audit-duration", EnvVars: []string{"NTFY_AUTH_AUDIT_DURATION"}, Value: server.DefaultAuthAuditDuration, Usage: "keep logins and publishes in the audit log for this time (0 = do not record them)"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "auth-audit-changes-duration", EnvVars: []string{"NTFY_AUTH_AUDIT_CHANGES_DURATION"}, Value: server.DefaultAuthAuditChangesDuration, Usage: "keep user and access changes in the audit log for this time (0 = forever)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "auth-reservation-limit", EnvVars: []string{"NTFY_AUTH_RESERVATION_LIMIT"}, Value: server.DefaultAuthReservationLimit, Usage: "number of topics a user can reserve (0 = only users with a tier)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-total-size-limit", Aliases: []string{"A"}, EnvVars: []string{"NTFY_ATTACHMENT_TOTAL_SIZE_LIMIT"}, DefaultText: "5G", Usage: "limit of the on-disk attachment cache"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-file-size-limit", Aliases: []string{"Y"}, EnvVars: []string{"NTFY_ATTACHMENT_FILE_SIZE_LIMIT"}, DefaultText: "15M", Usage: "per-file attachment size limit (e.g. 300k, 2M, 100M)"}),
@@ -85,9 +109,32 @@ func execServe(c *cli.Context) error {
 	certFile := c.String("cert-file")
 	firebaseKeyFile := c.String("firebase-key-file")
 	cacheFile := c.String("cache-file")
+	cacheDatabaseURL := c.String("cache-database-url")
 	cacheDuration := c.Duration("cache-duration")
+	idempotencyKeyDuration := c.Duration("idempotency-key-duration")
 	authFile := c.String("auth-file")
 	authDefaultAccess := c.String("auth-default-access")
+	authProxyHeader := c.String("auth-proxy-header")
+	authProxyTrustedCIDRs := util.SplitNoEmpty(c.String("auth-proxy-trusted-cidrs"), ",")
+	authProxyAutoProvision := c.Bool("auth-proxy-auto-provision")
+	authJWTJWKS := c.String("auth-jwt-jwks")
+	authJWTIssuer := c.String("auth-jwt-issuer")
+	authJWTAudience := c.String("auth-jwt-audience")
+	authJWTUsernameClaim := c.String("auth-jwt-username-claim")
+	authJWTGroupsClaim := c.String("auth-jwt-groups-claim")
+	authLDAPURL := c.String("auth-ldap-url")
+	authLDAPUserDN := c.String("auth-ldap-user-dn")
+	authLDAPGroupBaseDN := c.String("auth-ldap-group-base-dn")
+	authLDAPGroupMemberAttr := c.String("auth-ldap-group-member-attr")
+	authLDAPGroupNameAttr := c.String("auth-ldap-group-name-attr")
+	authLDAPCacheDuration := c.Duration("auth-ldap-cache-duration")
+	authLDAPLocalFallback := c.Bool("auth-ldap-local-fallback")
+	authClientCAFile := c.String("auth-client-ca-file")
+	authClientCertUsername := c.String("auth-client-cert-username")
+	authClientCertMappings := util.SplitNoEmpty(c.String("auth-client-cert-mapping"), ",")
+	authAuditDuration := c.Duration("auth-audit-duration")
+	authAuditChangesDuration := c.Duration("auth-audit-changes-duration")
+	authReservationLimit := c.Int("auth-reservation-limit")
 	attachmentCacheDir := c.String("attachment-cache-dir")
 	attachmentTotalSizeLimitStr := c.String("attachment-total-size-limit")
 	attachmentFileSizeLimitStr := c.String("attachment-file-size-limit")
@@ -113,6 +160,17 @@ func execServe(c *cli.Context) error {
 	visitorEmailLimitReplenish := c.Duration("visitor-email-limit-replenish")
 	behindProxy := c.Bool("behind-proxy")
 
+	// Read provisioned users and access control entries (auth-users and auth-access); these are
+	// structured lists, so they can only be defined in the config file, not as flags
+	authProvisioningFile := &provisioningFile{}
+	if configFile := c.String("config"); util.FileExists(configFile) {
+		file, err := readProvisioningFile(configFile)
+		if err != nil {
+			return err
+		}
+		authProvisioningFile = file
+	}
+
 	// Check values
 	if firebaseKeyFile != "" && !util.FileExists(firebaseKeyFile) {
 		return errors.New("if set, FCM key file must exist")
@@ -120,8 +178,18 @@ func execServe(c *cli.Context) error {
 		return errors.New("keepalive interval cannot be lower than five seconds")
 	} else if managerInterval < 5*time.Second {
 		return errors.New("manager interval cannot be lower than five seconds")
+	} else if cacheFile != "" && cacheDatabaseURL != "" {
+		return errors.New("cache-file and cache-database-url cannot both be set")
+	} else if cacheDatabaseURL != "" && !strings.HasPrefix(cacheDatabaseURL, "postgres://") && !strings.HasPrefix(cacheDatabaseURL, "postgresql://") {
+		return errors.New("if set, cache-database-url must start with postgres:// or postgresql://")
 	} else if cacheDuration > 0 && cacheDuration < managerInterval {
 		return errors.New("cache duration cannot be lower than manager interval")
+	} else if authAuditDuration > 0 && authAuditDuration < managerInterval {
+		return errors.New("auth audit duration cannot be lower than manager interval")
+	} else if authAuditChangesDuration > 0 && authAuditChangesDuration < managerInterval {
+		return errors.New("auth audit changes duration cannot be lower than manager interval")
+	} else if authReservationLimit < 0 {
+		return errors.New("auth reservation limit cannot be negative")
 	} else if keyFile != "" && !util.FileExists(keyFile) {
 		return errors.New("if set, key file must exist")
 	} else if certFile != "" && !util.FileExists(certFile) {
@@ -138,6 +206,20 @@ func execServe(c *cli.Context) error {
 		return errors.New("if set, base-url must start with http:// or https://")
 	} else if !util.InStringList([]string{"read-write", "read-only", "write-only", "deny-all"}, authDefaultAccess) {
 		return errors.New("if set, auth-default-access must start set to 'read-write', 'read-only', 'write-only' or 'deny-all'")
+	} else if authProxyHeader != "" && (authFile == "" || len(authProxyTrustedCIDRs) == 0) {
+		return errors.New("if auth-proxy-header is set, auth-file and auth-proxy-trusted-cidrs must also be set")
+	} else if authJWTJWKS != "" && (authFile == "" || authJWTIssuer == "" || authJWTAudience == "" || authJWTUsernameClaim == "") {
+		return errors.New("if auth-jwt-jwks is set, auth-file, auth-jwt-issuer, auth-jwt-audience and auth-jwt-username-claim must also be set")
+	} else if authLDAPURL != "" && (authFile == "" || !strings.Contains(authLDAPUserDN, auth.LDAPUsernamePlaceholder)) {
+		return errors.New("if auth-ldap-url is set, auth-file and auth-ldap-user-dn (containing " + auth.LDAPUsernamePlaceholder + ") must also be set")
+	} else if authClientCAFile != "" && (authFile == "" || listenHTTPS == "") {
+		return errors.New("if auth-client-ca-file is set, auth-file and listen-https must also be set")
+	} else if (len(authProvisioningFile.Users) > 0 || len(authProvisioningFile.Access) > 0) && authFile == "" {
+		return errors.New("if auth-users or auth-access is set, auth-file must also be set")
+	} else if authClientCAFile != "" && !util.FileExists(authClientCAFile) {
+		return errors.New("if set, client CA file must exist")
+	} else if !util.InStringList([]string{server.ClientCertUsernameCN, server.ClientCertUsernameSANDNS, server.ClientCertUsernameSANEmail}, authClientCertUsername) {
+		return errors.New("if set, auth-client-cert-username must be 'cn', 'san-dns' or 'san-email'")
 	} else if !util.InStringList([]string{"app", "home"}, webRoot) {
 		return errors.New("if set, web-root must be 'home' or 'app'")
 	}
@@ -185,6 +267,32 @@ func execServe(c *cli.Context) error {
 		}
 	}
 
+	// Parse trusted proxy networks
+	authProxyTrustedNets := make([]*net.IPNet, 0)
+	for _, cidr := range authProxyTrustedCIDRs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid IP range %s in auth-proxy-trusted-cidrs: %s", cidr, err.Error())
+		}
+		authProxyTrustedNets = append(authProxyTrustedNets, ipNet)
+	}
+
+	// Parse client certificate mappings
+	authClientCertMapping := make(map[string]string)
+	for _, mapping := range authClientCertMappings {
+		value, username, ok := splitClientCertMapping(mapping)
+		if !ok {
+			return fmt.Errorf("invalid mapping %s in auth-client-cert-mapping, must be <certificate-value>=<username>", mapping)
+		}
+		authClientCertMapping[value] = username
+	}
+
+	// Parse provisioned users and access control entries
+	authProvisioning, err := parseProvisioning(authProvisioningFile)
+	if err != nil {
+		return err
+	}
+
 	// Run server
 	conf := server.NewConfig()
 	conf.BaseURL = baseURL
@@ -195,10 +303,34 @@ func execServe(c *cli.Context) error {
 	conf.CertFile = certFile
 	conf.FirebaseKeyFile = firebaseKeyFile
 	conf.CacheFile = cacheFile
+	conf.CacheDatabaseURL = cacheDatabaseURL
 	conf.CacheDuration = cacheDuration
+	conf.IdempotencyKeyDuration = idempotencyKeyDuration
 	conf.AuthFile = authFile
 	conf.AuthDefaultRead = authDefaultRead
 	conf.AuthDefaultWrite = authDefaultWrite
+	conf.AuthProxyHeader = authProxyHeader
+	conf.AuthProxyTrustedNets = authProxyTrustedNets
+	conf.AuthProxyAutoProvision = authProxyAutoProvision
+	conf.AuthJWTJWKS = authJWTJWKS
+	conf.AuthJWTIssuer = authJWTIssuer
+	conf.AuthJWTAudience = authJWTAudience
+	conf.AuthJWTUsernameClaim = authJWTUsernameClaim
+	conf.AuthJWTGroupsClaim = authJWTGroupsClaim
+	conf.AuthLDAPURL = authLDAPURL
+	conf.AuthLDAPUserDN = authLDAPUserDN
+	conf.AuthLDAPGroupBaseDN = authLDAPGroupBaseDN
+	conf.AuthLDAPGroupMemberAttr = authLDAPGroupMemberAttr
+	conf.AuthLDAPGroupNameAttr = authLDAPGroupNameAttr
+	conf.AuthLDAPCacheDuration = authLDAPCacheDuration
+	conf.AuthLDAPLocalFallback = authLDAPLocalFallback
+	conf.AuthClientCAFile = authClientCAFile
+	conf.AuthClientCertUsername = authClientCertUsername
+	conf.AuthClientCertMapping = authClientCertMapping
+	conf.AuthAuditDuration = authAuditDuration
+	conf.AuthAuditChangesDuration = authAuditChangesDuration
+	conf.AuthReservationLimit = authReservationLimit
+	conf.AuthProvisioning = authProvisioning
 	conf.AttachmentCacheDir = attachmentCacheDir
 	conf.AttachmentTotalSizeLimit = attachmentTotalSizeLimit
 	conf.AttachmentFileSizeLimit = attachmentFileSizeLimit
@@ -244,3 +376,13 @@ func parseSize(s string, defaultValue int64) (v int64, err error) {
 	}
 	return v, nil
 }
+
+// splitClientCertMapping splits a mapping of the form <certificate-value>=<username>. Usernames cannot contain
+// a '=', so the last one is the separator.
+func splitClientCertMapping(mapping string) (value string, username string, ok bool) {
+	i := strings.LastIndex(mapping, "=")
+	if i <= 0 || i == len(mapping)-1 {
+		return "", "", false
+	}
+	return strings.TrimSpace(mapping[:i]), strings.TrimSpace(mapping[i+1:]), true
+}
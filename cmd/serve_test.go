@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/client"
 	"heckel.io/ntfy/test"
 	"heckel.io/ntfy/util"
@@ -70,8 +71,60 @@ func TestCLI_Serve_WebSocket(t *testing.T) {
 	require.Equal(t, "mytopic", m.Topic)
 }
 
+func TestCLI_Serve_Provisioning(t *testing.T) {
+	port := 10000 + rand.Intn(20000)
+	authFile := filepath.Join(t.TempDir(), "user.db")
+	configFile := filepath.Join(t.TempDir(), "server.yml")
+	require.Nil(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+auth-file: %s
+auth-default-access: deny-all
+auth-users:
+  - username: phil
+    password: $2a$10$YLiO8U21sX1uhZamTLJXHuxgVC0Z/GKISibrKCLohPgtG7yIxSk4C
+    role: admin
+  - username: backup
+    password: backup-pass
+    role: user
+auth-access:
+  - username: backup
+    topic: backups*
+    permission: rw
+  - username: everyone
+    topic: announcements
+    permission: ro
+`, authFile)), 0600))
+	go func() {
+		app, _, _, _ := newTestApp()
+		err := app.Run([]string{"ntfy", "serve", "--config=" + configFile, fmt.Sprintf("--listen-http=:%d", port)})
+		require.Nil(t, err)
+	}()
+	test.WaitForPortUp(t, port)
+
+	a, err := auth.NewSQLiteAuth(authFile, false, false)
+	require.Nil(t, err)
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, auth.RoleAdmin, phil.Role)
+	require.True(t, phil.Provisioned)
+	backup, err := a.Authenticate("backup", "backup-pass")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(backup, "backups-nightly", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(nil, "announcements", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "backups-nightly", auth.PermissionRead))
+}
+
 func newEmptyFile(t *testing.T) string {
 	filename := filepath.Join(t.TempDir(), "empty")
 	require.Nil(t, os.WriteFile(filename, []byte{}, 0600))
 	return filename
 }
+
+func TestCLI_Serve_CacheDatabaseURL_Invalid(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	err := app.Run([]string{"ntfy", "serve", "--cache-database-url=mysql://localhost/ntfy"})
+	require.Equal(t, "if set, cache-database-url must start with postgres:// or postgresql://", err.Error())
+
+	app, _, _, _ = newTestApp()
+	err = app.Run([]string{"ntfy", "serve", "--cache-file=" + filepath.Join(t.TempDir(), "cache.db"), "--cache-database-url=postgres://localhost/ntfy"})
+	require.Equal(t, "cache-file and cache-database-url cannot both be set", err.Error())
+}
@@ -24,6 +24,7 @@ var cmdSubscribe = &cli.Command{
 		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "client config file"},
 		&cli.StringFlag{Name: "since", Aliases: []string{"s"}, Usage: "return events since `SINCE` (Unix timestamp, or all)"},
 		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, Usage: "username[:password] used to auth against the server"},
+		&cli.StringFlag{Name: "token", Aliases: []string{"k"}, Usage: "access token used to auth against the server"},
 		&cli.BoolFlag{Name: "from-config", Aliases: []string{"C"}, Usage: "read subscriptions from config file (service mode)"},
 		&cli.BoolFlag{Name: "poll", Aliases: []string{"p"}, Usage: "return events and exit, do not listen for new events"},
 		&cli.BoolFlag{Name: "scheduled", Aliases: []string{"sched", "S"}, Usage: "also return scheduled/delayed events"},
@@ -42,6 +43,7 @@ ntfy subscribe TOPIC
     ntfy sub home.lan/backups         # Subscribe to topic on different server
     ntfy sub --poll home.lan/backups  # Just query for latest messages and exit
     ntfy sub -u phil:mypass secret    # Subscribe with username/password
+    ntfy sub -k tk_AgQdq7mV... secret # Subscribe with access token
   
 ntfy subscribe TOPIC COMMAND
   This executes COMMAND for every incoming messages. The message fields are passed to the
@@ -84,6 +86,7 @@ func execSubscribe(c *cli.Context) error {
 	cl := client.New(conf)
 	since := c.String("since")
 	user := c.String("user")
+	token := c.String("token")
 	poll := c.Bool("poll")
 	scheduled := c.Bool("scheduled")
 	fromConfig := c.Bool("from-config")
@@ -92,6 +95,9 @@ func execSubscribe(c *cli.Context) error {
 	if !fromConfig {
 		conf.Subscribe = nil // wipe if --from-config not passed
 	}
+	if user != "" && token != "" {
+		return errors.New("cannot set both --user and --token")
+	}
 	var options []client.SubscribeOption
 	if since != "" {
 		options = append(options, client.WithSince(since))
@@ -112,6 +118,8 @@ func execSubscribe(c *cli.Context) error {
 			fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 20))
 		}
 		options = append(options, client.WithBasicAuth(user, pass))
+	} else if token != "" {
+		options = append(options, client.WithBearerAuth(token))
 	}
 	if poll {
 		options = append(options, client.WithPoll())
@@ -164,6 +172,8 @@ func doSubscribe(c *cli.Context, cl *client.Client, conf *client.Config, topic,
 		}
 		if s.User != "" && s.Password != "" {
 			topicOptions = append(topicOptions, client.WithBasicAuth(s.User, s.Password))
+		} else if s.Token != "" {
+			topicOptions = append(topicOptions, client.WithBearerAuth(s.Token))
 		}
 		subscriptionID := cl.Subscribe(s.Topic, topicOptions...)
 		commands[subscriptionID] = s.Command
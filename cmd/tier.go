@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+)
+
+var flagsTier = userCommandFlags()
+var flagsTierLimits = []cli.Flag{
+	&cli.IntFlag{Name: "request-limit", Usage: "number of requests a user can make at once (burst)"},
+	&cli.DurationFlag{Name: "request-limit-replenish", Usage: "rate at which the request limit is replenished, e.g. 1s"},
+	&cli.IntFlag{Name: "email-limit", Usage: "number of e-mails a user can send at once (burst)"},
+	&cli.DurationFlag{Name: "email-limit-replenish", Usage: "rate at which the e-mail limit is replenished, e.g. 10m"},
+	&cli.IntFlag{Name: "subscription-limit", Usage: "number of subscriptions a user can hold at the same time"},
+	&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size of all attachments of a user, e.g. 1G"},
+	&cli.StringFlag{Name: "attachment-bandwidth-limit", Usage: "daily upload/download bandwidth of attachments, e.g. 5G"},
+	&cli.IntFlag{Name: "reservation-limit", Usage: "number of topics a user can reserve"},
+}
+
+var cmdTier = &cli.Command{
+	Name:      "tier",
+	Usage:     "Manage/show tiers, i.e. rate limits and quotas of users",
+	UsageText: "ntfy tier [list|add|change|remove] ...",
+	Flags:     flagsTier,
+	Before:    initConfigFileInputSource("config", flagsTier),
+	Action:    execTierList,
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new tier",
+			UsageText: "ntfy tier add [--request-limit=..] [--email-limit=..] [...] TIER",
+			Action:    execTierAdd,
+			Flags:     flagsTierLimits,
+			Description: `Add a new tier to the ntfy user database.
+
+A tier overrides the default rate limits and quotas (visitor-* options in the server config),
+as well as the reservation limit (auth-reservation-limit), of the users it is assigned to. Limits
+that are not set, or set to 0, are not overridden. Use 'ntfy user change-tier' to assign the tier
+to users.
+
+Examples:
+  ntfy tier add --request-limit=600 pro               # Add tier pro with a higher request limit
+  ntfy tier add --attachment-total-size-limit=5G \
+    --subscription-limit=100 business                 # Add tier business with more storage and subscriptions
+`,
+		},
+		{
+			Name:      "change",
+			Aliases:   []string{"chg"},
+			Usage:     "Changes the limits of a tier",
+			UsageText: "ntfy tier change [--request-limit=..] [--email-limit=..] [...] TIER",
+			Action:    execTierChange,
+			Flags:     flagsTierLimits,
+			Description: `Change the limits of an existing tier.
+
+Only the limits that are passed are changed; all other limits keep their current value. To
+go back to the default for a limit, set it to 0. The new limits apply to all users of the tier
+with their next request.
+
+Examples:
+  ntfy tier change --request-limit=1000 pro           # Raise the request limit of tier pro
+  ntfy tier change --email-limit=0 pro                # Use the default e-mail limit for tier pro
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a tier",
+			UsageText: "ntfy tier remove TIER",
+			Action:    execTierDel,
+			Description: `Remove a tier from the ntfy user database.
+
+The users of the tier are not removed, but the default limits apply to them again.
+
+Example:
+  ntfy tier del pro
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of tiers",
+			Action:  execTierList,
+			Description: `Shows a list of all tiers and their limits.
+
+This is a server-only command. It directly reads from the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+`,
+		},
+	},
+	Description: `Manage tiers of the ntfy server.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
+to the related command 'ntfy user'.
+
+Authenticated users are rate limited per user, whereas anonymous users are rate limited per
+IP address. By default, the same limits apply to both (see visitor-* options in the server config).
+A tier overrides these limits for the users it is assigned to, e.g. to allow more requests,
+e-mails, subscriptions or attachment storage. To give a single user custom limits, create a
+tier just for that user.
+
+Examples:
+  ntfy tier list                                      # Shows list of tiers and their limits
+  ntfy tier add --request-limit=600 pro               # Add tier pro with a higher request limit
+  ntfy tier change --subscription-limit=100 pro       # Change the subscription limit of tier pro
+  ntfy tier del pro                                   # Delete tier pro
+  ntfy user change-tier phil pro                      # Assign tier pro to user phil
+`,
+}
+
+func execTierAdd(c *cli.Context) error {
+	code := c.Args().Get(0)
+	if code == "" {
+		return errors.New("tier code expected, type 'ntfy tier add --help' for help")
+	} else if !auth.AllowedTierCode(code) {
+		return errors.New("tier code not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if tier, _ := manager.Tier(code); tier != nil {
+		return fmt.Errorf("tier %s already exists", code)
+	}
+	tier := &auth.Tier{Code: code}
+	if err := readTierLimits(c, tier); err != nil {
+		return err
+	}
+	if err := manager.AddTier(tier); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "tier %s added\n\n", code)
+	showTiers(c, []*auth.Tier{tier})
+	return nil
+}
+
+func execTierChange(c *cli.Context) error {
+	code := c.Args().Get(0)
+	if code == "" {
+		return errors.New("tier code expected, type 'ntfy tier change --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	tier, err := manager.Tier(code)
+	if err == auth.ErrNotFound {
+		return fmt.Errorf("tier %s does not exist", code)
+	} else if err != nil {
+		return err
+	}
+	if err := readTierLimits(c, tier); err != nil {
+		return err
+	}
+	if err := manager.ChangeTier(tier); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "tier %s changed\n\n", code)
+	showTiers(c, []*auth.Tier{tier})
+	return nil
+}
+
+func execTierDel(c *cli.Context) error {
+	code := c.Args().Get(0)
+	if code == "" {
+		return errors.New("tier code expected, type 'ntfy tier del --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.Tier(code); err == auth.ErrNotFound {
+		return fmt.Errorf("tier %s does not exist", code)
+	}
+	if err := manager.RemoveTier(code); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "tier %s removed\n", code)
+	return nil
+}
+
+func execTierList(c *cli.Context) error {
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	tiers, err := manager.Tiers()
+	if err != nil {
+		return err
+	}
+	if len(tiers) == 0 {
+		fmt.Fprintln(c.App.ErrWriter, "no tiers")
+		return nil
+	}
+	showTiers(c, tiers)
+	return nil
+}
+
+// readTierLimits sets the limits of the tier from the flags, but only those that were passed
+func readTierLimits(c *cli.Context, tier *auth.Tier) error {
+	if c.IsSet("request-limit") {
+		tier.RequestLimit = c.Int("request-limit")
+	}
+	if c.IsSet("request-limit-replenish") {
+		tier.RequestLimitReplenish = c.Duration("request-limit-replenish")
+	}
+	if c.IsSet("email-limit") {
+		tier.EmailLimit = c.Int("email-limit")
+	}
+	if c.IsSet("email-limit-replenish") {
+		tier.EmailLimitReplenish = c.Duration("email-limit-replenish")
+	}
+	if c.IsSet("subscription-limit") {
+		tier.SubscriptionLimit = c.Int("subscription-limit")
+	}
+	if c.IsSet("attachment-total-size-limit") {
+		size, err := util.ParseSize(c.String("attachment-total-size-limit"))
+		if err != nil {
+			return err
+		}
+		tier.AttachmentTotalSizeLimit = size
+	}
+	if c.IsSet("attachment-bandwidth-limit") {
+		size, err := util.ParseSize(c.String("attachment-bandwidth-limit"))
+		if err != nil {
+			return err
+		}
+		tier.AttachmentBandwidthLimit = size
+	}
+	if c.IsSet("reservation-limit") {
+		tier.ReservationLimit = c.Int("reservation-limit")
+	}
+	if !auth.AllowedTier(tier) {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+func showTiers(c *cli.Context, tiers []*auth.Tier) {
+	for _, tier := range tiers {
+		limits := make([]string, 0)
+		if tier.RequestLimit > 0 {
+			limits = append(limits, fmt.Sprintf("request limit %d", tier.RequestLimit))
+		}
+		if tier.RequestLimitReplenish > 0 {
+			limits = append(limits, fmt.Sprintf("request limit replenished every %s", tier.RequestLimitReplenish))
+		}
+		if tier.EmailLimit > 0 {
+			limits = append(limits, fmt.Sprintf("e-mail limit %d", tier.EmailLimit))
+		}
+		if tier.EmailLimitReplenish > 0 {
+			limits = append(limits, fmt.Sprintf("e-mail limit replenished every %s", tier.EmailLimitReplenish))
+		}
+		if tier.SubscriptionLimit > 0 {
+			limits = append(limits, fmt.Sprintf("subscription limit %d", tier.SubscriptionLimit))
+		}
+		if tier.AttachmentTotalSizeLimit > 0 {
+			limits = append(limits, fmt.Sprintf("attachment total size limit %s", formatSize(tier.AttachmentTotalSizeLimit)))
+		}
+		if tier.AttachmentBandwidthLimit > 0 {
+			limits = append(limits, fmt.Sprintf("attachment bandwidth limit %s per day", formatSize(tier.AttachmentBandwidthLimit)))
+		}
+		if tier.ReservationLimit > 0 {
+			limits = append(limits, fmt.Sprintf("reservation limit %d", tier.ReservationLimit))
+		}
+		fmt.Fprintf(c.App.ErrWriter, "tier %s\n", tier.Code)
+		if len(limits) == 0 {
+			fmt.Fprintln(c.App.ErrWriter, "- default limits (server config)")
+			continue
+		}
+		for _, limit := range limits {
+			fmt.Fprintf(c.App.ErrWriter, "- %s\n", limit)
+		}
+		fmt.Fprintln(c.App.ErrWriter, "- default for all other limits (server config)")
+	}
+}
+
+// formatSize formats a size in bytes, using the largest unit that does not lose precision, see util.ParseSize
+func formatSize(b int64) string {
+	units := []string{"G", "M", "K"}
+	for i, unit := range units {
+		factor := int64(1) << (10 * (len(units) - i))
+		if b >= factor && b%factor == 0 {
+			return fmt.Sprintf("%d%s", b/factor, unit)
+		}
+	}
+	return fmt.Sprintf("%d bytes", b)
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"testing"
+)
+
+func TestCLI_Tier_AddChangeRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("philpass\nphilpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "list"))
+	require.Equal(t, "no tiers\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "add", "--request-limit=600", "--attachment-total-size-limit=5G", "pro"))
+	require.Equal(t, "tier pro added\n\ntier pro\n- request limit 600\n- attachment total size limit 5G\n- default for all other limits (server config)\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	err := runTierCommand(app, conf, "add", "pro")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tier pro already exists")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "change", "--request-limit=0", "--email-limit-replenish=10m", "pro"))
+	require.Equal(t, "tier pro changed\n\ntier pro\n- e-mail limit replenished every 10m0s\n- attachment total size limit 5G\n- default for all other limits (server config)\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-tier", "phil", "pro"))
+	require.Contains(t, stderr.String(), "changed tier for user phil to pro")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "user phil (user, tier pro)\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-tier", "--reset", "phil"))
+	require.Contains(t, stderr.String(), "removed tier from user phil")
+
+	app, _, _, _ = newTestApp()
+	err = runUserCommand(app, conf, "change-tier", "phil", "business")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tier business does not exist")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "del", "pro"))
+	require.Contains(t, stderr.String(), "tier pro removed")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "list"))
+	require.Equal(t, "no tiers\n", stderr.String())
+}
+
+func TestCLI_Tier_Invalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	require.Error(t, runTierCommand(app, conf, "add", "not valid"))
+	app, _, _, _ = newTestApp()
+	require.Error(t, runTierCommand(app, conf, "add", "--subscription-limit=-1", "pro"))
+	app, _, _, _ = newTestApp()
+	require.Error(t, runTierCommand(app, conf, "add", "--attachment-bandwidth-limit=lots", "pro"))
+	app, _, _, _ = newTestApp()
+	require.Error(t, runTierCommand(app, conf, "change", "--request-limit=10", "pro"))
+}
+
+func runTierCommand(app *cli.App, conf *server.Config, args ...string) error {
+	tierArgs := []string{
+		"ntfy",
+		"tier",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(tierArgs, args...))
+}
@@ -0,0 +1,259 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"strings"
+	"time"
+)
+
+var flagsToken = userCommandFlags()
+var cmdToken = &cli.Command{
+	Name:      "token",
+	Usage:     "Create, list or delete user tokens",
+	UsageText: "ntfy token [list|add|remove] ...",
+	Flags:     flagsToken,
+	Before:    initConfigFileInputSource("config", flagsToken),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Create a new token",
+			UsageText: "ntfy token add [--label=..] [--expires=..] [--scope=..] USERNAME",
+			Action:    execTokenAdd,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "label", Aliases: []string{"l"}, Usage: "token label"},
+				&cli.StringFlag{Name: "expires", Aliases: []string{"e"}, Usage: "token expires after"},
+				&cli.StringSliceFlag{Name: "scope", Aliases: []string{"s"}, Usage: "restrict token to topic pattern and permission (TOPIC[:PERMISSION])"},
+			},
+			Description: `Create a new access token for a user.
+
+An access token can be used instead of the user's password to publish or subscribe, by passing it
+in the Authorization header ("Authorization: Bearer tk_..."), or via the --token option of the
+'ntfy publish' and 'ntfy subscribe' commands.
+
+Tokens can have a label, and an optional expiry date. The expiry date can be a duration (e.g. 30d),
+a natural language date (e.g. "tomorrow"), or a Unix timestamp. If not set, tokens never expire.
+
+Tokens can be restricted to specific topics and permissions with one or more --scope options, each
+in the form TOPIC[:PERMISSION]. TOPIC may include wildcards (*), and PERMISSION is read-write (default),
+read-only or write-only (or the aliases rw, ro/read, wo/write). A scoped token can only access topics
+that match one of its scopes, and only if the user itself has access to them.
+
+Examples:
+  ntfy token add phil                      # Create token for user phil which never expires
+  ntfy token add --expires=30d phil        # Create token for user phil which expires in 30 days
+  ntfy token add -l "backups" phil         # Create token for user phil with label "backups"
+  ntfy token add -s "backup-*:wo" phil     # Create token which can only write to topics "backup-..."
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a token",
+			UsageText: "ntfy token remove USERNAME TOKEN",
+			Action:    execTokenDel,
+			Description: `Remove a token from the ntfy user database.
+
+Example:
+  ntfy token del phil tk_th2srHVlxrANQHAso5t0HuQ1J1TjN
+`,
+		},
+		{
+			Name:      "list",
+			Aliases:   []string{"l"},
+			Usage:     "Shows a list of tokens",
+			UsageText: "ntfy token list [USERNAME]",
+			Action:    execTokenList,
+			Description: `Shows a list of all tokens.
+
+This is a server-only command. It directly reads from the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy token list                          # Shows list of tokens for all users
+  ntfy token list phil                     # Shows list of tokens for user phil
+`,
+		},
+	},
+	Description: `Manage access tokens for individual users.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
+to the related command 'ntfy user'.
+
+Access tokens can be used instead of passwords to publish or subscribe to topics. They are passed
+via the Authorization header ("Authorization: Bearer tk_..."), or via the ?auth=... query parameter.
+
+Examples:
+  ntfy token list                          # Shows list of tokens for all users
+  ntfy token list phil                     # Shows list of tokens for user phil
+  ntfy token add phil                      # Create token for user phil which never expires
+  ntfy token add --expires=2d phil         # Create token for user phil which expires in 2 days
+  ntfy token remove phil tk_th2srHVlxr...  # Delete token
+`,
+}
+
+func execTokenAdd(c *cli.Context) error {
+	username := c.Args().Get(0)
+	label := c.String("label")
+	expiresStr := c.String("expires")
+	scopes, err := parseTokenScopes(c.StringSlice("scope"))
+	if err != nil {
+		return err
+	}
+	if username == "" {
+		return errors.New("username expected, type 'ntfy token add --help' for help")
+	} else if username == userEveryone || username == auth.Everyone {
+		return errors.New("username not allowed")
+	}
+	expires := time.Time{}
+	if expiresStr != "" {
+		expires, err = util.ParseFutureTime(expiresStr, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	token, err := manager.CreateToken(username, label, expires, scopes)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "token %s created for user %s, %s\n", token.Value, username, formatTokenExpiry(token))
+	printTokenScopes(c, token)
+	return nil
+}
+
+func execTokenDel(c *cli.Context) error {
+	username, token := c.Args().Get(0), c.Args().Get(1)
+	if username == "" || token == "" {
+		return errors.New("username and token expected, type 'ntfy token remove --help' for help")
+	} else if username == userEveryone || username == auth.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.RemoveToken(username, token); err == auth.ErrNotFound {
+		return fmt.Errorf("token %s for user %s does not exist", token, username)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "token %s for user %s removed\n", token, username)
+	return nil
+}
+
+func execTokenList(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == userEveryone || username == auth.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	var users []*auth.User
+	if username != "" {
+		u, err := manager.User(username)
+		if err == auth.ErrNotFound {
+			return fmt.Errorf("user %s does not exist", username)
+		} else if err != nil {
+			return err
+		}
+		users = append(users, u)
+	} else {
+		users, err = manager.Users()
+		if err != nil {
+			return err
+		}
+	}
+	usersWithTokens := 0
+	for _, u := range users {
+		if u.Name == auth.Everyone {
+			continue
+		}
+		tokens, err := manager.Tokens(u.Name)
+		if err != nil {
+			return err
+		} else if len(tokens) == 0 && username != "" {
+			fmt.Fprintf(c.App.ErrWriter, "user %s has no access tokens\n", username)
+			return nil
+		} else if len(tokens) == 0 {
+			continue
+		}
+		usersWithTokens++
+		fmt.Fprintf(c.App.ErrWriter, "user %s\n", u.Name)
+		for _, t := range tokens {
+			var label string
+			if t.Label != "" {
+				label = fmt.Sprintf(" (%s)", t.Label)
+			}
+			lastAccess := "never used"
+			if !t.LastAccess.IsZero() {
+				lastAccess = fmt.Sprintf("last access %s", t.LastAccess.Format(time.UnixDate))
+			}
+			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, %s\n", t.Value, label, formatTokenExpiry(t), lastAccess)
+			printTokenScopes(c, t)
+		}
+	}
+	if usersWithTokens == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "no users with tokens\n")
+	}
+	return nil
+}
+
+func formatTokenExpiry(t *auth.Token) string {
+	if t.Expires.IsZero() {
+		return "never expires"
+	}
+	return fmt.Sprintf("expires %s", t.Expires.Format(time.UnixDate))
+}
+
+func printTokenScopes(c *cli.Context, t *auth.Token) {
+	for _, scope := range t.Scopes {
+		if scope.AllowRead && scope.AllowWrite {
+			fmt.Fprintf(c.App.ErrWriter, "  - scope: read-write access to topic %s\n", scope.TopicPattern)
+		} else if scope.AllowRead {
+			fmt.Fprintf(c.App.ErrWriter, "  - scope: read-only access to topic %s\n", scope.TopicPattern)
+		} else if scope.AllowWrite {
+			fmt.Fprintf(c.App.ErrWriter, "  - scope: write-only access to topic %s\n", scope.TopicPattern)
+		}
+	}
+}
+
+func parseTokenScopes(scopes []string) ([]auth.Grant, error) {
+	grants := make([]auth.Grant, 0)
+	for _, scope := range scopes {
+		topic, perms := scope, "read-write"
+		if i := strings.LastIndex(scope, ":"); i >= 0 {
+			topic, perms = scope[:i], scope[i+1:]
+		}
+		read, write, err := parsePermission(perms)
+		if err != nil {
+			return nil, err
+		} else if !read && !write {
+			return nil, fmt.Errorf("scope %s does not allow any access", scope)
+		} else if !auth.AllowedTopicPattern(topic) {
+			return nil, fmt.Errorf("invalid topic pattern %s in scope %s", topic, scope)
+		}
+		grants = append(grants, auth.Grant{
+			TopicPattern: topic,
+			AllowRead:    read,
+			AllowWrite:   write,
+		})
+	}
+	return grants, nil
+}
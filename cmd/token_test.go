@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"regexp"
+	"testing"
+)
+
+func TestCLI_Token_AddListRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Contains(t, stderr.String(), "user phil added with role user")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--label=backups", "phil"))
+	require.Regexp(t, `token tk_[a-z0-9]{29} created for user phil, never expires`, stderr.String())
+	token := regexp.MustCompile(`tk_[a-z0-9]{29}`).FindString(stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "user phil\n- "+token+" (backups), never expires, never used")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "remove", "phil", token))
+	require.Contains(t, stderr.String(), "token "+token+" for user phil removed")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Contains(t, stderr.String(), "user phil has no access tokens")
+}
+
+func TestCLI_Token_Add_Expires(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--expires=2d", "phil"))
+	require.Regexp(t, `token tk_[a-z0-9]{29} created for user phil, expires `, stderr.String())
+}
+
+func TestCLI_Token_Add_Scoped(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--scope=backup-*:wo", "--scope=alerts", "phil"))
+	require.Contains(t, stderr.String(), "  - scope: write-only access to topic backup-*\n")
+	require.Contains(t, stderr.String(), "  - scope: read-write access to topic alerts\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Contains(t, stderr.String(), "  - scope: read-write access to topic alerts\n  - scope: write-only access to topic backup-*\n")
+}
+
+func TestCLI_Token_Add_Scoped_Invalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	err := runTokenCommand(app, conf, "add", "--scope=backup-*:deny", "phil")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "scope backup-*:deny does not allow any access")
+
+	app, _, _, _ = newTestApp()
+	err = runTokenCommand(app, conf, "add", "--scope=backup-*:xx", "phil")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission must be one of")
+}
+
+func TestCLI_Token_Add_UserNotFound(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	err := runTokenCommand(app, conf, "add", "phil")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user phil does not exist")
+}
+
+func TestCLI_Token_Remove_NotFound(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, _ = newTestApp()
+	err := runTokenCommand(app, conf, "remove", "phil", "tk_doesnotexist")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "token tk_doesnotexist for user phil does not exist")
+}
+
+func TestCLI_Token_PublishSubscribe(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+	topic := fmt.Sprintf("http://127.0.0.1:%d/mytopic", port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "--role=admin", "phil"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "phil"))
+	token := regexp.MustCompile(`tk_[a-z0-9]{29}`).FindString(stderr.String())
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", topic, "some message"}))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--token=" + token, topic, "some message"}))
+	require.Equal(t, "some message", toMessage(t, stdout.String()).Message)
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "subscribe", "--poll", "--token=" + token, topic}))
+	require.Equal(t, "some message", toMessage(t, stdout.String()).Message)
+
+	app, _, _, _ = newTestApp()
+	err := app.Run([]string{"ntfy", "publish", "--token=" + token, "--user=phil:mypass", topic, "some message"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot set both --user and --token")
+}
+
+func runTokenCommand(app *cli.App, conf *server.Config, args ...string) error {
+	tokenArgs := []string{
+		"ntfy",
+		"token",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(tokenArgs, args...))
+}
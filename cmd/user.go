@@ -15,7 +15,7 @@ var flagsUser = userCommandFlags()
 var cmdUser = &cli.Command{
 	Name:      "user",
 	Usage:     "Manage/show users",
-	UsageText: "ntfy user [list|add|remove|change-pass|change-role] ...",
+	UsageText: "ntfy user [list|add|remove|change-pass|change-role|change-tier|unlock] ...",
 	Flags:     flagsUser,
 	Before:    initConfigFileInputSource("config", flagsUser),
 	Category:  categoryServer,
@@ -87,6 +87,44 @@ user are removed, since they are no longer necessary.
 Example:
   ntfy user change-role phil admin   # Make user phil an admin 
   ntfy user change-role phil user    # Remove admin role from user phil 
+`,
+		},
+		{
+			Name:      "change-tier",
+			Aliases:   []string{"cht"},
+			Usage:     "Changes the tier of a user",
+			UsageText: "ntfy user change-tier [--reset] USERNAME [TIER]",
+			Action:    execUserChangeTier,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "reset", Aliases: []string{"r"}, Usage: "remove the user's tier"},
+			},
+			Description: `Change the tier of the given user, or remove the user's tier.
+
+A tier overrides the default rate limits and quotas for its users (see 'ntfy tier'). Users without
+a tier are rate limited with the defaults from the server config. Authenticated users are always 
+rate limited per user, and not per IP address.
+
+Examples:
+  ntfy user change-tier phil pro     # Assign tier pro to user phil
+  ntfy user change-tier --reset phil # Use the default limits for user phil
+`,
+		},
+		{
+			Name:      "unlock",
+			Usage:     "Unlocks a user that was locked out due to too many failed logins",
+			UsageText: "ntfy user unlock USERNAME",
+			Action:    execUserUnlock,
+			Description: `Unlock a user that was locked out due to too many failed logins.
+
+After 5 consecutive failed logins, a user is temporarily locked out. The lockout starts 
+at one minute, and doubles with every further failed login (up to 24 hours). This command 
+lifts the lockout and resets the failed login counter.
+
+Note that IP addresses with too many failed logins are also locked out. These lockouts
+are only kept in memory, and are lifted when the server is restarted.
+
+Example:
+  ntfy user unlock phil              # Unlock user phil
 `,
 		},
 		{
@@ -119,6 +157,8 @@ Examples:
   ntfy user del phil                 # Delete user phil
   ntfy user change-pass phil         # Change password for user phil
   ntfy user change-role phil admin   # Make user phil an admin 
+  ntfy user change-tier phil pro     # Assign tier pro to user phil (see 'ntfy tier')
+  ntfy user unlock phil              # Unlock user phil after too many failed logins
 `,
 }
 
@@ -218,6 +258,56 @@ func execUserChangeRole(c *cli.Context) error {
 	return nil
 }
 
+func execUserChangeTier(c *cli.Context) error {
+	username, code := c.Args().Get(0), c.Args().Get(1)
+	if username == "" || (code == "" && !c.Bool("reset")) || (code != "" && c.Bool("reset")) {
+		return errors.New("username and tier (or --reset) expected, type 'ntfy user change-tier --help' for help")
+	} else if username == userEveryone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if code != "" {
+		if _, err := manager.Tier(code); err == auth.ErrNotFound {
+			return fmt.Errorf("tier %s does not exist", code)
+		}
+	}
+	if err := manager.ChangeUserTier(username, code); err != nil {
+		return err
+	}
+	if code == "" {
+		fmt.Fprintf(c.App.ErrWriter, "removed tier from user %s\n", username)
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "changed tier for user %s to %s\n", username, code)
+	}
+	return nil
+}
+
+func execUserUnlock(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user unlock --help' for help")
+	} else if username == userEveryone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.UnlockUser(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "unlocked user %s\n", username)
+	return nil
+}
+
 func execUserList(c *cli.Context) error {
 	manager, err := createAuthManager(c)
 	if err != nil {
@@ -3,6 +3,7 @@ package cmd
 import (
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/server"
 	"heckel.io/ntfy/test"
 	"path/filepath"
@@ -89,6 +90,38 @@ func TestCLI_User_ChangeRole(t *testing.T) {
 	require.Contains(t, stderr.String(), "changed role for user phil to admin")
 }
 
+func TestCLI_User_Unlock(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	// Add user, and lock it out
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	a, err := auth.NewSQLiteAuth(conf.AuthFile, false, false)
+	require.Nil(t, err)
+	for i := 0; i < auth.LockoutThreshold; i++ {
+		_, err := a.Authenticate("phil", "wrong")
+		require.Equal(t, auth.ErrUnauthenticated, err)
+	}
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "user phil (user, locked until ")
+
+	// Unlock user
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "unlock", "phil"))
+	require.Contains(t, stderr.String(), "unlocked user phil")
+	_, err = a.Authenticate("phil", "mypass")
+	require.Nil(t, err)
+
+	// Unlock user that does not exist
+	app, _, _, _ = newTestApp()
+	err = runUserCommand(app, conf, "unlock", "ben")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user ben does not exist")
+}
+
 func TestCLI_User_Delete(t *testing.T) {
 	s, conf, port := newTestServerWithAuth(t)
 	defer test.StopServer(t, s, port)
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"heckel.io/ntfy/auth"
+	"net"
 	"time"
 )
 
@@ -8,20 +10,39 @@ import (
 const (
 	DefaultListenHTTP                = ":80"
 	DefaultCacheDuration             = 12 * time.Hour
+	DefaultIdempotencyKeyDuration    = 24 * time.Hour
 	DefaultKeepaliveInterval         = 45 * time.Second // Not too frequently to save battery (Android read timeout used to be 77s!)
 	DefaultManagerInterval           = time.Minute
 	DefaultAtSenderInterval          = 10 * time.Second
 	DefaultMinDelay                  = 10 * time.Second
 	DefaultMaxDelay                  = 3 * 24 * time.Hour
 	DefaultFirebaseKeepaliveInterval = 3 * time.Hour // Not too frequently to save battery
+	DefaultAuthJWTUsernameClaim      = "sub"
+	DefaultAuthJWTGroupsClaim        = "groups"
+	DefaultAuthLDAPGroupMemberAttr   = "member"
+	DefaultAuthLDAPGroupNameAttr     = "cn"
+	DefaultAuthLDAPCacheDuration     = 5 * time.Minute
+	DefaultAuthClientCertUsername    = ClientCertUsernameCN
+	DefaultAuthAuditDuration         = time.Duration(0) // Logins and publishes are not recorded by default
+	DefaultAuthAuditChangesDuration  = 90 * 24 * time.Hour
+	DefaultAuthReservationLimit      = 0
+)
+
+// Client certificate fields that can be used as username, see Config.AuthClientCertUsername
+const (
+	ClientCertUsernameCN       = "cn"        // Subject common name
+	ClientCertUsernameSANDNS   = "san-dns"   // DNS names of the subject alternative name extension
+	ClientCertUsernameSANEmail = "san-email" // E-mail addresses of the subject alternative name extension
 )
 
 // Defines all global and per-visitor limits
 // - message size limit: the max number of bytes for a message
+// - publish batch limit: the max number of messages in a single batch publish request
 // - total topic limit: max number of topics overall
 // - various attachment limits
 const (
 	DefaultMessageLengthLimit       = 4096 // Bytes
+	DefaultPublishBatchLimit        = 500
 	DefaultTotalTopicLimit          = 15000
 	DefaultAttachmentTotalSizeLimit = int64(5 * 1024 * 1024 * 1024) // 5 GB
 	DefaultAttachmentFileSizeLimit  = int64(15 * 1024 * 1024)       // 15 MB
@@ -54,10 +75,34 @@ type Config struct {
 	CertFile                             string
 	FirebaseKeyFile                      string
 	CacheFile                            string
+	CacheDatabaseURL                     string
 	CacheDuration                        time.Duration
+	IdempotencyKeyDuration               time.Duration
 	AuthFile                             string
 	AuthDefaultRead                      bool
 	AuthDefaultWrite                     bool
+	AuthProxyHeader                      string
+	AuthProxyTrustedNets                 []*net.IPNet
+	AuthProxyAutoProvision               bool
+	AuthJWTJWKS                          string
+	AuthJWTIssuer                        string
+	AuthJWTAudience                      string
+	AuthJWTUsernameClaim                 string
+	AuthJWTGroupsClaim                   string
+	AuthLDAPURL                          string
+	AuthLDAPUserDN                       string
+	AuthLDAPGroupBaseDN                  string
+	AuthLDAPGroupMemberAttr              string
+	AuthLDAPGroupNameAttr                string
+	AuthLDAPCacheDuration                time.Duration
+	AuthLDAPLocalFallback                bool
+	AuthClientCAFile                     string
+	AuthClientCertUsername               string
+	AuthClientCertMapping                map[string]string
+	AuthAuditDuration                    time.Duration
+	AuthAuditChangesDuration             time.Duration
+	AuthReservationLimit                 int
+	AuthProvisioning                     *auth.Provisioning
 	AttachmentCacheDir                   string
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
@@ -75,6 +120,7 @@ type Config struct {
 	SMTPServerDomain                     string
 	SMTPServerAddrPrefix                 string
 	MessageLimit                         int
+	PublishBatchLimit                    int
 	MinDelay                             time.Duration
 	MaxDelay                             time.Duration
 	TotalTopicLimit                      int
@@ -101,10 +147,34 @@ func NewConfig() *Config {
 		CertFile:                             "",
 		FirebaseKeyFile:                      "",
 		CacheFile:                            "",
+		CacheDatabaseURL:                     "",
 		CacheDuration:                        DefaultCacheDuration,
+		IdempotencyKeyDuration:               DefaultIdempotencyKeyDuration,
 		AuthFile:                             "",
 		AuthDefaultRead:                      true,
 		AuthDefaultWrite:                     true,
+		AuthProxyHeader:                      "",
+		AuthProxyTrustedNets:                 make([]*net.IPNet, 0),
+		AuthProxyAutoProvision:               false,
+		AuthJWTJWKS:                          "",
+		AuthJWTIssuer:                        "",
+		AuthJWTAudience:                      "",
+		AuthJWTUsernameClaim:                 DefaultAuthJWTUsernameClaim,
+		AuthJWTGroupsClaim:                   DefaultAuthJWTGroupsClaim,
+		AuthLDAPURL:                          "",
+		AuthLDAPUserDN:                       "",
+		AuthLDAPGroupBaseDN:                  "",
+		AuthLDAPGroupMemberAttr:              DefaultAuthLDAPGroupMemberAttr,
+		AuthLDAPGroupNameAttr:                DefaultAuthLDAPGroupNameAttr,
+		AuthLDAPCacheDuration:                DefaultAuthLDAPCacheDuration,
+		AuthLDAPLocalFallback:                false,
+		AuthClientCAFile:                     "",
+		AuthClientCertUsername:               DefaultAuthClientCertUsername,
+		AuthClientCertMapping:                make(map[string]string),
+		AuthAuditDuration:                    DefaultAuthAuditDuration,
+		AuthAuditChangesDuration:             DefaultAuthAuditChangesDuration,
+		AuthReservationLimit:                 DefaultAuthReservationLimit,
+		AuthProvisioning:                     nil,
 		AttachmentCacheDir:                   "",
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
@@ -112,6 +182,7 @@ func NewConfig() *Config {
 		KeepaliveInterval:                    DefaultKeepaliveInterval,
 		ManagerInterval:                      DefaultManagerInterval,
 		MessageLimit:                         DefaultMessageLengthLimit,
+		PublishBatchLimit:                    DefaultPublishBatchLimit,
 		MinDelay:                             DefaultMinDelay,
 		MaxDelay:                             DefaultMaxDelay,
 		AtSenderInterval:                     DefaultAtSenderInterval,
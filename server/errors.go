@@ -50,15 +50,38 @@ var (
 	errHTTPBadRequestWebSocketsUpgradeHeaderMissing  = &errHTTP{40016, http.StatusBadRequest, "invalid request: client not using the websocket protocol", "https://ntfy.sh/docs/subscribe/api/#websockets"}
 	errHTTPBadRequestJSONInvalid                     = &errHTTP{40017, http.StatusBadRequest, "invalid request: request body must be message JSON", "https://ntfy.sh/docs/publish/#publish-as-json"}
 	errHTTPBadRequestActionsInvalid                  = &errHTTP{40018, http.StatusBadRequest, "invalid request: actions invalid", "https://ntfy.sh/docs/publish/#action-buttons"}
+	errHTTPBadRequestIdempotencyKeyInvalid           = &errHTTP{40019, http.StatusBadRequest, "invalid request: idempotency key invalid", "https://ntfy.sh/docs/publish/#idempotent-publishing"}
+	errHTTPBadRequestIconURLInvalid                  = &errHTTP{40020, http.StatusBadRequest, "invalid request: icon URL is invalid", "https://ntfy.sh/docs/publish/#icons"}
+	errHTTPBadRequestUserInvalid                     = &errHTTP{40021, http.StatusBadRequest, "invalid request: username, password or role invalid", "https://ntfy.sh/docs/config/#admin-api"}
+	errHTTPBadRequestAccessInvalid                   = &errHTTP{40022, http.StatusBadRequest, "invalid request: username, topic pattern or capabilities invalid", "https://ntfy.sh/docs/config/#admin-api"}
+	errHTTPBadRequestAccountInvalid                  = &errHTTP{40023, http.StatusBadRequest, "invalid request: password, expiry or scopes invalid", "https://ntfy.sh/docs/config/#account-api"}
+	errHTTPBadRequestPasswordIncorrect               = &errHTTP{40024, http.StatusBadRequest, "invalid request: current password is incorrect", "https://ntfy.sh/docs/config/#account-api"}
+	errHTTPBadRequestReservationInvalid              = &errHTTP{40025, http.StatusBadRequest, "invalid request: topic invalid or not allowed", "https://ntfy.sh/docs/config/#reservations"}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", ""}
+	errHTTPNotFoundUser                              = &errHTTP{40402, http.StatusNotFound, "user not found", "https://ntfy.sh/docs/config/#admin-api"}
+	errHTTPNotFoundToken                             = &errHTTP{40403, http.StatusNotFound, "token not found", "https://ntfy.sh/docs/config/#account-api"}
+	errHTTPNotFoundReservation                       = &errHTTP{40404, http.StatusNotFound, "reservation not found", "https://ntfy.sh/docs/config/#reservations"}
+	errHTTPNotFoundMessage                           = &errHTTP{40405, http.StatusNotFound, "message not found", "https://ntfy.sh/docs/publish/#deleting-messages"}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication"}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication"}
+	errHTTPForbiddenAttachments                      = &errHTTP{40302, http.StatusForbidden, "forbidden: attachments not allowed for this topic", "https://ntfy.sh/docs/config/#capabilities"}
+	errHTTPForbiddenEmail                            = &errHTTP{40303, http.StatusForbidden, "forbidden: e-mail notifications not allowed for this topic", "https://ntfy.sh/docs/config/#capabilities"}
+	errHTTPForbiddenMaxPriority                      = &errHTTP{40304, http.StatusForbidden, "forbidden: max priority not allowed for this topic", "https://ntfy.sh/docs/config/#capabilities"}
+	errHTTPForbiddenDelay                            = &errHTTP{40305, http.StatusForbidden, "forbidden: delayed messages not allowed for this topic", "https://ntfy.sh/docs/config/#capabilities"}
+	errHTTPForbiddenDelete                           = &errHTTP{40306, http.StatusForbidden, "forbidden: deleting messages not allowed for this topic", "https://ntfy.sh/docs/config/#capabilities"}
+	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "https://ntfy.sh/docs/config/#admin-api"}
+	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: topic is reserved by another user", "https://ntfy.sh/docs/config/#reservations"}
+	errHTTPConflictIdempotencyKeyInProgress          = &errHTTP{40903, http.StatusConflict, "conflict: a request with this idempotency key is still in progress", "https://ntfy.sh/docs/publish/#idempotent-publishing"}
+	errHTTPConflictTopicInUse                        = &errHTTP{40904, http.StatusConflict, "conflict: topic has access control entries of other users", "https://ntfy.sh/docs/config/#reservations"}
 	errHTTPEntityTooLargeAttachmentTooLarge          = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPEntityTooLargeBatchTooLarge               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "batch too large: too many messages, or request body too large", "https://ntfy.sh/docs/publish/#batch-publishing"}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitTotalTopics           = &errHTTP{42904, http.StatusTooManyRequests, "limit reached: the total number of topics on the server has been reached, please contact the admin", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsAttachmentBandwidthLimit   = &errHTTP{42905, http.StatusTooManyRequests, "too many requests: daily bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPTooManyRequestsLimitLogins                = &errHTTP{42906, http.StatusTooManyRequests, "limit reached: too many failed logins, please try again later", "https://ntfy.sh/docs/config/#brute-force-protection"}
+	errHTTPTooManyRequestsLimitReservations          = &errHTTP{42907, http.StatusTooManyRequests, "limit reached: too many topic reservations", "https://ntfy.sh/docs/config/#reservations"}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", ""}
 	errHTTPInternalErrorInvalidFilePath              = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid file path", ""}
 )
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	gmutil "github.com/yuin/goldmark/util"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	contentTypeMarkdown       = "text/markdown"
+	markdownSanitizeMaxPasses = 10
+	markdownEscapeChar        = "\\"
+)
+
+var (
+	markdownSafeSchemes     = []string{"http", "https", "mailto", "tel"}
+	markdownSchemeRegex     = regexp.MustCompile(`^([a-zA-Z][-+.a-zA-Z0-9]*):`)
+	markdownIgnoredURLRegex = regexp.MustCompile(`[\x00-\x20\x7f]`) // Browsers ignore whitespace and control characters in URLs
+	markdownFallbackEscaper = strings.NewReplacer("<", "\\<", "[", "\\[")
+)
+
+// renderMarkdown renders the given Markdown text to HTML. The renderer runs in goldmark's default (safe)
+// mode, meaning that raw HTML is omitted, and links with potentially dangerous URLs are not rendered.
+func renderMarkdown(s string) (string, error) {
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(s), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sanitizeMarkdown escapes all constructs in the given Markdown text that may be unsafe to render in a client,
+// so that clients can render Markdown messages without having to sanitize them themselves. Raw HTML (inline and
+// blocks) is escaped so that it is shown as text, e.g. "<b>" becomes "\<b>". Links, images and autolinks with a URL
+// scheme other than http, https, mailto and tel are escaped as well, e.g. "[x](javascript:...)" becomes "\[x](...)".
+//
+// Escaping a construct may reveal new constructs (e.g. the content of an escaped HTML block may contain inline
+// HTML), so the text is sanitized until nothing changes anymore. If that does not happen in a few passes, or if
+// the position of an unsafe construct cannot be determined, all "<" and "[" characters are escaped.
+func sanitizeMarkdown(s string) string {
+	source := []byte(s)
+	for i := 0; i < markdownSanitizeMaxPasses; i++ {
+		positions, ok := markdownUnsafePositions(source)
+		if !ok {
+			return markdownFallbackEscaper.Replace(s)
+		} else if len(positions) == 0 {
+			return string(source)
+		}
+		source = insertMarkdownEscapes(source, positions)
+	}
+	return markdownFallbackEscaper.Replace(s)
+}
+
+// markdownUnsafePositions parses the given Markdown source and returns the byte positions at which a backslash
+// must be inserted to neutralize unsafe constructs. If a position cannot be determined, ok is false.
+func markdownUnsafePositions(source []byte) (positions []int, ok bool) {
+	doc := goldmark.DefaultParser().Parse(text.NewReader(source))
+	positions = make([]int, 0)
+	ok = true
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := n.(type) {
+		case *ast.RawHTML:
+			if node.Segments.Len() == 0 {
+				ok = false
+				return ast.WalkStop, nil
+			}
+			positions = append(positions, node.Segments.At(0).Start)
+		case *ast.HTMLBlock:
+			pos, found := markdownHTMLBlockStart(source, node)
+			if !found {
+				ok = false
+				return ast.WalkStop, nil
+			}
+			positions = append(positions, pos)
+			return ast.WalkSkipChildren, nil
+		case *ast.AutoLink:
+			if markdownSafeURL(node.URL(source)) {
+				return ast.WalkContinue, nil
+			}
+			pos, found := markdownAutoLinkStart(source, node)
+			if !found {
+				ok = false
+				return ast.WalkStop, nil
+			}
+			positions = append(positions, pos)
+		case *ast.Link, *ast.Image:
+			var destination []byte
+			if link, isLink := node.(*ast.Link); isLink {
+				destination = link.Destination
+			} else {
+				destination = node.(*ast.Image).Destination
+			}
+			if markdownSafeURL(destination) {
+				return ast.WalkContinue, nil
+			}
+			pos, found := markdownLinkStart(source, node)
+			if !found {
+				ok = false
+				return ast.WalkStop, nil
+			}
+			positions = append(positions, pos)
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return positions, ok
+}
+
+// markdownHTMLBlockStart returns the position of the opening "<" of the given HTML block
+func markdownHTMLBlockStart(source []byte, node *ast.HTMLBlock) (int, bool) {
+	if node.Lines().Len() == 0 {
+		return 0, false
+	}
+	line := node.Lines().At(0)
+	for pos := line.Start; pos < line.Stop; pos++ {
+		if source[pos] == '<' {
+			return pos, true
+		} else if source[pos] != ' ' && source[pos] != '\t' {
+			break
+		}
+	}
+	return 0, false
+}
+
+// markdownAutoLinkStart returns the position of the opening "<" of the given autolink node. Since goldmark
+// does not record the position of autolinks, we start at the end of the preceding text (or at the beginning
+// of the block, if the autolink is the first inline node) and skip any whitespace.
+func markdownAutoLinkStart(source []byte, node *ast.AutoLink) (int, bool) {
+	var pos int
+	if prev, isText := node.PreviousSibling().(*ast.Text); isText {
+		pos = prev.Segment.Stop
+	} else if node.PreviousSibling() == nil && node.Parent() != nil && node.Parent().Lines().Len() > 0 {
+		pos = node.Parent().Lines().At(0).Start
+	} else {
+		return 0, false
+	}
+	for ; pos < len(source); pos++ {
+		if source[pos] == '<' {
+			return pos, true
+		} else if source[pos] != ' ' && source[pos] != '\t' && source[pos] != '\r' && source[pos] != '\n' {
+			break
+		}
+	}
+	return 0, false
+}
+
+// markdownLinkStart returns the position of the opening "[" of the given link or image node. Since
+// goldmark does not record the position of the link itself, we search backwards from the first text in
+// the link label, skipping over any inline markup (e.g. "[**bold**](...)").
+func markdownLinkStart(source []byte, node ast.Node) (int, bool) {
+	textStart := -1
+	_ = ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if t, isText := n.(*ast.Text); entering && isText {
+			textStart = t.Segment.Start
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	if textStart <= 0 {
+		return 0, false
+	}
+	for pos := textStart - 1; pos >= 0; pos-- {
+		if source[pos] == '[' {
+			return pos, true
+		} else if source[pos] != '*' && source[pos] != '_' && source[pos] != '`' && source[pos] != '~' {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// markdownSafeURL returns true if the given URL is relative, or if its scheme is one of markdownSafeSchemes.
+// Backslash escapes and HTML entities are resolved first, since renderers do the same (e.g. "javascript&#58;...").
+func markdownSafeURL(u []byte) bool {
+	resolved := gmutil.ResolveEntityNames(gmutil.ResolveNumericReferences(gmutil.UnescapePunctuations(u)))
+	matches := markdownSchemeRegex.FindStringSubmatch(markdownIgnoredURLRegex.ReplaceAllString(string(resolved), ""))
+	if matches == nil {
+		return true // No scheme, relative URL
+	}
+	scheme := strings.ToLower(matches[1])
+	for _, safe := range markdownSafeSchemes {
+		if scheme == safe {
+			return true
+		}
+	}
+	return false
+}
+
+// insertMarkdownEscapes inserts a backslash at each of the given positions
+func insertMarkdownEscapes(source []byte, positions []int) []byte {
+	sort.Sort(sort.Reverse(sort.IntSlice(positions)))
+	result := append([]byte{}, source...)
+	last := -1
+	for _, pos := range positions {
+		if pos == last {
+			continue
+		}
+		result = append(result[:pos], append([]byte(markdownEscapeChar), result[pos:]...)...)
+		last = pos
+	}
+	return result
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSanitizeMarkdown_Safe(t *testing.T) {
+	inputs := []string{
+		"# Heading\n\nSome **bold** and _italic_ text",
+		"- item 1\n- item 2\n\n```\n<script>alert(1)</script>\n```",
+		"Inline `<b>code</b>` is fine",
+		"[link](https://ntfy.sh) and ![image](https://ntfy.sh/static/img/ntfy.png)",
+		"[mail](mailto:phil@example.com), [phone](tel:+123456) and [relative](/docs/publish)",
+		"<https://ntfy.sh> and 1 < 2",
+	}
+	for _, input := range inputs {
+		require.Equal(t, input, sanitizeMarkdown(input))
+	}
+}
+
+func TestSanitizeMarkdown_RawHTML(t *testing.T) {
+	require.Equal(t, `Hi \<b>there\</b>`, sanitizeMarkdown(`Hi <b>there</b>`))
+	require.Equal(t, `\<img src=x onerror=alert(1)>`, sanitizeMarkdown(`<img src=x onerror=alert(1)>`))
+	require.Equal(t, "\\<div>\n\\<script>alert(1)\\</script>\n\\</div>", sanitizeMarkdown("<div>\n<script>alert(1)</script>\n</div>"))
+}
+
+func TestSanitizeMarkdown_UnsafeLinks(t *testing.T) {
+	require.Equal(t, `\[click](javascript:alert(1))`, sanitizeMarkdown(`[click](javascript:alert(1))`))
+	require.Equal(t, `Look: !\[img](data:text/html;base64,PHNjcmlwdD4=)`, sanitizeMarkdown(`Look: ![img](data:text/html;base64,PHNjcmlwdD4=)`))
+	require.Equal(t, `\[**bold**](JavaScript:alert(1))`, sanitizeMarkdown(`[**bold**](JavaScript:alert(1))`))
+	require.Equal(t, `\[x](javascript&#58;alert(1))`, sanitizeMarkdown(`[x](javascript&#58;alert(1))`))
+	require.Equal(t, "\\[x]\\[ref]\n\n[ref]: vbscript:msgbox", sanitizeMarkdown("[x][ref]\n\n[ref]: vbscript:msgbox"))
+	require.Equal(t, `Go \<javascript:alert(1)>`, sanitizeMarkdown(`Go <javascript:alert(1)>`))
+}
+
+func TestSanitizeMarkdown_Fallback(t *testing.T) {
+	require.Equal(t, `\[](javascript:alert(1))`, sanitizeMarkdown(`[](javascript:alert(1))`))
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	html, err := renderMarkdown("# Hello\n\nThis is **bold** <b>raw</b>")
+	require.Nil(t, err)
+	require.Equal(t, "<h1>Hello</h1>\n<p>This is <strong>bold</strong> <!-- raw HTML omitted -->raw<!-- raw HTML omitted --></p>\n", html)
+}
@@ -8,15 +8,98 @@ import (
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 	"heckel.io/ntfy/util"
 	"log"
+	"sort"
 	"strings"
 	"time"
 )
 
 var (
 	errUnexpectedMessageType = errors.New("unexpected message type")
+	errMessageNotFound       = errors.New("message not found")
 )
 
-// Messages cache
+// messageCache stores published messages (including scheduled messages that are not yet published), so that
+// they can be retrieved by subscribers via "since=", as well as the responses of idempotent publish requests.
+// The implementations are sqlCache with an SQLite database (see newSqliteCache, newMemCache and newNopCache),
+// or with a PostgreSQL database (see newPostgresCache).
+type messageCache interface {
+	// AddMessage stores the given message, see AddMessages
+	AddMessage(m *message) error
+
+	// AddMessages stores the given messages in a single transaction. If any of the messages
+	// cannot be stored, none of them are.
+	AddMessages(ms []*message) error
+
+	// Messages returns the messages of the given topic since the given marker (time or message ID), oldest
+	// first. If scheduled is true, messages that are scheduled but not yet published are included.
+	Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error)
+
+	// ClaimMessagesDue atomically marks all scheduled messages that are due as published, and returns them, oldest
+	// first. If multiple servers share the cache, each message is returned to only one of them.
+	ClaimMessagesDue() ([]*message, error)
+
+	// DeleteMessage deletes the message with the given ID from the given topic, including a scheduled message
+	// that is not yet published, and returns it. It returns errMessageNotFound if the message does not exist.
+	DeleteMessage(topic, id string) (*message, error)
+
+	// MessageCount returns the number of messages in the given topic
+	MessageCount(topic string) (int, error)
+
+	// Topics returns all topics that have messages
+	Topics() (map[string]*topic, error)
+
+	// Prune deletes all published messages that are older than the given time
+	Prune(olderThan time.Time) error
+
+	// AttachmentBytesUsed returns the total size of the (non-expired) attachments of the given owner
+	AttachmentBytesUsed(owner string) (int64, error)
+
+	// AttachmentsExpired returns the IDs of the messages whose attachments have expired
+	AttachmentsExpired() ([]string, error)
+
+	// ReserveIdempotencyKey atomically reserves the given idempotency key of the given topic and owner (the visitor
+	// that published the request), with an empty response. It returns false if the key is already reserved and not
+	// yet expired, i.e. if the request is a repetition of an earlier (or still running) request.
+	ReserveIdempotencyKey(topic, owner, key string, expires time.Time) (bool, error)
+
+	// SetIdempotencyKeyResponse stores the response of the publish request of a reserved idempotency key,
+	// so that it can be returned if the request is repeated
+	SetIdempotencyKeyResponse(topic, owner, key, response string) error
+
+	// RemoveIdempotencyKey removes the reservation of an idempotency key, e.g. if the request failed
+	RemoveIdempotencyKey(topic, owner, key string) error
+
+	// IdempotencyKeyResponse returns the stored response for the given topic, owner and idempotency key,
+	// or an empty string if the key is unknown, expired, or the request is still in progress
+	IdempotencyKeyResponse(topic, owner, key string) (string, error)
+
+	// PruneIdempotencyKeys removes all expired idempotency keys
+	PruneIdempotencyKeys() error
+}
+
+// messageCacheQueries are the queries of an sqlCache, which differ between the SQL dialects
+type messageCacheQueries struct {
+	insertMessage                           string
+	pruneMessages                           string
+	selectRowIDFromMessageID                string
+	selectMessagesSinceTime                 string
+	selectMessagesSinceTimeIncludeScheduled string
+	selectMessagesSinceID                   string
+	selectMessagesSinceIDIncludeScheduled   string
+	claimMessagesDue                        string
+	deleteMessage                           string
+	selectMessageCountForTopic              string
+	selectTopics                            string
+	selectAttachmentsSize                   string
+	selectAttachmentsExpired                string
+	reserveIdempotencyKey                   string
+	updateIdempotencyKeyResponse            string
+	deleteIdempotencyKey                    string
+	selectIdempotencyKeyResponse            string
+	pruneIdempotencyKeys                    string
+}
+
+// Messages cache (SQLite)
 const (
 	createMessagesTableQuery = `
 		BEGIN;
@@ -38,49 +121,63 @@ const (
 			attachment_url TEXT NOT NULL,
 			attachment_owner TEXT NOT NULL,
 			encoding TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			icon TEXT NOT NULL,
+			sender TEXT NOT NULL,
 			published INT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			topic TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			key TEXT NOT NULL,
+			response TEXT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (topic, owner, key)
+		);
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, published) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender, published) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	pruneMessagesQuery           = `DELETE FROM messages WHERE time < ? AND published = 1`
 	selectRowIDFromMessageID     = `SELECT id FROM messages WHERE topic = ? AND mid = ?`
 	selectMessagesSinceTimeQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender
 		FROM messages 
 		WHERE topic = ? AND time >= ? AND published = 1
 		ORDER BY time, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender
 		FROM messages 
 		WHERE topic = ? AND time >= ?
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender
 		FROM messages 
 		WHERE topic = ? AND id > ? AND published = 1 
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender
 		FROM messages 
 		WHERE topic = ? AND (id > ? OR published = 0)
 		ORDER BY time, id
 	`
-	selectMessagesDueQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
-		FROM messages 
+	claimMessagesDueQuery = `
+		UPDATE messages SET published = 1
 		WHERE time <= ? AND published = 0
-		ORDER BY time, id
+		RETURNING mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender
+	`
+	deleteMessageQuery = `
+		DELETE FROM messages
+		WHERE topic = ? AND mid = ?
+		RETURNING mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, content_type, icon, sender
 	`
-	updateMessagePublishedQuery     = `UPDATE messages SET published = 1 WHERE mid = ?`
 	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
 	selectMessageCountForTopicQuery = `SELECT COUNT(*) FROM messages WHERE topic = ?`
 	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
@@ -88,9 +185,42 @@ const (
 	selectAttachmentsExpiredQuery   = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires < ?`
 )
 
+// Idempotency keys queries
+const (
+	reserveIdempotencyKeyQuery = `
+		INSERT INTO idempotency_keys (topic, owner, key, response, expires) VALUES (?, ?, ?, '', ?)
+		ON CONFLICT (topic, owner, key) DO UPDATE SET response = '', expires = excluded.expires WHERE idempotency_keys.expires < ?
+	`
+	updateIdempotencyKeyResponseQuery = `UPDATE idempotency_keys SET response = ? WHERE topic = ? AND owner = ? AND key = ?`
+	deleteIdempotencyKeyQuery         = `DELETE FROM idempotency_keys WHERE topic = ? AND owner = ? AND key = ?`
+	selectIdempotencyKeyResponseQuery = `SELECT response FROM idempotency_keys WHERE topic = ? AND owner = ? AND key = ? AND expires >= ?`
+	pruneIdempotencyKeysQuery         = `DELETE FROM idempotency_keys WHERE expires < ?`
+)
+
+var sqliteQueries = &messageCacheQueries{
+	insertMessage:                           insertMessageQuery,
+	pruneMessages:                           pruneMessagesQuery,
+	selectRowIDFromMessageID:                selectRowIDFromMessageID,
+	selectMessagesSinceTime:                 selectMessagesSinceTimeQuery,
+	selectMessagesSinceTimeIncludeScheduled: selectMessagesSinceTimeIncludeScheduledQuery,
+	selectMessagesSinceID:                   selectMessagesSinceIDQuery,
+	selectMessagesSinceIDIncludeScheduled:   selectMessagesSinceIDIncludeScheduledQuery,
+	claimMessagesDue:                        claimMessagesDueQuery,
+	deleteMessage:                           deleteMessageQuery,
+	selectMessageCountForTopic:              selectMessageCountForTopicQuery,
+	selectTopics:                            selectTopicsQuery,
+	selectAttachmentsSize:                   selectAttachmentsSizeQuery,
+	selectAttachmentsExpired:                selectAttachmentsExpiredQuery,
+	reserveIdempotencyKey:                   reserveIdempotencyKeyQuery,
+	updateIdempotencyKeyResponse:            updateIdempotencyKeyResponseQuery,
+	deleteIdempotencyKey:                    deleteIdempotencyKeyQuery,
+	selectIdempotencyKeyResponse:            selectIdempotencyKeyResponseQuery,
+	pruneIdempotencyKeys:                    pruneIdempotencyKeysQuery,
+}
+
 // Schema management queries
 const (
-	currentSchemaVersion          = 6
+	currentSchemaVersion          = 11
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -173,15 +303,60 @@ const (
 	migrate5To6AlterMessagesTableQuery = `
 		ALTER TABLE messages ADD COLUMN actions TEXT NOT NULL DEFAULT('');
 	`
+
+	// 6 -> 7
+	migrate6To7CreateIdempotencyKeysTableQuery = `
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			topic TEXT NOT NULL,
+			key TEXT NOT NULL,
+			response TEXT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (topic, key)
+		);
+	`
+
+	// 7 -> 8
+	migrate7To8AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN content_type TEXT NOT NULL DEFAULT('');
+	`
+
+	// 8 -> 9
+	migrate8To9AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN icon TEXT NOT NULL DEFAULT('');
+	`
+
+	// 9 -> 10
+	migrate9To10AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN sender TEXT NOT NULL DEFAULT('');
+	`
+
+	// 10 -> 11 (idempotency keys are short-lived, so the table is simply re-created)
+	migrate10To11RecreateIdempotencyKeysTableQuery = `
+		BEGIN;
+		DROP TABLE IF EXISTS idempotency_keys;
+		CREATE TABLE idempotency_keys (
+			topic TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			key TEXT NOT NULL,
+			response TEXT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (topic, owner, key)
+		);
+		COMMIT;
+	`
 )
 
-type messageCache struct {
-	db  *sql.DB
-	nop bool
+// sqlCache is a messageCache backed by an SQL database. The queries depend on the database, see messageCacheQueries.
+type sqlCache struct {
+	db      *sql.DB
+	queries *messageCacheQueries
+	nop     bool
 }
 
+var _ messageCache = (*sqlCache)(nil)
+
 // newSqliteCache creates a SQLite file-backed cache
-func newSqliteCache(filename string, nop bool) (*messageCache, error) {
+func newSqliteCache(filename string, nop bool) (*sqlCache, error) {
 	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
 		return nil, err
@@ -189,20 +364,21 @@ func newSqliteCache(filename string, nop bool) (*messageCache, error) {
 	if err := setupCacheDB(db); err != nil {
 		return nil, err
 	}
-	return &messageCache{
-		db:  db,
-		nop: nop,
+	return &sqlCache{
+		db:      db,
+		queries: sqliteQueries,
+		nop:     nop,
 	}, nil
 }
 
 // newMemCache creates an in-memory cache
-func newMemCache() (*messageCache, error) {
+func newMemCache() (*sqlCache, error) {
 	return newSqliteCache(createMemoryFilename(), false)
 }
 
 // newNopCache creates an in-memory cache that discards all messages;
 // it is always empty and can be used if caching is entirely disabled
-func newNopCache() (*messageCache, error) {
+func newNopCache() (*sqlCache, error) {
 	return newSqliteCache(createMemoryFilename(), true)
 }
 
@@ -216,57 +392,85 @@ func createMemoryFilename() string {
 	return fmt.Sprintf("file:%s?mode=memory&cache=shared", util.RandomString(10))
 }
 
-func (c *messageCache) AddMessage(m *message) error {
-	if m.Event != messageEvent {
-		return errUnexpectedMessageType
+// AddMessage stores the given message, see AddMessages
+func (c *sqlCache) AddMessage(m *message) error {
+	return c.AddMessages([]*message{m})
+}
+
+// AddMessages stores the given messages in a single transaction. If any of the messages
+// cannot be stored, none of them are.
+func (c *sqlCache) AddMessages(ms []*message) error {
+	for _, m := range ms {
+		if m.Event != messageEvent {
+			return errUnexpectedMessageType
+		}
 	}
 	if c.nop {
 		return nil
 	}
-	published := m.Time <= time.Now().Unix()
-	tags := strings.Join(m.Tags, ",")
-	var attachmentName, attachmentType, attachmentURL, attachmentOwner string
-	var attachmentSize, attachmentExpires int64
-	if m.Attachment != nil {
-		attachmentName = m.Attachment.Name
-		attachmentType = m.Attachment.Type
-		attachmentSize = m.Attachment.Size
-		attachmentExpires = m.Attachment.Expires
-		attachmentURL = m.Attachment.URL
-		attachmentOwner = m.Attachment.Owner
-	}
-	var actionsStr string
-	if len(m.Actions) > 0 {
-		actionsBytes, err := json.Marshal(m.Actions)
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(c.queries.insertMessage)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range ms {
+		published := m.Time <= time.Now().Unix()
+		tags := strings.Join(m.Tags, ",")
+		var attachmentName, attachmentType, attachmentURL, attachmentOwner string
+		var attachmentSize, attachmentExpires int64
+		if m.Attachment != nil {
+			attachmentName = m.Attachment.Name
+			attachmentType = m.Attachment.Type
+			attachmentSize = m.Attachment.Size
+			attachmentExpires = m.Attachment.Expires
+			attachmentURL = m.Attachment.URL
+			attachmentOwner = m.Attachment.Owner
+		}
+		var actionsStr string
+		if len(m.Actions) > 0 {
+			actionsBytes, err := json.Marshal(m.Actions)
+			if err != nil {
+				return err
+			}
+			actionsStr = string(actionsBytes)
+		}
+		_, err := stmt.Exec(
+			m.ID,
+			m.Time,
+			m.Topic,
+			m.Message,
+			m.Title,
+			m.Priority,
+			tags,
+			m.Click,
+			actionsStr,
+			attachmentName,
+			attachmentType,
+			attachmentSize,
+			attachmentExpires,
+			attachmentURL,
+			attachmentOwner,
+			m.Encoding,
+			m.ContentType,
+			m.Icon,
+			m.Sender,
+			published,
+		)
 		if err != nil {
 			return err
 		}
-		actionsStr = string(actionsBytes)
-	}
-	_, err := c.db.Exec(
-		insertMessageQuery,
-		m.ID,
-		m.Time,
-		m.Topic,
-		m.Message,
-		m.Title,
-		m.Priority,
-		tags,
-		m.Click,
-		actionsStr,
-		attachmentName,
-		attachmentType,
-		attachmentSize,
-		attachmentExpires,
-		attachmentURL,
-		attachmentOwner,
-		m.Encoding,
-		published,
-	)
-	return err
+	}
+	return tx.Commit()
 }
 
-func (c *messageCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+// Messages returns the messages of the given topic since the given marker (time or message ID), oldest
+// first. If scheduled is true, messages that are scheduled but not yet published are included.
+func (c *sqlCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
 	if since.IsNone() {
 		return make([]*message, 0), nil
 	} else if since.IsID() {
@@ -275,13 +479,13 @@ func (c *messageCache) Messages(topic string, since sinceMarker, scheduled bool)
 	return c.messagesSinceTime(topic, since, scheduled)
 }
 
-func (c *messageCache) messagesSinceTime(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+func (c *sqlCache) messagesSinceTime(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
 	var rows *sql.Rows
 	var err error
 	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
+		rows, err = c.db.Query(c.queries.selectMessagesSinceTimeIncludeScheduled, topic, since.Time().Unix())
 	} else {
-		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+		rows, err = c.db.Query(c.queries.selectMessagesSinceTime, topic, since.Time().Unix())
 	}
 	if err != nil {
 		return nil, err
@@ -289,8 +493,8 @@ func (c *messageCache) messagesSinceTime(topic string, since sinceMarker, schedu
 	return readMessages(rows)
 }
 
-func (c *messageCache) messagesSinceID(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	idrows, err := c.db.Query(selectRowIDFromMessageID, topic, since.ID())
+func (c *sqlCache) messagesSinceID(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	idrows, err := c.db.Query(c.queries.selectRowIDFromMessageID, topic, since.ID())
 	if err != nil {
 		return nil, err
 	}
@@ -305,9 +509,9 @@ func (c *messageCache) messagesSinceID(topic string, since sinceMarker, schedule
 	idrows.Close()
 	var rows *sql.Rows
 	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceIDIncludeScheduledQuery, topic, rowID)
+		rows, err = c.db.Query(c.queries.selectMessagesSinceIDIncludeScheduled, topic, rowID)
 	} else {
-		rows, err = c.db.Query(selectMessagesSinceIDQuery, topic, rowID)
+		rows, err = c.db.Query(c.queries.selectMessagesSinceID, topic, rowID)
 	}
 	if err != nil {
 		return nil, err
@@ -315,21 +519,43 @@ func (c *messageCache) messagesSinceID(topic string, since sinceMarker, schedule
 	return readMessages(rows)
 }
 
-func (c *messageCache) MessagesDue() ([]*message, error) {
-	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
+// ClaimMessagesDue atomically marks all scheduled messages that are due as published, and returns them, oldest
+// first. Since the messages are marked before they are delivered, a message is not delivered to live subscribers
+// if the server stops in between, but it is still returned to "since=" and "poll=1" requests.
+func (c *sqlCache) ClaimMessagesDue() ([]*message, error) {
+	rows, err := c.db.Query(c.queries.claimMessagesDue, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time // The order of RETURNING is not defined in SQLite
+	})
+	return messages, nil
 }
 
-func (c *messageCache) MarkPublished(m *message) error {
-	_, err := c.db.Exec(updateMessagePublishedQuery, m.ID)
-	return err
+// DeleteMessage deletes the message with the given ID from the given topic, including a scheduled message
+// that is not yet published, and returns it. It returns errMessageNotFound if the message does not exist.
+func (c *sqlCache) DeleteMessage(topic, id string) (*message, error) {
+	rows, err := c.db.Query(c.queries.deleteMessage, topic, id)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, errMessageNotFound
+	}
+	return messages[0], nil
 }
 
-func (c *messageCache) MessageCount(topic string) (int, error) {
-	rows, err := c.db.Query(selectMessageCountForTopicQuery, topic)
+// MessageCount returns the number of messages in the given topic
+func (c *sqlCache) MessageCount(topic string) (int, error) {
+	rows, err := c.db.Query(c.queries.selectMessageCountForTopic, topic)
 	if err != nil {
 		return 0, err
 	}
@@ -346,8 +572,9 @@ func (c *messageCache) MessageCount(topic string) (int, error) {
 	return count, nil
 }
 
-func (c *messageCache) Topics() (map[string]*topic, error) {
-	rows, err := c.db.Query(selectTopicsQuery)
+// Topics returns all topics that have messages
+func (c *sqlCache) Topics() (map[string]*topic, error) {
+	rows, err := c.db.Query(c.queries.selectTopics)
 	if err != nil {
 		return nil, err
 	}
@@ -366,13 +593,15 @@ func (c *messageCache) Topics() (map[string]*topic, error) {
 	return topics, nil
 }
 
-func (c *messageCache) Prune(olderThan time.Time) error {
-	_, err := c.db.Exec(pruneMessagesQuery, olderThan.Unix())
+// Prune deletes all published messages that are older than the given time
+func (c *sqlCache) Prune(olderThan time.Time) error {
+	_, err := c.db.Exec(c.queries.pruneMessages, olderThan.Unix())
 	return err
 }
 
-func (c *messageCache) AttachmentBytesUsed(owner string) (int64, error) {
-	rows, err := c.db.Query(selectAttachmentsSizeQuery, owner, time.Now().Unix())
+// AttachmentBytesUsed returns the total size of the (non-expired) attachments of the given owner
+func (c *sqlCache) AttachmentBytesUsed(owner string) (int64, error) {
+	rows, err := c.db.Query(c.queries.selectAttachmentsSize, owner, time.Now().Unix())
 	if err != nil {
 		return 0, err
 	}
@@ -389,8 +618,9 @@ func (c *messageCache) AttachmentBytesUsed(owner string) (int64, error) {
 	return size, nil
 }
 
-func (c *messageCache) AttachmentsExpired() ([]string, error) {
-	rows, err := c.db.Query(selectAttachmentsExpiredQuery, time.Now().Unix())
+// AttachmentsExpired returns the IDs of the messages whose attachments have expired
+func (c *sqlCache) AttachmentsExpired() ([]string, error) {
+	rows, err := c.db.Query(c.queries.selectAttachmentsExpired, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
@@ -409,13 +639,64 @@ func (c *messageCache) AttachmentsExpired() ([]string, error) {
 	return ids, nil
 }
 
+// ReserveIdempotencyKey atomically reserves the given idempotency key of the given topic and owner, see messageCache
+func (c *sqlCache) ReserveIdempotencyKey(topic, owner, key string, expires time.Time) (bool, error) {
+	result, err := c.db.Exec(c.queries.reserveIdempotencyKey, topic, owner, key, expires.Unix(), time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// SetIdempotencyKeyResponse stores the response of the publish request of a reserved idempotency key
+func (c *sqlCache) SetIdempotencyKeyResponse(topic, owner, key, response string) error {
+	_, err := c.db.Exec(c.queries.updateIdempotencyKeyResponse, response, topic, owner, key)
+	return err
+}
+
+// RemoveIdempotencyKey removes the reservation of an idempotency key
+func (c *sqlCache) RemoveIdempotencyKey(topic, owner, key string) error {
+	_, err := c.db.Exec(c.queries.deleteIdempotencyKey, topic, owner, key)
+	return err
+}
+
+// IdempotencyKeyResponse returns the stored response for the given topic, owner and idempotency key,
+// or an empty string if the key is unknown, expired, or the request is still in progress
+func (c *sqlCache) IdempotencyKeyResponse(topic, owner, key string) (string, error) {
+	rows, err := c.db.Query(c.queries.selectIdempotencyKeyResponse, topic, owner, key, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", nil
+	}
+	var response string
+	if err := rows.Scan(&response); err != nil {
+		return "", err
+	} else if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return response, nil
+}
+
+// PruneIdempotencyKeys removes all expired idempotency keys
+func (c *sqlCache) PruneIdempotencyKeys() error {
+	_, err := c.db.Exec(c.queries.pruneIdempotencyKeys, time.Now().Unix())
+	return err
+}
+
 func readMessages(rows *sql.Rows) ([]*message, error) {
 	defer rows.Close()
 	messages := make([]*message, 0)
 	for rows.Next() {
 		var timestamp, attachmentSize, attachmentExpires int64
 		var priority int
-		var id, topic, msg, title, tagsStr, click, actionsStr, attachmentName, attachmentType, attachmentURL, attachmentOwner, encoding string
+		var id, topic, msg, title, tagsStr, click, actionsStr, attachmentName, attachmentType, attachmentURL, attachmentOwner, encoding, contentType, icon, sender string
 		err := rows.Scan(
 			&id,
 			&timestamp,
@@ -433,6 +714,9 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 			&attachmentURL,
 			&attachmentOwner,
 			&encoding,
+			&contentType,
+			&icon,
+			&sender,
 		)
 		if err != nil {
 			return nil, err
@@ -459,18 +743,21 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 			}
 		}
 		messages = append(messages, &message{
-			ID:         id,
-			Time:       timestamp,
-			Event:      messageEvent,
-			Topic:      topic,
-			Message:    msg,
-			Title:      title,
-			Priority:   priority,
-			Tags:       tags,
-			Click:      click,
-			Actions:    actions,
-			Attachment: att,
-			Encoding:   encoding,
+			ID:          id,
+			Time:        timestamp,
+			Event:       messageEvent,
+			Topic:       topic,
+			Message:     msg,
+			Title:       title,
+			Priority:    priority,
+			Tags:        tags,
+			Click:       click,
+			Icon:        icon,
+			Actions:     actions,
+			Attachment:  att,
+			Encoding:    encoding,
+			ContentType: contentType,
+			Sender:      sender,
 		})
 	}
 	if err := rows.Err(); err != nil {
@@ -516,6 +803,16 @@ func setupCacheDB(db *sql.DB) error {
 		return migrateFrom4(db)
 	} else if schemaVersion == 5 {
 		return migrateFrom5(db)
+	} else if schemaVersion == 6 {
+		return migrateFrom6(db)
+	} else if schemaVersion == 7 {
+		return migrateFrom7(db)
+	} else if schemaVersion == 8 {
+		return migrateFrom8(db)
+	} else if schemaVersion == 9 {
+		return migrateFrom9(db)
+	} else if schemaVersion == 10 {
+		return migrateFrom10(db)
 	}
 	return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
 }
@@ -599,5 +896,60 @@ func migrateFrom5(db *sql.DB) error {
 	if _, err := db.Exec(updateSchemaVersion, 6); err != nil {
 		return err
 	}
+	return migrateFrom6(db)
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 6 to 7")
+	if _, err := db.Exec(migrate6To7CreateIdempotencyKeysTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return migrateFrom7(db)
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 7 to 8")
+	if _, err := db.Exec(migrate7To8AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return migrateFrom8(db)
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 8 to 9")
+	if _, err := db.Exec(migrate8To9AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return migrateFrom9(db)
+}
+
+func migrateFrom9(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 9 to 10")
+	if _, err := db.Exec(migrate9To10AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return migrateFrom10(db)
+}
+
+func migrateFrom10(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 10 to 11")
+	if _, err := db.Exec(migrate10To11RecreateIdempotencyKeysTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
 	return nil // Update this when a new version is added
 }
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/util"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPostgresCache_Messages(t *testing.T) {
+	testCacheMessages(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_MessagesScheduled(t *testing.T) {
+	testCacheMessagesScheduled(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_ClaimMessagesDue(t *testing.T) {
+	testCacheClaimMessagesDue(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_ClaimMessagesDue_Replicas(t *testing.T) {
+	url := newPostgresTestURL(t)
+	c1, err := newPostgresCache(url)
+	require.Nil(t, err)
+	defer c1.db.Close()
+	c2, err := newPostgresCache(url)
+	require.Nil(t, err)
+	defer c2.db.Close()
+	for i := 0; i < 50; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Hour).Unix()
+		require.Nil(t, c1.AddMessage(m))
+	}
+	_, err = c1.db.Exec("UPDATE messages SET time = time - 7200")
+	require.Nil(t, err)
+
+	// Both servers claim the due messages at the same time, but each message is only claimed once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	for _, c := range []*sqlCache{c1, c2, c1, c2} {
+		wg.Add(1)
+		go func(c *sqlCache) {
+			defer wg.Done()
+			messages, err := c.ClaimMessagesDue()
+			require.Nil(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, m := range messages {
+				claimed[m.ID]++
+			}
+		}(c)
+	}
+	wg.Wait()
+	require.Equal(t, 50, len(claimed))
+	for _, count := range claimed {
+		require.Equal(t, 1, count)
+	}
+}
+
+func TestPostgresCache_DeleteMessage(t *testing.T) {
+	testCacheDeleteMessage(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_ContentType(t *testing.T) {
+	testCacheContentType(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_Icon(t *testing.T) {
+	testCacheIcon(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_Sender(t *testing.T) {
+	testCacheSender(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_IdempotencyKeys(t *testing.T) {
+	testCacheIdempotencyKeys(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_Topics(t *testing.T) {
+	testCacheTopics(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_Prune(t *testing.T) {
+	testCachePrune(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_Attachments(t *testing.T) {
+	testCacheAttachments(t, newPostgresTestCache(t))
+}
+
+func TestPostgresCache_SetupTwice(t *testing.T) {
+	url := newPostgresTestURL(t)
+	c1, err := newPostgresCache(url)
+	require.Nil(t, err)
+	defer c1.db.Close()
+	require.Nil(t, c1.AddMessage(newDefaultMessage("mytopic", "my message")))
+
+	c2, err := newPostgresCache(url)
+	require.Nil(t, err)
+	defer c2.db.Close()
+	messages, err := c2.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my message", messages[0].Message)
+}
+
+// newPostgresTestCache creates a cache in a new, empty schema of the database defined by the
+// NTFY_TEST_POSTGRES_URL environment variable, or skips the test if the variable is not set
+func newPostgresTestCache(t *testing.T) *sqlCache {
+	c, err := newPostgresCache(newPostgresTestURL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+func newPostgresTestURL(t *testing.T) string {
+	url := os.Getenv("NTFY_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("NTFY_TEST_POSTGRES_URL not set")
+	}
+	db, err := sql.Open("postgres", url)
+	require.Nil(t, err)
+	schema := fmt.Sprintf("test_%s", strings.ToLower(util.RandomString(10)))
+	_, err = db.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		db.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema))
+		db.Close()
+	})
+	if strings.Contains(url, "?") {
+		return url + "&search_path=" + schema
+	}
+	return url + "?search_path=" + schema
+}
@@ -18,7 +18,7 @@ func TestMemCache_Messages(t *testing.T) {
 	testCacheMessages(t, newMemTestCache(t))
 }
 
-func testCacheMessages(t *testing.T, c *messageCache) {
+func testCacheMessages(t *testing.T, c *sqlCache) {
 	m1 := newDefaultMessage("mytopic", "my message")
 	m1.Time = 1
 
@@ -92,7 +92,7 @@ func TestMemCache_MessagesScheduled(t *testing.T) {
 	testCacheMessagesScheduled(t, newMemTestCache(t))
 }
 
-func testCacheMessagesScheduled(t *testing.T, c *messageCache) {
+func testCacheMessagesScheduled(t *testing.T, c *sqlCache) {
 	m1 := newDefaultMessage("mytopic", "message 1")
 	m2 := newDefaultMessage("mytopic", "message 2")
 	m2.Time = time.Now().Add(time.Hour).Unix()
@@ -114,10 +114,248 @@ func testCacheMessagesScheduled(t *testing.T, c *messageCache) {
 	require.Equal(t, "message 3", messages[1].Message) // Order!
 	require.Equal(t, "message 2", messages[2].Message)
 
-	messages, _ = c.MessagesDue()
+	messages, _ = c.ClaimMessagesDue()
 	require.Empty(t, messages)
 }
 
+func TestSqliteCache_ClaimMessagesDue(t *testing.T) {
+	testCacheClaimMessagesDue(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ClaimMessagesDue(t *testing.T) {
+	testCacheClaimMessagesDue(t, newMemTestCache(t))
+}
+
+func testCacheClaimMessagesDue(t *testing.T, c *sqlCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = time.Now().Add(time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Time = time.Now().Add(30 * time.Minute).Unix() // earlier than m1!
+	m3 := newDefaultMessage("mytopic", "message 3")
+	m3.Time = time.Now().Add(3 * time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+	_, err := c.db.Exec("UPDATE messages SET time = time - 7200") // m1 and m2 are now due
+	require.Nil(t, err)
+
+	messages, err := c.ClaimMessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message) // Order!
+	require.Equal(t, "message 1", messages[1].Message)
+
+	// Claimed messages are published, and are not claimed again
+	messages, err = c.ClaimMessagesDue()
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+}
+
+func TestSqliteCache_DeleteMessage(t *testing.T) {
+	testCacheDeleteMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteMessage(t *testing.T) {
+	testCacheDeleteMessage(t, newMemTestCache(t))
+}
+
+func testCacheDeleteMessage(t *testing.T, c *sqlCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "scheduled message")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	m3 := newDefaultMessage("othertopic", "message 3")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	m, err := c.DeleteMessage("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "message 1", m.Message)
+	m, err = c.DeleteMessage("mytopic", m2.ID) // Scheduled messages can be deleted, too
+	require.Nil(t, err)
+	require.Equal(t, "scheduled message", m.Message)
+
+	_, err = c.DeleteMessage("mytopic", m1.ID)
+	require.Equal(t, errMessageNotFound, err)
+	_, err = c.DeleteMessage("mytopic", m3.ID) // Wrong topic
+	require.Equal(t, errMessageNotFound, err)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	messages, err = c.Messages("othertopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newMemTestCache(t))
+}
+
+func testCacheAddMessages(t *testing.T, c *sqlCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m3 := newDefaultMessage("othertopic", "message 3")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+
+	messages, _ = c.Messages("othertopic", sinceAllMessages, false)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+
+	// Invalid messages reject the entire batch
+	m4 := newDefaultMessage("mytopic", "message 4")
+	require.Equal(t, errUnexpectedMessageType, c.AddMessages([]*message{m4, newKeepaliveMessage("mytopic")}))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestSqliteCache_ContentType(t *testing.T) {
+	testCacheContentType(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ContentType(t *testing.T) {
+	testCacheContentType(t, newMemTestCache(t))
+}
+
+func testCacheContentType(t *testing.T, c *sqlCache) {
+	m1 := newDefaultMessage("mytopic", "some **markdown**")
+	m1.ContentType = "text/markdown"
+	m2 := newDefaultMessage("mytopic", "plain text")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "text/markdown", messages[0].ContentType)
+	require.Equal(t, "", messages[1].ContentType)
+}
+
+func TestSqliteCache_Icon(t *testing.T) {
+	testCacheIcon(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Icon(t *testing.T) {
+	testCacheIcon(t, newMemTestCache(t))
+}
+
+func testCacheIcon(t *testing.T, c *sqlCache) {
+	m := newDefaultMessage("mytopic", "message with icon")
+	m.Icon = "https://ntfy.sh/static/img/ntfy.png"
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "https://ntfy.sh/static/img/ntfy.png", messages[0].Icon)
+}
+
+func TestSqliteCache_Sender(t *testing.T) {
+	testCacheSender(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Sender(t *testing.T) {
+	testCacheSender(t, newMemTestCache(t))
+}
+
+func testCacheSender(t *testing.T, c *sqlCache) {
+	m1 := newDefaultMessage("mytopic", "from phil")
+	m1.Sender = "phil"
+	m2 := newDefaultMessage("mytopic", "from anonymous")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "phil", messages[0].Sender)
+	require.Equal(t, "", messages[1].Sender)
+}
+
+func TestSqliteCache_IdempotencyKeys(t *testing.T) {
+	testCacheIdempotencyKeys(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_IdempotencyKeys(t *testing.T) {
+	testCacheIdempotencyKeys(t, newMemTestCache(t))
+}
+
+func TestMemCache_NopCache_IdempotencyKeys(t *testing.T) {
+	c, _ := newNopCache()
+	testCacheIdempotencyKeys(t, c)
+}
+
+func testCacheIdempotencyKeys(t *testing.T, c *sqlCache) {
+	expires := time.Now().Add(time.Hour)
+	reserved, err := c.ReserveIdempotencyKey("mytopic", "1.2.3.4", "key1", expires)
+	require.Nil(t, err)
+	require.True(t, reserved)
+	response, err := c.IdempotencyKeyResponse("mytopic", "1.2.3.4", "key1")
+	require.Nil(t, err)
+	require.Equal(t, "", response) // Still in progress
+	require.Nil(t, c.SetIdempotencyKeyResponse("mytopic", "1.2.3.4", "key1", "response 1"))
+
+	reserved, err = c.ReserveIdempotencyKey("mytopic", "1.2.3.4", "key1", expires) // Not overwritten
+	require.Nil(t, err)
+	require.False(t, reserved)
+	reserved, err = c.ReserveIdempotencyKey("othertopic", "1.2.3.4", "key1", expires)
+	require.Nil(t, err)
+	require.True(t, reserved)
+	require.Nil(t, c.SetIdempotencyKeyResponse("othertopic", "1.2.3.4", "key1", "response 3"))
+	reserved, err = c.ReserveIdempotencyKey("mytopic", "user:phil", "key1", expires) // Other owner
+	require.Nil(t, err)
+	require.True(t, reserved)
+	reserved, err = c.ReserveIdempotencyKey("mytopic", "1.2.3.4", "key2", time.Now().Add(-time.Hour)) // Expired
+	require.Nil(t, err)
+	require.True(t, reserved)
+	require.Nil(t, c.SetIdempotencyKeyResponse("mytopic", "1.2.3.4", "key2", "response 4"))
+
+	response, err = c.IdempotencyKeyResponse("mytopic", "1.2.3.4", "key1")
+	require.Nil(t, err)
+	require.Equal(t, "response 1", response)
+
+	response, err = c.IdempotencyKeyResponse("othertopic", "1.2.3.4", "key1")
+	require.Nil(t, err)
+	require.Equal(t, "response 3", response)
+
+	response, err = c.IdempotencyKeyResponse("mytopic", "1.2.3.4", "key2")
+	require.Nil(t, err)
+	require.Equal(t, "", response)
+
+	response, err = c.IdempotencyKeyResponse("mytopic", "1.2.3.4", "does-not-exist")
+	require.Nil(t, err)
+	require.Equal(t, "", response)
+
+	// An expired key can be reserved again
+	reserved, err = c.ReserveIdempotencyKey("mytopic", "1.2.3.4", "key2", expires)
+	require.Nil(t, err)
+	require.True(t, reserved)
+	response, err = c.IdempotencyKeyResponse("mytopic", "1.2.3.4", "key2")
+	require.Nil(t, err)
+	require.Equal(t, "", response)
+
+	// A removed key can be reserved again
+	require.Nil(t, c.RemoveIdempotencyKey("mytopic", "user:phil", "key1"))
+	reserved, err = c.ReserveIdempotencyKey("mytopic", "user:phil", "key1", expires)
+	require.Nil(t, err)
+	require.True(t, reserved)
+
+	reserved, err = c.ReserveIdempotencyKey("mytopic", "1.2.3.4", "key3", time.Now().Add(-time.Hour)) // Expired
+	require.Nil(t, err)
+	require.True(t, reserved)
+	require.Nil(t, c.PruneIdempotencyKeys())
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM idempotency_keys`).Scan(&count))
+	require.Equal(t, 4, count)
+}
+
 func TestSqliteCache_Topics(t *testing.T) {
 	testCacheTopics(t, newSqliteTestCache(t))
 }
@@ -126,7 +364,7 @@ func TestMemCache_Topics(t *testing.T) {
 	testCacheTopics(t, newMemTestCache(t))
 }
 
-func testCacheTopics(t *testing.T, c *messageCache) {
+func testCacheTopics(t *testing.T, c *sqlCache) {
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic1", "my example message")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 1")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 2")))
@@ -149,7 +387,7 @@ func TestMemCache_MessagesTagsPrioAndTitle(t *testing.T) {
 	testCacheMessagesTagsPrioAndTitle(t, newMemTestCache(t))
 }
 
-func testCacheMessagesTagsPrioAndTitle(t *testing.T, c *messageCache) {
+func testCacheMessagesTagsPrioAndTitle(t *testing.T, c *sqlCache) {
 	m := newDefaultMessage("mytopic", "some message")
 	m.Tags = []string{"tag1", "tag2"}
 	m.Priority = 5
@@ -170,7 +408,7 @@ func TestMemCache_MessagesSinceID(t *testing.T) {
 	testCacheMessagesSinceID(t, newMemTestCache(t))
 }
 
-func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
+func testCacheMessagesSinceID(t *testing.T, c *sqlCache) {
 	m1 := newDefaultMessage("mytopic", "message 1")
 	m1.Time = 100
 	m2 := newDefaultMessage("mytopic", "message 2")
@@ -240,7 +478,7 @@ func TestMemCache_Prune(t *testing.T) {
 	testCachePrune(t, newMemTestCache(t))
 }
 
-func testCachePrune(t *testing.T, c *messageCache) {
+func testCachePrune(t *testing.T, c *sqlCache) {
 	m1 := newDefaultMessage("mytopic", "my message")
 	m1.Time = 1
 
@@ -277,7 +515,7 @@ func TestMemCache_Attachments(t *testing.T) {
 	testCacheAttachments(t, newMemTestCache(t))
 }
 
-func testCacheAttachments(t *testing.T, c *messageCache) {
+func testCacheAttachments(t *testing.T, c *sqlCache) {
 	expires1 := time.Now().Add(-4 * time.Hour).Unix()
 	m := newDefaultMessage("mytopic", "flower for you")
 	m.ID = "m1"
@@ -467,7 +705,7 @@ func TestMemCache_NopCache(t *testing.T) {
 	assert.Empty(t, topics)
 }
 
-func newSqliteTestCache(t *testing.T) *messageCache {
+func newSqliteTestCache(t *testing.T) *sqlCache {
 	c, err := newSqliteCache(newSqliteTestCacheFile(t), false)
 	if err != nil {
 		t.Fatal(err)
@@ -479,7 +717,7 @@ func newSqliteTestCacheFile(t *testing.T) string {
 	return filepath.Join(t.TempDir(), "cache.db")
 }
 
-func newSqliteTestCacheFromFile(t *testing.T, filename string) *messageCache {
+func newSqliteTestCacheFromFile(t *testing.T, filename string) *sqlCache {
 	c, err := newSqliteCache(filename, false)
 	if err != nil {
 		t.Fatal(err)
@@ -487,7 +725,7 @@ func newSqliteTestCacheFromFile(t *testing.T, filename string) *messageCache {
 	return c
 }
 
-func newMemTestCache(t *testing.T) *messageCache {
+func newMemTestCache(t *testing.T) *sqlCache {
 	c, err := newMemCache()
 	if err != nil {
 		t.Fatal(err)
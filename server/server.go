@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -44,7 +46,8 @@ type Server struct {
 	mailer       mailer
 	messages     int64
 	auth         auth.Auther
-	messageCache *messageCache
+	jwt          *auth.JWTVerifier
+	messageCache messageCache
 	fileCache    *fileCache
 	closeChan    chan bool
 	mu           sync.Mutex
@@ -58,20 +61,34 @@ var (
 	topicRegex             = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)               // No /!
 	topicPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}$`)              // Regex must match JS & Android app!
 	externalTopicPathRegex = regexp.MustCompile(`^/[^/]+\.[^/]+/[-_A-Za-z0-9]{1,64}$`) // Extended topic path, for web-app, e.g. /example.com/mytopic
+	topicsPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*$`)
 	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/json$`)
 	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/sse$`)
 	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/raw$`)
 	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
 	authPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/auth$`)
 	publishPathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(publish|send|trigger)$`)
-
-	webConfigPath    = "/config.js"
-	userStatsPath    = "/user/stats"
-	staticRegex      = regexp.MustCompile(`^/static/.+`)
-	docsRegex        = regexp.MustCompile(`^/docs(|/.*)$`)
-	fileRegex        = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
-	disallowedTopics = []string{"docs", "static", "file", "app", "settings"} // If updated, also update in Android app
-	attachURLRegex   = regexp.MustCompile(`^https?://`)
+	messagePathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([-_A-Za-z0-9]{1,64})$`)
+
+	webConfigPath           = "/config.js"
+	userStatsPath           = "/user/stats"
+	publishBatchPath        = "/v1/publish/batch"
+	accountPath             = "/v1/account"
+	accountPasswordPath     = "/v1/account/password"
+	accountTokensPath       = "/v1/account/tokens"
+	accountTokenRegex       = regexp.MustCompile(`^/v1/account/tokens/([_a-z0-9]+)$`)
+	accountReservationsPath = "/v1/account/reservations"
+	accountReservationRegex = regexp.MustCompile(`^/v1/account/reservations/([-_A-Za-z0-9]{1,64})$`)
+	adminUsersPath          = "/v1/admin/users"
+	adminAccessPath         = "/v1/admin/access"
+	adminUserPathRegex      = regexp.MustCompile(`^/v1/admin/users/([-_.@a-zA-Z0-9*]+)$`)
+	adminAccessRegex        = regexp.MustCompile(`^/v1/admin/access/([-_.@a-zA-Z0-9*]+)(?:/([-_*A-Za-z0-9]{1,64}))?$`)
+	staticRegex             = regexp.MustCompile(`^/static/.+`)
+	docsRegex               = regexp.MustCompile(`^/docs(|/.*)$`)
+	fileRegex               = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
+	disallowedTopics        = []string{"docs", "static", "file", "app", "settings"} // If updated, also update in Android app
+	attachURLRegex          = regexp.MustCompile(`^https?://`)
+	idempotencyKeyRegex     = regexp.MustCompile(`^[-_.:A-Za-z0-9]{1,128}$`)
 
 	//go:embed "example.html"
 	exampleSource string
@@ -93,6 +110,14 @@ const (
 	emptyMessageBody         = "triggered"               // Used if message body is empty
 	defaultAttachmentMessage = "You received a file: %s" // Used if message body is empty, and there is an attachment
 	encodingBase64           = "base64"
+	bearerAuthPrefix         = "Bearer "
+)
+
+// contextKey is the type of the request context keys used by the server
+type contextKey int
+
+const (
+	userContextKey = contextKey(iota) // Authenticated user (*auth.User), nil for anonymous users, see userFromContext
 )
 
 // WebSocket constants
@@ -126,11 +151,38 @@ func New(conf *Config) (*Server, error) {
 		}
 	}
 	var auther auth.Auther
+	var jwtVerifier *auth.JWTVerifier
 	if conf.AuthFile != "" {
-		auther, err = auth.NewSQLiteAuth(conf.AuthFile, conf.AuthDefaultRead, conf.AuthDefaultWrite)
+		sqliteAuth, err := auth.NewSQLiteAuth(conf.AuthFile, conf.AuthDefaultRead, conf.AuthDefaultWrite)
 		if err != nil {
 			return nil, err
 		}
+		if conf.AuthProvisioning != nil {
+			if err := sqliteAuth.Provision(conf.AuthProvisioning); err != nil {
+				return nil, fmt.Errorf("cannot provision users and access control entries: %s", err.Error())
+			}
+		}
+		auther = sqliteAuth
+		if conf.AuthLDAPURL != "" {
+			auther, err = auth.NewLDAPAuth(sqliteAuth, &auth.LDAPConfig{
+				URL:                  conf.AuthLDAPURL,
+				UserDN:               conf.AuthLDAPUserDN,
+				GroupBaseDN:          conf.AuthLDAPGroupBaseDN,
+				GroupMemberAttribute: conf.AuthLDAPGroupMemberAttr,
+				GroupNameAttribute:   conf.AuthLDAPGroupNameAttr,
+				CacheDuration:        conf.AuthLDAPCacheDuration,
+				LocalFallback:        conf.AuthLDAPLocalFallback,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if conf.AuthJWTJWKS != "" {
+			jwtVerifier, err = auth.NewJWTVerifier(conf.AuthJWTJWKS, conf.AuthJWTIssuer, conf.AuthJWTAudience, conf.AuthJWTUsernameClaim, conf.AuthJWTGroupsClaim)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	var firebaseSubscriber subscriber
 	if conf.FirebaseKeyFile != "" {
@@ -148,13 +200,33 @@ func New(conf *Config) (*Server, error) {
 		mailer:       mailer,
 		topics:       topics,
 		auth:         auther,
+		jwt:          jwtVerifier,
 		visitors:     make(map[string]*visitor),
 	}, nil
 }
 
-func createMessageCache(conf *Config) (*messageCache, error) {
+// newClientCertTLSConfig returns the TLS config for the HTTPS listener if client certificate authentication
+// is enabled. Client certificates are optional, so users can still authenticate with passwords or tokens.
+func newClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no valid certificates found in client CA file %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+func createMessageCache(conf *Config) (messageCache, error) {
 	if conf.CacheDuration == 0 {
 		return newNopCache()
+	} else if conf.CacheDatabaseURL != "" {
+		return newPostgresCache(conf.CacheDatabaseURL)
 	} else if conf.CacheFile != "" {
 		return newSqliteCache(conf.CacheFile, false)
 	}
@@ -177,6 +249,14 @@ func (s *Server) Run() error {
 	if s.config.SMTPServerListen != "" {
 		listenStr += fmt.Sprintf(" %s[smtp]", s.config.SMTPServerListen)
 	}
+	var tlsConfig *tls.Config
+	if s.config.ListenHTTPS != "" && s.config.AuthClientCAFile != "" {
+		var err error
+		tlsConfig, err = newClientCertTLSConfig(s.config.AuthClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
 	log.Printf("Listening on%s", listenStr)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handle)
@@ -190,7 +270,7 @@ func (s *Server) Run() error {
 		}()
 	}
 	if s.config.ListenHTTPS != "" {
-		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux}
+		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux, TLSConfig: tlsConfig}
 		go func() {
 			errChan <- s.httpsServer.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
 		}()
@@ -280,10 +360,46 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.limitRequests(s.handleFile)(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.handleOptions(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == accountPath {
+		return s.limitRequests(s.handleAccountGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == accountPasswordPath {
+		return s.limitRequests(s.withAccount(s.handleAccountPasswordChange))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == accountTokensPath {
+		return s.limitRequests(s.withAccount(s.handleAccountTokensGet))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == accountTokensPath {
+		return s.limitRequests(s.withAccount(s.handleAccountTokensAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && accountTokenRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.withAccount(s.handleAccountTokenDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == accountReservationsPath {
+		return s.limitRequests(s.withAccount(s.handleAccountReservationsGet))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == accountReservationsPath {
+		return s.limitRequests(s.withAccount(s.handleAccountReservationAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && accountReservationRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.withAccount(s.handleAccountReservationDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == adminUsersPath {
+		return s.limitRequests(s.withAdmin(s.handleAdminUsersGet))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == adminUsersPath {
+		return s.limitRequests(s.withAdmin(s.handleAdminUsersAdd))(w, r, v)
+	} else if r.Method == http.MethodGet && adminUserPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.withAdmin(s.handleAdminUserGet))(w, r, v)
+	} else if r.Method == http.MethodPut && adminUserPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.withAdmin(s.handleAdminUserChange))(w, r, v)
+	} else if r.Method == http.MethodDelete && adminUserPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.withAdmin(s.handleAdminUserDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == adminAccessPath {
+		return s.limitRequests(s.withAdmin(s.handleAdminAccessGet))(w, r, v)
+	} else if r.Method == http.MethodPut && r.URL.Path == adminAccessPath {
+		return s.limitRequests(s.withAdmin(s.handleAdminAccessChange))(w, r, v)
+	} else if r.Method == http.MethodDelete && adminAccessRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.withAdmin(s.handleAdminAccessReset))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == publishBatchPath {
+		return s.limitRequests(s.handlePublishBatch)(w, r, v)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == "/" {
 		return s.limitRequests(s.transformBodyJSON(s.authWrite(s.handlePublish)))(w, r, v)
-	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicPathRegex.MatchString(r.URL.Path) {
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicsPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authWrite(s.handlePublish))(w, r, v)
+	} else if r.Method == http.MethodDelete && messagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authWrite(s.handleDeleteMessage))(w, r, v)
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authWrite(s.handlePublish))(w, r, v)
 	} else if r.Method == http.MethodGet && jsonPathRegex.MatchString(r.URL.Path) {
@@ -354,6 +470,7 @@ var config = {
 	return err
 }
 
+// handleUserStats returns the visitor's (per-IP) attachment usage, see also handleAccountGet
 func (s *Server) handleUserStats(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	stats, err := v.Stats()
 	if err != nil {
@@ -406,26 +523,357 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	return err
 }
 
+// handleDeleteMessage deletes a message from the cache, e.g. to cancel a scheduled message. Messages that were
+// already delivered to subscribers cannot be retracted. If the message has an attachment stored on this server,
+// the file is deleted as well.
+func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	if err := s.authorizeCapability(r, auth.CapabilityDelete); err != nil {
+		return err
+	}
+	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	matches := messagePathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 || len(topics) != 1 {
+		return errHTTPBadRequestTopicInvalid
+	}
+	m, err := s.messageCache.DeleteMessage(topicsStr, matches[1])
+	if err == errMessageNotFound {
+		return errHTTPNotFoundMessage
+	} else if err != nil {
+		return err
+	}
+	if m.Attachment != nil && m.Attachment.Owner != "" && s.fileCache != nil {
+		if err := s.fileCache.Remove(m.ID); err != nil {
+			log.Printf("error removing attachment of deleted message %s: %s", m.ID, err.Error())
+		}
+	}
+	return writeSuccess(w)
+}
+
 func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	t, err := s.topicFromPath(r.URL.Path)
+	idempotencyKey, topicsStr, err := s.parseIdempotencyKey(r)
 	if err != nil {
 		return err
 	}
-	body, err := util.Peek(r.Body, s.config.MessageLimit)
+	return s.writeIdempotentResponse(w, v, topicsStr, idempotencyKey, func() (*bytes.Buffer, error) {
+		topics, messages, cache, firebase, email, err := s.parsePublishRequest(r, v)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.sendMessages(v, topics, messages, firebase, email); err != nil {
+			return nil, err
+		}
+		s.auditPublish(v, userFromContext(r.Context()), messages)
+		if cache {
+			if err := s.messageCache.AddMessages(messages); err != nil {
+				return nil, err
+			}
+		}
+		var response bytes.Buffer // One message per line (NDJSON), if the message was published to multiple topics
+		encoder := json.NewEncoder(&response)
+		for _, m := range messages {
+			if err := encoder.Encode(m); err != nil {
+				return nil, err
+			}
+		}
+		return &response, nil
+	})
+}
+
+// writeIdempotentResponse calls the given publish function and writes its (JSON) response. If an idempotency key
+// is given, the key is reserved for the given topic(s) and visitor before publishing, and the response is stored,
+// so that a repeated request returns the original response instead of publishing again. The reservation makes
+// this safe for concurrent retries: only one of them publishes, the others fail with a conflict error until the
+// response is stored. If publishing or storing the response fails, the reservation is removed, so that the request
+// can be retried.
+func (s *Server) writeIdempotentResponse(w http.ResponseWriter, v *visitor, topicsStr, idempotencyKey string, publish func() (*bytes.Buffer, error)) error {
+	if idempotencyKey != "" {
+		expires := time.Now().Add(s.config.IdempotencyKeyDuration)
+		reserved, err := s.messageCache.ReserveIdempotencyKey(topicsStr, v.id, idempotencyKey, expires)
+		if err != nil {
+			return err
+		} else if !reserved {
+			response, err := s.messageCache.IdempotencyKeyResponse(topicsStr, v.id, idempotencyKey)
+			if err != nil {
+				return err
+			} else if response == "" {
+				return errHTTPConflictIdempotencyKeyInProgress
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+			_, err = io.WriteString(w, response)
+			return err
+		}
+	}
+	response, err := publish()
 	if err != nil {
+		if idempotencyKey != "" {
+			if err := s.messageCache.RemoveIdempotencyKey(topicsStr, v.id, idempotencyKey); err != nil {
+				log.Printf("error removing idempotency key: %s", err.Error())
+			}
+		}
 		return err
 	}
-	m := newDefaultMessage(t.ID, "")
-	cache, firebase, email, unifiedpush, err := s.parsePublishParams(r, v, m)
+	if idempotencyKey != "" {
+		// The message was published already, so the response is returned to the client in any case. If it cannot be
+		// stored, the reservation is removed, so that retries are not rejected with a conflict error until it expires.
+		if err := s.messageCache.SetIdempotencyKeyResponse(topicsStr, v.id, idempotencyKey, response.String()); err != nil {
+			log.Printf("error storing idempotency key response: %s", err.Error())
+			if err := s.messageCache.RemoveIdempotencyKey(topicsStr, v.id, idempotencyKey); err != nil {
+				log.Printf("error removing idempotency key: %s", err.Error())
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	_, err = io.Copy(w, response)
+	return err
+}
+
+// parseIdempotencyKey reads the optional idempotency key from the request, as well as the topics (as they
+// appear in the path, e.g. mytopic1,mytopic2) that the key applies to. An empty key is returned if the key was
+// not passed, or if idempotency keys are disabled.
+func (s *Server) parseIdempotencyKey(r *http.Request) (key string, topicsStr string, err error) {
+	key, err = s.readIdempotencyKey(r)
+	if err != nil || key == "" {
+		return "", "", err
+	}
+	_, topicsStr, err = s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return "", "", err
+	}
+	return key, topicsStr, nil
+}
+
+// readIdempotencyKey reads and validates the optional idempotency key from the request. An empty key is
+// returned if the key was not passed, or if idempotency keys are disabled.
+func (s *Server) readIdempotencyKey(r *http.Request) (string, error) {
+	key := readParam(r, "x-idempotency-key", "idempotency-key")
+	if key == "" || s.config.IdempotencyKeyDuration == 0 {
+		return "", nil
+	} else if !idempotencyKeyRegex.MatchString(key) {
+		return "", errHTTPBadRequestIdempotencyKeyInvalid
+	}
+	return key, nil
+}
+
+// handlePublishBatch publishes a list of messages in a single request. The request body is either a JSON array
+// or newline-delimited JSON (NDJSON) of publishMessage objects. Each message is authorized and validated on its own,
+// and all valid messages are stored in the message cache in a single transaction. The response is a JSON array
+// with one result (message or error) per message, in the order of the request. If a message is published
+// to multiple topics, the result contains the message of the first topic.
+//
+// The request as a whole only fails if nothing was stored. Once the messages are stored, errors while sending a
+// message are reported in its result (or only logged, if the message was stored, since subscribers can still
+// retrieve it), so that clients do not retry the whole batch. Like single messages, batches may be retried
+// safely with an idempotency key (see writeIdempotentResponse).
+func (s *Server) handlePublishBatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	idempotencyKey, err := s.readIdempotencyKey(r)
 	if err != nil {
 		return err
 	}
+	return s.writeIdempotentResponse(w, v, publishBatchPath, idempotencyKey, func() (*bytes.Buffer, error) {
+		results, err := s.publishBatch(r, v)
+		if err != nil {
+			return nil, err
+		}
+		var response bytes.Buffer
+		if err := json.NewEncoder(&response).Encode(results); err != nil {
+			return nil, err
+		}
+		return &response, nil
+	})
+}
+
+func (s *Server) publishBatch(r *http.Request, v *visitor) ([]*publishBatchResult, error) {
+	messages, err := s.readPublishBatch(r)
+	if err != nil {
+		return nil, err
+	}
+	user := userFromContext(r.Context()) // Authenticated in limitRequests
+	results := make([]*publishBatchResult, len(messages))
+	pending := make([]*publishBatchItem, 0)
+	for i, pm := range messages {
+		item, err := s.parsePublishBatchItem(r, v, user, pm)
+		if err != nil {
+			results[i] = &publishBatchResult{Error: asHTTPError(err)}
+			continue
+		}
+		item.index = i
+		results[i] = &publishBatchResult{Message: item.messages[0]}
+		pending = append(pending, item)
+	}
+	cached := make([]*message, 0)
+	for _, item := range pending {
+		if item.cache {
+			cached = append(cached, item.messages...)
+		}
+	}
+	if err := s.messageCache.AddMessages(cached); err != nil {
+		return nil, err // Nothing was stored or sent, the batch can be retried
+	}
+	for _, item := range pending {
+		if err := s.sendMessages(v, item.topics, item.messages, item.firebase, item.email); err != nil {
+			log.Printf("[%s] error sending message %s of batch: %s", v.ip, item.messages[0].ID, err.Error())
+			if !item.cache {
+				results[item.index] = &publishBatchResult{Error: asHTTPError(err)}
+			}
+			continue
+		}
+		s.auditPublish(v, user, item.messages)
+	}
+	return results, nil
+}
+
+// asHTTPError returns the given error if it is an *errHTTP, or errHTTPInternalError otherwise
+func asHTTPError(err error) *errHTTP {
+	if httpErr, ok := err.(*errHTTP); ok {
+		return httpErr
+	}
+	return errHTTPInternalError
+}
+
+// readPublishBatch reads the batch request body, which may either be a JSON array or
+// newline-delimited JSON (NDJSON), and enforces the batch limits
+func (s *Server) readPublishBatch(r *http.Request) ([]*publishMessage, error) {
+	body, err := util.Peek(r.Body, s.config.PublishBatchLimit*s.config.MessageLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if body.LimitReached {
+		return nil, errHTTPEntityTooLargeBatchTooLarge
+	}
+	trimmed := bytes.TrimSpace(body.PeekedBytes)
+	messages := make([]*publishMessage, 0)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &messages); err != nil {
+			return nil, errHTTPBadRequestJSONInvalid
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		for decoder.More() {
+			var m publishMessage
+			if err := decoder.Decode(&m); err != nil {
+				return nil, errHTTPBadRequestJSONInvalid
+			}
+			messages = append(messages, &m)
+		}
+	}
+	if len(messages) > s.config.PublishBatchLimit {
+		return nil, errHTTPEntityTooLargeBatchTooLarge
+	}
+	return messages, nil
+}
+
+// parsePublishBatchItem authorizes and parses a single message of a batch request. To reuse the
+// regular publishing logic, the message is converted to a request, just like with JSON publishing.
+func (s *Server) parsePublishBatchItem(r *http.Request, v *visitor, user *auth.User, pm *publishMessage) (*publishBatchItem, error) {
+	if pm == nil {
+		return nil, errHTTPBadRequestJSONInvalid
+	}
+	topicIDs, err := publishMessageTopics(pm)
+	if err != nil {
+		return nil, err
+	}
+	if s.auth != nil {
+		for _, topicID := range topicIDs {
+			if err := s.auth.Authorize(user, topicID, auth.PermissionWrite); err != nil {
+				log.Printf("unauthorized: %s", err.Error())
+				return nil, errHTTPForbidden
+			}
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, "/"+strings.Join(topicIDs, ","), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(contextWithUser(req.Context(), user))
+	req.RemoteAddr = r.RemoteAddr
+	if err := publishMessageToRequest(req, pm); err != nil {
+		return nil, err
+	}
+	topics, messages, cache, firebase, email, err := s.parsePublishRequest(req, v)
+	if err != nil {
+		return nil, err
+	}
+	return &publishBatchItem{
+		topics:   topics,
+		messages: messages,
+		cache:    cache,
+		firebase: firebase,
+		email:    email,
+	}, nil
+}
+
+// parsePublishRequest reads the topics, the publish parameters and the body from the given request, and returns
+// the resulting messages, one for each topic. It does not store or send the messages.
+//
+// If the request targets multiple topics (e.g. /mytopic1,mytopic2), all messages share the same content, but each
+// message has its own ID, so that the messages can be told apart (e.g. when a scheduled message is marked as published).
+// The attachment (if any) is only stored once (under the ID of the first message), and only the first message is marked
+// as its owner, so that it is only counted once towards the visitor's attachment limits.
+func (s *Server) parsePublishRequest(r *http.Request, v *visitor) (topics []*topic, messages []*message, cache bool, firebase bool, email string, err error) {
+	topics, _, err = s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return nil, nil, false, false, "", err
+	}
+	topics = uniqueTopics(topics)
+	body, err := util.Peek(r.Body, s.config.MessageLimit)
+	if err != nil {
+		return nil, nil, false, false, "", err
+	}
+	m := newDefaultMessage(topics[0].ID, "")
+	if user := userFromContext(r.Context()); user != nil {
+		m.Sender = user.Name // Set by the server only, never by the publisher
+	}
+	cache, firebase, email, unifiedpush, err := s.parsePublishParams(r, v, m)
+	if err != nil {
+		return nil, nil, false, false, "", err
+	}
 	if err := s.handlePublishBody(r, v, m, body, unifiedpush); err != nil {
-		return err
+		return nil, nil, false, false, "", err
 	}
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
+	if m.ContentType == contentTypeMarkdown {
+		m.Message = sanitizeMarkdown(m.Message)
+	}
+	messages = []*message{m}
+	for _, t := range topics[1:] {
+		c := *m
+		c.ID = util.RandomString(messageIDLength)
+		c.Topic = t.ID
+		if m.Attachment != nil {
+			a := *m.Attachment
+			a.Owner = ""
+			c.Attachment = &a
+		}
+		messages = append(messages, &c)
+	}
+	return topics, messages, cache, firebase, email, nil
+}
+
+// sendMessages sends the messages to the subscribers of their respective topic (see sendMessage). The
+// messages must be in the same order as the topics. The e-mail is only sent once, for the first message.
+func (s *Server) sendMessages(v *visitor, topics []*topic, messages []*message, firebase bool, email string) error {
+	for i, m := range messages {
+		if i > 0 {
+			email = ""
+		}
+		if err := s.sendMessage(v, topics[i], m, firebase, email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendMessage sends the message to all subscribers of the topic, as well as to Firebase
+// and via e-mail (if requested). Delayed messages are sent later by the sendDelayedMessages loop.
+func (s *Server) sendMessage(v *visitor, t *topic, m *message, firebase bool, email string) error {
 	delayed := m.Time > time.Now().Unix()
 	if !delayed {
 		if err := t.Publish(m); err != nil {
@@ -446,16 +894,6 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 			}
 		}()
 	}
-	if cache {
-		if err := s.messageCache.AddMessage(m); err != nil {
-			return err
-		}
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
-	if err := json.NewEncoder(w).Encode(m); err != nil {
-		return err
-	}
 	s.mu.Lock()
 	s.messages++
 	s.mu.Unlock()
@@ -467,6 +905,13 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
 	m.Title = readParam(r, "x-title", "title", "t")
 	m.Click = readParam(r, "x-click", "click")
+	m.Icon = readParam(r, "x-icon", "icon")
+	if m.Icon != "" && !attachURLRegex.MatchString(m.Icon) {
+		return false, false, "", false, errHTTPBadRequestIconURLInvalid
+	}
+	if readBoolParam(r, false, "x-markdown", "markdown", "md") {
+		m.ContentType = contentTypeMarkdown
+	}
 	filename := readParam(r, "x-filename", "filename", "file", "f")
 	attach := readParam(r, "x-attach", "attach", "a")
 	if attach != "" || filename != "" {
@@ -476,6 +921,9 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 		m.Attachment.Name = filename
 	}
 	if attach != "" {
+		if err := s.authorizeCapability(r, auth.CapabilityAttach); err != nil {
+			return false, false, "", false, err
+		}
 		if !attachURLRegex.MatchString(attach) {
 			return false, false, "", false, errHTTPBadRequestAttachmentURLInvalid
 		}
@@ -495,6 +943,9 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	}
 	email = readParam(r, "x-email", "x-e-mail", "email", "e-mail", "mail", "e")
 	if email != "" {
+		if err := s.authorizeCapability(r, auth.CapabilityEmail); err != nil {
+			return false, false, "", false, err
+		}
 		if err := v.EmailAllowed(); err != nil {
 			return false, false, "", false, errHTTPTooManyRequestsLimitEmails
 		}
@@ -509,6 +960,10 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	m.Priority, err = util.ParsePriority(readParam(r, "x-priority", "priority", "prio", "p"))
 	if err != nil {
 		return false, false, "", false, errHTTPBadRequestPriorityInvalid
+	} else if m.Priority == 5 {
+		if err := s.authorizeCapability(r, auth.CapabilityMaxPriority); err != nil {
+			return false, false, "", false, err
+		}
 	}
 	tagsStr := readParam(r, "x-tags", "tags", "tag", "ta")
 	if tagsStr != "" {
@@ -519,6 +974,9 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	}
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
+		if err := s.authorizeCapability(r, auth.CapabilityDelay); err != nil {
+			return false, false, "", false, err
+		}
 		if !cache {
 			return false, false, "", false, errHTTPBadRequestDelayNoCache
 		}
@@ -550,6 +1008,38 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	return cache, firebase, email, unifiedpush, nil
 }
 
+// authorizeCapability checks whether the user (see withAuth) may use the given publishing capability
+// on all topics of the request, and returns a capability-specific error if not
+func (s *Server) authorizeCapability(r *http.Request, capability auth.Capability) error {
+	if s.auth == nil {
+		return nil
+	}
+	topics, _, err := s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	user := userFromContext(r.Context())
+	for _, t := range topics {
+		if err := s.auth.AuthorizeCapability(user, t.ID, capability); err != nil {
+			log.Printf("unauthorized: %s (capability %s)", err.Error(), capability)
+			switch capability {
+			case auth.CapabilityAttach:
+				return errHTTPForbiddenAttachments
+			case auth.CapabilityEmail:
+				return errHTTPForbiddenEmail
+			case auth.CapabilityMaxPriority:
+				return errHTTPForbiddenMaxPriority
+			case auth.CapabilityDelay:
+				return errHTTPForbiddenDelay
+			case auth.CapabilityDelete:
+				return errHTTPForbiddenDelete
+			}
+			return errHTTPForbidden
+		}
+	}
+	return nil
+}
+
 // handlePublishBody consumes the PUT/POST body and decides whether the body is an attachment or the message.
 //
 // 1. curl -T somebinarydata.bin "ntfy.sh/mytopic?up=1"
@@ -590,7 +1080,11 @@ func (s *Server) handleBodyAsTextMessage(m *message, body *util.PeekedReadCloser
 		return errHTTPBadRequestMessageNotUTF8
 	}
 	if len(body.PeekedBytes) > 0 { // Empty body should not override message (publish via GET!)
-		m.Message = strings.TrimSpace(string(body.PeekedBytes)) // Truncates the message to the peek limit if required
+		if m.ContentType == contentTypeMarkdown {
+			m.Message = strings.TrimRight(strings.TrimLeft(string(body.PeekedBytes), "\r\n"), " \t\r\n") // Leading spaces are significant in Markdown (e.g. code blocks)
+		} else {
+			m.Message = strings.TrimSpace(string(body.PeekedBytes)) // Truncates the message to the peek limit if required
+		}
 	}
 	if m.Attachment != nil && m.Attachment.Name != "" && m.Message == "" {
 		m.Message = fmt.Sprintf(defaultAttachmentMessage, m.Attachment.Name)
@@ -603,6 +1097,8 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 		return errHTTPBadRequestAttachmentsDisallowed
 	} else if m.Time > time.Now().Add(s.config.AttachmentExpiryDuration).Unix() {
 		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery
+	} else if err := s.authorizeCapability(r, auth.CapabilityAttach); err != nil {
+		return err
 	}
 	visitorStats, err := v.Stats()
 	if err != nil {
@@ -619,7 +1115,7 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 		m.Attachment = &attachment{}
 	}
 	var ext string
-	m.Attachment.Owner = v.ip // Important for attachment rate limiting
+	m.Attachment.Owner = v.id // Important for attachment rate limiting
 	m.Attachment.Expires = time.Now().Add(s.config.AttachmentExpiryDuration).Unix()
 	m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
 	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
@@ -905,24 +1401,12 @@ func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 }
 
 func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE")
 	w.Header().Set("Access-Control-Allow-Origin", "*")  // CORS, allow cross-origin requests
 	w.Header().Set("Access-Control-Allow-Headers", "*") // CORS, allow auth via JS // FIXME is this terrible?
 	return nil
 }
 
-func (s *Server) topicFromPath(path string) (*topic, error) {
-	parts := strings.Split(path, "/")
-	if len(parts) < 2 {
-		return nil, errHTTPBadRequestTopicInvalid
-	}
-	topics, err := s.topicsFromIDs(parts[1])
-	if err != nil {
-		return nil, err
-	}
-	return topics[0], nil
-}
-
 func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
@@ -931,11 +1415,29 @@ func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	topicIDs := util.SplitNoEmpty(parts[1], ",")
 	topics, err := s.topicsFromIDs(topicIDs...)
 	if err != nil {
-		return nil, "", errHTTPBadRequestTopicInvalid
+		return nil, "", err
 	}
 	return topics, parts[1], nil
 }
 
+// uniqueTopics removes duplicate topics from the list, e.g. if a message is published to /mytopic,mytopic
+func uniqueTopics(topics []*topic) []*topic {
+	unique := make([]*topic, 0)
+	for _, t := range topics {
+		duplicate := false
+		for _, u := range unique {
+			if t.ID == u.ID {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, t)
+		}
+	}
+	return unique
+}
+
 func (s *Server) topicsFromIDs(ids ...string) ([]*topic, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -984,6 +1486,32 @@ func (s *Server) updateStatsAndPrune() {
 		log.Printf("error pruning cache: %s", err.Error())
 	}
 
+	// Prune audit log
+	if auditor, ok := s.auth.(auth.Auditor); ok {
+		var activityOlderThan, changesOlderThan time.Time
+		if s.config.AuthAuditDuration > 0 {
+			activityOlderThan = time.Now().Add(-s.config.AuthAuditDuration)
+		}
+		if s.config.AuthAuditChangesDuration > 0 {
+			changesOlderThan = time.Now().Add(-s.config.AuthAuditChangesDuration)
+		}
+		if err := auditor.PruneAuditEvents(activityOlderThan, changesOlderThan); err != nil {
+			log.Printf("error pruning audit log: %s", err.Error())
+		}
+	}
+
+	// Remove expired access control entries
+	if manager, ok := s.auth.(auth.Manager); ok {
+		if err := manager.RemoveExpiredAccess(); err != nil {
+			log.Printf("error removing expired access control entries: %s", err.Error())
+		}
+	}
+
+	// Prune expired idempotency keys
+	if err := s.messageCache.PruneIdempotencyKeys(); err != nil {
+		log.Printf("error pruning idempotency keys: %s", err.Error())
+	}
+
 	// Prune old topics, remove subscriptions without subscribers
 	var subscribers, messages int
 	for _, t := range s.topics {
@@ -1084,7 +1612,7 @@ func (s *Server) runFirebaseKeepaliver() {
 func (s *Server) sendDelayedMessages() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	messages, err := s.messageCache.MessagesDue()
+	messages, err := s.messageCache.ClaimMessagesDue()
 	if err != nil {
 		return err
 	}
@@ -1100,15 +1628,24 @@ func (s *Server) sendDelayedMessages() error {
 				log.Printf("unable to publish to Firebase: %v", err.Error())
 			}
 		}
-		if err := s.messageCache.MarkPublished(m); err != nil {
-			return err
-		}
 	}
 	return nil
 }
 
+// limitRequests authenticates the user (if any), and only calls the next handler if the visitor's request limit
+// has not been reached. Authenticated users are rate limited per user instead of per IP address (see userVisitor).
+// The user is passed on to the next handler via the request context, see userFromContext.
 func (s *Server) limitRequests(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.auth != nil {
+			user, err := s.authenticate(r, v)
+			if err != nil {
+				return err
+			} else if user != nil {
+				v = s.userVisitor(user, v)
+				r = r.WithContext(contextWithUser(r.Context(), user))
+			}
+		}
 		if util.InStringList(s.config.VisitorRequestExemptIPAddrs, v.ip) {
 			return next(w, r, v)
 		} else if err := v.RequestAllowed(); err != nil {
@@ -1131,47 +1668,81 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if err := json.NewDecoder(body).Decode(&m); err != nil {
 			return errHTTPBadRequestJSONInvalid
 		}
-		if !topicRegex.MatchString(m.Topic) {
-			return errHTTPBadRequestTopicInvalid
-		}
-		if m.Message == "" {
-			m.Message = emptyMessageBody
-		}
-		r.URL.Path = "/" + m.Topic
-		r.Body = io.NopCloser(strings.NewReader(m.Message))
-		if m.Title != "" {
-			r.Header.Set("X-Title", m.Title)
-		}
-		if m.Priority != 0 {
-			r.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
-		}
-		if m.Tags != nil && len(m.Tags) > 0 {
-			r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
-		}
-		if m.Attach != "" {
-			r.Header.Set("X-Attach", m.Attach)
-		}
-		if m.Filename != "" {
-			r.Header.Set("X-Filename", m.Filename)
-		}
-		if m.Click != "" {
-			r.Header.Set("X-Click", m.Click)
+		topics, err := publishMessageTopics(&m)
+		if err != nil {
+			return err
 		}
-		if len(m.Actions) > 0 {
-			actionsStr, err := json.Marshal(m.Actions)
-			if err != nil {
-				return errHTTPBadRequestJSONInvalid
-			}
-			r.Header.Set("X-Actions", string(actionsStr))
+		r.URL.Path = "/" + strings.Join(topics, ",")
+		if err := publishMessageToRequest(r, &m); err != nil {
+			return err
 		}
-		if m.Email != "" {
-			r.Header.Set("X-Email", m.Email)
+		return next(w, r, v)
+	}
+}
+
+// publishMessageTopics returns the list of topics of the JSON message, combining the "topic" and "topics" fields
+func publishMessageTopics(m *publishMessage) ([]string, error) {
+	topics := make([]string, 0)
+	if m.Topic != "" {
+		topics = append(topics, m.Topic)
+	}
+	topics = append(topics, m.Topics...)
+	if len(topics) == 0 {
+		return nil, errHTTPBadRequestTopicInvalid
+	}
+	for _, t := range topics {
+		if !topicRegex.MatchString(t) {
+			return nil, errHTTPBadRequestTopicInvalid
 		}
-		if m.Delay != "" {
-			r.Header.Set("X-Delay", m.Delay)
+	}
+	return topics, nil
+}
+
+// publishMessageToRequest converts the JSON message to the request body and headers, so that
+// it can be handled like any other publish request
+func publishMessageToRequest(r *http.Request, m *publishMessage) error {
+	if m.Message == "" {
+		m.Message = emptyMessageBody
+	}
+	r.Body = io.NopCloser(strings.NewReader(m.Message))
+	if m.Title != "" {
+		r.Header.Set("X-Title", m.Title)
+	}
+	if m.Priority != 0 {
+		r.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
+	}
+	if m.Tags != nil && len(m.Tags) > 0 {
+		r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
+	}
+	if m.Attach != "" {
+		r.Header.Set("X-Attach", m.Attach)
+	}
+	if m.Filename != "" {
+		r.Header.Set("X-Filename", m.Filename)
+	}
+	if m.Click != "" {
+		r.Header.Set("X-Click", m.Click)
+	}
+	if m.Icon != "" {
+		r.Header.Set("X-Icon", m.Icon)
+	}
+	if len(m.Actions) > 0 {
+		actionsStr, err := json.Marshal(m.Actions)
+		if err != nil {
+			return errHTTPBadRequestJSONInvalid
 		}
-		return next(w, r, v)
+		r.Header.Set("X-Actions", string(actionsStr))
+	}
+	if m.Email != "" {
+		r.Header.Set("X-Email", m.Email)
+	}
+	if m.Delay != "" {
+		r.Header.Set("X-Delay", m.Delay)
 	}
+	if m.Markdown {
+		r.Header.Set("X-Markdown", "yes")
+	}
+	return nil
 }
 
 func (s *Server) authWrite(next handleFunc) handleFunc {
@@ -1191,14 +1762,7 @@ func (s *Server) withAuth(next handleFunc, perm auth.Permission) handleFunc {
 		if err != nil {
 			return err
 		}
-		var user *auth.User // may stay nil if no auth header!
-		username, password, ok := extractUserPass(r)
-		if ok {
-			if user, err = s.auth.Authenticate(username, password); err != nil {
-				log.Printf("authentication failed: %s", err.Error())
-				return errHTTPUnauthorized
-			}
-		}
+		user := userFromContext(r.Context()) // Authenticated in limitRequests
 		for _, t := range topics {
 			if err := s.auth.Authorize(user, t.ID, perm); err != nil {
 				log.Printf("unauthorized: %s", err.Error())
@@ -1209,6 +1773,218 @@ func (s *Server) withAuth(next handleFunc, perm auth.Permission) handleFunc {
 	}
 }
 
+// contextWithUser returns a copy of the context that carries the authenticated user, see userFromContext
+func contextWithUser(ctx context.Context, user *auth.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// userFromContext returns the authenticated user from the request context, or nil for anonymous users
+func userFromContext(ctx context.Context) *auth.User {
+	user, _ := ctx.Value(userContextKey).(*auth.User)
+	return user
+}
+
+// authenticate reads the credentials from the request and authenticates the user. The returned
+// user may be nil if no credentials were passed, in which case the anonymous user is assumed.
+// Credentials may either be an access token (Authorization: Bearer ...), or username/password.
+func (s *Server) authenticate(r *http.Request, v *visitor) (*auth.User, error) {
+	var user *auth.User
+	var err error
+	var method, username string // For the audit log
+	guessable := false          // Passwords and tokens can be guessed, and failures count towards the visitor's lockout
+	if proxyUsername, ok := s.extractProxyUser(r); ok {
+		method, username = "proxy", proxyUsername
+		user, err = s.authenticateProxyUser(username)
+	} else if token, ok := extractToken(r); ok {
+		if err := v.LoginAllowed(); err != nil {
+			return nil, errHTTPTooManyRequestsLimitLogins
+		}
+		guessable = true
+		if s.jwt != nil && strings.Count(token, ".") == 2 { // JWTs have three parts, access tokens (tk_...) have one
+			method = "jwt"
+			user, err = s.authenticateJWT(token)
+		} else {
+			method = "token"
+			user, err = s.auth.AuthenticateToken(token)
+		}
+	} else if basicUsername, password, ok := extractUserPass(r); ok {
+		if err := v.LoginAllowed(); err != nil {
+			return nil, errHTTPTooManyRequestsLimitLogins
+		}
+		guessable = true
+		method, username = "password", basicUsername
+		user, err = s.auth.Authenticate(username, password)
+	} else if certUsername, ok := s.extractClientCertUser(r); ok {
+		method, username = "client-cert", certUsername
+		user, err = s.authenticateClientCertUser(username)
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		// The "[<ip>] authentication failed" prefix is stable, so it can be matched by tools like fail2ban
+		log.Printf("[%s] authentication failed: %s", v.ip, err.Error())
+		s.audit(&auth.AuditEvent{Action: auth.AuditActionLoginFailure, Subject: username, IP: v.ip, Detail: method + ": " + err.Error()})
+		if guessable {
+			if lockout := v.LoginFailed(); lockout > 0 {
+				log.Printf("[%s] Too many failed logins, locking out IP address for %s", v.ip, lockout)
+			}
+		}
+		return nil, errHTTPUnauthorized // Also if the user is locked out, to not reveal whether the user exists
+	}
+	s.audit(&auth.AuditEvent{Action: auth.AuditActionLoginSuccess, Subject: user.Name, IP: v.ip, Detail: method})
+	return user, nil
+}
+
+// audit records the given event in the audit log, if the auth backend keeps one and auth-audit-duration is set.
+// Changes made through the auth.Manager are recorded by the backend itself.
+func (s *Server) audit(event *auth.AuditEvent) {
+	auditor, ok := s.auth.(auth.Auditor)
+	if !ok || s.config.AuthAuditDuration == 0 {
+		return
+	}
+	if err := auditor.Audit(event); err != nil {
+		log.Printf("error writing audit log: %s", err.Error())
+	}
+}
+
+// auditPublish records the given messages in the audit log, if they were published by an authenticated user
+func (s *Server) auditPublish(v *visitor, user *auth.User, messages []*message) {
+	if user == nil {
+		return
+	}
+	for _, m := range messages {
+		s.audit(&auth.AuditEvent{Action: auth.AuditActionPublish, Actor: user.Name, Topic: m.Topic, IP: v.ip, Detail: m.ID})
+	}
+}
+
+// manager returns the auth.Manager for the admin and account API. If the auth backend keeps an audit log,
+// the authenticated user is recorded as the actor of all changes.
+func (s *Server) manager(r *http.Request) auth.Manager {
+	if auditor, ok := s.auth.(auth.Auditor); ok {
+		if user := userFromContext(r.Context()); user != nil {
+			return auditor.WithActor(user.Name)
+		}
+	}
+	return s.auth.(auth.Manager)
+}
+
+// extractProxyUser reads the username from the configured auth-proxy-header, if the request comes directly
+// from one of the trusted proxies. The header is ignored for all other requests, since anyone could set it.
+func (s *Server) extractProxyUser(r *http.Request) (username string, ok bool) {
+	if s.config.AuthProxyHeader == "" {
+		return "", false
+	}
+	username = strings.TrimSpace(r.Header.Get(s.config.AuthProxyHeader))
+	if username == "" {
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr // This should not happen in real life; only in tests.
+	}
+	ip := net.ParseIP(host)
+	if ip != nil {
+		for _, ipNet := range s.config.AuthProxyTrustedNets {
+			if ipNet.Contains(ip) {
+				return username, true
+			}
+		}
+	}
+	log.Printf("[%s] Ignoring %s header, request does not come from a trusted proxy", r.RemoteAddr, s.config.AuthProxyHeader)
+	return "", false
+}
+
+// authenticateProxyUser looks up a user that was authenticated by a trusted proxy. If auth-proxy-auto-provision
+// is set, unknown users are created with the user role and a random password.
+func (s *Server) authenticateProxyUser(username string) (*auth.User, error) {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return nil, errors.New("proxy authentication requires an auth database")
+	} else if username == auth.Everyone || !auth.AllowedUsername(username) {
+		return nil, fmt.Errorf("invalid username %s in proxy header", username)
+	}
+	user, err := manager.User(username)
+	if err == auth.ErrNotFound && s.config.AuthProxyAutoProvision {
+		log.Printf("Auto-provisioning user %s authenticated via proxy header", username)
+		if err := manager.AddUser(username, util.RandomString(32), auth.RoleUser); err != nil {
+			return nil, err
+		}
+		return manager.User(username)
+	}
+	return user, err
+}
+
+// authenticateJWT verifies a JWT issued by the configured identity provider (see auth-jwt-jwks), and returns
+// the user it asserts, including its groups. Users do not have to exist in the auth database; if they do,
+// their role, entries and group memberships are considered as well.
+func (s *Server) authenticateJWT(token string) (*auth.User, error) {
+	identity, err := s.jwt.Verify(token)
+	if err != nil {
+		return nil, err
+	} else if identity.Username == auth.Everyone || !auth.AllowedUsername(identity.Username) {
+		return nil, fmt.Errorf("invalid username %s in token", identity.Username)
+	}
+	user, err := s.auth.(auth.Manager).User(identity.Username)
+	if err == auth.ErrNotFound {
+		user = &auth.User{Name: identity.Username, Role: auth.RoleUser}
+	} else if err != nil {
+		return nil, err
+	}
+	user.ExternalGroups = identity.Groups
+	return user, nil
+}
+
+// extractClientCertUser returns the username for the verified client certificate of the request (see
+// auth-client-ca-file). The username is taken from the configured certificate field, and may be mapped to
+// a different username via auth-client-cert-mapping. For SAN fields, the first mapped value wins.
+func (s *Server) extractClientCertUser(r *http.Request) (username string, ok bool) {
+	if s.config.AuthClientCAFile == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var values []string
+	switch s.config.AuthClientCertUsername {
+	case ClientCertUsernameCN:
+		values = []string{cert.Subject.CommonName}
+	case ClientCertUsernameSANDNS:
+		values = cert.DNSNames
+	case ClientCertUsernameSANEmail:
+		values = cert.EmailAddresses
+	}
+	for _, value := range values {
+		if mapped, ok := s.config.AuthClientCertMapping[value]; ok {
+			return mapped, true
+		}
+	}
+	if len(values) == 0 || values[0] == "" {
+		log.Printf("[%s] Ignoring client certificate, field %s is empty", r.RemoteAddr, s.config.AuthClientCertUsername)
+		return "", false
+	}
+	return values[0], true
+}
+
+// authenticateClientCertUser looks up the user of a verified client certificate. Unlike with proxy
+// authentication, the user must exist in the auth database.
+func (s *Server) authenticateClientCertUser(username string) (*auth.User, error) {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return nil, errors.New("client certificate authentication requires an auth database")
+	} else if username == auth.Everyone || !auth.AllowedUsername(username) {
+		return nil, fmt.Errorf("invalid username %s in client certificate", username)
+	}
+	return manager.User(username)
+}
+
+// extractToken reads the access token from the bearer auth header (Authorization: Bearer ...),
+// or from the ?auth=... query param, see extractUserPass for details.
+func extractToken(r *http.Request) (token string, ok bool) {
+	value := strings.TrimSpace(readAuthHeader(r))
+	if len(value) <= len(bearerAuthPrefix) || !strings.EqualFold(value[:len(bearerAuthPrefix)], bearerAuthPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(value[len(bearerAuthPrefix):]), true
+}
+
 // extractUserPass reads the username/password from the basic auth header (Authorization: Basic ...),
 // or from the ?auth=... query param. The latter is required only to support the WebSocket JavaScript
 // class, which does not support passing headers during the initial request. The auth query param
@@ -1218,16 +1994,29 @@ func extractUserPass(r *http.Request) (username string, password string, ok bool
 	if ok {
 		return
 	}
+	value := readAuthHeader(r)
+	if value != "" {
+		r.Header.Set("Authorization", value)
+		return r.BasicAuth()
+	}
+	return
+}
+
+// readAuthHeader returns the value of the Authorization header, or if it is not set, the decoded
+// value of the ?auth=... query param, e.g. "Basic cGhpbDpteXBhc3M=" or "Bearer tk_...".
+func readAuthHeader(r *http.Request) string {
+	if value := r.Header.Get("Authorization"); value != "" {
+		return value
+	}
 	authParam := readQueryParam(r, "authorization", "auth")
 	if authParam != "" {
 		a, err := base64.RawURLEncoding.DecodeString(authParam)
 		if err != nil {
-			return
+			return ""
 		}
-		r.Header.Set("Authorization", string(a))
-		return r.BasicAuth()
+		return string(a)
 	}
-	return
+	return ""
 }
 
 // visitor creates or retrieves a rate.Limiter for the given visitor.
@@ -1245,9 +2034,27 @@ func (s *Server) visitor(r *http.Request) *visitor {
 	}
 	v, exists := s.visitors[ip]
 	if !exists {
-		s.visitors[ip] = newVisitor(s.config, s.messageCache, ip)
+		s.visitors[ip] = newVisitor(s.config, s.messageCache, ip, ip, nil)
 		return s.visitors[ip]
 	}
 	v.Keepalive()
 	return v
 }
+
+// userVisitor returns the visitor of the given authenticated user, with the IP address of the given visitor.
+// All requests of a user share the same limits, regardless of the IP address they come from (see visitor.withIP).
+// The limits are those of the user's tier, or the defaults. If the tier has changed, the limits are updated.
+func (s *Server) userVisitor(user *auth.User, ipVisitor *visitor) *visitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := userVisitorPrefix + user.Name
+	v, exists := s.visitors[id]
+	if !exists {
+		v = newVisitor(s.config, s.messageCache, id, ipVisitor.ip, user.Tier)
+		s.visitors[id] = v
+	} else {
+		v.Keepalive()
+		v.SetTier(user.Tier)
+	}
+	return v.withIP(ipVisitor.ip)
+}
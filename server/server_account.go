@@ -0,0 +1,259 @@
+package server
+
+import (
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The account API allows authenticated users to manage their own account, without the help of an admin:
+//
+//   GET    /v1/account                 Show role, grants, groups and usage stats (also works for anonymous users)
+//   POST   /v1/account/password        Change password, body: {"password":..,"newPassword":..}
+//   GET    /v1/account/tokens          List access tokens
+//   POST   /v1/account/tokens          Create access token, body: {"label":..,"expires":..,"scopes":[..]}
+//   DELETE /v1/account/tokens/<token>  Remove access token
+//   GET    /v1/account/reservations          List reserved topics
+//   POST   /v1/account/reservations          Reserve a topic, body: {"topic":..}
+//   DELETE /v1/account/reservations/<topic>  Remove a topic reservation
+
+// withAccount only calls the next handler if the user is logged in (see limitRequests). The
+// account API is only available if access control is enabled, and not to scoped tokens, since they
+// could otherwise be used to create unrestricted tokens.
+func (s *Server) withAccount(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if _, ok := s.auth.(auth.Manager); !ok {
+			return errHTTPNotFound
+		}
+		user := userFromContext(r.Context()) // Authenticated in limitRequests
+		if user == nil {
+			return errHTTPUnauthorized
+		} else if len(user.Scopes) > 0 {
+			log.Printf("unauthorized: scoped token of user %s cannot access account API", user.Name)
+			return errHTTPForbidden
+		} else if _, err := s.auth.(auth.Manager).User(user.Name); err == auth.ErrNotFound {
+			log.Printf("unauthorized: user %s is not in the auth database (authenticated via identity provider)", user.Name)
+			return errHTTPForbidden
+		} else if err != nil {
+			return err
+		}
+		return next(w, r, v)
+	}
+}
+
+// handleAccountGet returns the current user's role, grants and groups, as well as the visitor's
+// usage stats (see handleUserStats). Anonymous users see the grants of the everyone user. Users authenticated via
+// an identity provider (see authenticateJWT) may not exist in the auth database, and only see their groups.
+func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	stats, err := v.Stats()
+	if err != nil {
+		return err
+	}
+	account := &apiAccount{
+		Username: auth.Everyone,
+		Role:     string(auth.RoleAnonymous),
+		Grants:   make([]*apiGrant, 0),
+		Groups:   make([]string, 0),
+		Stats:    stats,
+	}
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return writeJSON(w, account)
+	}
+	user := userFromContext(r.Context())
+	username := auth.Everyone
+	if user != nil {
+		username = user.Name
+	}
+	u, err := manager.User(username)
+	if err == auth.ErrNotFound && user != nil {
+		u = user
+	} else if err != nil {
+		return err
+	}
+	account.Username = u.Name
+	account.Role = string(u.Role)
+	if u.Tier != nil {
+		account.Tier = u.Tier.Code
+	}
+	for _, grant := range u.Grants {
+		account.Grants = append(account.Grants, toAPIGrant(grant))
+	}
+	if u.Groups != nil {
+		account.Groups = u.Groups
+	}
+	if user != nil {
+		for _, group := range user.ExternalGroups {
+			if !util.InStringList(account.Groups, group) {
+				account.Groups = append(account.Groups, group)
+			}
+		}
+	}
+	return writeJSON(w, account)
+}
+
+func (s *Server) handleAccountPasswordChange(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	user := userFromContext(r.Context())
+	var req apiAccountPasswordRequest
+	if err := readJSONBody(r, &req); err != nil || req.NewPassword == "" {
+		return errHTTPBadRequestAccountInvalid
+	}
+	if _, err := s.auth.Authenticate(user.Name, req.Password); err != nil {
+		return errHTTPBadRequestPasswordIncorrect
+	}
+	if err := s.manager(r).ChangePassword(user.Name, req.NewPassword); err != nil {
+		return err
+	}
+	return writeSuccess(w)
+}
+
+func (s *Server) handleAccountTokensGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	user := userFromContext(r.Context())
+	tokens, err := s.auth.(auth.Manager).Tokens(user.Name)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAccountToken, 0)
+	for _, t := range tokens {
+		response = append(response, toAPIAccountToken(t))
+	}
+	return writeJSON(w, response)
+}
+
+func (s *Server) handleAccountTokensAdd(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	user := userFromContext(r.Context())
+	var req apiAccountTokenRequest
+	if err := readJSONBody(r, &req); err != nil {
+		return errHTTPBadRequestAccountInvalid
+	}
+	expires := time.Time{}
+	if req.Expires != "" {
+		var err error
+		expires, err = util.ParseFutureTime(req.Expires, time.Now())
+		if err != nil {
+			return errHTTPBadRequestAccountInvalid
+		}
+	}
+	scopes := make([]auth.Grant, 0)
+	for _, scope := range req.Scopes {
+		if scope == nil || !auth.AllowedTopicPattern(scope.Topic) || (!scope.Read && !scope.Write) {
+			return errHTTPBadRequestAccountInvalid
+		}
+		scopes = append(scopes, auth.Grant{
+			TopicPattern: scope.Topic,
+			AllowRead:    scope.Read,
+			AllowWrite:   scope.Write,
+		})
+	}
+	token, err := s.manager(r).CreateToken(user.Name, req.Label, expires, scopes)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, toAPIAccountToken(token))
+}
+
+func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	user := userFromContext(r.Context())
+	token := accountTokenRegex.FindStringSubmatch(r.URL.Path)[1]
+	if err := s.manager(r).RemoveToken(user.Name, token); err == auth.ErrNotFound {
+		return errHTTPNotFoundToken
+	} else if err != nil {
+		return err
+	}
+	return writeSuccess(w)
+}
+
+func (s *Server) handleAccountReservationsGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	user := userFromContext(r.Context())
+	reservations, err := s.auth.(auth.Manager).Reservations(user.Name)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAccountReservation, 0)
+	for _, reservation := range reservations {
+		response = append(response, toAPIAccountReservation(reservation))
+	}
+	return writeJSON(w, response)
+}
+
+// handleAccountReservationAdd reserves a topic for the current user, see auth.Manager.AddReservation. The user
+// must have write access to the topic. The number of reservations is limited by the auth-reservation-limit option,
+// or the reservation limit of the user's tier.
+func (s *Server) handleAccountReservationAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	user := userFromContext(r.Context())
+	manager := s.manager(r)
+	var req apiAccountReservationRequest
+	if err := readJSONBody(r, &req); err != nil || !auth.AllowedTopic(req.Topic) || util.InStringList(disallowedTopics, req.Topic) {
+		return errHTTPBadRequestReservationInvalid
+	}
+	if reservation, err := manager.Reservation(req.Topic); err == nil {
+		if reservation.Username != user.Name {
+			return errHTTPConflictTopicReserved
+		}
+		return writeJSON(w, toAPIAccountReservation(reservation)) // Already reserved by this user
+	} else if err != auth.ErrNotFound {
+		return err
+	}
+	if err := s.auth.Authorize(user, req.Topic, auth.PermissionWrite); err != nil {
+		return errHTTPForbidden
+	}
+	reservations, err := manager.Reservations(user.Name)
+	if err != nil {
+		return err
+	} else if len(reservations) >= v.Limits().ReservationLimit {
+		return errHTTPTooManyRequestsLimitReservations
+	}
+	if err := manager.AddReservation(user.Name, req.Topic); err == auth.ErrTopicReserved {
+		return errHTTPConflictTopicReserved
+	} else if err == auth.ErrTopicInUse {
+		return errHTTPConflictTopicInUse
+	} else if err != nil {
+		return err
+	}
+	reservation, err := manager.Reservation(req.Topic)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, toAPIAccountReservation(reservation))
+}
+
+func (s *Server) handleAccountReservationDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	user := userFromContext(r.Context())
+	topic := accountReservationRegex.FindStringSubmatch(r.URL.Path)[1]
+	if err := s.manager(r).RemoveReservation(user.Name, topic); err == auth.ErrNotFound {
+		return errHTTPNotFoundReservation
+	} else if err != nil {
+		return err
+	}
+	return writeSuccess(w)
+}
+
+func toAPIAccountReservation(r *auth.Reservation) *apiAccountReservation {
+	return &apiAccountReservation{
+		Topic:   r.Topic,
+		Created: r.Created.Unix(),
+	}
+}
+
+func toAPIAccountToken(t *auth.Token) *apiAccountToken {
+	token := &apiAccountToken{
+		Token: t.Value,
+		Label: t.Label,
+	}
+	if !t.LastAccess.IsZero() {
+		token.LastAccess = t.LastAccess.Unix()
+	}
+	if !t.Expires.IsZero() {
+		token.Expires = t.Expires.Unix()
+	}
+	for _, scope := range t.Scopes {
+		token.Scopes = append(token.Scopes, &apiGrant{
+			Topic: scope.TopicPattern,
+			Read:  scope.AllowRead,
+			Write: scope.AllowWrite,
+		})
+	}
+	return token
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Account_Get(t *testing.T) {
+	s := newTestServerWithAccount(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AllowAccess("ben", "mytopic", true, false))
+	require.Nil(t, manager.AddGroup("devs"))
+	require.Nil(t, manager.AddGroupMember("devs", "ben"))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "announcements", true, false))
+
+	response := request(t, s, "GET", "/v1/account", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+	account := toAPIAccountForTest(t, response.Body.String())
+	require.Equal(t, "ben", account.Username)
+	require.Equal(t, "user", account.Role)
+	require.Equal(t, []*apiGrant{{Topic: "mytopic", Read: true, Capabilities: auth.Capabilities}}, account.Grants)
+	require.Equal(t, []string{"devs"}, account.Groups)
+	require.Equal(t, int64(5000), account.Stats.AttachmentFileSizeLimit)
+
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account = toAPIAccountForTest(t, response.Body.String())
+	require.Equal(t, "*", account.Username)
+	require.Equal(t, "anonymous", account.Role)
+	require.Equal(t, "announcements", account.Grants[0].Topic)
+
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{"Authorization": basicAuth("ben:wrong")})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_Account_Get_Tier(t *testing.T) {
+	s := newTestServerWithAccount(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", AttachmentTotalSizeLimit: 1024 * 1024 * 1024}))
+	require.Nil(t, manager.ChangeUserTier("ben", "pro"))
+
+	response := request(t, s, "GET", "/v1/account", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+	account := toAPIAccountForTest(t, response.Body.String())
+	require.Equal(t, "pro", account.Tier)
+	require.Equal(t, int64(1024*1024*1024), account.Stats.VisitorAttachmentBytesTotal)
+
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account = toAPIAccountForTest(t, response.Body.String())
+	require.Equal(t, "", account.Tier)
+	require.Equal(t, s.config.VisitorAttachmentTotalSizeLimit, account.Stats.VisitorAttachmentBytesTotal)
+}
+
+func TestServer_Account_Get_AuthDisabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account := toAPIAccountForTest(t, response.Body.String())
+	require.Equal(t, "*", account.Username)
+	require.Equal(t, 0, len(account.Grants))
+	require.NotNil(t, account.Stats)
+
+	response = request(t, s, "GET", "/v1/account/tokens", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Account_ChangePassword(t *testing.T) {
+	s := newTestServerWithAccount(t)
+
+	response := request(t, s, "POST", "/v1/account/password", `{"password":"wrong","newPassword":"newpass"}`, map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40024, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/account/password", `{"password":"ben"}`, map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 40023, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/account/password", `{"password":"ben","newPassword":"newpass"}`, map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{"Authorization": basicAuth("ben:newpass")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "POST", "/v1/account/password", `{"password":"ben","newPassword":"newpass"}`, nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_Account_Tokens(t *testing.T) {
+	s := newTestServerWithAccount(t)
+	headers := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/v1/account/tokens", `{"label":"ci","expires":"30d","scopes":[{"topic":"backup-*","write":true}]}`, headers)
+	require.Equal(t, 200, response.Code)
+	var token apiAccountToken
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&token))
+	require.True(t, strings.HasPrefix(token.Token, "tk_"))
+	require.Equal(t, "ci", token.Label)
+	require.Equal(t, int64(0), token.LastAccess)
+	require.True(t, token.Expires > time.Now().Add(29*24*time.Hour).Unix())
+	require.Equal(t, []*apiGrant{{Topic: "backup-*", Write: true}}, token.Scopes)
+
+	response = request(t, s, "GET", "/v1/account/tokens", "", headers)
+	require.Equal(t, 200, response.Code)
+	var tokens []*apiAccountToken
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&tokens))
+	require.Equal(t, 1, len(tokens))
+	require.Equal(t, token.Token, tokens[0].Token)
+
+	// Scoped tokens cannot manage tokens themselves
+	response = request(t, s, "GET", "/v1/account/tokens", "", map[string]string{"Authorization": "Bearer " + token.Token})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "DELETE", "/v1/account/tokens/"+token.Token, "", headers)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "DELETE", "/v1/account/tokens/"+token.Token, "", headers)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40403, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/account/tokens", `{"expires":"not a date"}`, headers)
+	require.Equal(t, 40023, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/account/tokens", `{"scopes":[{"topic":"mytopic"}]}`, headers)
+	require.Equal(t, 40023, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Account_Tokens_OtherUser(t *testing.T) {
+	s := newTestServerWithAccount(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	token, err := manager.CreateToken("phil", "", time.Time{}, nil)
+	require.Nil(t, err)
+
+	// Ben cannot delete phil's token
+	response := request(t, s, "DELETE", "/v1/account/tokens/"+token.Value, "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 404, response.Code)
+	tokens, err := manager.Tokens("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tokens))
+}
+
+func TestServer_Account_Reservations(t *testing.T) {
+	s := newTestServerWithAccount(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "mytopic", true, true))
+	headers := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/v1/account/reservations", `{"topic":"mytopic"}`, headers)
+	require.Equal(t, 200, response.Code)
+	var reservation apiAccountReservation
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&reservation))
+	require.Equal(t, "mytopic", reservation.Topic)
+	require.True(t, reservation.Created > 0)
+
+	response = request(t, s, "GET", "/v1/account/reservations", "", headers)
+	require.Equal(t, 200, response.Code)
+	var reservations []*apiAccountReservation
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&reservations))
+	require.Equal(t, 1, len(reservations))
+	require.Equal(t, "mytopic", reservations[0].Topic)
+
+	// Owner can publish, others cannot
+	response = request(t, s, "PUT", "/mytopic", "hi", headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 403, response.Code)
+
+	// Phil cannot take over or remove ben's reservation
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"mytopic"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40902, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "DELETE", "/v1/account/reservations/mytopic", "", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40404, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"docs"}`, headers)
+	require.Equal(t, 40025, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"my*"}`, headers)
+	require.Equal(t, 40025, toHTTPError(t, response.Body.String()).Code)
+
+	// Topics without write access cannot be reserved (default access is deny-all)
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"othertopic"}`, headers)
+	require.Equal(t, 403, response.Code)
+
+	// Removing the reservation restores ben's previous entry, and lifts the deny for everyone
+	response = request(t, s, "DELETE", "/v1/account/reservations/mytopic", "", headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", headers)
+	require.Equal(t, 200, response.Code)
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "mytopic", true, false))
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 403, response.Code)
+	remaining, err := manager.Reservations("ben")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(remaining))
+
+	// Topics with entries of other users cannot be reserved
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"mytopic"}`, headers)
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40904, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Account_Reservations_DefaultLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	s := newTestServer(t, c)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("ben", "ben", auth.RoleUser))
+
+	// Only users with a tier can reserve topics by default
+	response := request(t, s, "POST", "/v1/account/reservations", `{"topic":"mytopic"}`, map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42907, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Account_Reservations_Limit(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthReservationLimit = 1
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	headers := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/v1/account/reservations", `{"topic":"topic1"}`, headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"topic1"}`, headers)
+	require.Equal(t, 200, response.Code) // Already reserved by ben
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"topic2"}`, headers)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42907, toHTTPError(t, response.Body.String()).Code)
+
+	// A tier overrides the limit
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", ReservationLimit: 2}))
+	require.Nil(t, manager.ChangeUserTier("ben", "pro"))
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"topic2"}`, headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"topic3"}`, headers)
+	require.Equal(t, 42907, toHTTPError(t, response.Body.String()).Code)
+
+	// Anonymous users cannot reserve topics
+	response = request(t, s, "POST", "/v1/account/reservations", `{"topic":"topic4"}`, nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func newTestServerWithAccount(t *testing.T) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.AttachmentFileSizeLimit = 5000
+	c.AuthReservationLimit = 3
+	s := newTestServer(t, c)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("ben", "ben", auth.RoleUser))
+	return s
+}
+
+func toAPIAccountForTest(t *testing.T, s string) *apiAccount {
+	var a apiAccount
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&a))
+	return &a
+}
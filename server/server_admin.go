@@ -0,0 +1,265 @@
+package server
+
+import (
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The admin API allows managing users and the access control list remotely. It is backed by auth.Manager,
+// just like the 'ntfy user' and 'ntfy access' commands, and is only available to users with the admin role.
+//
+//   GET    /v1/admin/users                    List all users (including the everyone user "*")
+//   POST   /v1/admin/users                    Add a user, body: {"username":..,"password":..,"role":..}
+//   GET    /v1/admin/users/<user>             Show a single user
+//   PUT    /v1/admin/users/<user>             Change password and/or role, body: {"password":..,"role":..}
+//   DELETE /v1/admin/users/<user>             Remove a user
+//   GET    /v1/admin/access                   List all access control entries
+//   PUT    /v1/admin/access                   Add/change an entry, body: {"username":..,"topic":..,"read":..,"write":..,"expires":..}
+//   DELETE /v1/admin/access/<user>[/<topic>]  Reset all entries of a user, or a single entry
+
+const (
+	adminUserEveryone = "everyone"
+)
+
+// withAdmin only calls the next handler if the authenticated user (see limitRequests) has the admin role.
+// The admin API is only available if access control is enabled, and not to scoped tokens.
+func (s *Server) withAdmin(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if _, ok := s.auth.(auth.Manager); !ok {
+			return errHTTPNotFound
+		}
+		user := userFromContext(r.Context()) // Authenticated in limitRequests
+		if user == nil {
+			return errHTTPUnauthorized
+		} else if user.Role != auth.RoleAdmin || len(user.Scopes) > 0 {
+			log.Printf("unauthorized: user %s cannot access admin API", user.Name)
+			return errHTTPForbidden
+		}
+		return next(w, r, v)
+	}
+}
+
+func (s *Server) handleAdminUsersGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	users, err := s.auth.(auth.Manager).Users()
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAdminUser, 0)
+	for _, u := range users {
+		response = append(response, toAPIAdminUser(u))
+	}
+	return writeJSON(w, response)
+}
+
+func (s *Server) handleAdminUsersAdd(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager := s.manager(r)
+	var req apiAdminUserRequest
+	if err := readJSONBody(r, &req); err != nil {
+		return errHTTPBadRequestUserInvalid
+	}
+	role := auth.Role(req.Role)
+	if role == "" {
+		role = auth.RoleUser
+	}
+	if !auth.AllowedUsername(req.Username) || req.Username == adminUserEveryone || req.Password == "" || !auth.AllowedRole(role) {
+		return errHTTPBadRequestUserInvalid
+	}
+	if _, err := manager.User(req.Username); err == nil {
+		return errHTTPConflictUserExists
+	} else if err != auth.ErrNotFound {
+		return err
+	}
+	if err := manager.AddUser(req.Username, req.Password, role); err != nil {
+		return err
+	}
+	return s.writeAdminUser(w, req.Username)
+}
+
+func (s *Server) handleAdminUserGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	return s.writeAdminUser(w, adminUsernameFromPath(r.URL.Path))
+}
+
+func (s *Server) handleAdminUserChange(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager := s.manager(r)
+	username := adminUsernameFromPath(r.URL.Path)
+	var req apiAdminUserRequest
+	if err := readJSONBody(r, &req); err != nil {
+		return errHTTPBadRequestUserInvalid
+	} else if req.Username != "" && req.Username != username {
+		return errHTTPBadRequestUserInvalid // Users cannot be renamed
+	} else if req.Role != "" && !auth.AllowedRole(auth.Role(req.Role)) {
+		return errHTTPBadRequestUserInvalid
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound || username == auth.Everyone {
+		return errHTTPNotFoundUser
+	} else if err != nil {
+		return err
+	}
+	if req.Password != "" {
+		if err := manager.ChangePassword(username, req.Password); err != nil {
+			return err
+		}
+	}
+	if req.Role != "" {
+		if err := manager.ChangeRole(username, auth.Role(req.Role)); err != nil {
+			return err
+		}
+	}
+	return s.writeAdminUser(w, username)
+}
+
+func (s *Server) handleAdminUserDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager := s.manager(r)
+	username := adminUsernameFromPath(r.URL.Path)
+	if _, err := manager.User(username); err == auth.ErrNotFound || username == auth.Everyone {
+		return errHTTPNotFoundUser
+	} else if err != nil {
+		return err
+	}
+	if err := manager.RemoveUser(username); err != nil {
+		return err
+	}
+	return writeSuccess(w)
+}
+
+func (s *Server) handleAdminAccessGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	users, err := s.auth.(auth.Manager).Users()
+	if err != nil {
+		return err
+	}
+	response := make([]*apiGrant, 0)
+	for _, u := range users {
+		for _, grant := range u.Grants {
+			g := toAPIGrant(grant)
+			g.Username = u.Name
+			response = append(response, g)
+		}
+	}
+	return writeJSON(w, response)
+}
+
+func (s *Server) handleAdminAccessChange(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager := s.manager(r)
+	var req apiAdminAccessRequest
+	if err := readJSONBody(r, &req); err != nil {
+		return errHTTPBadRequestAccessInvalid
+	}
+	username := req.Username
+	if username == adminUserEveryone {
+		username = auth.Everyone
+	}
+	if !auth.AllowedTopicPattern(req.Topic) {
+		return errHTTPBadRequestAccessInvalid
+	}
+	for _, c := range req.Capabilities {
+		if !auth.AllowedCapability(c) {
+			return errHTTPBadRequestAccessInvalid
+		}
+	}
+	expires := time.Time{}
+	if req.Expires != "" {
+		var err error
+		expires, err = util.ParseFutureTime(req.Expires, time.Now())
+		if err != nil {
+			return errHTTPBadRequestAccessInvalid
+		}
+	}
+	user, err := manager.User(username)
+	if err == auth.ErrNotFound {
+		return errHTTPNotFoundUser
+	} else if err != nil {
+		return err
+	} else if user.Role == auth.RoleAdmin {
+		return wrapErrHTTP(errHTTPBadRequestAccessInvalid, "user %s is an admin user, access control entries have no effect", username)
+	}
+	if err := manager.AllowAccessUntil(username, req.Topic, req.Read, req.Write, expires); err == auth.ErrInvalidArgument {
+		return errHTTPBadRequestAccessInvalid
+	} else if err != nil {
+		return err
+	}
+	if req.Capabilities != nil {
+		if err := manager.SetCapabilities(username, req.Topic, req.Capabilities); err != nil {
+			return err
+		}
+	}
+	return s.writeAdminUser(w, username)
+}
+
+func (s *Server) handleAdminAccessReset(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager := s.manager(r)
+	matches := adminAccessRegex.FindStringSubmatch(r.URL.Path)
+	username, topic := matches[1], matches[2]
+	if username == adminUserEveryone {
+		username = auth.Everyone
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return errHTTPNotFoundUser
+	} else if err != nil {
+		return err
+	}
+	if err := manager.ResetAccess(username, topic); err == auth.ErrInvalidArgument {
+		return errHTTPBadRequestAccessInvalid
+	} else if err != nil {
+		return err
+	}
+	return s.writeAdminUser(w, username)
+}
+
+func (s *Server) writeAdminUser(w http.ResponseWriter, username string) error {
+	user, err := s.auth.(auth.Manager).User(username)
+	if err == auth.ErrNotFound {
+		return errHTTPNotFoundUser
+	} else if err != nil {
+		return err
+	}
+	return writeJSON(w, toAPIAdminUser(user))
+}
+
+func adminUsernameFromPath(path string) string {
+	username := adminUserPathRegex.FindStringSubmatch(path)[1]
+	if username == adminUserEveryone {
+		return auth.Everyone
+	}
+	return username
+}
+
+func toAPIAdminUser(u *auth.User) *apiAdminUser {
+	grants := make([]*apiGrant, 0)
+	for _, grant := range u.Grants {
+		grants = append(grants, toAPIGrant(grant))
+	}
+	groups := u.Groups
+	if groups == nil {
+		groups = make([]string, 0)
+	}
+	user := &apiAdminUser{
+		Username: u.Name,
+		Role:     string(u.Role),
+		Grants:   grants,
+		Groups:   groups,
+	}
+	if u.Tier != nil {
+		user.Tier = u.Tier.Code
+	}
+	return user
+}
+
+func toAPIGrant(grant auth.Grant) *apiGrant {
+	capabilities := grant.Capabilities
+	if capabilities == nil {
+		capabilities = auth.Capabilities
+	}
+	g := &apiGrant{
+		Topic:        grant.TopicPattern,
+		Read:         grant.AllowRead,
+		Write:        grant.AllowWrite,
+		Capabilities: capabilities,
+	}
+	if !grant.Expires.IsZero() {
+		g.Expires = grant.Expires.Unix()
+	}
+	return g
+}
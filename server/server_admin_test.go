@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Admin_Users(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "POST", "/v1/admin/users", `{"username":"ben","password":"ben"}`, headers)
+	require.Equal(t, 200, response.Code)
+	ben := toAPIAdminUserForTest(t, response.Body.String())
+	require.Equal(t, "ben", ben.Username)
+	require.Equal(t, "user", ben.Role)
+	require.Equal(t, 0, len(ben.Grants))
+
+	response = request(t, s, "POST", "/v1/admin/users", `{"username":"ben","password":"other"}`, headers)
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40901, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/v1/admin/users", "", headers)
+	require.Equal(t, 200, response.Code)
+	var users []*apiAdminUser
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&users))
+	require.Equal(t, 3, len(users))
+	require.Equal(t, "phil", users[0].Username)
+	require.Equal(t, "ben", users[1].Username)
+	require.Equal(t, "*", users[2].Username)
+
+	// Ben can publish with the new password and role
+	response = request(t, s, "PUT", "/v1/admin/users/ben", `{"password":"newpass","role":"admin"}`, headers)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "admin", toAPIAdminUserForTest(t, response.Body.String()).Role)
+
+	response = request(t, s, "PUT", "/mytopic", "test", map[string]string{"Authorization": basicAuth("ben:newpass")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "DELETE", "/v1/admin/users/ben", "", headers)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/admin/users/ben", "", headers)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Admin_Users_Invalid(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "POST", "/v1/admin/users", `{"username":"ben"}`, headers)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40021, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/admin/users", `{"username":"ben","password":"ben","role":"superuser"}`, headers)
+	require.Equal(t, 40021, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/admin/users", `not json`, headers)
+	require.Equal(t, 40021, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/v1/admin/users/nobody", `{"password":"pass"}`, headers)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "DELETE", "/v1/admin/users/everyone", "", headers)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Admin_Access(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+	require.Nil(t, s.auth.(auth.Manager).AddUser("ben", "ben", auth.RoleUser))
+
+	response := request(t, s, "PUT", "/mytopic", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"ben","topic":"mytopic","read":true,"write":true,"capabilities":["attach"]}`, headers)
+	require.Equal(t, 200, response.Code)
+	ben := toAPIAdminUserForTest(t, response.Body.String())
+	require.Equal(t, []*apiGrant{{Topic: "mytopic", Read: true, Write: true, Capabilities: []auth.Capability{auth.CapabilityAttach}}}, ben.Grants)
+
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"everyone","topic":"announcements","read":true}`, headers)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/admin/access", "", headers)
+	require.Equal(t, 200, response.Code)
+	var grants []*apiGrant
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&grants))
+	require.Equal(t, []*apiGrant{
+		{Username: "ben", Topic: "mytopic", Read: true, Write: true, Capabilities: []auth.Capability{auth.CapabilityAttach}},
+		{Username: "*", Topic: "announcements", Read: true, Capabilities: auth.Capabilities},
+	}, grants)
+
+	response = request(t, s, "DELETE", "/v1/admin/access/ben/mytopic", "", headers)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 0, len(toAPIAdminUserForTest(t, response.Body.String()).Grants))
+
+	response = request(t, s, "PUT", "/mytopic", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_Admin_Access_Invalid(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "PUT", "/v1/admin/access", `{"username":"phil","topic":"mytopic","read":true}`, headers)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40022, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"nobody","topic":"mytopic","read":true}`, headers)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"everyone","topic":"my/topic","read":true}`, headers)
+	require.Equal(t, 40022, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"everyone","topic":"mytopic","capabilities":["invalid"]}`, headers)
+	require.Equal(t, 40022, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Admin_Access_Expires(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+
+	response := request(t, s, "PUT", "/v1/admin/access", `{"username":"ben","topic":"incident","read":true,"write":true,"expires":"7d"}`, headers)
+	require.Equal(t, 200, response.Code)
+	ben := toAPIAdminUserForTest(t, response.Body.String())
+	require.Equal(t, 1, len(ben.Grants))
+	require.True(t, ben.Grants[0].Expires > time.Now().Add(6*24*time.Hour).Unix())
+
+	response = request(t, s, "PUT", "/incident", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"ben","topic":"incident","read":true,"expires":"not a date"}`, headers)
+	require.Equal(t, 40022, toHTTPError(t, response.Body.String()).Code)
+
+	// Expired entries are ignored, and removed by the manager loop
+	require.Nil(t, manager.AllowAccessUntil("ben", "incident", true, true, time.Now().Add(-time.Minute)))
+	response = request(t, s, "PUT", "/incident", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+	s.updateStatsAndPrune()
+	response = request(t, s, "GET", "/v1/admin/users/ben", "", headers)
+	require.Equal(t, 0, len(toAPIAdminUserForTest(t, response.Body.String()).Grants))
+}
+
+func TestServer_Admin_Unauthorized(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+
+	response := request(t, s, "GET", "/v1/admin/users", "", nil)
+	require.Equal(t, 401, response.Code)
+
+	response = request(t, s, "GET", "/v1/admin/users", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/v1/admin/users", "", map[string]string{"Authorization": basicAuth("phil:wrong")})
+	require.Equal(t, 401, response.Code)
+
+	// Scoped tokens cannot use the admin API, even if the user is an admin
+	token, err := manager.CreateToken("phil", "", time.Time{}, []auth.Grant{{TopicPattern: "mytopic", AllowRead: true}})
+	require.Nil(t, err)
+	response = request(t, s, "GET", "/v1/admin/users", "", map[string]string{"Authorization": "Bearer " + token.Value})
+	require.Equal(t, 403, response.Code)
+
+	token, err = manager.CreateToken("phil", "", time.Time{}, nil)
+	require.Nil(t, err)
+	response = request(t, s, "GET", "/v1/admin/users", "", map[string]string{"Authorization": "Bearer " + token.Value})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Admin_AuditLog(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	s.config.AuthAuditDuration = 24 * time.Hour
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "POST", "/v1/admin/users", `{"username":"ben","password":"ben"}`, headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/v1/admin/access", `{"username":"ben","topic":"alerts","read":true,"write":true}`, headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/alerts", "test", map[string]string{"Authorization": basicAuth("ben:INVALID")})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "PUT", "/alerts", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	auditor := s.auth.(auth.Auditor)
+	events, err := auditor.AuditEvents(&auth.AuditFilter{Username: "ben"})
+	require.Nil(t, err)
+	require.Equal(t, 5, len(events))
+	require.Equal(t, auth.AuditActionUserAdd, events[0].Action)
+	require.Equal(t, "phil", events[0].Actor)
+	require.Equal(t, auth.AuditActionAccessAllow, events[1].Action)
+	require.Equal(t, "phil", events[1].Actor)
+	require.Equal(t, &auth.AuditEvent{Time: events[2].Time, Action: auth.AuditActionLoginFailure, Subject: "ben", IP: "9.9.9.9", Detail: "password: unauthenticated"}, events[2])
+	require.Equal(t, &auth.AuditEvent{Time: events[3].Time, Action: auth.AuditActionLoginSuccess, Subject: "ben", IP: "9.9.9.9", Detail: "password"}, events[3])
+	require.Equal(t, &auth.AuditEvent{Time: events[4].Time, Action: auth.AuditActionPublish, Actor: "ben", Topic: "alerts", IP: "9.9.9.9", Detail: m.ID}, events[4])
+
+	// Logins and publishes are not recorded if the audit duration is zero (default)
+	s.config.AuthAuditDuration = 0
+	response = request(t, s, "PUT", "/alerts", "test", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+	events, err = auditor.AuditEvents(&auth.AuditFilter{Username: "ben"})
+	require.Nil(t, err)
+	require.Equal(t, 5, len(events))
+}
+
+func TestServer_Admin_AuditLog_PruneChanges(t *testing.T) {
+	s := newTestServerWithAdmin(t) // Audit duration is zero (default), changes are still recorded
+	s.config.AuthAuditChangesDuration = 24 * time.Hour
+	auditor := s.auth.(auth.Auditor)
+	require.Nil(t, auditor.Audit(&auth.AuditEvent{Time: time.Now().Add(-48 * time.Hour), Action: auth.AuditActionUserAdd, Actor: "phil", Subject: "ben"}))
+	require.Nil(t, auditor.Audit(&auth.AuditEvent{Action: auth.AuditActionUserAdd, Actor: "phil", Subject: "carl"}))
+
+	s.updateStatsAndPrune()
+	events, err := auditor.AuditEvents(&auth.AuditFilter{Username: "ben"})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(events))
+	events, err = auditor.AuditEvents(&auth.AuditFilter{Username: "carl"})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(events))
+}
+
+func TestServer_Admin_AuthDisabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/v1/admin/users", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func newTestServerWithAdmin(t *testing.T) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("phil", "phil", auth.RoleAdmin))
+	return s
+}
+
+func toAPIAdminUserForTest(t *testing.T, s string) *apiAdminUser {
+	var u apiAdminUser
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&u))
+	return &u
+}
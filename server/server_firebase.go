@@ -77,6 +77,7 @@ func toFirebaseMessage(m *message, auther auth.Auther) (*messaging.Message, erro
 				"priority": fmt.Sprintf("%d", m.Priority),
 				"tags":     strings.Join(m.Tags, ","),
 				"click":    m.Click,
+				"icon":     m.Icon,
 				"title":    m.Title,
 				"message":  m.Message,
 				"encoding": m.Encoding,
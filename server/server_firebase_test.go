@@ -19,6 +19,10 @@ func (t testAuther) Authenticate(_, _ string) (*auth.User, error) {
 	return nil, errors.New("not used")
 }
 
+func (t testAuther) AuthenticateToken(_ string) (*auth.User, error) {
+	return nil, errors.New("not used")
+}
+
 func (t testAuther) Authorize(_ *auth.User, _ string, _ auth.Permission) error {
 	if t.Allow {
 		return nil
@@ -26,6 +30,10 @@ func (t testAuther) Authorize(_ *auth.User, _ string, _ auth.Permission) error {
 	return errors.New("unauthorized")
 }
 
+func (t testAuther) AuthorizeCapability(_ *auth.User, _ string, _ auth.Capability) error {
+	return nil
+}
+
 func TestToFirebaseMessage_Keepalive(t *testing.T) {
 	m := newKeepaliveMessage("mytopic")
 	fbm, err := toFirebaseMessage(m, nil)
@@ -59,6 +67,7 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 	m.Priority = 4
 	m.Tags = []string{"tag 1", "tag2"}
 	m.Click = "https://google.com"
+	m.Icon = "https://ntfy.sh/static/img/ntfy.png"
 	m.Title = "some title"
 	m.Attachment = &attachment{
 		Name:    "some file.jpg",
@@ -82,6 +91,7 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 		"priority":           "4",
 		"tags":               strings.Join(m.Tags, ","),
 		"click":              "https://google.com",
+		"icon":               "https://ntfy.sh/static/img/ntfy.png",
 		"title":              "some title",
 		"message":            "this is a message",
 		"encoding":           "",
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"heckel.io/ntfy/util"
+	"html"
 	"mime"
 	"net"
 	"net/smtp"
@@ -12,6 +13,10 @@ import (
 	"time"
 )
 
+const (
+	mailBoundaryPrefix = "ntfy-boundary-"
+)
+
 type mailer interface {
 	Send(from, to string, m *message) error
 }
@@ -77,6 +82,44 @@ Content-Type: text/plain; charset="utf-8"
 
 --
 This message was sent by {ip} at {time} via {topicURL}`
+	if m.ContentType == contentTypeMarkdown {
+		htmlMessage, err := renderMarkdown(m.Message)
+		if err != nil {
+			return "", err
+		}
+		if trailer != "" {
+			htmlMessage += "<p>" + strings.ReplaceAll(html.EscapeString(trailer), "\n", "<br>") + "</p>"
+		}
+		body = `From: "{shortTopicURL}" <{from}>
+To: {to}
+Subject: {subject}
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="{boundary}"
+
+--{boundary}
+Content-Type: text/plain; charset="utf-8"
+
+{message}
+
+--
+This message was sent by {ip} at {time} via {topicURL}
+--{boundary}
+Content-Type: text/html; charset="utf-8"
+
+<!DOCTYPE html>
+<html>
+<body>
+{htmlMessage}
+<hr>
+<p>This message was sent by {htmlIP} at {time} via <a href="{htmlTopicURL}">{htmlTopicURL}</a></p>
+</body>
+</html>
+--{boundary}--`
+		body = strings.ReplaceAll(body, "{boundary}", mailBoundaryPrefix+m.ID)
+		body = strings.ReplaceAll(body, "{htmlIP}", html.EscapeString(senderIP))
+		body = strings.ReplaceAll(body, "{htmlTopicURL}", html.EscapeString(topicURL))
+		body = strings.ReplaceAll(body, "{htmlMessage}", htmlMessage)
+	}
 	body = strings.ReplaceAll(body, "{from}", from)
 	body = strings.ReplaceAll(body, "{to}", to)
 	body = strings.ReplaceAll(body, "{subject}", subject)
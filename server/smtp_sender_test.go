@@ -139,3 +139,44 @@ Priority: max
 This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
 	require.Equal(t, expected, actual)
 }
+
+func TestFormatMail_Markdown(t *testing.T) {
+	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:          "abc",
+		Time:        1640382204,
+		Event:       "message",
+		Topic:       "alerts",
+		Message:     "Backup **failed**, see <b>logs</b>",
+		Priority:    5,
+		ContentType: "text/markdown",
+	})
+	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+To: phil@example.com
+Subject: Backup **failed**, see <b>logs</b>
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="ntfy-boundary-abc"
+
+--ntfy-boundary-abc
+Content-Type: text/plain; charset="utf-8"
+
+Backup **failed**, see <b>logs</b>
+
+Priority: max
+
+--
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts
+--ntfy-boundary-abc
+Content-Type: text/html; charset="utf-8"
+
+<!DOCTYPE html>
+<html>
+<body>
+<p>Backup <strong>failed</strong>, see <!-- raw HTML omitted -->logs<!-- raw HTML omitted --></p>
+<p>Priority: max</p>
+<hr>
+<p>This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via <a href="https://ntfy.sh/alerts">https://ntfy.sh/alerts</a></p>
+</body>
+</html>
+--ntfy-boundary-abc--`
+	require.Equal(t, expected, actual)
+}
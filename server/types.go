@@ -1,6 +1,7 @@
 package server
 
 import (
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/util"
 	"net/http"
 	"time"
@@ -20,18 +21,21 @@ const (
 
 // message represents a message published to a topic
 type message struct {
-	ID         string      `json:"id"`    // Random message ID
-	Time       int64       `json:"time"`  // Unix time in seconds
-	Event      string      `json:"event"` // One of the above
-	Topic      string      `json:"topic"`
-	Priority   int         `json:"priority,omitempty"`
-	Tags       []string    `json:"tags,omitempty"`
-	Click      string      `json:"click,omitempty"`
-	Actions    []*action   `json:"actions,omitempty"`
-	Attachment *attachment `json:"attachment,omitempty"`
-	Title      string      `json:"title,omitempty"`
-	Message    string      `json:"message,omitempty"`
-	Encoding   string      `json:"encoding,omitempty"` // empty for raw UTF-8, or "base64" for encoded bytes
+	ID          string      `json:"id"`    // Random message ID
+	Time        int64       `json:"time"`  // Unix time in seconds
+	Event       string      `json:"event"` // One of the above
+	Topic       string      `json:"topic"`
+	Priority    int         `json:"priority,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Click       string      `json:"click,omitempty"`
+	Icon        string      `json:"icon,omitempty"`
+	Actions     []*action   `json:"actions,omitempty"`
+	Attachment  *attachment `json:"attachment,omitempty"`
+	Title       string      `json:"title,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
+	ContentType string      `json:"content_type,omitempty"` // empty for plain text, or "text/markdown"
+	Sender      string      `json:"sender,omitempty"`       // username of the authenticated publisher, empty if anonymous
 }
 
 type attachment struct {
@@ -40,7 +44,7 @@ type attachment struct {
 	Size    int64  `json:"size,omitempty"`
 	Expires int64  `json:"expires,omitempty"`
 	URL     string `json:"url"`
-	Owner   string `json:"-"` // IP address of uploader, used for rate limiting
+	Owner   string `json:"-"` // IP address or user of uploader (see visitor.id), used for rate limiting
 }
 
 type action struct {
@@ -66,16 +70,37 @@ func newAction() *action {
 // publishMessage is used as input when publishing as JSON
 type publishMessage struct {
 	Topic    string   `json:"topic"`
+	Topics   []string `json:"topics"`
 	Title    string   `json:"title"`
 	Message  string   `json:"message"`
 	Priority int      `json:"priority"`
 	Tags     []string `json:"tags"`
 	Click    string   `json:"click"`
+	Icon     string   `json:"icon"`
 	Actions  []action `json:"actions"`
 	Attach   string   `json:"attach"`
 	Filename string   `json:"filename"`
 	Email    string   `json:"email"`
 	Delay    string   `json:"delay"`
+	Markdown bool     `json:"markdown"`
+}
+
+// publishBatchResult is the result for a single message of a batch publish request. Exactly one of
+// the fields is set: the published message, or the error that prevented it from being published.
+type publishBatchResult struct {
+	Message *message `json:"message,omitempty"`
+	Error   *errHTTP `json:"error,omitempty"`
+}
+
+// publishBatchItem is a parsed message of a batch publish request that is ready to be stored and sent.
+// If the message is published to multiple topics, there is one message per topic.
+type publishBatchItem struct {
+	index    int // Index of the message in the batch request
+	topics   []*topic
+	messages []*message
+	cache    bool
+	firebase bool
+	email    string
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -155,6 +180,7 @@ var (
 type queryFilter struct {
 	Message  string
 	Title    string
+	Sender   string
 	Tags     []string
 	Priority []int
 }
@@ -162,6 +188,7 @@ type queryFilter struct {
 func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 	messageFilter := readParam(r, "x-message", "message", "m")
 	titleFilter := readParam(r, "x-title", "title", "t")
+	senderFilter := readParam(r, "x-sender", "sender")
 	tagsFilter := util.SplitNoEmpty(readParam(r, "x-tags", "tags", "tag", "ta"), ",")
 	priorityFilter := make([]int, 0)
 	for _, p := range util.SplitNoEmpty(readParam(r, "x-priority", "priority", "prio", "p"), ",") {
@@ -174,6 +201,7 @@ func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 	return &queryFilter{
 		Message:  messageFilter,
 		Title:    titleFilter,
+		Sender:   senderFilter,
 		Tags:     tagsFilter,
 		Priority: priorityFilter,
 	}, nil
@@ -189,6 +217,9 @@ func (q *queryFilter) Pass(msg *message) bool {
 	if q.Title != "" && msg.Title != q.Title {
 		return false
 	}
+	if q.Sender != "" && msg.Sender != q.Sender {
+		return false
+	}
 	messagePriority := msg.Priority
 	if messagePriority == 0 {
 		messagePriority = 3 // For query filters, default priority (3) is the same as "not set" (0)
@@ -201,3 +232,90 @@ func (q *queryFilter) Pass(msg *message) bool {
 	}
 	return true
 }
+
+// apiAdminUser is a user as returned by the admin API, see handleAdminUsersGet
+type apiAdminUser struct {
+	Username string      `json:"username"`
+	Role     string      `json:"role"`
+	Tier     string      `json:"tier,omitempty"`
+	Grants   []*apiGrant `json:"grants"`
+	Groups   []string    `json:"groups"`
+}
+
+// apiGrant is an access control entry as returned by the admin and account API. Capabilities is
+// always the full list of allowed publishing capabilities. Expires is a Unix timestamp, or 0 if the
+// entry never expires.
+type apiGrant struct {
+	Username     string            `json:"username,omitempty"`
+	Topic        string            `json:"topic"`
+	Read         bool              `json:"read"`
+	Write        bool              `json:"write"`
+	Capabilities []auth.Capability `json:"capabilities"`
+	Expires      int64             `json:"expires,omitempty"`
+}
+
+// apiAdminUserRequest is the request body to create or change a user via the admin API.
+// When changing a user, empty fields are left unchanged.
+type apiAdminUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// apiAdminAccessRequest is the request body to add or change an access control entry via the admin API.
+// If Capabilities is not set, all publishing capabilities are allowed. Expires may be a duration (e.g. 7d),
+// a natural language date, or a Unix timestamp; if it is not set, the entry never expires.
+type apiAdminAccessRequest struct {
+	Username     string            `json:"username"`
+	Topic        string            `json:"topic"`
+	Read         bool              `json:"read"`
+	Write        bool              `json:"write"`
+	Capabilities []auth.Capability `json:"capabilities"`
+	Expires      string            `json:"expires"`
+}
+
+// apiAccount is the response of the account API, see handleAccountGet. For anonymous users,
+// the username is "*" and only the everyone user's grants are returned.
+type apiAccount struct {
+	Username string        `json:"username"`
+	Role     string        `json:"role"`
+	Tier     string        `json:"tier,omitempty"`
+	Grants   []*apiGrant   `json:"grants"`
+	Groups   []string      `json:"groups"`
+	Stats    *visitorStats `json:"stats"`
+}
+
+// apiAccountToken is an access token as returned by the account API. LastAccess and Expires
+// are Unix timestamps, and 0 if the token was never used or never expires.
+type apiAccountToken struct {
+	Token      string      `json:"token"`
+	Label      string      `json:"label,omitempty"`
+	LastAccess int64       `json:"lastAccess"`
+	Expires    int64       `json:"expires"`
+	Scopes     []*apiGrant `json:"scopes,omitempty"`
+}
+
+// apiAccountPasswordRequest is the request body to change the password of the current user
+type apiAccountPasswordRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+// apiAccountTokenRequest is the request body to create a new access token for the current user.
+// Expires may be a duration (e.g. 30d), a natural language date, or a Unix timestamp.
+type apiAccountTokenRequest struct {
+	Label   string      `json:"label"`
+	Expires string      `json:"expires"`
+	Scopes  []*apiGrant `json:"scopes"`
+}
+
+// apiAccountReservation is a topic reservation as returned by the account API. Created is a Unix timestamp.
+type apiAccountReservation struct {
+	Topic   string `json:"topic"`
+	Created int64  `json:"created"`
+}
+
+// apiAccountReservationRequest is the request body to reserve a topic for the current user
+type apiAccountReservationRequest struct {
+	Topic string `json:"topic"`
+}
@@ -1,10 +1,16 @@
 package server
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"strings"
 )
 
+const (
+	jsonBodyLimit = 4096 // Max size of a JSON request body in bytes, see readJSONBody
+)
+
 func readBoolParam(r *http.Request, defaultValue bool, names ...string) bool {
 	value := strings.ToLower(readParam(r, names...))
 	if value == "" {
@@ -40,3 +46,22 @@ func readQueryParam(r *http.Request, names ...string) string {
 	}
 	return ""
 }
+
+// readJSONBody decodes the JSON request body into v, reading at most jsonBodyLimit bytes
+func readJSONBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(io.LimitReader(r.Body, jsonBodyLimit)).Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeSuccess(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	_, err := io.WriteString(w, `{"success":true}`+"\n")
+	return err
+}
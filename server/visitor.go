@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"golang.org/x/time/rate"
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/util"
 	"sync"
 	"time"
@@ -13,25 +14,53 @@ const (
 	// has to be very high to prevent e-mail abuse, but it doesn't really affect the other limits anyway, since
 	// they are replenished faster (typically).
 	visitorExpungeAfter = 24 * time.Hour
+
+	// userVisitorPrefix is the prefix of the ID of visitors that represent an authenticated user, see Server.userVisitor
+	userVisitorPrefix = "user:"
 )
 
 var (
 	errVisitorLimitReached = errors.New("limit reached")
 )
 
-// visitor represents an API user, and its associated rate.Limiter used for rate limiting
+// visitor represents an API user, and its associated rate.Limiter used for rate limiting. Anonymous visitors
+// are identified by their IP address, authenticated users by their username (see Server.userVisitor).
 type visitor struct {
+	*visitorState        // Shared by all requests of the visitor
+	ip            string // IP address of the client of the current request
+}
+
+// visitorState holds the limiters and other state of a visitor. An authenticated user may send requests from
+// different IP addresses, so each request has its own visitor, but they all point to the same visitorState.
+type visitorState struct {
 	config        *Config
-	messageCache  *messageCache
-	ip            string
+	messageCache  messageCache
+	id            string     // IP address, or "user:<username>" for authenticated users; also the owner of attachments
+	tier          *auth.Tier // Tier of the authenticated user, nil if the default limits apply
+	limits        *visitorLimits
 	requests      *rate.Limiter
 	emails        *rate.Limiter
-	subscriptions util.Limiter
-	bandwidth     util.Limiter
+	subscriptions *util.FixedLimiter
+	bandwidth     *util.RateLimiter
+	loginFailures int       // Consecutive failed logins, see auth.LockoutDuration
+	loginFailed   time.Time // Time of the last failed login
+	loginLocked   time.Time // Locked out until this time due to too many failed logins
 	seen          time.Time
 	mu            sync.Mutex
 }
 
+// visitorLimits are the limits of a visitor, either the defaults from the config, or the limits of a user's tier
+type visitorLimits struct {
+	RequestLimitBurst             int
+	RequestLimitReplenish         time.Duration
+	EmailLimitBurst               int
+	EmailLimitReplenish           time.Duration
+	SubscriptionLimit             int
+	AttachmentTotalSizeLimit      int64
+	AttachmentDailyBandwidthLimit int64
+	ReservationLimit              int
+}
+
 type visitorStats struct {
 	AttachmentFileSizeLimit         int64 `json:"attachmentFileSizeLimit"`
 	VisitorAttachmentBytesTotal     int64 `json:"visitorAttachmentBytesTotal"`
@@ -39,17 +68,109 @@ type visitorStats struct {
 	VisitorAttachmentBytesRemaining int64 `json:"visitorAttachmentBytesRemaining"`
 }
 
-func newVisitor(conf *Config, messageCache *messageCache, ip string) *visitor {
+func newVisitor(conf *Config, messageCache messageCache, id, ip string, tier *auth.Tier) *visitor {
+	limits := newVisitorLimits(conf, tier)
 	return &visitor{
-		config:        conf,
-		messageCache:  messageCache,
-		ip:            ip,
-		requests:      rate.NewLimiter(rate.Every(conf.VisitorRequestLimitReplenish), conf.VisitorRequestLimitBurst),
-		emails:        rate.NewLimiter(rate.Every(conf.VisitorEmailLimitReplenish), conf.VisitorEmailLimitBurst),
-		subscriptions: util.NewFixedLimiter(int64(conf.VisitorSubscriptionLimit)),
-		bandwidth:     util.NewBytesLimiter(conf.VisitorAttachmentDailyBandwidthLimit, 24*time.Hour),
-		seen:          time.Now(),
+		visitorState: &visitorState{
+			config:        conf,
+			messageCache:  messageCache,
+			id:            id,
+			tier:          tier,
+			limits:        limits,
+			requests:      rate.NewLimiter(rate.Every(limits.RequestLimitReplenish), limits.RequestLimitBurst),
+			emails:        rate.NewLimiter(rate.Every(limits.EmailLimitReplenish), limits.EmailLimitBurst),
+			subscriptions: util.NewFixedLimiter(int64(limits.SubscriptionLimit)),
+			bandwidth:     util.NewBytesLimiter(int(limits.AttachmentDailyBandwidthLimit), 24*time.Hour),
+			seen:          time.Now(),
+		},
+		ip: ip,
+	}
+}
+
+// newVisitorLimits returns the default limits from the config, overridden by the non-zero limits of the given tier
+func newVisitorLimits(conf *Config, tier *auth.Tier) *visitorLimits {
+	limits := &visitorLimits{
+		RequestLimitBurst:             conf.VisitorRequestLimitBurst,
+		RequestLimitReplenish:         conf.VisitorRequestLimitReplenish,
+		EmailLimitBurst:               conf.VisitorEmailLimitBurst,
+		EmailLimitReplenish:           conf.VisitorEmailLimitReplenish,
+		SubscriptionLimit:             conf.VisitorSubscriptionLimit,
+		AttachmentTotalSizeLimit:      conf.VisitorAttachmentTotalSizeLimit,
+		AttachmentDailyBandwidthLimit: int64(conf.VisitorAttachmentDailyBandwidthLimit),
+		ReservationLimit:              conf.AuthReservationLimit,
+	}
+	if tier == nil {
+		return limits
+	}
+	if tier.RequestLimit > 0 {
+		limits.RequestLimitBurst = tier.RequestLimit
+	}
+	if tier.RequestLimitReplenish > 0 {
+		limits.RequestLimitReplenish = tier.RequestLimitReplenish
+	}
+	if tier.EmailLimit > 0 {
+		limits.EmailLimitBurst = tier.EmailLimit
+	}
+	if tier.EmailLimitReplenish > 0 {
+		limits.EmailLimitReplenish = tier.EmailLimitReplenish
+	}
+	if tier.SubscriptionLimit > 0 {
+		limits.SubscriptionLimit = tier.SubscriptionLimit
+	}
+	if tier.AttachmentTotalSizeLimit > 0 {
+		limits.AttachmentTotalSizeLimit = tier.AttachmentTotalSizeLimit
+	}
+	if tier.AttachmentBandwidthLimit > 0 {
+		limits.AttachmentDailyBandwidthLimit = tier.AttachmentBandwidthLimit
+	}
+	if tier.ReservationLimit > 0 {
+		limits.ReservationLimit = tier.ReservationLimit
+	}
+	return limits
+}
+
+// withIP returns a visitor for a request from the given IP address. It shares its state (limiters, last
+// seen time, etc.) with the original visitor, so that the requests of an authenticated user count towards
+// the same limits, regardless of the IP address they come from.
+func (v *visitor) withIP(ip string) *visitor {
+	return &visitor{
+		visitorState: v.visitorState,
+		ip:           ip,
+	}
+}
+
+// SetTier changes the limits of the visitor to those of the given tier, if the tier has changed. Open
+// subscriptions count towards the new limit, and the attachment bandwidth is not reset. The request and
+// email limiters start over with the new limits.
+func (v *visitor) SetTier(tier *auth.Tier) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sameTier(tier) {
+		return
+	}
+	limits := newVisitorLimits(v.config, tier)
+	v.tier = tier
+	v.limits = limits
+	v.requests = rate.NewLimiter(rate.Every(limits.RequestLimitReplenish), limits.RequestLimitBurst)
+	v.emails = rate.NewLimiter(rate.Every(limits.EmailLimitReplenish), limits.EmailLimitBurst)
+	v.subscriptions.SetLimit(int64(limits.SubscriptionLimit))
+	v.bandwidth.SetBytesLimit(int(limits.AttachmentDailyBandwidthLimit), 24*time.Hour)
+}
+
+// sameTier returns true if the visitor's limits were derived from the given tier, i.e. if the tier
+// of a user has not been changed since its limits were set
+func (v *visitor) sameTier(tier *auth.Tier) bool {
+	if v.tier == nil || tier == nil {
+		return v.tier == nil && tier == nil
 	}
+	return *v.tier == *tier
+}
+
+// Limits returns the visitor's limits, see SetTier
+func (v *visitor) Limits() *visitorLimits {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.limits
 }
 
 func (v *visitor) IP() string {
@@ -57,6 +178,8 @@ func (v *visitor) IP() string {
 }
 
 func (v *visitor) RequestAllowed() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	if !v.requests.Allow() {
 		return errVisitorLimitReached
 	}
@@ -64,12 +187,42 @@ func (v *visitor) RequestAllowed() error {
 }
 
 func (v *visitor) EmailAllowed() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	if !v.emails.Allow() {
 		return errVisitorLimitReached
 	}
 	return nil
 }
 
+// LoginAllowed returns errVisitorLimitReached if the visitor is locked out due to too many failed logins
+func (v *visitor) LoginAllowed() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Now().Before(v.loginLocked) {
+		return errVisitorLimitReached
+	}
+	return nil
+}
+
+// LoginFailed records a failed login, and returns how long the visitor is locked out as a result (zero if
+// it is not). The same policy as for users applies, see auth.LockoutDuration.
+func (v *visitor) LoginFailed() time.Duration {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if now.Sub(v.loginFailed) > auth.LockoutResetAfter {
+		v.loginFailures = 0
+	}
+	v.loginFailures++
+	v.loginFailed = now
+	lockout := auth.LockoutDuration(v.loginFailures)
+	if lockout > 0 {
+		v.loginLocked = now.Add(lockout)
+	}
+	return lockout
+}
+
 func (v *visitor) SubscriptionAllowed() error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
@@ -102,17 +255,18 @@ func (v *visitor) Stale() bool {
 }
 
 func (v *visitor) Stats() (*visitorStats, error) {
-	attachmentsBytesUsed, err := v.messageCache.AttachmentBytesUsed(v.ip)
+	attachmentsBytesUsed, err := v.messageCache.AttachmentBytesUsed(v.id)
 	if err != nil {
 		return nil, err
 	}
-	attachmentsBytesRemaining := v.config.VisitorAttachmentTotalSizeLimit - attachmentsBytesUsed
+	limits := v.Limits()
+	attachmentsBytesRemaining := limits.AttachmentTotalSizeLimit - attachmentsBytesUsed
 	if attachmentsBytesRemaining < 0 {
 		attachmentsBytesRemaining = 0
 	}
 	return &visitorStats{
 		AttachmentFileSizeLimit:         v.config.AttachmentFileSizeLimit,
-		VisitorAttachmentBytesTotal:     v.config.VisitorAttachmentTotalSizeLimit,
+		VisitorAttachmentBytesTotal:     limits.AttachmentTotalSizeLimit,
 		VisitorAttachmentBytesUsed:      attachmentsBytesUsed,
 		VisitorAttachmentBytesRemaining: attachmentsBytesRemaining,
 	}, nil
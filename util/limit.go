@@ -37,13 +37,21 @@ func NewFixedLimiter(limit int64) *FixedLimiter {
 func (l *FixedLimiter) Allow(n int64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	if l.value+n > l.limit {
+	if n > 0 && l.value+n > l.limit {
 		return ErrLimitReached
 	}
 	l.value += n
 	return nil
 }
 
+// SetLimit changes the limit, keeping the current value. If the value exceeds the new limit, Allow returns
+// ErrLimitReached until the value is below the limit again.
+func (l *FixedLimiter) SetLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
 // RateLimiter is a Limiter that wraps a rate.Limiter, allowing a floating time-based limit.
 type RateLimiter struct {
 	limiter *rate.Limiter
@@ -74,6 +82,14 @@ func (l *RateLimiter) Allow(n int64) error {
 	return nil
 }
 
+// SetBytesLimit changes the limit of a limiter created with NewBytesLimiter. The bytes that are currently
+// available are not reset, they are replenished at the new rate up to the new limit.
+func (l *RateLimiter) SetBytesLimit(bytes int, interval time.Duration) {
+	now := time.Now()
+	l.limiter.SetLimitAt(now, rate.Limit(bytes)*rate.Every(interval))
+	l.limiter.SetBurstAt(now, bytes)
+}
+
 // LimitWriter implements an io.Writer that will pass through all Write calls to the underlying
 // writer w until any of the limiter's limit is reached, at which point a Write will return ErrLimitReached.
 // Each limiter's value is increased with every write.
@@ -32,6 +32,26 @@ func TestFixedLimiter_AddSub(t *testing.T) {
 	}
 }
 
+func TestFixedLimiter_SetLimit(t *testing.T) {
+	l := NewFixedLimiter(10)
+	require.Nil(t, l.Allow(8))
+	l.SetLimit(5)
+	require.Equal(t, ErrLimitReached, l.Allow(1))
+	require.Nil(t, l.Allow(-4))
+	require.Nil(t, l.Allow(1))
+	require.Equal(t, ErrLimitReached, l.Allow(1))
+	l.SetLimit(10)
+	require.Nil(t, l.Allow(5))
+}
+
+func TestBytesLimiter_SetBytesLimit(t *testing.T) {
+	l := NewBytesLimiter(1000, 24*time.Hour)
+	require.Nil(t, l.Allow(800))
+	l.SetBytesLimit(2000, 24*time.Hour)
+	require.Equal(t, ErrLimitReached, l.Allow(300)) // Not reset to the new limit
+	require.Nil(t, l.Allow(200))
+}
+
 func TestBytesLimiter_Add_Simple(t *testing.T) {
 	l := NewBytesLimiter(250*1024*1024, 24*time.Hour) // 250 MB per 24h
 	require.Nil(t, l.Allow(100*1024*1024))
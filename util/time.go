@@ -33,6 +33,20 @@ func ParseFutureTime(s string, now time.Time) (time.Time, error) {
 	return time.Time{}, errUnparsableTime
 }
 
+// ParsePastTime parses a date/time string to a time.Time in the past. It supports unix timestamps
+// and durations, e.g. "30m" or "2 days" (meaning 30 minutes or 2 days ago)
+func ParsePastTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := strconv.ParseInt(s, 10, 64); err == nil && t <= now.Unix() {
+		return time.Unix(t, 0).UTC(), nil
+	}
+	d, err := parseDuration(s)
+	if err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, errUnparsableTime
+}
+
 func parseFromDuration(s string, now time.Time) (time.Time, error) {
 	d, err := parseDuration(s)
 	if err == nil {
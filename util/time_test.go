@@ -58,3 +58,22 @@ func TestParseFutureTime_UnixTime(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, time.Date(2021, 12, 11, 0, 51, 51, 0, time.UTC), d)
 }
+
+func TestParsePastTime_2days(t *testing.T) {
+	d, err := ParsePastTime("2 days", base)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2021, 12, 8, 10, 17, 23, 0, time.UTC), d)
+}
+
+func TestParsePastTime_UnixTime(t *testing.T) {
+	d, err := ParsePastTime("1639000000", base)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2021, 12, 8, 21, 46, 40, 0, time.UTC), d)
+}
+
+func TestParsePastTime_Invalid(t *testing.T) {
+	_, err := ParsePastTime("tomorrow", base)
+	require.Equal(t, errUnparsableTime, err)
+	_, err = ParsePastTime("1639183911", base) // In the future
+	require.Equal(t, errUnparsableTime, err)
+}
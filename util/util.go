@@ -269,3 +269,8 @@ func ReadPassword(in io.Reader) ([]byte, error) {
 func BasicAuth(user, pass string) string {
 	return fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", user, pass))))
 }
+
+// BearerAuth encodes the Authorization header value for a bearer/access token
+func BearerAuth(token string) string {
+	return fmt.Sprintf("Bearer %s", token)
+}